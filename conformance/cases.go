@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"wstest"
+)
+
+// ケースの結果。
+const (
+	statusPass = "PASS"
+	// statusNonStrict は RFC 6455 の MUST は満たすが、推奨される振る舞いと異なる場合。
+	statusNonStrict = "NON-STRICT"
+	statusFail      = "FAIL"
+	// statusSkip は -mode=none でメッセージを確認できない場合。
+	statusSkip = "SKIP"
+)
+
+// RFC 6455 7.4.1 のステータスコード。
+const (
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeInvalidData   = 1007
+)
+
+type outcome struct {
+	status string
+	detail string
+}
+
+func pass() outcome {
+	return outcome{status: statusPass}
+}
+
+func fail(format string, args ...any) outcome {
+	return outcome{status: statusFail, detail: fmt.Sprintf(format, args...)}
+}
+
+func nonStrict(format string, args ...any) outcome {
+	return outcome{status: statusNonStrict, detail: fmt.Sprintf(format, args...)}
+}
+
+// testCase は 1 つの確認。
+type testCase struct {
+	id      string
+	section string
+	desc    string
+	// data はメッセージの配信を確認するかどうか。-mode=none では SKIP にする。
+	data bool
+	run  func(s *session) outcome
+}
+
+// sendThen は frames を送信してから expect で確認する。
+func sendThen(frames []wstest.Frame, expect func(s *session) outcome) func(s *session) outcome {
+	return func(s *session) outcome {
+		if err := s.send(frames...); err != nil {
+			return fail("%s", err)
+		}
+		return expect(s)
+	}
+}
+
+// roundTrip は frames を送信し、opcode と payload のメッセージが届くことを確認する。
+func roundTrip(frames []wstest.Frame, opcode byte, payload []byte) func(s *session) outcome {
+	return sendThen(frames, func(s *session) outcome { return s.expectMessage(opcode, payload) })
+}
+
+// failWith は frames を送信し、サーバーが code でコネクションを失敗させることを確認する。
+func failWith(code uint16, frames ...wstest.Frame) func(s *session) outcome {
+	return sendThen(frames, func(s *session) outcome { return s.expectFailure(code) })
+}
+
+func text(n int) []byte {
+	return bytes.Repeat([]byte{'*'}, n)
+}
+
+func frames(f ...wstest.Frame) []wstest.Frame {
+	return f
+}
+
+// cases は Autobahn Testsuite の構成を参考にした確認の一覧。
+var cases = []testCase{
+	// 1. framing
+	{id: "1.1.1", section: "framing", desc: "text message with empty payload", data: true,
+		run: roundTrip(frames(wstest.Text("")), wstest.OpText, nil)},
+	{id: "1.1.2", section: "framing", desc: "text message with 125 byte payload", data: true,
+		run: roundTrip(frames(wstest.Frame{Fin: true, Opcode: wstest.OpText, Payload: text(125)}), wstest.OpText, text(125))},
+	{id: "1.1.3", section: "framing", desc: "text message with 126 byte payload (16 bit length)", data: true,
+		run: roundTrip(frames(wstest.Frame{Fin: true, Opcode: wstest.OpText, Payload: text(126)}), wstest.OpText, text(126))},
+	{id: "1.1.4", section: "framing", desc: "text message with 65535 byte payload", data: true,
+		run: roundTrip(frames(wstest.Frame{Fin: true, Opcode: wstest.OpText, Payload: text(65535)}), wstest.OpText, text(65535))},
+	{id: "1.1.5", section: "framing", desc: "text message with 65536 byte payload (64 bit length)", data: true,
+		run: roundTrip(frames(wstest.Frame{Fin: true, Opcode: wstest.OpText, Payload: text(65536)}), wstest.OpText, text(65536))},
+	{id: "1.2.1", section: "framing", desc: "binary message with 125 byte payload", data: true,
+		run: roundTrip(frames(wstest.Binary(bytes.Repeat([]byte{0xfe}, 125))), wstest.OpBinary, bytes.Repeat([]byte{0xfe}, 125))},
+
+	// 2. ping, pong
+	{id: "2.1", section: "control", desc: "ping without payload is answered with an empty pong",
+		run: sendThen(frames(wstest.Ping(nil)), func(s *session) outcome { return s.expectPong(nil) })},
+	{id: "2.2", section: "control", desc: "ping payload is echoed in the pong (RFC 6455 5.5.3)",
+		run: sendThen(frames(wstest.Ping([]byte("Hello, world!"))), func(s *session) outcome { return s.expectPong([]byte("Hello, world!")) })},
+	{id: "2.3", section: "control", desc: "ping with 125 byte binary payload is echoed",
+		run: sendThen(frames(wstest.Ping(bytes.Repeat([]byte{0xfe}, 125))), func(s *session) outcome { return s.expectPong(bytes.Repeat([]byte{0xfe}, 125)) })},
+	{id: "2.4", section: "control", desc: "ping with 126 byte payload fails the connection",
+		run: failWith(closeProtocolError, wstest.Ping(text(126)))},
+	{id: "2.5", section: "control", desc: "unsolicited pong is ignored", data: true,
+		run: roundTrip(frames(wstest.Pong([]byte("unsolicited")), wstest.Text("after pong")), wstest.OpText, []byte("after pong"))},
+	{id: "2.6", section: "control", desc: "fragmented ping fails the connection",
+		run: failWith(closeProtocolError, wstest.Frame{Opcode: wstest.OpPing, Payload: []byte("frag")}, wstest.Frame{Fin: true, Opcode: wstest.OpContinuation, Payload: []byte("ment")})},
+
+	// 3. reserved bits
+	{id: "3.1", section: "framing", desc: "RSV1 without negotiated extension fails the connection",
+		run: failWith(closeProtocolError, wstest.Frame{Fin: true, RSV: wstest.RSV1, Opcode: wstest.OpText, Payload: []byte("rsv1")})},
+	{id: "3.2", section: "framing", desc: "RSV2 fails the connection",
+		run: failWith(closeProtocolError, wstest.Frame{Fin: true, RSV: wstest.RSV2, Opcode: wstest.OpText, Payload: []byte("rsv2")})},
+	{id: "3.3", section: "framing", desc: "RSV3 on a ping fails the connection",
+		run: failWith(closeProtocolError, wstest.Frame{Fin: true, RSV: wstest.RSV3, Opcode: wstest.OpPing})},
+
+	// 4. opcodes
+	{id: "4.1", section: "framing", desc: "reserved non-control opcode 0x3 fails the connection",
+		run: failWith(closeProtocolError, wstest.Frame{Fin: true, Opcode: 0x3, Payload: []byte("reserved")})},
+	{id: "4.2", section: "framing", desc: "reserved control opcode 0xb fails the connection",
+		run: failWith(closeProtocolError, wstest.Frame{Fin: true, Opcode: 0xb})},
+
+	// 5. fragmentation
+	{id: "5.1", section: "fragmentation", desc: "text message in 2 fragments is reassembled", data: true,
+		run: roundTrip(wstest.Fragments(wstest.OpText, []byte("fragmented message"), 2), wstest.OpText, []byte("fragmented message"))},
+	{id: "5.2", section: "fragmentation", desc: "text message in 10 fragments is reassembled", data: true,
+		run: roundTrip(wstest.Fragments(wstest.OpText, text(1000), 10), wstest.OpText, text(1000))},
+	{id: "5.3", section: "fragmentation", desc: "ping between fragments is answered and the message is reassembled", data: true,
+		run: func(s *session) outcome {
+			f := wstest.Fragments(wstest.OpText, []byte("fragmented message"), 2)
+			if err := s.send(f[0], wstest.Ping([]byte("between"))); err != nil {
+				return fail("%s", err)
+			}
+			if o := s.expectPong([]byte("between")); o.status != statusPass {
+				return o
+			}
+			if err := s.send(f[1]); err != nil {
+				return fail("%s", err)
+			}
+			return s.expectMessage(wstest.OpText, []byte("fragmented message"))
+		}},
+	{id: "5.4", section: "fragmentation", desc: "continuation frame without a started message fails the connection",
+		run: failWith(closeProtocolError, wstest.Frame{Fin: true, Opcode: wstest.OpContinuation, Payload: []byte("orphan")})},
+	{id: "5.5", section: "fragmentation", desc: "new text frame inside a fragmented message fails the connection",
+		run: failWith(closeProtocolError, wstest.Frame{Opcode: wstest.OpText, Payload: []byte("first")}, wstest.Text("second"))},
+
+	// 6. UTF-8
+	{id: "6.1", section: "utf-8", desc: "valid multi-byte UTF-8 text is delivered", data: true,
+		run: roundTrip(frames(wstest.Text("κόσμε 文字化け 🙂")), wstest.OpText, []byte("κόσμε 文字化け 🙂"))},
+	{id: "6.2", section: "utf-8", desc: "code point split across fragments is reassembled", data: true,
+		run: roundTrip(frames(
+			wstest.Frame{Opcode: wstest.OpText, Payload: []byte("文字化")[:4]},
+			wstest.Frame{Fin: true, Opcode: wstest.OpContinuation, Payload: []byte("文字化")[4:]},
+		), wstest.OpText, []byte("文字化"))},
+	{id: "6.3", section: "utf-8", desc: "invalid UTF-8 text fails the connection with 1007",
+		run: failWith(closeInvalidData, wstest.Frame{Fin: true, Opcode: wstest.OpText, Payload: []byte{0xce, 0xba, 0xe1, 0xbd, 0xb9, 0xcf, 0x83, 0xce, 0xbc, 0xce, 0xb5, 0xed, 0xa0, 0x80, 0x65, 0x64, 0x69, 0x74, 0x65, 0x64}})},
+	{id: "6.4", section: "utf-8", desc: "truncated UTF-8 at the end of a message fails the connection with 1007",
+		run: failWith(closeInvalidData, wstest.Frame{Fin: true, Opcode: wstest.OpText, Payload: []byte("文字化")[:8]})},
+
+	// 7. masking
+	{id: "7.1", section: "masking", desc: "unmasked client frame fails the connection (RFC 6455 5.1)",
+		run: func(s *session) outcome {
+			if err := s.sendUnmasked(wstest.Text("unmasked")); err != nil {
+				return fail("%s", err)
+			}
+			return s.expectFailure(closeProtocolError)
+		}},
+
+	// 8. close handshake
+	{id: "8.1", section: "close", desc: "close 1000 is answered with a close frame and the server closes TCP",
+		run: sendThen(frames(wstest.Close(closeNormal, "bye")), func(s *session) outcome { return s.expectCloseReply(closeNormal) })},
+	{id: "8.2", section: "close", desc: "close without status code is answered",
+		run: sendThen(frames(wstest.Close(0, "")), func(s *session) outcome { return s.expectCloseReply(closeNormal, wstest.CloseNoStatus) })},
+	{id: "8.3", section: "close", desc: "close with application status code 3000 is answered",
+		run: sendThen(frames(wstest.Close(3000, "")), func(s *session) outcome { return s.expectCloseReply(3000, closeNormal) })},
+	{id: "8.4", section: "close", desc: "close with 1 byte payload fails the connection",
+		run: failWith(closeProtocolError, wstest.Frame{Fin: true, Opcode: wstest.OpClose, Payload: []byte{0x03}})},
+	{id: "8.5", section: "close", desc: "close with invalid status code 999 fails the connection",
+		run: failWith(closeProtocolError, wstest.Close(999, ""))},
+	{id: "8.6", section: "close", desc: "close with reserved status code 1005 fails the connection",
+		run: failWith(closeProtocolError, wstest.Close(wstest.CloseNoStatus, ""))},
+	{id: "8.7", section: "close", desc: "close with invalid UTF-8 reason fails the connection with 1007",
+		run: failWith(closeInvalidData, wstest.Frame{Fin: true, Opcode: wstest.OpClose, Payload: []byte{0x03, 0xe8, 0xff, 0xfe}})},
+	{id: "8.8", section: "close", desc: "data after close is not delivered", data: true,
+		run: func(s *session) outcome {
+			if err := s.send(wstest.Close(closeNormal, ""), wstest.Text("after close")); err != nil {
+				return fail("%s", err)
+			}
+			if s.t.mode == modeEcho {
+				return s.expectCloseReply(closeNormal)
+			}
+			o := s.expectMessage(wstest.OpText, []byte("after close"))
+			if o.status == statusPass {
+				return fail("message sent after close was delivered")
+			}
+			return pass()
+		}},
+}
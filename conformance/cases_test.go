@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"wstest"
+)
+
+// caseByID は id のケースを返す。
+func caseByID(t *testing.T, id string) testCase {
+	t.Helper()
+
+	for _, c := range cases {
+		if c.id == id {
+			return c
+		}
+	}
+	t.Fatalf("no such case: %s", id)
+	return testCase{}
+}
+
+// echo はデータメッセージを同じ opcode で返し、PingFrame には同じペイロードの PongFrame を返す Step。
+// wstest.Echo と異なり、ケースの終わりにクライアントが切断してもエラーにしない。
+func echo() wstest.Step {
+	return func(c *wstest.Conn) error {
+		for {
+			opcode, payload, err := c.ReadMessage()
+			if err != nil {
+				return nil
+			}
+			if err := c.WriteFrame(wstest.Frame{Fin: true, Opcode: opcode, Payload: payload}); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// fixedPong は xnet/server と同じく、PingFrame にペイロードによらず "thanks to ping!" の PongFrame を返し、
+// データメッセージはそのまま返す Step。
+func fixedPong() wstest.Step {
+	return func(c *wstest.Conn) error {
+		for {
+			f, err := c.ReadFrame()
+			if err != nil {
+				return nil
+			}
+			switch f.Opcode {
+			case wstest.OpPing:
+				err = c.WriteFrame(wstest.Pong([]byte("thanks to ping!")))
+			case wstest.OpText, wstest.OpBinary, wstest.OpContinuation:
+				err = c.WriteFrame(f)
+			case wstest.OpClose:
+				c.WriteFrame(f)
+				return nil
+			}
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+func TestCases(t *testing.T) {
+	tests := []struct {
+		name   string
+		server wstest.FakeServer
+		mode   string
+		// want はケースの ID ごとの結果。
+		want map[string]string
+		// detail は FAIL などの detail に含まれる文字列。
+		detail map[string]string
+	}{
+		{
+			name:   "echo",
+			server: wstest.FakeServer{Steps: []wstest.Step{echo()}},
+			mode:   modeEcho,
+			want: map[string]string{
+				"1.1.1": statusPass,
+				"1.1.5": statusPass,
+				"1.2.1": statusPass,
+				"2.1":   statusPass,
+				"2.2":   statusPass,
+				"2.5":   statusPass,
+				"5.2":   statusPass,
+				"5.3":   statusPass,
+				"6.2":   statusPass,
+				"8.1":   statusPass,
+				"8.3":   statusPass,
+				"8.8":   statusPass,
+				// RSV ビットを確認しないサーバーは、コネクションを失敗させない。
+				"3.2": statusFail,
+			},
+		},
+		{
+			name:   "fixed pong",
+			server: wstest.FakeServer{Steps: []wstest.Step{fixedPong()}},
+			mode:   modeEcho,
+			want: map[string]string{
+				"1.1.2": statusPass,
+				"2.1":   statusFail,
+				"2.2":   statusFail,
+				"2.3":   statusFail,
+				"5.3":   statusFail,
+			},
+			detail: map[string]string{
+				"2.2": `got pong payload "thanks to ping!", want "Hello, world!"`,
+			},
+		},
+		{
+			name:   "none",
+			server: wstest.FakeServer{Steps: []wstest.Step{echo()}},
+			mode:   modeNone,
+			want: map[string]string{
+				"1.1.1": statusSkip,
+				"5.1":   statusSkip,
+				"2.2":   statusPass,
+				"8.1":   statusPass,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server.Start(t)
+			target := &target{url: s.URL("/"), mode: tt.mode, timeout: 200 * time.Millisecond}
+
+			for id, want := range tt.want {
+				r := target.runCase(caseByID(t, id))
+				if r.Status != want {
+					t.Errorf("%s: got %s (%s), want %s", id, r.Status, r.Detail, want)
+				}
+				if d := tt.detail[id]; !strings.Contains(r.Detail, d) {
+					t.Errorf("%s: got detail %q, want %q", id, r.Detail, d)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+module conformance
+
+go 1.22
+
+require (
+	diag v0.0.0
+	wstest v0.0.0
+)
+
+replace wstest => ../wstest
+
+replace diag => ../diag
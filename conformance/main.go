@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	neturl "net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"diag"
+)
+
+// conformance は RFC 6455 の振る舞いを、サーバーに実際にフレームを送って確認する。
+//
+// 仕様:
+//
+//	ケースごとに新しいコネクションを張り、フレームを送信してサーバーの応答を確認する。
+//	データメッセージの確認は -mode で方法を選ぶ (echo: 同じコネクションに返る、pubsub: 同じ topic の受信用コネクションに届く)。
+//	-mode=none ではデータメッセージの確認が必要なケースを SKIP にし、制御フレームと close handshake のみを確認する。
+//	外部のツールやネットワークを使わずに実行できる。
+
+// caseResult は 1 つのケースの結果。-json で JSON として書き出す。
+type caseResult struct {
+	ID          string  `json:"id"`
+	Section     string  `json:"section"`
+	Description string  `json:"description"`
+	Status      string  `json:"status"`
+	Detail      string  `json:"detail,omitempty"`
+	Seconds     float64 `json:"seconds"`
+}
+
+// runCase は c を実行する。
+func (t *target) runCase(c testCase) (r caseResult) {
+	r = caseResult{ID: c.id, Section: c.section, Description: c.desc}
+	if c.data && t.mode == modeNone {
+		r.Status = statusSkip
+		r.Detail = "needs -mode=echo or -mode=pubsub to observe messages"
+		return r
+	}
+
+	started := time.Now()
+	defer func() { r.Seconds = time.Since(started).Seconds() }()
+
+	s, err := t.newSession(c.id)
+	if err != nil {
+		r.Status, r.Detail = statusFail, err.Error()
+		return r
+	}
+	defer s.close()
+
+	o := c.run(s)
+	r.Status, r.Detail = o.status, o.detail
+
+	return r
+}
+
+// writeReport は結果を表にして w に書き出す。
+func writeReport(w io.Writer, results []caseResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tSTATUS\tSECTION\tCASE\tDETAIL\n")
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Status]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.ID, r.Status, r.Section, r.Description, r.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%s: %d, %s: %d, %s: %d, %s: %d\n",
+		statusPass, counts[statusPass], statusNonStrict, counts[statusNonStrict], statusFail, counts[statusFail], statusSkip, counts[statusSkip])
+	return err
+}
+
+func main() {
+	// flag の設定。
+	url := flag.String("url", "ws://localhost:12341/subscribe", "The WebSocket URL of the server under test (with -mode=pubsub, the case ID is appended to the topic)")
+	origin := flag.String("origin", "", "The Origin header to send (default: http:// and the host of -url)")
+	mode := flag.String("mode", modeEcho, fmt.Sprintf("How to observe data messages (%s, %s, %s)", modeEcho, modePubSub, modeNone))
+	protocols := flag.String("protocols", "", "Comma separated subprotocols to offer (e.g. pubsub.v1.text)")
+	timeout := flag.Duration("timeout", 2*time.Second, "How long to wait for each response")
+	only := flag.String("cases", "", "Only run cases whose ID starts with this prefix (e.g. 2. or 8.1)")
+	jsonPath := flag.String("json", "", "Also write the results as JSON to this file (- for stdout)")
+	flag.Parse()
+
+	diag.Serve()
+
+	// x/net/websocket は Origin のない handshake を、gorilla/websocket は host の異なる Origin を拒否する。
+	if *origin == "" {
+		u, err := neturl.Parse(*url)
+		if err != nil {
+			slog.Error(fmt.Sprintf("invalid url: %s", err))
+			os.Exit(2)
+		}
+		*origin = "http://" + u.Host
+	}
+	t := &target{url: *url, origin: *origin, mode: *mode, timeout: *timeout}
+	switch t.mode {
+	case modeEcho, modePubSub, modeNone:
+	default:
+		slog.Error(fmt.Sprintf("unknown mode: %q", t.mode))
+		os.Exit(2)
+	}
+	for _, p := range strings.Split(*protocols, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			t.protocols = append(t.protocols, p)
+		}
+	}
+
+	// 接続できない場合は、全てのケースを FAIL にせずに終了する。
+	c, err := t.dial(t.caseURL("0"))
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to connect to %s: %s", t.url, err))
+		os.Exit(2)
+	}
+	c.Close()
+
+	var results []caseResult
+	failed := false
+	for _, c := range cases {
+		if !strings.HasPrefix(c.id, *only) {
+			continue
+		}
+		r := t.runCase(c)
+		slog.Debug(fmt.Sprintf("%s %s %s", r.ID, r.Status, r.Detail))
+		failed = failed || r.Status == statusFail
+		results = append(results, r)
+	}
+
+	if err := writeReport(os.Stdout, results); err != nil {
+		slog.Error(fmt.Sprintf("failed to write report: %s", err))
+	}
+
+	if *jsonPath != "" {
+		w := os.Stdout
+		if *jsonPath != "-" {
+			f, err := os.Create(*jsonPath)
+			if err != nil {
+				slog.Error(fmt.Sprintf("failed to create %s: %s", *jsonPath, err))
+				os.Exit(2)
+			}
+			defer f.Close()
+			w = f
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			slog.Error(fmt.Sprintf("failed to write JSON: %s", err))
+		}
+	}
+
+	// FAIL がある場合は CI で検出できるよう、0 以外で終了する。
+	if failed {
+		os.Exit(1)
+	}
+}
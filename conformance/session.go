@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"wstest"
+)
+
+// 確認の方法。
+const (
+	// modeEcho はデータメッセージを返すサーバー。送信したコネクションでメッセージを確認する。
+	modeEcho = "echo"
+	// modePubSub は同じ topic の他のコネクションに配信するサーバー。受信用のコネクションでメッセージを確認する。
+	modePubSub = "pubsub"
+	// modeNone はデータメッセージを返さないサーバー。メッセージの確認が必要なケースは SKIP にする。
+	modeNone = "none"
+)
+
+// probePrefix は modePubSub で受信用のコネクションの参加を確かめるメッセージの接頭辞。
+// このメッセージは確認の対象にしない。
+const probePrefix = "conformance-probe "
+
+// target はテスト対象のサーバー。
+type target struct {
+	url       string
+	origin    string
+	mode      string
+	protocols []string
+	timeout   time.Duration
+}
+
+// session は 1 つのケースで使うコネクション。
+type session struct {
+	t *target
+	// c はフレームを送信するコネクション。
+	c *wstest.Conn
+	// recv はメッセージを確認するコネクション。modeEcho では c と同じ、modeNone では nil。
+	recv *wstest.Conn
+}
+
+// caseURL は id のケースで接続する URL。modePubSub ではケースごとに別の topic にする。
+func (t *target) caseURL(id string) string {
+	if t.mode != modePubSub {
+		return t.url
+	}
+
+	return t.url + "." + id
+}
+
+func (t *target) dial(url string) (*wstest.Conn, error) {
+	header := http.Header{}
+	if t.origin != "" {
+		header.Set("Origin", t.origin)
+	}
+	if len(t.protocols) > 0 {
+		header.Set("Sec-WebSocket-Protocol", strings.Join(t.protocols, ", "))
+	}
+	c, _, err := wstest.Connect(url, header)
+	if err != nil {
+		return nil, err
+	}
+	c.Timeout = t.timeout
+
+	return c, nil
+}
+
+// newSession は id のケースのコネクションを張る。
+func (t *target) newSession(id string) (*session, error) {
+	url := t.caseURL(id)
+	c, err := t.dial(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+	s := &session{t: t, c: c}
+
+	switch t.mode {
+	case modeEcho:
+		s.recv = c
+	case modePubSub:
+		if s.recv, err = t.dial(url); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to dial receiver: %w", err)
+		}
+		if err := s.probe(); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// probe は受信用のコネクションが topic に参加するまで、probe のメッセージを送る。
+func (s *session) probe() error {
+	timeout := s.recv.Timeout
+	s.recv.Timeout = 50 * time.Millisecond
+	defer func() { s.recv.Timeout = timeout }()
+
+	deadline := time.Now().Add(timeout)
+	for i := 0; time.Now().Before(deadline); i++ {
+		if err := s.c.WriteFrame(wstest.Text(probePrefix + strconv.Itoa(i))); err != nil {
+			return fmt.Errorf("failed to send probe: %w", err)
+		}
+		_, payload, err := s.recv.ReadMessage()
+		if err == nil && bytes.HasPrefix(payload, []byte(probePrefix)) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("failed to receive probe: %w", err)
+		}
+	}
+
+	return fmt.Errorf("receiver did not get any message within %s", timeout)
+}
+
+func (s *session) close() {
+	s.c.Close()
+	if s.recv != nil {
+		s.recv.Close()
+	}
+}
+
+// send は frames を順に送信する。
+func (s *session) send(frames ...wstest.Frame) error {
+	for _, f := range frames {
+		if err := s.c.WriteFrame(f); err != nil {
+			return fmt.Errorf("failed to send %s: %w", f, err)
+		}
+	}
+
+	return nil
+}
+
+// sendUnmasked は f をマスクせずに送信する。
+func (s *session) sendUnmasked(f wstest.Frame) error {
+	f.Masked = false
+	return s.c.WriteRaw(wstest.AppendFrame(nil, f))
+}
+
+// expectMessage は opcode と payload のメッセージが届くことを確認する。
+// modePubSub では opcode は受信側の subprotocol で決まるため、payload のみを比較する。
+func (s *session) expectMessage(opcode byte, payload []byte) outcome {
+	for {
+		got, b, err := s.recv.ReadMessage()
+		if err != nil {
+			return readFailure("message", s.t.timeout, err)
+		}
+		if s.t.mode == modePubSub && bytes.HasPrefix(b, []byte(probePrefix)) {
+			continue
+		}
+
+		if !bytes.Equal(b, payload) {
+			return fail("got payload %s, want %s", summarize(b), summarize(payload))
+		}
+		if s.t.mode == modeEcho && got != opcode {
+			return fail("got opcode %#x, want %#x", got, opcode)
+		}
+		return pass()
+	}
+}
+
+// expectPong は payload の PongFrame が届くことを確認する。データメッセージは読み捨てる。
+func (s *session) expectPong(payload []byte) outcome {
+	for {
+		f, err := s.c.ReadFrame()
+		if err != nil {
+			return readFailure("pong", s.t.timeout, err)
+		}
+
+		switch f.Opcode {
+		case wstest.OpPong:
+			if !bytes.Equal(f.Payload, payload) {
+				return fail("got pong payload %s, want %s", summarize(f.Payload), summarize(payload))
+			}
+			return pass()
+		case wstest.OpPing:
+			s.c.WriteFrame(wstest.Pong(f.Payload))
+		case wstest.OpClose:
+			code, reason := f.CloseCode()
+			return fail("got close frame %d %q, want pong", code, reason)
+		}
+	}
+}
+
+// expectFailure はサーバーがコネクションを失敗させる (code の CloseFrame を送って閉じる) ことを確認する。
+//
+// 仕様:
+//
+//	code の CloseFrame が届いた場合は PASS、他のステータスコードの場合と、CloseFrame なしで閉じられた場合は NON-STRICT。
+//	timeout の間に CloseFrame も切断もない場合は FAIL。
+func (s *session) expectFailure(code uint16) outcome {
+	for {
+		f, err := s.c.ReadFrame()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fail("connection was not failed within %s", s.t.timeout)
+		}
+		if err != nil {
+			return nonStrict("connection closed without close frame (%s)", err)
+		}
+
+		switch f.Opcode {
+		case wstest.OpClose:
+			got, reason := f.CloseCode()
+			if got != code {
+				return nonStrict("got close code %d %q, want %d", got, reason, code)
+			}
+			return pass()
+		case wstest.OpPing:
+			s.c.WriteFrame(wstest.Pong(f.Payload))
+		}
+	}
+}
+
+// expectCloseReply は送信した CloseFrame に codes のいずれかの CloseFrame が返り、サーバーが TCP を閉じることを確認する。
+func (s *session) expectCloseReply(codes ...uint16) outcome {
+	for {
+		f, err := s.c.ReadFrame()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return fail("no close frame within %s", s.t.timeout)
+			}
+			return fail("connection closed without close frame (%s)", err)
+		}
+		if f.Opcode != wstest.OpClose {
+			continue
+		}
+
+		code, reason := f.CloseCode()
+		if !slices.Contains(codes, code) {
+			return nonStrict("got close code %d %q, want one of %v", code, reason, codes)
+		}
+		break
+	}
+
+	// RFC 6455 7.1.1: サーバーが先に TCP コネクションを閉じる。
+	for {
+		if _, err := s.c.ReadFrame(); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nonStrict("TCP connection was not closed by server within %s", s.t.timeout)
+			}
+			return pass()
+		}
+	}
+}
+
+// readFailure は want の読み込みに失敗した場合の結果。
+func readFailure(want string, timeout time.Duration, err error) outcome {
+	var ce *wstest.CloseError
+	switch {
+	case errors.As(err, &ce):
+		return fail("got close frame %d %q, want %s", ce.Code, ce.Reason, want)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fail("no %s within %s", want, timeout)
+	case errors.Is(err, io.EOF):
+		return fail("connection closed, want %s", want)
+	default:
+		return fail("failed to read %s: %s", want, err)
+	}
+}
+
+// summarize は比較に失敗したペイロードを短く表示する。
+func summarize(b []byte) string {
+	if len(b) <= 32 {
+		return strconv.Quote(string(b))
+	}
+
+	return fmt.Sprintf("%q... (%d bytes)", b[:32], len(b))
+}
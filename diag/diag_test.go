@@ -0,0 +1,176 @@
+package diag
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const dump = `goroutine 7 [running]:
+main.handler()
+	/src/main.go:40 +0x1a5
+
+goroutine 1 [IO wait, 2 minutes]:
+main.main()
+	/src/main.go:10 +0x25
+
+goroutine 18 [chan receive]:
+main.reader()
+	/src/main.go:60 +0x10
+created by main.handler in goroutine 7
+	/src/main.go:45 +0x9c
+
+goroutine 19 [chan receive]:
+main.reader()
+	/src/main.go:60 +0x10
+created by main.handler in goroutine 7
+	/src/main.go:45 +0x9c
+
+goroutine 21 [select]:
+main.ticker()
+	/src/main.go:80 +0x10
+created by main.reader in goroutine 18
+	/src/main.go:65 +0x30
+
+goroutine 30 [sleep]:
+time.Sleep(0x3b9aca00)
+created by main.old
+	/src/old.go:5 +0x30
+`
+
+func TestParseGoroutines(t *testing.T) {
+	gs := parseGoroutines([]byte(dump))
+	if len(gs) != 6 {
+		t.Fatalf("got %d goroutines, want 6", len(gs))
+	}
+
+	for i, want := range []Goroutine{
+		{ID: 7, State: "running", Site: siteNone},
+		{ID: 1, State: "IO wait", Site: siteNone},
+		{ID: 18, State: "chan receive", Site: "main.handler (main.go:45)", Parent: 7},
+		{ID: 19, State: "chan receive", Site: "main.handler (main.go:45)", Parent: 7},
+		{ID: 21, State: "select", Site: "main.reader (main.go:65)", Parent: 18},
+		// Go 1.21 より前の形式。
+		{ID: 30, State: "sleep", Site: "main.old (old.go:5)"},
+	} {
+		got := gs[i]
+		if got.ID != want.ID || got.State != want.State || got.Site != want.Site || got.Parent != want.Parent {
+			t.Errorf("#%d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestGroupBySite(t *testing.T) {
+	groups := GroupBySite(parseGoroutines([]byte(dump)))
+	if len(groups) != 4 {
+		t.Fatalf("got %d groups, want 4", len(groups))
+	}
+	if g := groups[0]; g.Site != siteNone || g.Count != 2 || g.States["running"] != 1 || g.States["IO wait"] != 1 {
+		t.Errorf("got %+v, want 2 goroutines without site", g)
+	}
+	if g := groups[1]; g.Site != "main.handler (main.go:45)" || g.Count != 2 || formatStates(g.States) != "chan receive: 2" {
+		t.Errorf("got %+v, want 2 goroutines from main.handler", g)
+	}
+}
+
+func TestDescendants(t *testing.T) {
+	gs := parseGoroutines([]byte(dump))
+	var ids []int64
+	for _, g := range descendants(gs, 7) {
+		ids = append(ids, g.ID)
+	}
+	if len(ids) != 3 || ids[0] != 18 || ids[1] != 19 || ids[2] != 21 {
+		t.Errorf("got %v, want [18 19 21]", ids)
+	}
+	if gs := descendants(gs, 1); len(gs) != 0 {
+		t.Errorf("got %d descendants of main, want 0", len(gs))
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check(time.Second, func() {
+		done := make(chan struct{})
+		go func() { <-done }()
+		close(done)
+	}); err != nil {
+		t.Errorf("got %s, want no leak", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	err := Check(50*time.Millisecond, func() {
+		go func() {
+			// 孫の goroutine も検出する。
+			go func() { <-stop }()
+			<-stop
+		}()
+	})
+	var leak *LeakError
+	if !errors.As(err, &leak) {
+		t.Fatalf("got %v, want *LeakError", err)
+	}
+	if len(leak.Leaked) != 2 {
+		t.Errorf("got %d leaked goroutines, want 2", len(leak.Leaked))
+	}
+	if !strings.Contains(err.Error(), "TestCheck") {
+		t.Errorf("got %q, want the site of the leak", err)
+	}
+}
+
+func TestCheckPanic(t *testing.T) {
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("got %v, want boom", r)
+		}
+	}()
+	Check(time.Second, func() { panic("boom") })
+}
+
+func TestMount(t *testing.T) {
+	mux := http.NewServeMux()
+	Mount(mux)
+
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/debug/goroutines?stack=1"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d, want 200", path, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/goroutines?stack=1", nil))
+	if body := w.Body.String(); !strings.Contains(body, "COUNT") || !strings.Contains(body, "goroutine ") {
+		t.Errorf("got %q, want sites and stacks", body)
+	}
+}
+
+func TestServeAddr(t *testing.T) {
+	tests := map[string]string{
+		":6060":          "localhost:6060",
+		"127.0.0.1:6060": "127.0.0.1:6060",
+		"[::1]:6060":     "[::1]:6060",
+	}
+	for addr, want := range tests {
+		got, err := serveAddr(addr)
+		if err != nil || got != want {
+			t.Errorf("serveAddr(%q) = %q, %v, want %q", addr, got, err, want)
+		}
+	}
+
+	if _, err := serveAddr("6060"); err == nil {
+		t.Error("serveAddr(\"6060\"): want error")
+	}
+}
+
+func TestWriteGroups(t *testing.T) {
+	var b bytes.Buffer
+	writeGroups(&b, GroupBySite(parseGoroutines([]byte(dump))))
+	if !strings.Contains(b.String(), "main.reader (main.go:65)") {
+		t.Errorf("got %q, want main.reader", b.String())
+	}
+}
@@ -0,0 +1,192 @@
+// Package diag は各プログラムで共通の診断用の道具。
+//
+// net/http/pprof と expvar をマウントし、goroutine を作成した場所ごとに集計する。
+// コネクションを閉じた後も残る goroutine を検出する leak check を、環境変数 DIAG_LEAKCHECK で有効にできる。
+// 環境変数 DIAG_RECORD を設定すると、コネクションの全てのフレームを JSONL に記録する。
+// go 1.20 のモジュールからも使えるよう、標準ライブラリのみを使う。
+package diag
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Goroutine はスタックダンプの 1 つの goroutine。
+type Goroutine struct {
+	ID int64
+	// State は "chan receive" などの状態。待っている時間は含まない。
+	State string
+	// Site は goroutine を作成した場所 (関数とファイル名:行)。main goroutine などは "(none)"。
+	Site string
+	// Parent は作成した goroutine の ID。Go 1.21 より前のランタイムなど、不明な場合は 0。
+	Parent int64
+	// Stack は goroutine のスタックトレース。
+	Stack string
+}
+
+// siteNone は作成した場所のない goroutine の Site。
+const siteNone = "(none)"
+
+// Goroutines は全ての goroutine を返す。
+func Goroutines() []Goroutine {
+	return parseGoroutines(stack(true))
+}
+
+// stack は runtime.Stack の結果を、バッファが足りるまで広げて返す。
+func stack(all bool) []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, all)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// currentID は呼び出した goroutine の ID を返す。
+func currentID() int64 {
+	gs := parseGoroutines(stack(false))
+	if len(gs) == 0 {
+		return 0
+	}
+
+	return gs[0].ID
+}
+
+// parseGoroutines は runtime.Stack の形式のダンプを goroutine ごとに分ける。
+//
+// 仕様:
+//
+//	goroutine は空行で区切られ、1 行目は "goroutine 18 [chan receive, 2 minutes]:" の形式。
+//	作成した場所は最後の "created by main.f in goroutine 1" と、続くファイル名:行から求める。
+//	Go 1.21 より前のランタイムでは "in goroutine N" がなく、Parent は 0 になる。
+func parseGoroutines(dump []byte) []Goroutine {
+	var gs []Goroutine
+	for _, block := range strings.Split(strings.TrimSpace(string(dump)), "\n\n") {
+		lines := strings.Split(block, "\n")
+		header := lines[0]
+		if !strings.HasPrefix(header, "goroutine ") {
+			continue
+		}
+
+		g := Goroutine{Site: siteNone, Stack: block}
+		rest := strings.TrimPrefix(header, "goroutine ")
+		id, state, ok := strings.Cut(rest, " [")
+		if !ok {
+			continue
+		}
+		g.ID, _ = strconv.ParseInt(id, 10, 64)
+		state = strings.TrimSuffix(state, "]:")
+		// "chan receive, 2 minutes" の待っている時間を除く。
+		state, _, _ = strings.Cut(state, ",")
+		g.State = state
+
+		for i, line := range lines {
+			fn, ok := strings.CutPrefix(line, "created by ")
+			if !ok {
+				continue
+			}
+			fn, parent, ok := strings.Cut(fn, " in goroutine ")
+			if ok {
+				g.Parent, _ = strconv.ParseInt(parent, 10, 64)
+			}
+			g.Site = fn
+			if i+1 < len(lines) {
+				g.Site += " (" + location(lines[i+1]) + ")"
+			}
+		}
+		gs = append(gs, g)
+	}
+
+	return gs
+}
+
+// location は "\t/path/to/main.go:89 +0x1a5" をファイル名:行にする。
+func location(line string) string {
+	line = strings.TrimSpace(line)
+	if i := strings.LastIndex(line, " +0x"); i >= 0 {
+		line = line[:i]
+	}
+
+	return filepath.Base(line)
+}
+
+// Group は作成した場所ごとの goroutine。
+type Group struct {
+	Site  string
+	Count int
+	// States は状態ごとの goroutine の数。
+	States map[string]int
+	// Sample は最初の goroutine のスタックトレース。
+	Sample string
+}
+
+// GroupBySite は gs を作成した場所ごとに集計し、数の多い順に返す。
+func GroupBySite(gs []Goroutine) []Group {
+	index := make(map[string]int)
+	var groups []Group
+	for _, g := range gs {
+		i, ok := index[g.Site]
+		if !ok {
+			i = len(groups)
+			index[g.Site] = i
+			groups = append(groups, Group{Site: g.Site, States: make(map[string]int), Sample: g.Stack})
+		}
+		groups[i].Count++
+		groups[i].States[g.State]++
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Site < groups[j].Site
+	})
+
+	return groups
+}
+
+// descendants は gs のうち、id の goroutine から (生きている goroutine を辿って) 作られたものを返す。
+// 作成元の goroutine が既に終了している場合は辿れない。
+func descendants(gs []Goroutine, id int64) []Goroutine {
+	owned := map[int64]bool{id: true}
+	var found []Goroutine
+	// 子が親より前に並ぶ場合があるため、増えなくなるまで繰り返す。
+	for changed := true; changed; {
+		changed = false
+		for _, g := range gs {
+			if g.Parent != 0 && owned[g.Parent] && !owned[g.ID] {
+				owned[g.ID] = true
+				found = append(found, g)
+				changed = true
+			}
+		}
+	}
+
+	return found
+}
+
+// formatStates は States を "chan receive: 2, select: 1" の形式にする。
+func formatStates(states map[string]int) string {
+	keys := make([]string, 0, len(states))
+	for k := range states {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %d", k, states[k])
+	}
+
+	return b.String()
+}
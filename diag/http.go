@@ -0,0 +1,150 @@
+package diag
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"text/tabwriter"
+	"time"
+)
+
+// AddrEnv は診断用のハンドラーを提供するアドレスを指定する環境変数。
+const AddrEnv = "DIAG_ADDR"
+
+func init() {
+	// 作成した場所ごとの goroutine の数。
+	expvar.Publish("goroutine_sites", expvar.Func(func() any {
+		sites := make(map[string]int)
+		for _, g := range GroupBySite(Goroutines()) {
+			sites[g.Site] = g.Count
+		}
+		return sites
+	}))
+}
+
+// Mount は mux に診断用のハンドラーを登録する。
+//
+// 仕様:
+//
+//	/debug/pprof/ に net/http/pprof を、/debug/vars に expvar を、/debug/goroutines に作成した場所ごとの goroutine を登録する。
+//	net/http/pprof と expvar は import 時に http.DefaultServeMux へ登録するため、mux が http.DefaultServeMux の場合は登録しない。
+//
+// 注意)
+//   - pprof はプロファイルの取得でプロセスに負荷をかけられ、expvar はコマンドラインを返す。
+//     WebSocket を受け付ける mux には登録せず、Serve で別のアドレスから提供する。
+//   - このパッケージを import すると http.DefaultServeMux にも pprof と expvar が登録されるため、
+//     http.DefaultServeMux を外部に公開しないこと。
+func Mount(mux *http.ServeMux) {
+	if mux != http.DefaultServeMux {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+	mux.HandleFunc("/debug/goroutines", serveGoroutines)
+}
+
+// Serve は AddrEnv のアドレスで、Mount したハンドラーを別の goroutine で提供する。
+//
+// 仕様:
+//
+//	AddrEnv が空の場合は何もしない。外部に公開しないよう、デフォルトでは提供しない。
+//	ホストを省略した場合 (例: :6060) は localhost で待ち受ける。
+//	待ち受けられない場合はプロセスを終了する。
+func Serve() {
+	addr := os.Getenv(AddrEnv)
+	if addr == "" {
+		return
+	}
+
+	addr, err := serveAddr(addr)
+	if err != nil {
+		log.Fatalf("diag: invalid %s: %s", AddrEnv, err)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("diag: failed to listen: %s", err)
+	}
+	log.Printf("diag: serving on http://%s/debug/", ln.Addr())
+
+	mux := http.NewServeMux()
+	Mount(mux)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("diag: failed to serve: %s", err)
+		}
+	}()
+}
+
+// serveAddr はホストを省略したアドレスを localhost のアドレスにする。
+func serveAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// serveGoroutines は作成した場所ごとの goroutine の数を表にして返す。
+// ?stack=1 の場合は、場所ごとに 1 つのスタックトレースも返す。
+func serveGoroutines(w http.ResponseWriter, r *http.Request) {
+	gs := Goroutines()
+	groups := GroupBySite(gs)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "goroutines: %d, sites: %d\n\n", len(gs), len(groups))
+	writeGroups(w, groups)
+
+	if r.URL.Query().Get("stack") != "1" {
+		return
+	}
+	for _, g := range groups {
+		fmt.Fprintf(w, "\n# %d: %s\n%s\n", g.Count, g.Site, g.Sample)
+	}
+}
+
+// writeGroups は groups を表にして w に書き出す。
+func writeGroups(w io.Writer, groups []Group) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "COUNT\tSITE\tSTATES\n")
+	for _, g := range groups {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", g.Count, g.Site, formatStates(g.States))
+	}
+	tw.Flush()
+}
+
+// Watch は interval ごとに goroutine の数と、前回から数が変わった作成場所を w に書き出す。
+// 数が増え続ける場所がリークの候補になる。
+func Watch(w io.Writer, interval time.Duration) {
+	prev := make(map[string]int)
+	for range time.Tick(interval) {
+		fmt.Fprintf(w, "runtime.NumGoroutine(): %v\n", runtime.NumGoroutine())
+
+		cur := make(map[string]int)
+		for _, g := range GroupBySite(Goroutines()) {
+			cur[g.Site] = g.Count
+			if d := g.Count - prev[g.Site]; d != 0 {
+				fmt.Fprintf(w, "  %+d\t%d\t%s\n", d, g.Count, g.Site)
+			}
+		}
+		for site, n := range prev {
+			if _, ok := cur[site]; !ok {
+				fmt.Fprintf(w, "  %+d\t0\t%s\n", -n, site)
+			}
+		}
+		prev = cur
+	}
+}
@@ -0,0 +1,101 @@
+package diag
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// LeakCheckEnv は leak check を有効にする環境変数。
+//
+//	log:  リークした goroutine をログに書き出す
+//	fail: ログに書き出した後、終了コード 1 でプロセスを終了する
+const LeakCheckEnv = "DIAG_LEAKCHECK"
+
+// leakGrace はハンドラーの終了後、goroutine の終了を待つ時間。
+const leakGrace = 2 * time.Second
+
+// leaks はリークした goroutine の数。
+var leaks = expvar.NewInt("goroutine_leaks")
+
+// LeakError はハンドラーの終了後も残っている goroutine。
+type LeakError struct {
+	Leaked []Goroutine
+}
+
+func (e *LeakError) Error() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d goroutines outlived the connection\n", len(e.Leaked))
+	writeGroups(&b, GroupBySite(e.Leaked))
+	for _, g := range GroupBySite(e.Leaked) {
+		fmt.Fprintf(&b, "\n# %d: %s\n%s\n", g.Count, g.Site, g.Sample)
+	}
+
+	return b.String()
+}
+
+// Check は f を新しい goroutine で実行し、f の終了後 grace の間に f から作られた goroutine が終了しない場合は *LeakError を返す。
+// f の panic はそのまま呼び出し元に伝える。
+func Check(grace time.Duration, f func()) error {
+	var (
+		id        int64
+		recovered any
+	)
+	// f の goroutine は f の終了とともに終了するため、以降に作られる goroutine は f の子孫にならない。
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { recovered = recover() }()
+
+		id = currentID()
+		f()
+	}()
+	<-done
+	if recovered != nil {
+		panic(recovered)
+	}
+
+	deadline := time.Now().Add(grace)
+	for {
+		leaked := descendants(Goroutines(), id)
+		if len(leaked) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return &LeakError{Leaked: leaked}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// LeakCheck は next を Check で実行するハンドラーを返す。
+//
+// 仕様:
+//
+//	WebSocket のコネクションは next の中で閉じられるため、next の終了後も残る goroutine をリークとみなす。
+//	LeakCheckEnv が空の場合は next をそのまま返す。
+//	ハンドラーの終了後もコネクションを使い続ける実装 (netpoll など) には使えない。
+func LeakCheck(next http.Handler) http.Handler {
+	mode := os.Getenv(LeakCheckEnv)
+	if mode == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := Check(leakGrace, func() { next.ServeHTTP(w, r) })
+		if err == nil {
+			return
+		}
+
+		leaked := err.(*LeakError).Leaked
+		leaks.Add(int64(len(leaked)))
+		log.Printf("leak check: %s %s: %s", r.Method, r.URL.Path, err)
+		if mode == "fail" {
+			os.Exit(1)
+		}
+	})
+}
@@ -0,0 +1,513 @@
+package diag
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// RecordEnv は全てのフレームを記録する JSONL のファイル名を指定する環境変数。
+const RecordEnv = "DIAG_RECORD"
+
+// Record の Event。
+const (
+	EventOpen  = "open"
+	EventFrame = "frame"
+	EventClose = "close"
+)
+
+// Frame の Dir。
+const (
+	ClientToServer = "c2s"
+	ServerToClient = "s2c"
+)
+
+// Handshake の Side。
+const (
+	SideClient = "client"
+	SideServer = "server"
+)
+
+const (
+	// maxRecordHead は handshake のリクエスト、レスポンスのヘッダーの上限。
+	maxRecordHead = 64 << 10
+	// maxRecordFrame は記録するフレームのペイロードの上限。超えた場合はそのコネクションの記録をやめる。
+	maxRecordFrame = 16 << 20
+)
+
+// redactedHeaders は記録しないリクエストヘッダー。
+var redactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// Record は記録の JSONL の 1 行。
+//
+// 仕様:
+//
+//	コネクションごとに open (handshake), frame (フレームごと), close の順に記録する。
+//	Conn は記録したプロセスの中でコネクションを区別する番号。複数のプロセスで同じファイルに記録すると重なるため、ファイルはプロセスごとに分ける。
+//	Time はフレームの最後のバイトを読み書きした時刻。
+type Record struct {
+	Time  time.Time `json:"time"`
+	Conn  int64     `json:"conn"`
+	Event string    `json:"event"`
+	// Handshake は open の場合のみ。
+	*Handshake
+	// Frame は frame の場合のみ。
+	*Frame
+	// Error は記録を途中でやめた理由。
+	Error string `json:"error,omitempty"`
+}
+
+// Handshake は 101 Switching Protocols で終わった handshake。
+type Handshake struct {
+	// Side は記録した側 (SideClient, SideServer)。
+	Side   string `json:"side"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	// URI は "/topic?x=1" のようなリクエストの URI。
+	URI string `json:"uri"`
+	// Header はリクエストヘッダー。Authorization, Cookie などは含まない。
+	Header         http.Header `json:"header"`
+	ResponseHeader http.Header `json:"responseHeader"`
+}
+
+// Frame は記録したフレーム。Payload はマスクを外したもの。
+type Frame struct {
+	// Dir は送信した向き (ClientToServer, ServerToClient)。
+	Dir     string `json:"dir"`
+	Fin     bool   `json:"fin"`
+	RSV     byte   `json:"rsv"`
+	Opcode  Opcode `json:"opcode"`
+	Masked  bool   `json:"masked"`
+	Payload []byte `json:"payload"`
+}
+
+// Opcode は JSON で "text" などの名前になる opcode。予約済みの opcode は "0x3" の形式になる。
+type Opcode byte
+
+var opcodeNames = map[Opcode]string{
+	0x0: "continuation",
+	0x1: "text",
+	0x2: "binary",
+	0x8: "close",
+	0x9: "ping",
+	0xa: "pong",
+}
+
+func (o Opcode) String() string {
+	if name, ok := opcodeNames[o]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%#x", byte(o))
+}
+
+func (o Opcode) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+func (o *Opcode) UnmarshalText(b []byte) error {
+	for op, name := range opcodeNames {
+		if name == string(b) {
+			*o = op
+			return nil
+		}
+	}
+
+	n, err := strconv.ParseUint(string(b), 0, 4)
+	if err != nil {
+		return fmt.Errorf("diag: invalid opcode: %q", b)
+	}
+	*o = Opcode(n)
+
+	return nil
+}
+
+// Recorder はコネクションの全てのフレームを JSONL に書き出す。
+// nil の Recorder は何も記録せず、コネクションをそのまま返す。
+type Recorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	failed bool
+
+	conns atomic.Int64
+}
+
+// NewRecorder は w に書き出す Recorder を返す。
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+var (
+	recordingOnce sync.Once
+	recording     *Recorder
+)
+
+// Recording は RecordEnv のファイルに追記する Recorder を返す。RecordEnv が空の場合は nil を返す。
+// ファイルを開けない場合はプロセスを終了する。
+func Recording() *Recorder {
+	recordingOnce.Do(func() {
+		path := os.Getenv(RecordEnv)
+		if path == "" {
+			return
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalf("diag: failed to open %s: %s", path, err)
+		}
+		recording = NewRecorder(f)
+	})
+
+	return recording
+}
+
+// Listener は ln が受け付けたコネクションをサーバー側として記録する Listener を返す。
+//
+// 仕様:
+//
+//	暗号化する前のフレームを記録するため、TLS の場合は tls.NewListener の Listener を渡す。
+//	http.Server からは *tls.Conn に見えなくなるため、r.TLS は nil になる。
+func (r *Recorder) Listener(ln net.Listener) net.Listener {
+	if r == nil {
+		return ln
+	}
+
+	return &recordListener{Listener: ln, rec: r}
+}
+
+// Server は c をサーバー側のコネクションとして記録する。
+func (r *Recorder) Server(c net.Conn) net.Conn {
+	return r.wrap(c, SideServer)
+}
+
+// Client は c をクライアント側のコネクションとして記録する。
+func (r *Recorder) Client(c net.Conn) net.Conn {
+	return r.wrap(c, SideClient)
+}
+
+// DialContext は dial で接続したコネクションをクライアント側として記録する関数を返す。
+// gorilla/websocket の Dialer.NetDialContext, gobwas/ws の Dialer.NetDial などに使う。
+func (r *Recorder) DialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if r == nil {
+		return dial
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return r.Client(c), nil
+	}
+}
+
+func (r *Recorder) wrap(c net.Conn, side string) net.Conn {
+	if r == nil {
+		return c
+	}
+
+	return &recordConn{Conn: c, rec: r, id: r.conns.Add(1), side: side}
+}
+
+// write は rec を 1 行で書き出す。書き込みに失敗した場合は 1 度だけログに出す。
+func (r *Recorder) write(rec Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(rec); err != nil && !r.failed {
+		r.failed = true
+		log.Printf("diag: failed to record: %s", err)
+	}
+}
+
+// ListenAndServe は http.ListenAndServe と同じ。RecordEnv が設定されている場合は、全てのコネクションのフレームを記録する。
+func ListenAndServe(addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return http.Serve(Recording().Listener(ln), handler)
+}
+
+type recordListener struct {
+	net.Listener
+	rec *Recorder
+}
+
+func (l *recordListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.rec.Server(c), nil
+}
+
+// recordConn の状態。
+const (
+	recordHandshake = iota
+	recordOpen
+	// recordStopped は WebSocket ではない、または記録をやめたコネクション。
+	recordStopped
+)
+
+// recordConn は読み書きしたバイト列をフレームに分けて記録する net.Conn。
+//
+// 仕様:
+//
+//	クライアントからサーバーへの向きは HTTP のリクエスト、逆の向きはレスポンスのヘッダーから始まり、その後にフレームが続く。
+//	レスポンスが 101 以外の場合は記録しない。keep-alive で 2 つ目以降のリクエストから upgrade するコネクションは記録できない。
+type recordConn struct {
+	net.Conn
+	rec  *Recorder
+	id   int64
+	side string
+
+	mu    sync.Mutex
+	state int
+	req   *http.Request
+	// streams は ClientToServer, ServerToClient の向きの、まだフレームになっていないバイト列。
+	streams map[string]*recordStream
+}
+
+type recordStream struct {
+	buf  []byte
+	head bool
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		dir := ServerToClient
+		if c.side == SideServer {
+			dir = ClientToServer
+		}
+		c.feed(dir, b[:n])
+	}
+
+	return n, err
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		dir := ClientToServer
+		if c.side == SideServer {
+			dir = ServerToClient
+		}
+		c.feed(dir, b[:n])
+	}
+
+	return n, err
+}
+
+func (c *recordConn) Close() error {
+	err := c.Conn.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop(time.Now(), nil)
+
+	return err
+}
+
+// SyscallConn は元のコネクションのファイルディスクリプタを返す。netpoll でコネクションを待つ実装のため。
+func (c *recordConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("%T does not expose its file descriptor", c.Conn)
+	}
+
+	return sc.SyscallConn()
+}
+
+// feed は dir の向きに読み書きした b を記録する。
+func (c *recordConn) feed(dir string, b []byte) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == recordStopped {
+		return
+	}
+	if c.streams == nil {
+		c.streams = map[string]*recordStream{ClientToServer: {}, ServerToClient: {}}
+	}
+	s := c.streams[dir]
+	s.buf = append(s.buf, b...)
+
+	if !s.head {
+		i := bytes.Index(s.buf, []byte("\r\n\r\n"))
+		if i < 0 {
+			if len(s.buf) > maxRecordHead {
+				c.stop(now, nil)
+			}
+			return
+		}
+		head := s.buf[:i+4]
+		s.buf = s.buf[i+4:]
+		s.head = true
+		if err := c.handshake(now, dir, head); err != nil {
+			c.stop(now, nil)
+			return
+		}
+	}
+
+	if c.state != recordOpen {
+		return
+	}
+	// 101 を受け取る前に届いたフレームも記録する。
+	for _, dir := range []string{ClientToServer, ServerToClient} {
+		if err := c.frames(now, dir); err != nil {
+			c.stop(now, err)
+			return
+		}
+	}
+}
+
+// handshake は dir の向きの HTTP のヘッダーを読み込む。101 のレスポンスの場合は open を記録する。
+func (c *recordConn) handshake(now time.Time, dir string, head []byte) error {
+	r := bufio.NewReader(bytes.NewReader(head))
+	if dir == ClientToServer {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return err
+		}
+		c.req = req
+		return nil
+	}
+
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || c.req == nil {
+		return fmt.Errorf("not a websocket handshake: %s", resp.Status)
+	}
+
+	header := c.req.Header.Clone()
+	for _, k := range redactedHeaders {
+		header.Del(k)
+	}
+	c.state = recordOpen
+	c.rec.write(Record{
+		Time:  now,
+		Conn:  c.id,
+		Event: EventOpen,
+		Handshake: &Handshake{
+			Side:           c.side,
+			Local:          c.LocalAddr().String(),
+			Remote:         c.RemoteAddr().String(),
+			URI:            c.req.RequestURI,
+			Header:         header,
+			ResponseHeader: resp.Header,
+		},
+	})
+
+	return nil
+}
+
+// frames は dir の向きのバイト列のうち、揃ったフレームを記録する。
+func (c *recordConn) frames(now time.Time, dir string) error {
+	s := c.streams[dir]
+	for {
+		f, n, err := parseFrame(s.buf)
+		if err != nil || n == 0 {
+			return err
+		}
+		f.Dir = dir
+		s.buf = s.buf[n:]
+		c.rec.write(Record{Time: now, Conn: c.id, Event: EventFrame, Frame: &f})
+	}
+}
+
+// stop は記録をやめる。open を記録している場合は err とともに close を記録する。
+func (c *recordConn) stop(now time.Time, err error) {
+	if c.state == recordOpen {
+		rec := Record{Time: now, Conn: c.id, Event: EventClose}
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		c.rec.write(rec)
+	}
+	c.state = recordStopped
+	c.streams = nil
+	c.req = nil
+}
+
+var errRecordFrameTooLarge = errors.New("diag: frame too large to record")
+
+// parseFrame は b の先頭のフレームを読み込み、フレームと読み込んだバイト数を返す。
+// フレームが揃っていない場合は 0 を返す。
+func parseFrame(b []byte) (Frame, int, error) {
+	if len(b) < 2 {
+		return Frame{}, 0, nil
+	}
+
+	f := Frame{
+		Fin:    b[0]&0x80 != 0,
+		RSV:    b[0] & 0x70,
+		Opcode: Opcode(b[0] & 0x0f),
+		Masked: b[1]&0x80 != 0,
+	}
+
+	off := 2
+	n := uint64(b[1] & 0x7f)
+	switch n {
+	case 126:
+		if len(b) < off+2 {
+			return Frame{}, 0, nil
+		}
+		n = uint64(binary.BigEndian.Uint16(b[off:]))
+		off += 2
+	case 127:
+		if len(b) < off+8 {
+			return Frame{}, 0, nil
+		}
+		n = binary.BigEndian.Uint64(b[off:])
+		off += 8
+	}
+	if n > maxRecordFrame {
+		return Frame{}, 0, fmt.Errorf("%w: %d bytes", errRecordFrameTooLarge, n)
+	}
+
+	var key []byte
+	if f.Masked {
+		if len(b) < off+4 {
+			return Frame{}, 0, nil
+		}
+		key = b[off : off+4]
+		off += 4
+	}
+
+	end := off + int(n)
+	if len(b) < end {
+		return Frame{}, 0, nil
+	}
+	f.Payload = make([]byte, n)
+	copy(f.Payload, b[off:end])
+	if f.Masked {
+		for i := range f.Payload {
+			f.Payload[i] ^= key[i%4]
+		}
+	}
+
+	return f, end, nil
+}
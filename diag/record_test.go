@@ -0,0 +1,188 @@
+package diag
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+const (
+	handshakeRequest  = "GET /topic?x=1 HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: pubsub.v1.text\r\nAuthorization: Bearer secret\r\n\r\n"
+	handshakeResponse = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: pubsub.v1.text\r\n\r\n"
+)
+
+// appendTestFrame は payload のフレームを b に追加する。mask が nil の場合はマスクしない。
+func appendTestFrame(b []byte, fin bool, opcode byte, mask []byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	b = append(b, b0)
+
+	var m byte
+	if mask != nil {
+		m = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, m|byte(len(payload)))
+	default:
+		b = append(b, m|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	if mask == nil {
+		return append(b, payload...)
+	}
+
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+
+	return b
+}
+
+func readRecords(t *testing.T, r io.Reader) []Record {
+	t.Helper()
+
+	var records []Record
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// session はクライアントとサーバーを記録しながら、handshake の後に c2s と s2c のバイト列を送る。
+// クライアントは 1 バイトずつ書き込み、サーバーは 101 のレスポンスと s2c をまとめて書き込む。
+func session(t *testing.T, response string, c2s, s2c []byte) (client, server []Record) {
+	t.Helper()
+
+	var cb, sb bytes.Buffer
+	cc, sc := net.Pipe()
+	cc = NewRecorder(&cb).Client(cc)
+	sc = NewRecorder(&sb).Server(sc)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer sc.Close()
+
+		r := bufio.NewReader(sc)
+		if _, err := http.ReadRequest(r); err != nil {
+			t.Error(err)
+			return
+		}
+		sc.Write(append([]byte(response), s2c...))
+		io.ReadFull(r, make([]byte, len(c2s)))
+	}()
+
+	cc.Write([]byte(handshakeRequest))
+	r := bufio.NewReader(cc)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		io.ReadFull(r, make([]byte, len(s2c)))
+	}
+	for i := range c2s {
+		cc.Write(c2s[i : i+1])
+	}
+	<-done
+	cc.Close()
+
+	return readRecords(t, &cb), readRecords(t, &sb)
+}
+
+func TestRecord(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	var c2s, s2c []byte
+	c2s = appendTestFrame(c2s, false, 0x1, mask, []byte("hel"))
+	c2s = appendTestFrame(c2s, true, 0x0, mask, []byte("lo"))
+	// マスクしない PingFrame も記録する。
+	c2s = appendTestFrame(c2s, true, 0x9, nil, []byte("ping"))
+	s2c = appendTestFrame(s2c, true, 0x2, nil, bytes.Repeat([]byte{'x'}, 200))
+	s2c = appendTestFrame(s2c, true, 0x8, nil, []byte{0x03, 0xe8})
+
+	type frame struct {
+		dir     string
+		fin     bool
+		opcode  Opcode
+		masked  bool
+		payload string
+	}
+	want := []frame{
+		{ServerToClient, true, 0x2, false, string(bytes.Repeat([]byte{'x'}, 200))},
+		{ServerToClient, true, 0x8, false, "\x03\xe8"},
+		{ClientToServer, false, 0x1, true, "hel"},
+		{ClientToServer, true, 0x0, true, "lo"},
+		{ClientToServer, true, 0x9, false, "ping"},
+	}
+
+	client, server := session(t, handshakeResponse, c2s, s2c)
+	for side, records := range map[string][]Record{SideClient: client, SideServer: server} {
+		if len(records) != len(want)+2 {
+			t.Fatalf("%s: got %d records, want %d", side, len(records), len(want)+2)
+		}
+
+		open := records[0]
+		if open.Event != EventOpen || open.Handshake == nil {
+			t.Fatalf("%s: got %+v, want open", side, open)
+		}
+		if open.Side != side || open.URI != "/topic?x=1" || open.Header.Get("Sec-WebSocket-Protocol") != "pubsub.v1.text" || open.ResponseHeader.Get("Sec-WebSocket-Protocol") != "pubsub.v1.text" {
+			t.Errorf("%s: got %+v, want the handshake", side, open.Handshake)
+		}
+		if open.Header.Get("Authorization") != "" {
+			t.Errorf("%s: Authorization is recorded", side)
+		}
+
+		for i, w := range want {
+			rec := records[i+1]
+			if rec.Event != EventFrame || rec.Frame == nil {
+				t.Fatalf("%s #%d: got %+v, want frame", side, i, rec)
+			}
+			got := frame{rec.Dir, rec.Fin, rec.Opcode, rec.Masked, string(rec.Payload)}
+			if got != w {
+				t.Errorf("%s #%d: got %+v, want %+v", side, i, got, w)
+			}
+		}
+
+		if last := records[len(records)-1]; last.Event != EventClose || last.Error != "" {
+			t.Errorf("%s: got %+v, want close", side, last)
+		}
+	}
+}
+
+func TestRecordNotUpgraded(t *testing.T) {
+	client, server := session(t, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n", nil, nil)
+	if len(client) != 0 || len(server) != 0 {
+		t.Errorf("got %d, %d records, want none", len(client), len(server))
+	}
+}
+
+func TestOpcodeText(t *testing.T) {
+	for _, op := range []Opcode{0x0, 0x1, 0x2, 0x3, 0x8, 0x9, 0xa, 0xf} {
+		b, err := op.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Opcode
+		if err := got.UnmarshalText(b); err != nil || got != op {
+			t.Errorf("%s: got %s, %v", b, got, err)
+		}
+	}
+
+	var op Opcode
+	if err := op.UnmarshalText([]byte("0x10")); err == nil {
+		t.Errorf("got %s, want error", op)
+	}
+}
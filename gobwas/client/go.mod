@@ -5,7 +5,10 @@ go 1.20
 require github.com/gobwas/ws v1.2.0
 
 require (
+	diag v0.0.0
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 )
+
+replace diag => ../../diag
@@ -4,20 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
-	"runtime"
 	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
-)
 
-func checkGoroutineNum() {
-	for range time.Tick(5 * time.Second) {
-		fmt.Printf("runtime.NumGoroutine(): %v\n", runtime.NumGoroutine())
-	}
-}
+	"diag"
+)
 
 func gobwasTest(ctx context.Context) error {
 	conn, r, hs, err := ws.DefaultDialer.Dial(ctx, "ws://localhost:11111/subscribe")
@@ -69,8 +65,13 @@ func subscribe(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	go checkGoroutineNum()
+	go diag.Watch(os.Stdout, 5*time.Second)
+	diag.Serve()
+	// DIAG_RECORD が設定されている場合は、全てのコネクションのフレームを記録する。
+	ws.DefaultDialer.NetDial = diag.Recording().DialContext((&net.Dialer{}).DialContext)
 
-	http.HandleFunc("/subscribe", subscribe)
-	http.ListenAndServe(":8181", nil)
+	// diag を import すると http.DefaultServeMux に pprof が登録されるため、別の mux を使う。
+	mux := http.NewServeMux()
+	mux.Handle("/subscribe", diag.LeakCheck(http.HandlerFunc(subscribe)))
+	http.ListenAndServe(":8181", mux)
 }
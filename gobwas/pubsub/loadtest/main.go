@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+
+	"diag"
+)
+
+// loadtest は待機中のコネクションを大量に張り、サーバーのコネクションあたりのメモリ使用量を測る。
+//
+// 仕様:
+//
+//	接続前後にサーバーの /debug/vars から memstats を取得し、その差をコネクション数で割る。
+//	xnet の pubsub サーバー (goroutine per connection) と、gobwas の pubsub サーバー (epoll + worker pool) の
+//	どちらも DIAG_ADDR を指定すると /debug/vars を提供するため、同じ手順で比較できる。
+//	コネクションは PingFrame に応答するのみで、メッセージは送信しない。
+
+// memStats は /debug/vars の memstats のうち、比較に使う値。
+type memStats struct {
+	HeapInuse  uint64
+	StackInuse uint64
+	Sys        uint64
+	NumGC      uint32
+}
+
+// inuse はヒープとスタックで使用中のメモリ。
+func (m memStats) inuse() uint64 {
+	return m.HeapInuse + m.StackInuse
+}
+
+// fetchMemStats はサーバーの /debug/vars から memstats を取得する。
+func fetchMemStats(url string) (memStats, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return memStats{}, fmt.Errorf("failed to get %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	var vars struct {
+		Memstats memStats `json:"memstats"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		return memStats{}, fmt.Errorf("failed to decode %s: %w", url, err)
+	}
+
+	return vars.Memstats, nil
+}
+
+// dialIdle は n 個のコネクションを concurrency 個ずつ並行して張る。
+// 張ったコネクションは PingFrame に応答しながら ctx が終了するまで待機する。
+func dialIdle(ctx context.Context, url string, n, concurrency int) (conns []net.Conn, failed int) {
+	dialer := ws.Dialer{
+		Timeout:   10 * time.Second,
+		Protocols: []string{"pubsub.v1.text"},
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		errs    atomic.Int64
+		next    atomic.Int64
+		started = time.Now()
+	)
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next.Add(1) <= int64(n) {
+				conn, _, _, err := dialer.Dial(ctx, url)
+				if err != nil {
+					slog.Debug(fmt.Sprintf("failed to dial: %s", err))
+					errs.Add(1)
+					continue
+				}
+				mu.Lock()
+				conns = append(conns, conn)
+				mu.Unlock()
+
+				// サーバーからの PingFrame に応答する。受け取ったメッセージは捨てる。
+				go func() {
+					for {
+						if _, _, err := wsutil.ReadServerData(conn); err != nil {
+							return
+						}
+					}
+				}()
+			}
+		}()
+	}
+	wg.Wait()
+
+	slog.Info(fmt.Sprintf("dialed %d connections in %s (%d failed)", len(conns), time.Since(started).Round(time.Millisecond), errs.Load()))
+
+	return conns, int(errs.Load())
+}
+
+func main() {
+	// flag の設定。
+	url := flag.String("url", "ws://localhost:12345/loadtest", "The WebSocket URL of the pubsub server")
+	vars := flag.String("vars", "http://localhost:6060/debug/vars", "The expvar URL of the pubsub server (served on DIAG_ADDR)")
+	n := flag.Int("conns", 1000, "The number of idle connections")
+	concurrency := flag.Int("concurrency", 50, "The number of concurrent dials")
+	settle := flag.Duration("settle", 3*time.Second, "How long to wait before measuring, to let the server settle")
+	flag.Parse()
+
+	diag.Serve()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	before, err := fetchMemStats(*vars)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	conns, failed := dialIdle(ctx, *url, *n, *concurrency)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	if len(conns) == 0 {
+		slog.Error("no connections established")
+		os.Exit(1)
+	}
+
+	time.Sleep(*settle)
+	after, err := fetchMemStats(*vars)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	perConn := func(before, after uint64) string {
+		return fmt.Sprintf("%.0f", (float64(after)-float64(before))/float64(len(conns)))
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "\tbefore\tafter\tbytes/conn\t\n")
+	fmt.Fprintf(tw, "heap_inuse\t%d\t%d\t%s\t\n", before.HeapInuse, after.HeapInuse, perConn(before.HeapInuse, after.HeapInuse))
+	fmt.Fprintf(tw, "stack_inuse\t%d\t%d\t%s\t\n", before.StackInuse, after.StackInuse, perConn(before.StackInuse, after.StackInuse))
+	fmt.Fprintf(tw, "heap+stack\t%d\t%d\t%s\t\n", before.inuse(), after.inuse(), perConn(before.inuse(), after.inuse()))
+	fmt.Fprintf(tw, "sys\t%d\t%d\t%s\t\n", before.Sys, after.Sys, perConn(before.Sys, after.Sys))
+	tw.Flush()
+	fmt.Printf("connections: %d (failed: %d), gc runs during test: %d\n", len(conns), failed, after.NumGC-before.NumGC)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	"wire"
+)
+
+var (
+	errCloseFrame = errors.New("CloseFrame received")
+	errOutboxFull = errors.New("too many frames waiting to be sent")
+)
+
+// connID はコネクションに割り当てた最後の ID。
+var connID atomic.Uint64
+
+// conn は topic に参加している 1 つのコネクション。
+//
+// コネクションごとの goroutine とバッファを持たないため、待機中のコネクションが使うメモリはこの構造体のみになる。
+// 読み込みは poller が通知した時に worker が行い、書き込みは mu で直列化する。
+// 配信するフレームは outbox にためて writer が書き込むため、遅いコネクションがあっても配信元の worker は待たない。
+type conn struct {
+	// id は poller でコネクションを識別する番号。ファイルディスクリプタは閉じた後に再利用されるため使わない。
+	id    uint64
+	nc    net.Conn
+	fd    int
+	topic string
+
+	// format はメッセージの形式。接続時に選択された subprotocol で決まる。
+	format format
+	// filter は受け取るメッセージの条件。nil の場合は全て受け取る。
+	filter *wire.Filter
+	// echo は自身が publish したメッセージも受け取るかどうか。
+	echo bool
+
+	// r は読み込みに使う。ハンドシェイク時に読みすぎたデータがある場合は、それを先に読む。
+	r io.Reader
+	// pending はハンドシェイク時に読みすぎたデータの残り。
+	pending *bytes.Reader
+
+	// fragments は分割されて届いているメッセージ。読み込みは同時に 1 つの worker のみが行うため、ロックは不要。
+	fragments []byte
+	fragOp    ws.OpCode
+
+	mu     sync.Mutex
+	closed bool
+
+	// outbox は writer の書き込みを待っているフレーム。flushing は writer が書き込み中かどうか。
+	// sendErr は書き込みに失敗した場合のエラーで、以降のフレームは受け付けない。sendMu で保護する。
+	sendMu   sync.Mutex
+	outbox   [][]byte
+	flushing bool
+	sendErr  error
+
+	// lastRead は最後にフレームを受信した時刻 (UnixNano)。heartbeat のタイムアウトの判定に使う。
+	lastRead atomic.Int64
+}
+
+func newConn(nc net.Conn, fd int, topic string, opts connOptions, buffered []byte) *conn {
+	c := &conn{
+		id:     connID.Add(1),
+		nc:     nc,
+		fd:     fd,
+		topic:  topic,
+		format: opts.format,
+		filter: opts.filter,
+		echo:   opts.echo,
+		r:      nc,
+	}
+	if len(buffered) > 0 {
+		c.pending = bytes.NewReader(buffered)
+		c.r = io.MultiReader(c.pending, nc)
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+
+	return c
+}
+
+// hasPending はハンドシェイク時に読みすぎたデータが残っているかどうかを返す。
+// 残っている場合、epoll では通知されないため、poller に登録する前に読み込む必要がある。
+func (c *conn) hasPending() bool {
+	return c.pending != nil && c.pending.Len() > 0
+}
+
+// readMessage は 1 つのフレームを読み込み、メッセージが揃った場合はそのペイロードを返す。
+//
+// 仕様:
+//
+//	PingFrame には同じペイロードの PongFrame を返す。
+//	CloseFrame を受け取った場合は errCloseFrame を返す。
+//	分割されたメッセージは最後のフレームを受け取るまで nil を返す。
+func (c *conn) readMessage() ([]byte, error) {
+	c.nc.SetReadDeadline(time.Now().Add(readTimeout))
+
+	h, err := ws.ReadHeader(c.r)
+	if err != nil {
+		return nil, err
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+
+	if !h.Masked {
+		return nil, errors.New("unmasked frame from client")
+	}
+	if h.Length > maxPayloadSize || int64(len(c.fragments))+h.Length > maxPayloadSize {
+		return nil, fmt.Errorf("too large payload: > %d", maxPayloadSize)
+	}
+
+	payload := make([]byte, h.Length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return nil, err
+	}
+	ws.Cipher(payload, h.Mask, 0)
+
+	switch h.OpCode {
+	case ws.OpPing:
+		return nil, c.write(ws.NewPongFrame(payload))
+
+	case ws.OpPong:
+		return nil, nil
+
+	case ws.OpClose:
+		return nil, errCloseFrame
+
+	case ws.OpText, ws.OpBinary:
+		if c.fragments != nil {
+			return nil, errors.New("new message while fragmented message in progress")
+		}
+		if h.Fin {
+			return payload, nil
+		}
+		c.fragOp, c.fragments = h.OpCode, payload
+		return nil, nil
+
+	case ws.OpContinuation:
+		if c.fragments == nil {
+			return nil, errors.New("unexpected continuation frame")
+		}
+		c.fragments = append(c.fragments, payload...)
+		if !h.Fin {
+			return nil, nil
+		}
+		payload, c.fragments = c.fragments, nil
+		return payload, nil
+
+	default:
+		return nil, fmt.Errorf("unknown opcode: %d", h.OpCode)
+	}
+}
+
+// write はフレームを書き込む。
+func (c *conn) write(f ws.Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return ws.WriteFrame(c.nc, f)
+}
+
+// writeCompiled は ws.CompileFrame でエンコード済みのフレームを書き込む。
+func (c *conn) writeCompiled(frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.nc.Write(frame)
+	return err
+}
+
+// enqueue はエンコード済みのフレームを outbox に追加する。
+// writer が書き込み中でない場合は start が true になり、呼び出し元が flush を writer に任せる。
+// outbox が maxOutbox を超える場合は errOutboxFull を返す。
+func (c *conn) enqueue(frame []byte) (start bool, err error) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.sendErr != nil {
+		return false, c.sendErr
+	}
+	if len(c.outbox) >= maxOutbox {
+		return false, errOutboxFull
+	}
+	c.outbox = append(c.outbox, frame)
+	if c.flushing {
+		return false, nil
+	}
+	c.flushing = true
+
+	return true, nil
+}
+
+// flush は outbox が空になるまでフレームを書き込む。writer で実行する。
+// 書き込みに失敗した場合は、残りのフレームを捨ててそのエラーを返す。
+func (c *conn) flush() error {
+	for {
+		c.sendMu.Lock()
+		frames := c.outbox
+		c.outbox = nil
+		if len(frames) == 0 {
+			c.flushing = false
+			c.sendMu.Unlock()
+			return nil
+		}
+		c.sendMu.Unlock()
+
+		for _, frame := range frames {
+			if err := c.writeCompiled(frame); err != nil {
+				c.sendMu.Lock()
+				c.outbox, c.flushing, c.sendErr = nil, false, err
+				c.sendMu.Unlock()
+				return err
+			}
+		}
+	}
+}
+
+// close は CloseFrame を書き込んでからコネクションを閉じる。
+// 2 回目以降の呼び出しでは何もせず false を返す。
+func (c *conn) close(status ws.StatusCode) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.closed = true
+
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	ws.WriteFrame(c.nc, ws.NewCloseFrame(ws.NewCloseFrameBody(status, "")))
+	c.nc.Close()
+
+	return true
+}
@@ -0,0 +1,20 @@
+module gobwas-pubsub-server
+
+go 1.22
+
+require github.com/gobwas/ws v1.2.0
+
+require (
+	diag v0.0.0
+	github.com/gobwas/httphead v0.1.0 // indirect
+	github.com/gobwas/pool v0.2.1 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	wire v0.0.0
+	wstest v0.0.0
+)
+
+replace diag => ../../../diag
+
+replace wire => ../../../wire
+
+replace wstest => ../../../wstest
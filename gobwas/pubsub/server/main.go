@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+
+	"diag"
+	"wire"
+)
+
+const (
+	hostPort        = ":12346"
+	defaultLogLevel = slog.LevelInfo
+
+	// defaultTopicGracePeriod はコネクションも retained message もなくなった topic を破棄するまでのデフォルトの猶予。
+	defaultTopicGracePeriod = time.Minute
+
+	// heartbeatInterval はサーバーから PingFrame を送信する間隔。
+	heartbeatInterval = 10 * time.Second
+	// heartbeatTimeout はフレームを受信しない場合に切断とみなすまでの時間。
+	heartbeatTimeout = 3 * heartbeatInterval
+
+	// readTimeout は読み込み可能が通知されてから、1 つのフレームを読み終えるまでの上限。
+	// フレームの途中までしか届いていない場合に、worker が待ち続けないようにする。
+	readTimeout = 5 * time.Second
+	// writeTimeout は 1 つのフレームの書き込みの上限。遅い subscriber が writer を占有し続けないようにする。
+	writeTimeout = 5 * time.Second
+	// maxOutbox はコネクションごとに書き込みを待てるフレームの数。超えた subscriber は切断する。
+	maxOutbox = 1024
+
+	// maxPayloadSize は受け取るメッセージのペイロードの上限。
+	maxPayloadSize = 1998_0206
+)
+
+var (
+	errConnClosed = errors.New("connection already closed")
+
+	// pingFrame はエンコード済みの PingFrame。
+	pingFrame = ws.MustCompileFrame(ws.NewPingFrame([]byte("ping")))
+
+	// connections は接続中のコネクション数。/debug/vars で公開する。
+	connections = expvar.NewInt("connections")
+	// topics は現在の topic の数。/debug/vars で公開する。
+	topics = expvar.NewInt("topics")
+)
+
+// server は epoll と worker pool でコネクションを扱う pubsub サーバー。
+//
+// 仕様:
+//
+//	xnet の pubsub サーバーと同じく、/{topic} に接続したコネクションは topic に参加し、
+//	受け取ったメッセージを同じ topic のコネクションに送信する。
+//	コネクションごとに goroutine を持たず、読み込み可能になったコネクションのみを worker が処理する。
+//	配信の書き込みは writer が行い、worker は遅い subscriber の書き込みを待たない。
+type server struct {
+	poller *poller
+	// pool は読み込みと、受け取ったメッセージの処理を行う worker。
+	pool *pool
+	// writers は outbox にためたフレームを書き込む writer。
+	writers *pool
+
+	// topics は topic ごとのコネクションと retained message。
+	topics   map[string]*topic
+	topicsMu sync.RWMutex
+	// gracePeriod はコネクションも retained message もなくなった topic を破棄するまでの猶予。
+	gracePeriod time.Duration
+}
+
+// connOptions は接続時にクエリパラメータで指定するオプション。
+//
+// 仕様:
+//
+//	xnet の pubsub サーバーの filter, echo と同じ。
+//	filter: 受け取るメッセージを絞り込む条件式。（例: type == "alert" && level >= 3）
+//	echo:   true の場合、自身が publish したメッセージも self: true として受け取る。
+//	        自身のメッセージかを区別するため、pubsub.v1.text 以外の subprotocol の場合のみ指定できる。
+type connOptions struct {
+	format format
+	filter *wire.Filter
+	echo   bool
+}
+
+// parseConnOptions はリクエストと、選択された subprotocol の format から connOptions を取り出す。
+func parseConnOptions(req *http.Request, f format) (connOptions, error) {
+	opts := connOptions{
+		format: f,
+	}
+
+	q := req.URL.Query()
+	if src := q.Get("filter"); src != "" {
+		f, err := wire.ParseFilter(src)
+		if err != nil {
+			return connOptions{}, fmt.Errorf("invalid filter: %w", err)
+		}
+		opts.filter = f
+	}
+
+	if v := q.Get("echo"); v != "" {
+		echo, err := strconv.ParseBool(v)
+		if err != nil {
+			return connOptions{}, fmt.Errorf("invalid echo: %w", err)
+		}
+		if echo && !opts.format.hasEnvelope() {
+			return connOptions{}, fmt.Errorf("echo is not supported on %s", opts.format)
+		}
+		opts.echo = echo
+	}
+
+	return opts, nil
+}
+
+// upgrade は WebSocket にアップグレードしたコネクションを poller に登録する。
+// 登録後はハンドラーの goroutine を終了し、以降の読み込みは worker が行う。
+func (s *server) upgrade(w http.ResponseWriter, req *http.Request) {
+	topic := req.PathValue("topic")
+	f, err := selectFormat(req)
+	if err != nil {
+		slog.Info(fmt.Sprintf("handshake rejected: %s", err))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	opts, err := parseConnOptions(req, f)
+	if err != nil {
+		slog.Info(fmt.Sprintf("handshake rejected: %s", err))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	u := ws.HTTPUpgrader{
+		Protocol: func(p string) bool { return p == string(f) },
+	}
+	nc, rw, _, err := u.Upgrade(req, w)
+	if err != nil {
+		slog.Info(fmt.Sprintf("failed to upgrade: %s", err))
+		return
+	}
+
+	fd, err := connFD(nc)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to get file descriptor: %s", err))
+		nc.Close()
+		return
+	}
+
+	// ハンドシェイクの読み込みで、最初のフレームまで bufio に読み込まれている場合がある。
+	var buffered []byte
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ = rw.Reader.Peek(n)
+		buffered = append([]byte(nil), buffered...)
+	}
+
+	c := newConn(nc, fd, topic, opts, buffered)
+	retained, ok := s.join(c)
+	connections.Add(1)
+	slog.Info(fmt.Sprintf("connected: %s (fd: %d, format: %s)", topic, fd, f))
+
+	if ok {
+		if err := s.sendRetained(c, retained); err != nil {
+			slog.Info(fmt.Sprintf("failed to send retained message: %s", err))
+			s.drop(c, ws.StatusGoingAway)
+			return
+		}
+	}
+
+	// 読みすぎたデータは epoll では通知されないため、登録する前にハンドラーの goroutine で読む。
+	// 登録した後に読むと、epoll から通知された worker と同時に読み込むおそれがある。
+	for c.hasPending() {
+		if !s.receive(c) {
+			return
+		}
+	}
+
+	if err := s.poller.add(c); err != nil {
+		slog.Error(err.Error())
+		s.drop(c, ws.StatusInternalServerError)
+	}
+}
+
+// onReadable は poller から通知されたコネクションの読み込みを worker に任せる。
+// poller の goroutine で呼ばれるため、worker の空きを待ってもよい。
+func (s *server) onReadable(c *conn) {
+	if err := s.pool.schedule(func() { s.read(c) }); err != nil {
+		s.drop(c, ws.StatusGoingAway)
+	}
+}
+
+// read は 1 つのフレームを読み込んで処理し、再び読み込み可能を待つ。
+// 続くフレームが届いている場合は、レベルトリガーのため resume の直後に再び通知される。
+func (s *server) read(c *conn) {
+	if !s.receive(c) {
+		return
+	}
+
+	if err := s.poller.resume(c); err != nil {
+		slog.Info(err.Error())
+		s.drop(c, ws.StatusInternalServerError)
+	}
+}
+
+// receive は 1 つのフレームを読み込んで処理する。
+// コネクションを切断した場合は false を返す。
+func (s *server) receive(c *conn) bool {
+	payload, err := c.readMessage()
+	if err != nil {
+		if errors.Is(err, errCloseFrame) {
+			slog.Info("connection closed")
+		} else {
+			slog.Info(fmt.Sprintf("connection lost: %s", err))
+		}
+		s.drop(c, ws.StatusNormalClosure)
+		return false
+	}
+
+	if payload == nil {
+		return true
+	}
+	if err := s.handle(c, payload); err != nil {
+		slog.Info(err.Error())
+		s.drop(c, ws.StatusUnsupportedData)
+		return false
+	}
+
+	return true
+}
+
+// handle は受け取ったメッセージを処理する。
+//
+// 仕様:
+//
+//	pubsub.v1.json, pubsub.v1.msgpack の場合は message として解釈する。
+//	xnet の pubsub サーバーと同じく、retain が指定された場合は retained message を更新してから配信する。
+//	publish 以外の kind (ack, request, reply, hello, direct) には対応しておらず、切断する。
+func (s *server) handle(c *conn, data []byte) error {
+	m, err := decodeMessage(c.format, data)
+	if err != nil {
+		return err
+	}
+	if m.Kind != kindPublish {
+		return fmt.Errorf("unexpected message kind: %q", m.Kind)
+	}
+
+	if m.Retain {
+		s.retain(c.topic, m.Payload)
+	}
+	s.publish(c, m.Payload)
+
+	return nil
+}
+
+// publish は topic のコネクションにメッセージを送信する。
+//
+// 仕様:
+//
+//	publisher 自身には、echo が有効な場合のみ self として送信する。
+//	filter の条件に合わないメッセージは送信しない。自身へのエコーは受理の確認のため、条件に関わらず送信する。
+//	それ以外のコネクションには、format ごとに 1 度だけエンコードしたフレームを送信する。
+//	書き込みは writer に任せるため、遅いコネクションがあっても他のコネクションへの送信は待たない。
+func (s *server) publish(publisher *conn, payload string) {
+	m := message{
+		Kind:    kindMessage,
+		Topic:   publisher.topic,
+		Payload: payload,
+	}
+
+	frames := make(map[format][]byte, len(supportedFormats))
+	for _, c := range s.getConns(publisher.topic) {
+		self := c == publisher
+		if self && !c.echo {
+			continue
+		}
+		if !self && c.filter != nil && !c.filter.Match([]byte(payload)) {
+			continue
+		}
+
+		var (
+			frame []byte
+			err   error
+		)
+		if self {
+			m := m
+			m.Self = true
+			frame, err = compileMessage(c.format, m)
+		} else if frame = frames[c.format]; frame == nil {
+			frame, err = compileMessage(c.format, m)
+			frames[c.format] = frame
+		}
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to compile frame: %s", err))
+			return
+		}
+
+		if err := s.send(c, frame); err != nil {
+			slog.Info(fmt.Sprintf("failed to send message: %s", err))
+			s.drop(c, sendErrorStatus(err))
+		}
+	}
+}
+
+// send はエンコード済みのフレームをコネクションの outbox に追加し、書き込みを writer に任せる。
+// 書き込みに失敗した場合、writer がコネクションを切断する。
+func (s *server) send(c *conn, frame []byte) error {
+	start, err := c.enqueue(frame)
+	if err != nil || !start {
+		return err
+	}
+
+	return s.writers.schedule(func() {
+		if err := c.flush(); err != nil {
+			slog.Info(fmt.Sprintf("failed to write: %s", err))
+			s.drop(c, ws.StatusGoingAway)
+		}
+	})
+}
+
+// sendErrorStatus は send のエラーで切断する時のステータスコードを返す。
+// outbox があふれた場合は、受信が追いつかない subscriber として 1008 で切断する。
+func sendErrorStatus(err error) ws.StatusCode {
+	if errors.Is(err, errOutboxFull) {
+		return ws.StatusPolicyViolation
+	}
+	return ws.StatusGoingAway
+}
+
+// sendRetained は retained message を filter の条件に合う場合のみコネクションに送信する。
+func (s *server) sendRetained(c *conn, payload string) error {
+	if c.filter != nil && !c.filter.Match([]byte(payload)) {
+		return nil
+	}
+
+	frame, err := compileMessage(c.format, message{
+		Kind:    kindMessage,
+		Topic:   c.topic,
+		Payload: payload,
+		Retain:  true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.send(c, frame)
+}
+
+// drop はコネクションを topic と poller から削除して閉じる。
+func (s *server) drop(c *conn, status ws.StatusCode) {
+	// ファイルディスクリプタが再利用される前に epoll から削除する。
+	s.poller.remove(c)
+	if c.close(status) {
+		s.leave(c)
+		connections.Add(-1)
+	}
+}
+
+// heartbeat は PingFrame を送信し、heartbeatTimeout の間フレームを受信していないコネクションを切断する。
+// コネクションごとのタイマーを持たず、1 つの goroutine で全てのコネクションを確認する。
+// PingFrame も配信と同じく outbox に追加し、writer が書き込む。
+func (s *server) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deadline := time.Now().Add(-heartbeatTimeout).UnixNano()
+		for _, c := range s.allConns() {
+			if c.lastRead.Load() < deadline {
+				slog.Info("connection lost: heartbeat timeout")
+				s.drop(c, ws.StatusGoingAway)
+				continue
+			}
+
+			if err := s.send(c, pingFrame); err != nil {
+				slog.Debug(fmt.Sprintf("failed to send ping: %s", err))
+				s.drop(c, sendErrorStatus(err))
+			}
+		}
+	}
+}
+
+// close は全てのコネクションを切断する。
+func (s *server) close() {
+	for _, c := range s.allConns() {
+		s.drop(c, ws.StatusGoingAway)
+	}
+	s.pool.close()
+	s.writers.close()
+	s.poller.close()
+}
+
+func main() {
+	// flag の設定。
+	logLevel := flag.String("logLevel", defaultLogLevel.String(), "The log level")
+	workers := flag.Int("workers", runtime.NumCPU()*8, "The number of workers that read frames and handle messages")
+	writers := flag.Int("writers", runtime.NumCPU()*8, "The number of writers that write queued frames to connections")
+	queue := flag.Int("queue", 1024, "The number of tasks waiting for a worker")
+	topicGracePeriod := flag.Duration("topicGracePeriod", defaultTopicGracePeriod, "How long a topic without connections or a retained message is kept (0 to reclaim immediately)")
+	flag.Parse()
+
+	// logger の設定。
+	ll := defaultLogLevel
+	ll.UnmarshalText([]byte(*logLevel))
+	slog.SetLogLoggerLevel(ll)
+
+	p, err := newPoller()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	s := &server{
+		poller:  p,
+		pool:    newPool(*workers, *queue),
+		writers: newPool(*writers, *queue),
+		topics:  make(map[string]*topic),
+
+		gracePeriod: *topicGracePeriod,
+	}
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+
+	diag.Serve()
+
+	mux := http.NewServeMux()
+	// コネクションは netpoll で読むため、ハンドラーの終了後も残る。diag.LeakCheck は使えない。
+	mux.HandleFunc("GET /{topic}", s.upgrade)
+
+	srv := &http.Server{
+		Addr:    hostPort,
+		Handler: mux,
+	}
+
+	// graceful shutdown の準備
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go func() {
+		if err := s.poller.wait(s.onReadable); err != nil {
+			slog.Error(err.Error())
+			stop()
+		}
+	}()
+	go s.heartbeat(ctx)
+
+	// signal を受け取るために goroutine で ListenAndServe を実行する。
+	go func() {
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to listen: %s", err))
+			stop()
+			return
+		}
+		// DIAG_RECORD が設定されている場合は、全てのコネクションのフレームを記録する。
+		if err := srv.Serve(diag.Recording().Listener(ln)); err != nil {
+			if errors.Is(err, http.ErrServerClosed) {
+				slog.Info("server closed gracefully")
+				return
+			}
+			slog.Error(fmt.Sprintf("failed to listen and serve: %s", err))
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("shutting down...")
+
+	// 正常にリソースを解放した後、サーバーをシャットダウンする。
+	s.close()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		slog.Error(fmt.Sprintf("failed to shutdown: %s", err))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gobwas/ws"
+
+	"wire"
+)
+
+// format はコネクションとやり取りするメッセージの形式。
+// xnet の pubsub サーバーと同じく、接続時に Sec-WebSocket-Protocol で選択された subprotocol によって決まる。
+type format string
+
+const (
+	// formatText はペイロードをそのまま TextFrame で送受信する。
+	formatText format = "pubsub.v1.text"
+	// formatJSON は message を JSON にして TextFrame で送受信する。
+	formatJSON format = "pubsub.v1.json"
+	// formatMsgpack は message を MessagePack にして BinaryFrame で送受信する。
+	formatMsgpack format = "pubsub.v1.msgpack"
+)
+
+// supportedFormats はサーバーが対応している subprotocol。
+// MQTT, STOMP はコネクションごとの状態が必要なため対応しない。
+var supportedFormats = []format{formatText, formatJSON, formatMsgpack}
+
+// hasEnvelope は message の形式でやり取りするかどうかを返す。
+func (f format) hasEnvelope() bool {
+	return f == formatJSON || f == formatMsgpack
+}
+
+// opCode は f のメッセージを送信するフレームの opcode を返す。
+func (f format) opCode() ws.OpCode {
+	if f == formatMsgpack {
+		return ws.OpBinary
+	}
+	return ws.OpText
+}
+
+// selectFormat はクライアントが提示した subprotocol から、対応しているものを提示された順に選ぶ。
+func selectFormat(req *http.Request) (format, error) {
+	var offered []string
+	for _, v := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			offered = append(offered, strings.TrimSpace(p))
+		}
+	}
+
+	for _, p := range offered {
+		if f := format(p); slices.Contains(supportedFormats, f) {
+			return f, nil
+		}
+	}
+
+	return "", fmt.Errorf("no acceptable subprotocol in %q (supported: %q)", offered, supportedFormats)
+}
+
+// message の種類。
+const (
+	// kindPublish はクライアントからの publish。
+	kindPublish = "publish"
+	// kindMessage はサーバーからの配信。
+	kindMessage = "message"
+)
+
+// message は formatJSON, formatMsgpack のコネクションとやり取りするメッセージ。
+// キーは xnet の pubsub サーバーと同じ。at-least-once や request/reply などのフィールドは扱わない。
+type message struct {
+	Kind    string `json:"kind"`
+	Topic   string `json:"topic,omitempty"`
+	Payload string `json:"payload,omitempty"`
+
+	// Self は自身が publish したメッセージが返ってきたものかどうか。
+	Self bool `json:"self,omitempty"`
+	// Retain は retained message かどうか。
+	// publish 時に指定すると topic の retained message として保持し、以降に subscribe したコネクションにも送信する。
+	// 配信時は retained message として送信されたものかを表す。
+	Retain bool `json:"retain,omitempty"`
+}
+
+// decodeMessage はクライアントから受け取ったデータを message に変換する。
+// formatText の場合、データはそのまま publish のペイロードとして扱う。
+func decodeMessage(f format, data []byte) (message, error) {
+	var (
+		m   message
+		err error
+	)
+
+	switch f {
+	case formatJSON:
+		err = json.Unmarshal(data, &m)
+	case formatMsgpack:
+		err = wire.UnmarshalMsgpack(data, &m)
+	default:
+		return message{Kind: kindPublish, Payload: string(data)}, nil
+	}
+
+	if err != nil {
+		return message{}, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+
+	return m, nil
+}
+
+// compileMessage は f に合わせて message をエンコードしたフレームを返す。
+// formatText の場合はペイロードのみを送信する。
+func compileMessage(f format, m message) ([]byte, error) {
+	var (
+		b   []byte
+		err error
+	)
+
+	switch f {
+	case formatJSON:
+		b, err = json.Marshal(m)
+	case formatMsgpack:
+		b, err = wire.MarshalMsgpack(m)
+	default:
+		b = []byte(m.Payload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	return ws.CompileFrame(ws.NewFrame(f.opCode(), true, b))
+}
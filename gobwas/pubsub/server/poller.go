@@ -0,0 +1,160 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// poller は epoll でコネクションの読み込み可能を待つ。
+//
+// 仕様:
+//
+//	コネクションは EPOLLONESHOT で登録するため、1 度通知されたコネクションは resume するまで再び通知されない。
+//	これにより、同じコネクションのフレームを複数の worker が同時に読み込むことはない。
+//	通知はレベルトリガーのため、読み残したデータがあれば resume の直後に再び通知される。
+//	イベントにはファイルディスクリプタではなくコネクションの ID を載せる。
+//	閉じたコネクションのファイルディスクリプタが再利用されても、古いイベントが新しいコネクションに届かない。
+type poller struct {
+	epfd int
+
+	// conns は登録中のコネクション。epoll の操作は mu をロックして行い、
+	// remove の後にコネクションを閉じるため、ロック中はファイルディスクリプタが閉じられていない。
+	mu    sync.RWMutex
+	conns map[uint64]*conn
+}
+
+func newPoller() (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create epoll: %w", err)
+	}
+
+	return &poller{
+		epfd:  epfd,
+		conns: make(map[uint64]*conn),
+	}, nil
+}
+
+// waitTimeout は epoll_wait の 1 回の待ち時間 (ミリ秒)。
+const waitTimeout = 1000
+
+// pollEvents はコネクションの読み込み可能と、相手からの切断を待つイベント。
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// connFD は net.Conn のファイルディスクリプタを返す。
+// ファイルディスクリプタは複製せず、net.Conn が閉じられるまで使う。
+func connFD(nc net.Conn) (int, error) {
+	sc, ok := nc.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("%T does not expose its file descriptor", nc)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var fd int
+	if err := rc.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return 0, err
+	}
+
+	return fd, nil
+}
+
+// pollEvent はコネクションの ID を載せたイベント。
+// epoll_event の 64 bit の data は、syscall.EpollEvent では Fd と Pad に分かれている。
+func pollEvent(c *conn) *syscall.EpollEvent {
+	return &syscall.EpollEvent{Events: pollEvents, Fd: int32(uint32(c.id)), Pad: int32(uint32(c.id >> 32))}
+}
+
+// eventID はイベントに載せたコネクションの ID を返す。
+func eventID(ev syscall.EpollEvent) uint64 {
+	return uint64(uint32(ev.Fd)) | uint64(uint32(ev.Pad))<<32
+}
+
+// add はコネクションの読み込み可能を待ち始める。
+func (p *poller) add(c *conn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, c.fd, pollEvent(c)); err != nil {
+		return fmt.Errorf("failed to add to epoll: %w", err)
+	}
+	p.conns[c.id] = c
+
+	return nil
+}
+
+// resume は通知されたコネクションの読み込み可能を再び待つ。
+// 読み込みの間に remove されたコネクションの場合は何もしない。
+// ファイルディスクリプタが閉じられて別のコネクションに再利用されていても、そのコネクションの登録を変えない。
+func (p *poller) resume(c *conn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns[c.id] != c {
+		return nil
+	}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, c.fd, pollEvent(c)); err != nil {
+		return fmt.Errorf("failed to resume epoll: %w", err)
+	}
+
+	return nil
+}
+
+// remove はコネクションを epoll から削除する。
+// ファイルディスクリプタが再利用されないよう、コネクションを閉じる前に呼ぶ。
+func (p *poller) remove(c *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns[c.id] != c {
+		return
+	}
+	delete(p.conns, c.id)
+	syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+}
+
+// wait は通知されたコネクションごとに f を呼ぶ。close されるまで戻らない。
+// close を検知できるよう、waitTimeout ごとに epoll_wait から戻る。
+// f はイベントを待つ goroutine で呼ばれるため、処理は worker に任せてすぐに戻ること。
+func (p *poller) wait(f func(c *conn)) error {
+	events := make([]syscall.EpollEvent, 128)
+	ready := make([]*conn, 0, len(events))
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, waitTimeout)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			if errors.Is(err, syscall.EBADF) {
+				return nil
+			}
+			return fmt.Errorf("failed to wait epoll: %w", err)
+		}
+
+		// f は worker の空きを待つことがあるため、ロックを解放してから呼ぶ。
+		ready = ready[:0]
+		p.mu.RLock()
+		for _, ev := range events[:n] {
+			if c, ok := p.conns[eventID(ev)]; ok {
+				ready = append(ready, c)
+			}
+		}
+		p.mu.RUnlock()
+
+		for _, c := range ready {
+			f(c)
+		}
+	}
+}
+
+// close は epoll を閉じ、wait を終了させる。
+func (p *poller) close() error {
+	return syscall.Close(p.epfd)
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// errPollerUnsupported は epoll のない OS で poller を作ろうとした場合のエラー。
+var errPollerUnsupported = fmt.Errorf("poller is not supported on %s: epoll is required", runtime.GOOS)
+
+// poller は linux 以外ではコネクションを待てない。newPoller は常にエラーを返す。
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errPollerUnsupported
+}
+
+func connFD(nc net.Conn) (int, error) {
+	return 0, errPollerUnsupported
+}
+
+func (p *poller) add(c *conn) error {
+	return errPollerUnsupported
+}
+
+func (p *poller) resume(c *conn) error {
+	return errPollerUnsupported
+}
+
+func (p *poller) remove(c *conn) {}
+
+func (p *poller) wait(f func(c *conn)) error {
+	return errPollerUnsupported
+}
+
+func (p *poller) close() error {
+	return errPollerUnsupported
+}
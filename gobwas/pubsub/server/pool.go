@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var errPoolClosed = errors.New("pool already closed")
+
+// pool は決まった数の worker で task を実行する。
+//
+// 仕様:
+//
+//	worker の数と、実行を待つ task の数には上限がある。
+//	全ての worker が処理中でキューも埋まっている場合、schedule は空きができるまで待つ。
+//	コネクションごとに goroutine を持たず、処理が必要になった時のみ worker が担当する。
+//
+// 注意)
+//   - worker で実行中の task から、同じ pool の schedule を呼ばないこと。
+//     全ての worker が空きを待つと、キューから task を取り出す worker がいなくなり止まってしまう。
+//     別の pool (worker から writer) であれば、その pool の task が schedule を呼ばない限り待ってもよい。
+type pool struct {
+	tasks chan func()
+	wg    sync.WaitGroup
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newPool は workers 個の worker と、queue 個まで task をためられるキューを持つ pool を作る。
+func newPool(workers, queue int) *pool {
+	p := &pool{
+		tasks: make(chan func(), queue),
+		done:  make(chan struct{}),
+	}
+
+	p.wg.Add(workers)
+	for range workers {
+		go p.worker()
+	}
+
+	return p
+}
+
+func (p *pool) worker() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case task := <-p.tasks:
+			task()
+		}
+	}
+}
+
+// schedule は task を実行するよう予約する。
+// キューが埋まっている場合は空きができるまで待つ。
+func (p *pool) schedule(task func()) error {
+	select {
+	case <-p.done:
+		return errPoolClosed
+	case p.tasks <- task:
+		return nil
+	}
+}
+
+// close は新しい task の予約を止め、実行中の task の完了を待つ。
+// キューに残っている task は実行しない。
+func (p *pool) close() {
+	p.closeOnce.Do(func() { close(p.done) })
+	p.wg.Wait()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+
+	"wstest"
+)
+
+// skipUnlessEpoll は epoll のない OS でテストを skip する。
+func skipUnlessEpoll(t *testing.T) {
+	t.Helper()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("poller requires epoll")
+	}
+}
+
+// startServer は pubsub サーバーを空いているポートで起動する。
+func startServer(t *testing.T) (*wstest.Server, *server) {
+	t.Helper()
+
+	skipUnlessEpoll(t)
+	p, err := newPoller()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		poller:  p,
+		pool:    newPool(4, 16),
+		writers: newPool(4, 16),
+		topics:  make(map[string]*topic),
+	}
+	go s.poller.wait(s.onReadable)
+	t.Cleanup(s.close)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{topic}", s.upgrade)
+
+	return wstest.Start(t, mux), s
+}
+
+// waitJoined は topic に n 個のコネクションが参加するまで待つ。
+func waitJoined(t *testing.T, s *server, topic string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(wstest.DefaultTimeout)
+	for len(s.getConns(topic)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d connections on %s, want %d", len(s.getConns(topic)), topic, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	ts, s := startServer(t)
+
+	pub := wstest.Dial(t, ts.URL("/news?echo=true"), string(formatJSON))
+	sub := wstest.Dial(t, ts.URL("/news"), string(formatText))
+	other := wstest.Dial(t, ts.URL("/sports"), string(formatText))
+	waitJoined(t, s, "news", 2)
+	waitJoined(t, s, "sports", 1)
+
+	pub.Run(
+		wstest.SendText(`{"kind":"publish","payload":"hello"}`),
+		wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"hello","self":true}`),
+	)
+	sub.Run(wstest.ExpectText("hello"))
+	other.Run(wstest.ExpectNoMessage(100 * time.Millisecond))
+
+	sub.Run(wstest.SendText("world"))
+	pub.Run(wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"world"}`))
+
+	// retained message は後から接続したコネクションにも送信する。
+	pub.Run(
+		wstest.SendText(`{"kind":"publish","payload":"latest","retain":true}`),
+		wstest.ExpectJSON(`{"kind":"message","payload":"latest","self":true}`),
+	)
+	late := wstest.Dial(t, ts.URL("/news"), string(formatJSON))
+	late.Run(wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"latest","retain":true}`))
+}
+
+// TestFilter は filter の判定が xnet の pubsub サーバーと同じ wire.Filter で行われることを確認する。
+func TestFilter(t *testing.T) {
+	ts, s := startServer(t)
+
+	pub := wstest.Dial(t, ts.URL("/news"), string(formatText))
+	alerts := wstest.Dial(t, ts.URL("/news?filter="+url.QueryEscape(`type == "alert" && level >= 3`)), string(formatText))
+	all := wstest.Dial(t, ts.URL("/news"), string(formatText))
+	waitJoined(t, s, "news", 3)
+
+	for _, payload := range []string{
+		`{"type":"alert","level":1}`,
+		`{"type":"info","level":5}`,
+		`not json`,
+		`{"type":"alert","level":3}`,
+	} {
+		pub.Run(wstest.SendText(payload))
+		all.Run(wstest.ExpectText(payload))
+	}
+	alerts.Run(
+		wstest.ExpectText(`{"type":"alert","level":3}`),
+		wstest.ExpectNoMessage(100*time.Millisecond),
+	)
+
+	header := http.Header{"Sec-WebSocket-Protocol": {string(formatText)}}
+	if _, resp, err := wstest.Handshake(t, ts.URL("/news?filter="+url.QueryEscape("level >=")), header); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("invalid filter: got %v, want 403", err)
+	}
+}
+
+func TestOutboxFull(t *testing.T) {
+	c := newConn(nil, 0, "news", connOptions{format: formatText}, nil)
+
+	// 書き込まれないまま maxOutbox を超えると errOutboxFull になる。
+	for i := range maxOutbox {
+		start, err := c.enqueue([]byte("frame"))
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if start != (i == 0) {
+			t.Fatalf("%d: got start %v", i, start)
+		}
+	}
+	if _, err := c.enqueue([]byte("frame")); !errors.Is(err, errOutboxFull) {
+		t.Errorf("got %v, want %v", err, errOutboxFull)
+	}
+}
+
+// TestPollerReusedFD は閉じたコネクションのファイルディスクリプタが再利用されても、
+// 古いコネクションの resume が新しいコネクションの登録を変えないことを確認する。
+func TestPollerReusedFD(t *testing.T) {
+	skipUnlessEpoll(t)
+	p, err := newPoller()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.close() })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	dial := func() (client net.Conn, c *conn) {
+		t.Helper()
+
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		nc, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := connFD(nc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, newConn(nc, fd, "news", connOptions{format: formatText}, nil)
+	}
+
+	_, old := dial()
+	if err := p.add(old); err != nil {
+		t.Fatal(err)
+	}
+	p.remove(old)
+	old.nc.Close()
+
+	client, c := dial()
+	if err := p.add(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.resume(old); err != nil {
+		t.Errorf("resume after remove: %s", err)
+	}
+
+	notified := make(chan *conn, 1)
+	go p.wait(func(c *conn) { notified <- c })
+	client.Write([]byte("x"))
+	select {
+	case got := <-notified:
+		if got != c {
+			t.Errorf("got conn %d, want %d", got.id, c.id)
+		}
+	case <-time.After(wstest.DefaultTimeout):
+		t.Fatal("no notification")
+	}
+}
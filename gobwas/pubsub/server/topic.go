@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// topic は 1 つの topic に参加しているコネクションと、retained message。
+//
+// 仕様:
+//
+//	xnet の pubsub サーバーと同じく、最初のコネクションの参加か retained message の保持で作成する。
+//	コネクションも retained message もなくなってから gracePeriod が経過すると破棄する。
+//	猶予の間にコネクションが参加した場合は破棄しない。
+type topic struct {
+	conns map[*conn]struct{}
+
+	// retained は retained message のペイロード。hasRetained が false の場合は保持していない。
+	retained    string
+	hasRetained bool
+
+	// reclaim は破棄を予約したタイマー。予約していない場合は nil。
+	reclaim *time.Timer
+}
+
+// reclaimable はコネクションも retained message もなく、破棄できるかどうかを返す。
+func (t *topic) reclaimable() bool {
+	return len(t.conns) == 0 && !t.hasRetained
+}
+
+// getTopicLocked は name の topic を返す。ない場合は作成する。
+// 破棄が予約されている場合は取り消す。topicsMu をロックして呼ぶこと。
+func (s *server) getTopicLocked(name string) *topic {
+	t, ok := s.topics[name]
+	if !ok {
+		t = &topic{conns: make(map[*conn]struct{})}
+		s.topics[name] = t
+		topics.Add(1)
+		slog.Info(fmt.Sprintf("topic created: %s", name))
+	}
+	if t.reclaim != nil {
+		t.reclaim.Stop()
+		t.reclaim = nil
+	}
+
+	return t
+}
+
+// scheduleReclaimLocked は破棄できる topic の破棄を予約する。
+// gracePeriod が 0 の場合はすぐに破棄する。topicsMu をロックして呼ぶこと。
+func (s *server) scheduleReclaimLocked(name string, t *topic) {
+	if !t.reclaimable() || t.reclaim != nil {
+		return
+	}
+	if s.gracePeriod == 0 {
+		s.reclaimLocked(name, t)
+		return
+	}
+
+	// タイマーの設定は topicsMu をロックした状態で行うため、コールバックからは t.reclaim を安全に読める。
+	var timer *time.Timer
+	timer = time.AfterFunc(s.gracePeriod, func() {
+		s.topicsMu.Lock()
+		defer s.topicsMu.Unlock()
+
+		// 予約を取り消した後や、予約し直した後のタイマーでは破棄しない。
+		if t.reclaim != timer {
+			return
+		}
+		t.reclaim = nil
+		if t.reclaimable() {
+			s.reclaimLocked(name, t)
+		}
+	})
+	t.reclaim = timer
+}
+
+// reclaimLocked は topic を破棄する。topicsMu をロックして呼ぶこと。
+func (s *server) reclaimLocked(name string, t *topic) {
+	if s.topics[name] != t {
+		return
+	}
+	delete(s.topics, name)
+	topics.Add(-1)
+	slog.Info(fmt.Sprintf("topic destroyed: %s", name))
+}
+
+// join は topic にコネクションを追加し、topic の retained message を返す。
+func (s *server) join(c *conn) (retained string, ok bool) {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+
+	t := s.getTopicLocked(c.topic)
+	t.conns[c] = struct{}{}
+
+	return t.retained, t.hasRetained
+}
+
+// leave は topic からコネクションを削除する。
+func (s *server) leave(c *conn) {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+
+	t, ok := s.topics[c.topic]
+	if !ok {
+		return
+	}
+	delete(t.conns, c)
+	s.scheduleReclaimLocked(c.topic, t)
+}
+
+// retain は topic の retained message を更新する。
+//
+// 仕様:
+//
+//	ペイロードが空の場合は retained message を削除する。
+//	retained message を保持している topic は破棄されない。削除するとコネクションのない topic は破棄される。
+func (s *server) retain(name string, payload string) {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+
+	if payload == "" {
+		t, ok := s.topics[name]
+		if !ok {
+			return
+		}
+		t.retained, t.hasRetained = "", false
+		s.scheduleReclaimLocked(name, t)
+		slog.Debug(fmt.Sprintf("retained message cleared: %s", name))
+		return
+	}
+
+	t := s.getTopicLocked(name)
+	t.retained, t.hasRetained = payload, true
+}
+
+// getConns は topic に紐づくコネクション一覧を返す。
+func (s *server) getConns(name string) []*conn {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+
+	t, ok := s.topics[name]
+	if !ok {
+		return nil
+	}
+
+	conns := make([]*conn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+// allConns は全てのコネクションを返す。
+func (s *server) allConns() []*conn {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+
+	var conns []*conn
+	for _, t := range s.topics {
+		for c := range t.conns {
+			conns = append(conns, c)
+		}
+	}
+
+	return conns
+}
@@ -7,18 +7,14 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"runtime"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-)
 
-func checkGoroutineNum() {
-	for range time.Tick(5 * time.Second) {
-		fmt.Printf("runtime.NumGoroutine(): %v\n", runtime.NumGoroutine())
-	}
-}
+	"diag"
+)
 
 // deadline kills the entire connection, not only the read process.
 // https://github.com/gorilla/websocket/issues/474
@@ -74,6 +70,8 @@ func deadline(w http.ResponseWriter, r *http.Request) {
 }
 
 // There's a memory leak, how can I fix it?
+// DIAG_LEAKCHECK=log で起動すると、/goroutine の終了後も残る goroutine を作成した場所ごとにログへ書き出す。
+// 実行中の goroutine は DIAG_ADDR=:6060 で起動し、localhost:6060/debug/goroutines?stack=1 で確認できる。
 func wsAccessG(ctx context.Context, w io.Writer) {
 	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, "ws://localhost:11111/subscribe", nil)
 	if err != nil {
@@ -193,14 +191,19 @@ func subscribe(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	go checkGoroutineNum()
+	go diag.Watch(os.Stdout, 5*time.Second)
+	diag.Serve()
+	// DIAG_RECORD が設定されている場合は、全てのコネクションのフレームを記録する。
+	websocket.DefaultDialer.NetDialContext = diag.Recording().DialContext((&net.Dialer{}).DialContext)
 
 	go ping()
 
-	http.HandleFunc("/subscribe", subscribe)
-	http.HandleFunc("/goroutine", goroutine)
-	http.HandleFunc("/deadline", deadline)
-	http.ListenAndServe(":7999", nil)
+	// diag を import すると http.DefaultServeMux に pprof が登録されるため、別の mux を使う。
+	mux := http.NewServeMux()
+	mux.Handle("/subscribe", diag.LeakCheck(http.HandlerFunc(subscribe)))
+	mux.Handle("/goroutine", diag.LeakCheck(http.HandlerFunc(goroutine)))
+	mux.Handle("/deadline", diag.LeakCheck(http.HandlerFunc(deadline)))
+	http.ListenAndServe(":7999", mux)
 }
 
 func ping() {
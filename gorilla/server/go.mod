@@ -2,4 +2,9 @@ module gorila-server
 
 go 1.20
 
-require github.com/gorilla/websocket v1.5.0 // indirect
+require (
+	diag v0.0.0
+	github.com/gorilla/websocket v1.5.0
+)
+
+replace diag => ../../diag
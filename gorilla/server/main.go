@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"diag"
 )
 
 var upgrader = websocket.Upgrader{}
@@ -64,6 +66,11 @@ func subscribe(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	http.HandleFunc("/subscribe", subscribe)
-	http.ListenAndServe(":11111", nil)
+	diag.Serve()
+
+	// diag を import すると http.DefaultServeMux に pprof が登録されるため、別の mux を使う。
+	mux := http.NewServeMux()
+	mux.Handle("/subscribe", diag.LeakCheck(http.HandlerFunc(subscribe)))
+	// DIAG_RECORD が設定されている場合は、全てのコネクションのフレームを記録する。
+	diag.ListenAndServe(":11111", mux)
 }
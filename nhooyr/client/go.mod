@@ -3,6 +3,10 @@ module nhooyr-client
 go 1.20
 
 require (
-	github.com/klauspost/compress v1.10.3 // indirect
-	nhooyr.io/websocket v1.8.7 // indirect
+	diag v0.0.0
+	nhooyr.io/websocket v1.8.7
 )
+
+require github.com/klauspost/compress v1.10.3 // indirect
+
+replace diag => ../../diag
@@ -7,17 +7,16 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"runtime"
+	"os"
 	"time"
 
 	"nhooyr.io/websocket"
+
+	"diag"
 )
 
-func checkGoroutineNum() {
-	for range time.Tick(5 * time.Second) {
-		fmt.Printf("runtime.NumGoroutine(): %v\n", runtime.NumGoroutine())
-	}
-}
+// dialOptions は DIAG_RECORD が設定されている場合に、全てのコネクションのフレームを記録する。main で設定する。
+var dialOptions *websocket.DialOptions
 
 // Ping must be called concurrently with Reader
 func Ping(c *websocket.Conn, ctx context.Context) {
@@ -37,7 +36,7 @@ func Ping(c *websocket.Conn, ctx context.Context) {
 }
 
 func wsAccessGoroutine(ctx context.Context, w io.Writer) {
-	c, _, err := websocket.Dial(ctx, "ws://localhost:11111/subscribe", nil)
+	c, _, err := websocket.Dial(ctx, "ws://localhost:11111/subscribe", dialOptions)
 	if err != nil {
 		fmt.Printf("err: %v\n", err)
 
@@ -124,7 +123,7 @@ func wsAccessGoroutine(ctx context.Context, w io.Writer) {
 }
 
 func wsAccessD(ctx context.Context, w io.Writer) {
-	c, _, err := websocket.Dial(ctx, "ws://localhost:11111/subscribe", nil)
+	c, _, err := websocket.Dial(ctx, "ws://localhost:11111/subscribe", dialOptions)
 	if err != nil {
 		fmt.Printf("err: %v\n", err)
 
@@ -221,9 +220,17 @@ func goroutine(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	go checkGoroutineNum()
+	go diag.Watch(os.Stdout, 5*time.Second)
+	diag.Serve()
+	if rec := diag.Recording(); rec != nil {
+		dialOptions = &websocket.DialOptions{
+			HTTPClient: &http.Client{Transport: &http.Transport{DialContext: rec.DialContext((&net.Dialer{}).DialContext)}},
+		}
+	}
 
-	http.HandleFunc("/goroutine", goroutine)
-	http.HandleFunc("/deadline", deadline)
-	http.ListenAndServe(":7776", nil)
+	// diag を import すると http.DefaultServeMux に pprof が登録されるため、別の mux を使う。
+	mux := http.NewServeMux()
+	mux.Handle("/goroutine", diag.LeakCheck(http.HandlerFunc(goroutine)))
+	mux.Handle("/deadline", diag.LeakCheck(http.HandlerFunc(deadline)))
+	http.ListenAndServe(":7776", mux)
 }
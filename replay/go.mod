@@ -0,0 +1,13 @@
+module replay
+
+go 1.22
+
+require (
+	diag v0.0.0
+	wstest v0.0.0
+)
+
+replace (
+	diag => ../diag
+	wstest => ../wstest
+)
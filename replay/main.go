@@ -0,0 +1,209 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"diag"
+)
+
+// replay は diag で記録した JSONL をサーバーに再生する。
+//
+// 仕様:
+//
+//	記録したコネクションごとに新しいコネクションを張り、クライアントが送信したフレームを記録の間隔で送る。
+//	間隔は -speed で変えられる (2 は 2 倍の速さ、0 は待たずに送る)。コネクションは並行して再生する。
+//	複数のファイル (プロセスごとの記録) を指定した場合は、記録した時刻にあわせて全てのファイルを並行して再生する。
+//	サーバーから受信したフレームの数を記録と比べて表示する。-out で再生したフレームを同じ形式で書き出せる。
+
+// writeReport は結果を表にして w に書き出す。
+func writeReport(w io.Writer, results []result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "FILE\tCONN\tURI\tSENT\tRECEIVED\tRECORDED\tERROR\n")
+	for _, r := range results {
+		errMsg := ""
+		if r.Err != nil {
+			errMsg = r.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%d\t%s\n", r.Source, r.ID, r.URI, r.Sent, r.Received, r.Recorded, errMsg)
+	}
+
+	return tw.Flush()
+}
+
+// readFile は path (- の場合は標準入力) の記録を読み込む。
+func readFile(path string) ([]*session, time.Time, error) {
+	if path == "-" {
+		return readSessions(os.Stdin, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	return readSessions(f, path)
+}
+
+// parseConns は "1,3" を接続の番号の集合にする。空の場合は nil を返す。
+func parseConns(s string) (map[int64]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	conns := make(map[int64]bool)
+	for _, v := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid conn: %q", v)
+		}
+		conns[id] = true
+	}
+
+	return conns, nil
+}
+
+// checkURL は -url が再生できるサーバーの URL かどうかを確認する。
+// 記録の URI を後ろに付けるため、ws:// か wss:// で host を含む必要がある。
+func checkURL(raw string) error {
+	u, err := neturl.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("invalid url: %q: scheme must be ws or wss", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid url: %q: host is required", raw)
+	}
+
+	return nil
+}
+
+func main() {
+	// flag の設定。
+	url := flag.String("url", "ws://localhost:12345", "The server to replay against, ws:// or wss:// (the URI of each recorded connection is appended)")
+	speed := flag.Float64("speed", 1, "Replay speed relative to the recording (2 is twice as fast, 0 sends without waiting)")
+	only := flag.String("conns", "", "Comma separated recorded connection numbers to replay (default: all, applies to every file)")
+	linger := flag.Duration("linger", time.Second, "How long to keep reading after the last frame of each connection")
+	outPath := flag.String("out", "", "Also record the replayed frames as JSONL to this file (- for stdout)")
+	header := http.Header{}
+	flag.Func("header", "Extra request header such as \"Authorization: Bearer ...\" (can be repeated, replaces the recorded one)", func(s string) error {
+		k, v, ok := strings.Cut(s, ":")
+		if !ok {
+			return fmt.Errorf("want \"Key: value\", got %q", s)
+		}
+		header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+		return nil
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: replay [flags] <recording.jsonl | ->...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	diag.Serve()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := checkURL(*url); err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+	conns, err := parseConns(*only)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	// 記録を読み込む。時刻は全てのファイルで最も早い記録を基準にする。
+	var (
+		sessions []*session
+		recorded time.Time
+	)
+	for _, path := range flag.Args() {
+		ss, start, err := readFile(path)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to read %s: %s", path, err))
+			os.Exit(2)
+		}
+		sessions = append(sessions, ss...)
+		if recorded.IsZero() || (!start.IsZero() && start.Before(recorded)) {
+			recorded = start
+		}
+	}
+
+	r := &replayer{
+		url:    strings.TrimSuffix(*url, "/"),
+		header: header,
+		clock:  clock{recorded: recorded, started: time.Now(), speed: *speed},
+		linger: *linger,
+	}
+	if *outPath != "" {
+		w := os.Stdout
+		if *outPath != "-" {
+			f, err := os.Create(*outPath)
+			if err != nil {
+				slog.Error(fmt.Sprintf("failed to create %s: %s", *outPath, err))
+				os.Exit(2)
+			}
+			defer f.Close()
+			w = f
+		}
+		r.out = &recordWriter{enc: json.NewEncoder(w)}
+	}
+
+	// コネクションの間の順序 (subscribe してから publish するなど) を保つため、全てのコネクションを並行して再生する。
+	var (
+		wg      sync.WaitGroup
+		results = make([]result, 0, len(sessions))
+		mu      sync.Mutex
+	)
+	for _, s := range sessions {
+		if conns != nil && !conns[s.id] {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := r.replay(s)
+			if res.Err != nil {
+				slog.Error(fmt.Sprintf("%s: conn %d: %s", s.source, s.id, res.Err))
+			}
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	slices.SortFunc(results, func(a, b result) int {
+		return cmp.Or(cmp.Compare(a.Source, b.Source), cmp.Compare(a.ID, b.ID))
+	})
+	if err := writeReport(os.Stdout, results); err != nil {
+		slog.Error(fmt.Sprintf("failed to write report: %s", err))
+	}
+
+	// 接続や送信に失敗したコネクションがある場合は、0 以外で終了する。
+	for _, res := range results {
+		if res.Err != nil {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"diag"
+	"wstest"
+)
+
+// handshakeHeaders は記録から引き継がず、再生するコネクションで作り直すリクエストヘッダー。
+var handshakeHeaders = []string{"Host", "Upgrade", "Connection", "Sec-WebSocket-Key", "Sec-WebSocket-Version", "Content-Length"}
+
+// session は記録した 1 つのコネクション。
+type session struct {
+	// source は記録したファイル。Conn はプロセスごとの番号のため、ファイルとあわせて区別する。
+	source string
+	id     int64
+	open   diag.Record
+	// sends はクライアントが送信したフレーム。
+	sends []diag.Record
+	// recorded はサーバーが送信したフレームの数。
+	recorded int
+	// closed は記録したコネクションが閉じた時刻。記録の途中で終わった場合はゼロ値。
+	closed time.Time
+}
+
+// readSessions は source の JSONL の記録をコネクションごとにまとめ、最初の記録の時刻とともに返す。
+// open のないコネクション (記録の途中から始まったもの) は含めない。
+func readSessions(r io.Reader, source string) ([]*session, time.Time, error) {
+	var (
+		sessions []*session
+		byID     = make(map[int64]*session)
+		start    time.Time
+	)
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var rec diag.Record
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, time.Time{}, fmt.Errorf("record %d: %w", line, err)
+		}
+		if start.IsZero() {
+			start = rec.Time
+		}
+
+		s := byID[rec.Conn]
+		switch rec.Event {
+		case diag.EventOpen:
+			if rec.Handshake == nil {
+				return nil, time.Time{}, fmt.Errorf("record %d: open without handshake", line)
+			}
+			s = &session{source: source, id: rec.Conn, open: rec}
+			byID[rec.Conn] = s
+			sessions = append(sessions, s)
+		case diag.EventFrame:
+			if s == nil {
+				continue
+			}
+			if rec.Frame == nil {
+				return nil, time.Time{}, fmt.Errorf("record %d: frame without payload", line)
+			}
+			if rec.Dir == diag.ClientToServer {
+				s.sends = append(s.sends, rec)
+			} else {
+				s.recorded++
+			}
+		case diag.EventClose:
+			if s != nil {
+				s.closed = rec.Time
+			}
+		}
+	}
+
+	return sessions, start, nil
+}
+
+// clock は記録の時刻を再生する時刻に変換する。
+type clock struct {
+	recorded time.Time
+	started  time.Time
+	// speed は再生の速さ。1 は記録と同じ間隔、0 は待たない。
+	speed float64
+}
+
+// wait は記録の t に対応する時刻まで待つ。
+func (c clock) wait(t time.Time) {
+	if c.speed <= 0 {
+		return
+	}
+
+	at := c.started.Add(time.Duration(float64(t.Sub(c.recorded)) / c.speed))
+	time.Sleep(time.Until(at))
+}
+
+// result は 1 つのコネクションを再生した結果。
+type result struct {
+	Source   string
+	ID       int64
+	URI      string
+	Sent     int
+	Received int
+	Recorded int
+	Err      error
+}
+
+// replayer は記録をサーバーに再生する。
+type replayer struct {
+	url    string
+	header http.Header
+	clock  clock
+	// linger は最後のフレームを送信した後、サーバーからのフレームを待つ時間。
+	linger time.Duration
+	// out は再生したフレームを記録する。nil の場合は記録しない。
+	out *recordWriter
+}
+
+// replay は s を再生する。
+//
+// 仕様:
+//
+//	記録した時刻に接続し、クライアントが送信したフレームを記録した時刻に送る。
+//	マスクしないで送信されたフレームはマスクせずに送る。PingFrame への PongFrame なども記録のまま送り、自動では返さない。
+//	全てのフレームを送った後、記録したコネクションが閉じた時刻と linger を待つか、サーバーが閉じるまでフレームを読み込む。
+func (r *replayer) replay(s *session) result {
+	res := result{Source: s.source, ID: s.id, URI: s.open.URI, Recorded: s.recorded}
+
+	header := s.open.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	for _, k := range handshakeHeaders {
+		header.Del(k)
+	}
+	for k, v := range r.header {
+		header[k] = v
+	}
+
+	r.clock.wait(s.open.Time)
+	c, _, err := wstest.Connect(r.url+s.open.URI, header)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	r.out.open(s.id, s.open.URI, header)
+
+	// サーバーが閉じるか、Close されるまで読み込む。
+	c.Timeout = 24 * time.Hour
+	var (
+		wg       sync.WaitGroup
+		received int
+	)
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for {
+			f, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			received++
+			r.out.frame(s.id, diag.ServerToClient, f)
+		}
+	}()
+
+	for _, rec := range s.sends {
+		r.clock.wait(rec.Time)
+		f := wstest.Frame{Fin: rec.Fin, RSV: rec.RSV, Opcode: byte(rec.Opcode), Masked: rec.Masked, Payload: rec.Payload}
+		if f.Masked {
+			err = c.WriteFrame(f)
+		} else {
+			err = c.WriteRaw(wstest.AppendFrame(nil, f))
+		}
+		if err != nil {
+			res.Err = fmt.Errorf("failed to send frame %d: %w", res.Sent+1, err)
+			break
+		}
+		res.Sent++
+		r.out.frame(s.id, diag.ClientToServer, f)
+	}
+
+	if !s.closed.IsZero() {
+		r.clock.wait(s.closed)
+	}
+	select {
+	case <-done:
+	case <-time.After(r.linger):
+	}
+	c.Close()
+	wg.Wait()
+	r.out.close(s.id)
+
+	res.Received = received
+	return res
+}
+
+// recordWriter は再生したフレームを diag.Record の JSONL で書き出す。記録と並べて比べられるよう、Conn は記録の番号にする。
+// 複数のファイルを再生した場合、Conn が重なることがある。
+type recordWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (w *recordWriter) write(rec diag.Record) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enc.Encode(rec)
+}
+
+func (w *recordWriter) open(id int64, uri string, header http.Header) {
+	w.write(diag.Record{Time: time.Now(), Conn: id, Event: diag.EventOpen, Handshake: &diag.Handshake{Side: diag.SideClient, URI: uri, Header: header}})
+}
+
+func (w *recordWriter) frame(id int64, dir string, f wstest.Frame) {
+	w.write(diag.Record{Time: time.Now(), Conn: id, Event: diag.EventFrame, Frame: &diag.Frame{
+		Dir:     dir,
+		Fin:     f.Fin,
+		RSV:     f.RSV,
+		Opcode:  diag.Opcode(f.Opcode),
+		Masked:  f.Masked,
+		Payload: f.Payload,
+	}})
+}
+
+func (w *recordWriter) close(id int64) {
+	w.write(diag.Record{Time: time.Now(), Conn: id, Event: diag.EventClose})
+}
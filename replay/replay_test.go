@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"diag"
+	"wstest"
+)
+
+func TestReplay(t *testing.T) {
+	s := wstest.StartEcho(t)
+
+	start := time.Now()
+	frame := func(d time.Duration, dir string, opcode diag.Opcode, payload string) diag.Record {
+		return diag.Record{Time: start.Add(d), Conn: 7, Event: diag.EventFrame, Frame: &diag.Frame{Dir: dir, Fin: true, Opcode: opcode, Masked: dir == diag.ClientToServer, Payload: []byte(payload)}}
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, rec := range []diag.Record{
+		{Time: start, Conn: 7, Event: diag.EventOpen, Handshake: &diag.Handshake{Side: diag.SideServer, URI: "/topic", Header: http.Header{"Sec-Websocket-Key": {"recorded"}}}},
+		frame(10*time.Millisecond, diag.ClientToServer, 0x1, "hello"),
+		frame(11*time.Millisecond, diag.ServerToClient, 0x1, "hello"),
+		frame(20*time.Millisecond, diag.ClientToServer, 0x8, "\x03\xe8"),
+		frame(21*time.Millisecond, diag.ServerToClient, 0x8, "\x03\xe8"),
+		{Time: start.Add(30 * time.Millisecond), Conn: 7, Event: diag.EventClose},
+	} {
+		if err := enc.Encode(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 記録の途中から始まったコネクションは再生しない。
+	enc.Encode(diag.Record{Time: start, Conn: 8, Event: diag.EventFrame, Frame: &diag.Frame{Dir: diag.ClientToServer, Opcode: 0x1}})
+
+	sessions, recorded, err := readSessions(&b, "test.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || !recorded.Equal(start) {
+		t.Fatalf("got %d sessions from %s, want 1 from %s", len(sessions), recorded, start)
+	}
+
+	var out bytes.Buffer
+	r := &replayer{
+		url:    strings.TrimSuffix(s.URL(""), "/"),
+		clock:  clock{recorded: recorded, started: time.Now(), speed: 2},
+		linger: time.Second,
+		out:    &recordWriter{enc: json.NewEncoder(&out)},
+	}
+	res := r.replay(sessions[0])
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if res.Sent != 2 || res.Received != 2 || res.Recorded != 2 {
+		t.Errorf("got %+v, want 2 frames each", res)
+	}
+
+	var events []string
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var rec diag.Record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Conn != 7 {
+			t.Errorf("got conn %d, want 7", rec.Conn)
+		}
+		e := rec.Event
+		if rec.Frame != nil {
+			e += " " + rec.Dir + " " + rec.Opcode.String()
+		}
+		events = append(events, e)
+	}
+	// 読み込みと書き込みは並行するため、順序は open と close のみ確かめる。
+	want := map[string]bool{"open": true, "frame c2s text": true, "frame c2s close": true, "frame s2c text": true, "frame s2c close": true, "close": true}
+	if len(events) != len(want) || events[0] != "open" || events[len(events)-1] != "close" {
+		t.Fatalf("got %v", events)
+	}
+	for _, e := range events {
+		if !want[e] {
+			t.Errorf("unexpected %q in %v", e, events)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"ws://localhost:12345", true},
+		{"wss://example.com", true},
+		{"wss://example.com:8443/", true},
+		{"http://localhost:12345", false},
+		{"https://example.com", false},
+		{"localhost:12345", false},
+		{"ws://", false},
+		{"ws://%zz", false},
+	}
+	for _, tt := range tests {
+		if err := checkURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("%q: got %v, want ok=%v", tt.url, err, tt.ok)
+		}
+	}
+}
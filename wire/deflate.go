@@ -0,0 +1,106 @@
+package wire
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// permessage-deflate 拡張。
+// see: https://datatracker.ietf.org/doc/html/rfc7692
+//
+// compress/flate は LZ77 のウィンドウサイズを指定できないため、圧縮は常に 15 bit (32KB) のウィンドウで行う。
+
+const (
+	ExtensionsHeader = "Sec-WebSocket-Extensions"
+	DeflateExtension = "permessage-deflate"
+
+	// DeflateMaxWindowBits はウィンドウサイズの上限かつ、指定がない場合のウィンドウサイズ。
+	DeflateMaxWindowBits = 15
+	DeflateMinWindowBits = 8
+	deflateWindowSize    = 1 << DeflateMaxWindowBits
+)
+
+// ErrPayloadTooLarge は展開後のメッセージが上限を超えている場合のエラー。
+var ErrPayloadTooLarge = errors.New("too large payload")
+
+// deflateTail は圧縮時に取り除かれる末尾のバイト列。
+// 展開時は最後に空の final block を追加し、ストリームの終端とする。
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// Compressor は送信するメッセージを圧縮する。ゼロ値で使える。
+//
+// 注意)
+//   - 並行に使うことはできない。
+type Compressor struct {
+	// NoContextTakeover はメッセージごとに圧縮の状態をリセットするかどうか。
+	// サーバーでは server_no_context_takeover、クライアントでは client_no_context_takeover を指定する。
+	NoContextTakeover bool
+
+	// w は context takeover の場合はメッセージをまたいで使い回す。
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+// Compress は payload を圧縮する。
+// 返すバイト列は次の Compress の呼び出しまで有効。
+func (c *Compressor) Compress(payload []byte) ([]byte, error) {
+	c.buf.Reset()
+	if c.w == nil {
+		var err error
+		if c.w, err = flate.NewWriter(&c.buf, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	} else if c.NoContextTakeover {
+		c.w.Reset(&c.buf)
+	}
+
+	if _, err := c.w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Flush で追加される 0x00 0x00 0xff 0xff を取り除く。
+	return bytes.TrimSuffix(c.buf.Bytes(), deflateTail[:4]), nil
+}
+
+// Decompressor は届いた圧縮されたメッセージを展開する。ゼロ値で使える。
+//
+// 注意)
+//   - 並行に使うことはできない。
+type Decompressor struct {
+	// NoContextTakeover は相手がメッセージごとに圧縮の状態をリセットするかどうか。
+	// サーバーでは client_no_context_takeover、クライアントでは server_no_context_takeover を指定する。
+	NoContextTakeover bool
+
+	// window は context takeover の場合に、直前までに展開したデータの末尾を保持する。
+	window []byte
+}
+
+// Decompress は compressed を展開する。
+// 展開後のサイズが limit を超える場合は ErrPayloadTooLarge を返す。
+func (d *Decompressor) Decompress(compressed []byte, limit int) ([]byte, error) {
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(compressed), bytes.NewReader(deflateTail)), d.window)
+	defer r.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	if len(payload) > limit {
+		return nil, fmt.Errorf("%w: decompressed > %d", ErrPayloadTooLarge, limit)
+	}
+
+	if !d.NoContextTakeover {
+		d.window = append(d.window, payload...)
+		if len(d.window) > deflateWindowSize {
+			d.window = d.window[len(d.window)-deflateWindowSize:]
+		}
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,418 @@
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter は subscribe 時に指定する、受け取るメッセージを絞り込むための条件式。
+//
+// 仕様:
+//
+//	ペイロードを JSON object として解釈し、フィールドに対する条件式を評価する。
+//	  例) type == "alert" && level >= 3
+//	比較演算子は ==, !=, <, <=, >, >= を使える。
+//	論理演算子は &&, ||, ! とカッコを使える。
+//	ネストしたフィールドは . 区切りで指定する。（例: meta.host == "a"）
+//	比較演算子のないフィールドは、値が truthy かどうかで評価する。
+//	ペイロードが JSON object でない場合は条件を満たさないものとする。
+type Filter struct {
+	src  string
+	root filterNode
+}
+
+// filterNode は条件式の構文木のノード。
+type filterNode interface {
+	eval(doc map[string]any) bool
+}
+
+type andNode struct{ l, r filterNode }
+
+func (n andNode) eval(doc map[string]any) bool { return n.l.eval(doc) && n.r.eval(doc) }
+
+type orNode struct{ l, r filterNode }
+
+func (n orNode) eval(doc map[string]any) bool { return n.l.eval(doc) || n.r.eval(doc) }
+
+type notNode struct{ x filterNode }
+
+func (n notNode) eval(doc map[string]any) bool { return !n.x.eval(doc) }
+
+// fieldNode は比較演算子を伴わないフィールドの参照。
+type fieldNode struct{ path []string }
+
+func (n fieldNode) eval(doc map[string]any) bool {
+	v, ok := lookupField(doc, n.path)
+	if !ok {
+		return false
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return true
+	}
+}
+
+// cmpNode はフィールドとリテラルの比較。
+type cmpNode struct {
+	path  []string
+	op    string
+	value any
+}
+
+func (n cmpNode) eval(doc map[string]any) bool {
+	v, ok := lookupField(doc, n.path)
+	if !ok {
+		return n.op == "!="
+	}
+
+	switch n.op {
+	case "==":
+		return v == n.value
+	case "!=":
+		return v != n.value
+	}
+
+	// 大小比較は数値同士、文字列同士の場合のみ評価する。
+	var c int
+	switch lit := n.value.(type) {
+	case float64:
+		f, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case f < lit:
+			c = -1
+		case f > lit:
+			c = 1
+		}
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(s, lit)
+	default:
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+
+	return false
+}
+
+// lookupField は . 区切りのパスに対応する値を doc から取り出す。
+func lookupField(doc map[string]any, path []string) (any, bool) {
+	var cur any = doc
+	for _, key := range path {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		cur, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+// Match はペイロードが条件式を満たすかを返す。
+func (f *Filter) Match(payload []byte) bool {
+	var doc map[string]any
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return false
+	}
+
+	return f.root.eval(doc)
+}
+
+func (f *Filter) String() string {
+	return f.src
+}
+
+// ParseFilter は条件式の文字列から Filter を作成する。
+func ParseFilter(src string) (*Filter, error) {
+	tokens, err := tokenizeFilter(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected token %q at %d", p.peek().text, p.peek().pos)
+	}
+
+	return &Filter{src: src, root: root}, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// tokenizeFilter は条件式を字句に分割する。
+func tokenizeFilter(src string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: i})
+			i++
+
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: i})
+			i++
+
+		case c == '"':
+			// 閉じクォートまでを strconv.Unquote に任せる。
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %w", i, err)
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, pos: i})
+			i = j + 1
+
+		case strings.ContainsRune("=!<>&|", rune(c)):
+			op := src[i : i+1]
+			if i+1 < len(src) {
+				if two := src[i : i+2]; slices.Contains(filterOps, two) {
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, fmt.Errorf("unknown operator %q at %d", op, i)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(src) && strings.ContainsRune("0123456789.eE+-", rune(src[j])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:j], pos: i})
+			i = j
+
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[i:j], pos: i})
+			i = j
+
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+		}
+	}
+
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+var (
+	filterOps  = []string{"==", "!=", "<=", ">=", "&&", "||"}
+	compareOps = []string{"==", "!=", "<", "<=", ">", ">="}
+)
+
+// filterParser は再帰下降で条件式を構文解析する。
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | primary
+//	primary = "(" or ")" | ident [ cmpOp literal ]
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokOp && p.peek().text == "||" {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l: l, r: r}
+	}
+
+	return l, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokOp && p.peek().text == "&&" {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l: l, r: r}
+	}
+
+	return l, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.peek().kind == tokOp && p.peek().text == "!" {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return notNode{x: x}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if r := p.next(); r.kind != tokRParen {
+			return nil, fmt.Errorf("expected ')' at %d", r.pos)
+		}
+
+		return x, nil
+
+	case tokIdent:
+		path := strings.Split(t.text, ".")
+
+		op := p.peek()
+		if op.kind != tokOp || !slices.Contains(compareOps, op.text) {
+			return fieldNode{path: path}, nil
+		}
+		p.next()
+
+		value, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+
+		return cmpNode{path: path, op: op.text, value: value}, nil
+
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of filter")
+
+	default:
+		return nil, fmt.Errorf("unexpected token %q at %d", t.text, t.pos)
+	}
+}
+
+// parseLiteral は比較の右辺を JSON の値と同じ型で返す。
+func (p *filterParser) parseLiteral() (any, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokString:
+		return t.text, nil
+
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+
+		return f, nil
+
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+
+	return nil, fmt.Errorf("expected literal at %d", t.pos)
+}
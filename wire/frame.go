@@ -0,0 +1,76 @@
+// Package wire は pubsub のサーバーとクライアントで共通の、フレームとメッセージのエンコードと、subscribe の filter。
+//
+// 同じ内容をサーバーとクライアントに別々に持つと食い違うため、バイト列を組み立てる処理と filter の条件式の解釈はここにまとめる。
+// ハンドシェイクでの permessage-deflate のパラメータの決め方や、フレームの書き込みのロックなど、
+// サーバーとクライアントで振る舞いが異なるものは各モジュールに置く。
+package wire
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// CloseFrame のステータスコード。
+const (
+	// CloseStatusNormal は正常な切断を表す。
+	CloseStatusNormal = 1000
+	// CloseStatusTooBig は受け取ったメッセージが大きすぎるための切断を表す。
+	CloseStatusTooBig = 1009
+)
+
+// AppendFrameHeader はマスクしないフレームのヘッダーを b に追加する。
+// サーバーから送信するフレームはマスクしない。
+func AppendFrameHeader(b []byte, opcode byte, rsv1 bool, length int) []byte {
+	return appendHeader(b, opcode, rsv1, 0, length)
+}
+
+// AppendMaskedFrame はランダムな masking key でマスクしたフレームを b に追加する。
+// クライアントから送信するフレームは必ずマスクする。
+func AppendMaskedFrame(b []byte, opcode byte, rsv1 bool, payload []byte) []byte {
+	b = appendHeader(b, opcode, rsv1, 0x80, len(payload))
+
+	var key [4]byte
+	rand.Read(key[:])
+	b = append(b, key[:]...)
+	for i, c := range payload {
+		b = append(b, c^key[i%4])
+	}
+
+	return b
+}
+
+func appendHeader(b []byte, opcode byte, rsv1 bool, mask byte, length int) []byte {
+	first := 0x80 | opcode // FIN
+	if rsv1 {
+		first |= 0x40
+	}
+
+	switch {
+	case length <= 125:
+		return append(b, first, mask|byte(length))
+	case length <= 0xffff:
+		b = append(b, first, mask|126)
+		return binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, first, mask|127)
+		return binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+}
+
+// IsCompressed はフレームの RSV1 ビットが立っているかどうかを返す。
+// websocket.Frame の HeaderReader はヘッダーのバイト列を返すため、先頭のバイトから判定する。
+func IsCompressed(fr interface{ HeaderReader() io.Reader }) (bool, error) {
+	r := fr.HeaderReader()
+	if r == nil {
+		return false, errors.New("frame header is not available")
+	}
+
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return false, err
+	}
+
+	return first[0]&0x40 != 0, nil
+}
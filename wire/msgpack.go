@@ -0,0 +1,366 @@
+package wire
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MessagePack のエンコードとデコード。
+// see: https://github.com/msgpack/msgpack/blob/master/spec.md
+//
+// 構造体は JSON と同じキーの map としてエンコードする。
+// JSON を経由することで、サーバーとクライアントの message のフィールドのタグをそのまま使う。
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// MarshalMsgpack は v を JSON と同じ構造の MessagePack にエンコードする。
+func MarshalMsgpack(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic any
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return nil, err
+	}
+
+	return appendMsgpack(nil, generic)
+}
+
+// UnmarshalMsgpack は MessagePack を JSON と同じ構造として v にデコードする。
+func UnmarshalMsgpack(data []byte, v any) error {
+	generic, rest, err := readMsgpack(data, 0)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(rest))
+	}
+
+	b, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// appendMsgpack は JSON のデコード結果と同じ型の値を MessagePack にエンコードする。
+func appendMsgpack(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v <= math.MaxInt64 {
+			return appendMsgpackInt(b, int64(v)), nil
+		}
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v)), nil
+
+	case string:
+		return appendMsgpackString(b, v), nil
+
+	case []any:
+		n := len(v)
+		switch {
+		case n < 16:
+			b = append(b, 0x90|byte(n))
+		case n <= math.MaxUint16:
+			b = append(b, 0xdc)
+			b = binary.BigEndian.AppendUint16(b, uint16(n))
+		default:
+			b = append(b, 0xdd)
+			b = binary.BigEndian.AppendUint32(b, uint32(n))
+		}
+		for _, e := range v {
+			var err error
+			if b, err = appendMsgpack(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+
+	case map[string]any:
+		n := len(v)
+		switch {
+		case n < 16:
+			b = append(b, 0x80|byte(n))
+		case n <= math.MaxUint16:
+			b = append(b, 0xde)
+			b = binary.BigEndian.AppendUint16(b, uint16(n))
+		default:
+			b = append(b, 0xdf)
+			b = binary.BigEndian.AppendUint32(b, uint32(n))
+		}
+
+		// 出力を安定させるため、キーの順序を揃える。
+		keys := make([]string, 0, n)
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			b = appendMsgpackString(b, k)
+			var err error
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+func appendMsgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		return append(b, byte(v))
+	case v < 0 && v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		b = append(b, 0xd2)
+		return binary.BigEndian.AppendUint32(b, uint32(v))
+	default:
+		b = append(b, 0xd3)
+		return binary.BigEndian.AppendUint64(b, uint64(v))
+	}
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdb)
+		b = binary.BigEndian.AppendUint32(b, uint32(n))
+	}
+
+	return append(b, s...)
+}
+
+// msgpackMaxDepth はネストの上限。深すぎるデータによるスタックの枯渇を防ぐ。
+const msgpackMaxDepth = 32
+
+// readMsgpack は data の先頭の値を 1 つデコードし、残りのデータとともに返す。
+// bin は string として、ext は無視して nil としてデコードする。
+func readMsgpack(data []byte, depth int) (any, []byte, error) {
+	if depth > msgpackMaxDepth {
+		return nil, nil, errors.New("msgpack: too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errMsgpackShort
+	}
+
+	c, data := data[0], data[1:]
+
+	switch {
+	case c <= 0x7f:
+		return float64(c), data, nil
+	case c >= 0xe0:
+		return float64(int8(c)), data, nil
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(data, int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(data, int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return readMsgpackBytes(data, int(c&0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, data, nil
+	case 0xc2:
+		return false, data, nil
+	case 0xc3:
+		return true, data, nil
+
+	case 0xc4, 0xd9: // bin8, str8
+		n, data, err := readMsgpackUint(data, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackBytes(data, int(n))
+	case 0xc5, 0xda: // bin16, str16
+		n, data, err := readMsgpackUint(data, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackBytes(data, int(n))
+	case 0xc6, 0xdb: // bin32, str32
+		n, data, err := readMsgpackUint(data, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackBytes(data, int(n))
+
+	case 0xc7, 0xc8, 0xc9: // ext8, ext16, ext32
+		size := map[byte]int{0xc7: 1, 0xc8: 2, 0xc9: 4}[c]
+		n, data, err := readMsgpackUint(data, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		if uint64(len(data)) < n+1 {
+			return nil, nil, errMsgpackShort
+		}
+		return nil, data[n+1:], nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext
+		n := 1 << (c - 0xd4)
+		if len(data) < n+1 {
+			return nil, nil, errMsgpackShort
+		}
+		return nil, data[n+1:], nil
+
+	case 0xca: // float32
+		n, data, err := readMsgpackUint(data, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return float64(math.Float32frombits(uint32(n))), data, nil
+	case 0xcb: // float64
+		n, data, err := readMsgpackUint(data, 8)
+		if err != nil {
+			return nil, nil, err
+		}
+		return math.Float64frombits(n), data, nil
+
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint
+		n, data, err := readMsgpackUint(data, 1<<(c-0xcc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return float64(n), data, nil
+	case 0xd0: // int8
+		n, data, err := readMsgpackUint(data, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return float64(int8(n)), data, nil
+	case 0xd1: // int16
+		n, data, err := readMsgpackUint(data, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return float64(int16(n)), data, nil
+	case 0xd2: // int32
+		n, data, err := readMsgpackUint(data, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return float64(int32(n)), data, nil
+	case 0xd3: // int64
+		n, data, err := readMsgpackUint(data, 8)
+		if err != nil {
+			return nil, nil, err
+		}
+		return float64(int64(n)), data, nil
+
+	case 0xdc, 0xdd: // array16, array32
+		n, data, err := readMsgpackUint(data, map[byte]int{0xdc: 2, 0xdd: 4}[c])
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackArray(data, int(n), depth)
+	case 0xde, 0xdf: // map16, map32
+		n, data, err := readMsgpackUint(data, map[byte]int{0xde: 2, 0xdf: 4}[c])
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackMap(data, int(n), depth)
+	}
+
+	return nil, nil, fmt.Errorf("msgpack: unknown type 0x%02x", c)
+}
+
+func readMsgpackUint(data []byte, size int) (uint64, []byte, error) {
+	if len(data) < size {
+		return 0, nil, errMsgpackShort
+	}
+
+	var n uint64
+	for _, b := range data[:size] {
+		n = n<<8 | uint64(b)
+	}
+
+	return n, data[size:], nil
+}
+
+func readMsgpackBytes(data []byte, n int) (any, []byte, error) {
+	if n < 0 || len(data) < n {
+		return nil, nil, errMsgpackShort
+	}
+
+	return string(data[:n]), data[n:], nil
+}
+
+func readMsgpackArray(data []byte, n int, depth int) (any, []byte, error) {
+	// 要素は最低 1 byte のため、データ長を超える要素数は不正。
+	if n < 0 || n > len(data) {
+		return nil, nil, errMsgpackShort
+	}
+
+	arr := make([]any, 0, n)
+	for i := 0; i < n; i++ {
+		var (
+			v   any
+			err error
+		)
+		v, data, err = readMsgpack(data, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		arr = append(arr, v)
+	}
+
+	return arr, data, nil
+}
+
+func readMsgpackMap(data []byte, n int, depth int) (any, []byte, error) {
+	// キーと値は最低 2 byte のため、データ長を超える要素数は不正。
+	if n < 0 || n*2 > len(data) {
+		return nil, nil, errMsgpackShort
+	}
+
+	m := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		var (
+			k, v any
+			err  error
+		)
+		k, data, err = readMsgpack(data, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("msgpack: map key must be string, got %T", k)
+		}
+
+		v, data, err = readMsgpack(data, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		m[key] = v
+	}
+
+	return m, data, nil
+}
@@ -0,0 +1,171 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	type message struct {
+		Kind    string         `json:"kind"`
+		Payload string         `json:"payload,omitempty"`
+		Seq     int64          `json:"seq"`
+		Ratio   float64        `json:"ratio"`
+		Tags    []string       `json:"tags"`
+		Headers map[string]any `json:"headers"`
+		Retain  bool           `json:"retain"`
+	}
+
+	tests := []message{
+		{Kind: "publish", Payload: "hello", Seq: 1, Ratio: 0.5, Tags: []string{"a", "b"}, Headers: map[string]any{"x": "y"}, Retain: true},
+		{Kind: strings.Repeat("k", 300), Seq: -1 << 40, Tags: []string{}, Headers: map[string]any{}},
+		{Payload: strings.Repeat("p", 70000), Seq: -31, Tags: make([]string, 20)},
+	}
+	for _, want := range tests {
+		b, err := MarshalMsgpack(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got message
+		if err := UnmarshalMsgpack(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestUnmarshalMsgpackInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":    nil,
+		"short":    {0xa5, 'a'},
+		"trailing": {0xc0, 0xc0},
+		"int key":  {0x81, 0x01, 0x01},
+		"too deep": bytes.Repeat([]byte{0x91}, msgpackMaxDepth+2),
+		"unknown":  {0xc1},
+	}
+	for name, data := range tests {
+		var v any
+		if err := UnmarshalMsgpack(data, &v); err == nil {
+			t.Errorf("%s: want error, got %v", name, v)
+		}
+	}
+}
+
+func TestAppendFrameHeader(t *testing.T) {
+	tests := []struct {
+		opcode byte
+		rsv1   bool
+		length int
+		want   []byte
+	}{
+		{0x1, false, 5, []byte{0x81, 5}},
+		{0x2, true, 125, []byte{0xc2, 125}},
+		{0x1, false, 126, []byte{0x81, 126, 0, 126}},
+		{0x1, false, 0x10000, []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+	for _, tt := range tests {
+		if got := AppendFrameHeader(nil, tt.opcode, tt.rsv1, tt.length); !bytes.Equal(got, tt.want) {
+			t.Errorf("AppendFrameHeader(%#x, %v, %d) = % x, want % x", tt.opcode, tt.rsv1, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestAppendMaskedFrame(t *testing.T) {
+	payload := []byte("hello")
+	b := AppendMaskedFrame(nil, 0x1, true, payload)
+
+	if b[0] != 0xc1 || b[1] != 0x80|byte(len(payload)) {
+		t.Fatalf("header = % x", b[:2])
+	}
+	key, masked := b[2:6], b[6:]
+	for i := range masked {
+		masked[i] ^= key[i%4]
+	}
+	if !bytes.Equal(masked, payload) {
+		t.Errorf("unmasked payload = %q, want %q", masked, payload)
+	}
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	messages := [][]byte{
+		[]byte(strings.Repeat("hello world ", 100)),
+		[]byte(strings.Repeat("hello world ", 100)),
+		[]byte("short"),
+	}
+
+	for _, noContextTakeover := range []bool{false, true} {
+		c := Compressor{NoContextTakeover: noContextTakeover}
+		d := Decompressor{NoContextTakeover: noContextTakeover}
+
+		var sizes []int
+		for _, m := range messages {
+			compressed, err := c.Compress(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, len(compressed))
+
+			got, err := d.Decompress(compressed, 1<<20)
+			if err != nil {
+				t.Fatalf("noContextTakeover=%v: %v", noContextTakeover, err)
+			}
+			if !bytes.Equal(got, m) {
+				t.Errorf("noContextTakeover=%v: decompressed = %q, want %q", noContextTakeover, got, m)
+			}
+		}
+
+		// context takeover の場合、同じメッセージは前のメッセージを参照して小さくなる。
+		if smaller := sizes[1] < sizes[0]; smaller == noContextTakeover {
+			t.Errorf("noContextTakeover=%v: sizes = %v", noContextTakeover, sizes)
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	var c Compressor
+	compressed, err := c.Compress(bytes.Repeat([]byte{'a'}, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d Decompressor
+	if _, err := d.Decompress(compressed, 999); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Decompress = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		src     string
+		payload string
+		want    bool
+	}{
+		{`type == "alert" && level >= 3`, `{"type":"alert","level":3}`, true},
+		{`type == "alert" && level >= 3`, `{"type":"alert","level":2}`, false},
+		{`meta.host == "a" || !enabled`, `{"meta":{"host":"b"},"enabled":false}`, true},
+		{`(a || b) && c`, `{"a":true,"c":true}`, true},
+		{`missing != 1`, `{}`, true},
+		{`level > 1`, `not json`, false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.src)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q): %v", tt.src, err)
+		}
+		if got := f.Match([]byte(tt.payload)); got != tt.want {
+			t.Errorf("%q.Match(%s) = %v, want %v", tt.src, tt.payload, got, tt.want)
+		}
+	}
+
+	for _, src := range []string{`a ==`, `(a`, `a == "b`, `a b`} {
+		if _, err := ParseFilter(src); err == nil {
+			t.Errorf("ParseFilter(%q): want error", src)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Package wstest は WebSocket のサーバーとクライアントをテストするための道具。
+//
+// httptest で空いているポートにサーバーを起動し、フレーム単位で操作できるクライアントとサーバーを提供する。
+// クライアントとサーバーの振る舞いは Step の列 (スクリプト) で書き、受信したメッセージの検証も Step として書く。
+// 不正なフレームも送信できるよう、フレームの読み書きはライブラリを使わずに行う。
+package wstest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultTimeout は Conn の読み込みを待つデフォルトの時間。
+const DefaultTimeout = 5 * time.Second
+
+// acceptGUID は Sec-WebSocket-Accept の計算に使う GUID (RFC 6455 1.3)。
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// CloseError は CloseFrame を受信した場合に ReadMessage が返すエラー。
+type CloseError struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("wstest: close frame received: %d %q", e.Code, e.Reason)
+}
+
+// Conn は handshake 済みの WebSocket のコネクション。
+//
+// 仕様:
+//
+//	クライアント側のコネクションは WriteFrame で書き込むフレームを常にマスクする。マスクしないフレームは WriteRaw で送る。
+//	ReadMessage は PingFrame に PongFrame を返し、CloseFrame には同じステータスコードの CloseFrame を返す。
+//	Run で Step が失敗した場合、クライアントは t.Fatal で、サーバーは t.Error でテストを失敗させる。
+type Conn struct {
+	t  testing.TB
+	nc net.Conn
+	r  *bufio.Reader
+
+	client bool
+
+	// Protocol は handshake で選択された subprotocol。
+	Protocol string
+	// Timeout は読み込みを待つ時間。
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	closeSent bool
+}
+
+// Dial は url (ws:// か wss://) に接続し、protocols を Sec-WebSocket-Protocol で提示する。
+// handshake に失敗した場合はテストを失敗させる。コネクションはテストの終了時に閉じる。
+func Dial(t testing.TB, url string, protocols ...string) *Conn {
+	t.Helper()
+
+	header := http.Header{}
+	if len(protocols) > 0 {
+		header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+	}
+	c, _, err := Handshake(t, url, header)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %s", url, err)
+	}
+
+	return c
+}
+
+// Handshake は url (ws:// か wss://) に header を付けて接続する。
+// 101 以外のレスポンスの場合は、ボディを読み込んだレスポンスとエラーを返す。
+// 接続した場合、コネクションはテストの終了時に閉じる。
+func Handshake(t testing.TB, url string, header http.Header) (*Conn, *http.Response, error) {
+	c, resp, err := Connect(url, header)
+	if err != nil {
+		return nil, resp, err
+	}
+	c.t = t
+	t.Cleanup(func() { c.Close() })
+
+	return c, resp, nil
+}
+
+// Connect はテスト以外から使う Handshake。
+// url は ws:// か wss:// で、wss:// の場合はシステムのルート証明書で検証して TLS で接続する。
+// 返した Conn では Run を使えず、Close は呼び出し元が行う。
+func Connect(rawURL string, header http.Header) (*Conn, *http.Response, error) {
+	return ConnectTLS(rawURL, header, nil)
+}
+
+// ConnectTLS は wss:// の接続に config を使う Connect。config が nil の場合は Connect と同じ。
+func ConnectTLS(rawURL string, header http.Header, config *tls.Config) (*Conn, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var nc net.Conn
+	switch u.Scheme {
+	case "ws":
+		nc, err = net.Dial("tcp", hostPort(u, "80"))
+		u.Scheme = "http"
+	case "wss":
+		nc, err = tls.Dial("tcp", hostPort(u, "443"), config)
+		u.Scheme = "https"
+	default:
+		return nil, nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], rand.Uint64())
+	binary.BigEndian.PutUint64(b[8:], rand.Uint64())
+	key := base64.StdEncoding.EncodeToString(b[:])
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	nc.SetDeadline(time.Now().Add(DefaultTimeout))
+	if err := req.Write(nc); err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	r := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// ボディを読み込んでからコネクションを閉じる。
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(strings.NewReader(string(body)))
+		nc.Close()
+		return nil, resp, fmt.Errorf("unexpected status: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), acceptKey(key); got != want {
+		nc.Close()
+		return nil, resp, fmt.Errorf("invalid Sec-WebSocket-Accept: %q, want %q", got, want)
+	}
+
+	return &Conn{
+		nc:       nc,
+		r:        r,
+		client:   true,
+		Protocol: resp.Header.Get("Sec-WebSocket-Protocol"),
+		Timeout:  DefaultTimeout,
+	}, resp, nil
+}
+
+// hostPort は u の host に、ポートを省略している場合は port を付けて返す。
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// acceptKey は Sec-WebSocket-Key に対する Sec-WebSocket-Accept の値。
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WriteFrame は f を書き込む。クライアント側のコネクションではマスクする。
+func (c *Conn) WriteFrame(f Frame) error {
+	if c.client {
+		f.Masked = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f.Opcode == OpClose {
+		c.closeSent = true
+	}
+	_, err := c.nc.Write(AppendFrame(nil, f))
+	return err
+}
+
+// WriteRaw は b をそのまま書き込む。
+func (c *Conn) WriteRaw(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.nc.Write(b)
+	return err
+}
+
+// ReadFrame は Timeout まで待って次のフレームを読み込む。
+func (c *Conn) ReadFrame() (Frame, error) {
+	c.nc.SetReadDeadline(time.Now().Add(c.Timeout))
+
+	return ReadFrame(c.r)
+}
+
+// ReadMessage は次のデータメッセージを読み込み、分割されたフレームを結合して返す。
+//
+// 仕様:
+//
+//	PingFrame には同じペイロードの PongFrame を返し、PongFrame は読み捨てる。
+//	CloseFrame を受信した場合は、まだ送っていなければ同じステータスコードの CloseFrame を返し、*CloseError を返す。
+//	フレームの順序が不正な場合 (先頭が ContinuationFrame、途中にデータフレーム) はエラーを返す。
+func (c *Conn) ReadMessage() (opcode byte, payload []byte, err error) {
+	started := false
+	for {
+		f, err := c.ReadFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.Opcode {
+		case OpPing:
+			if err := c.WriteFrame(Pong(f.Payload)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			code, reason := f.CloseCode()
+			c.replyClose(code)
+			return 0, nil, &CloseError{Code: code, Reason: reason}
+		case OpContinuation:
+			if !started {
+				return 0, nil, errors.New("wstest: unexpected continuation frame")
+			}
+			payload = append(payload, f.Payload...)
+		default:
+			if started {
+				return 0, nil, fmt.Errorf("wstest: expected continuation frame, got opcode %#x", f.Opcode)
+			}
+			opcode, payload, started = f.Opcode, f.Payload, true
+		}
+
+		if f.Fin {
+			return opcode, payload, nil
+		}
+	}
+}
+
+// replyClose は受信した CloseFrame に CloseFrame を返す。既に送っている場合は何もしない。
+func (c *Conn) replyClose(code uint16) {
+	c.mu.Lock()
+	sent := c.closeSent
+	c.mu.Unlock()
+	if sent {
+		return
+	}
+
+	if code == CloseNoStatus {
+		code = 0
+	}
+	c.WriteFrame(Close(code, ""))
+}
+
+// Run は steps を順に実行する。失敗した Step があれば、その番号とエラーでテストを失敗させる。
+func (c *Conn) Run(steps ...Step) {
+	if c.t == nil {
+		panic("wstest: Run requires a Conn from Dial, Handshake or FakeServer")
+	}
+	c.t.Helper()
+
+	for i, step := range steps {
+		if err := step(c); err != nil {
+			if c.client {
+				c.t.Fatalf("client step %d: %s", i, err)
+			}
+			c.t.Errorf("server step %d: %s", i, err)
+			return
+		}
+	}
+}
+
+// Close は CloseFrame を送らずにコネクションを閉じる。
+func (c *Conn) Close() error {
+	return c.nc.Close()
+}
@@ -0,0 +1,213 @@
+package wstest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+)
+
+// RFC 6455 の opcode。
+const (
+	OpContinuation byte = 0x0
+	OpText         byte = 0x1
+	OpBinary       byte = 0x2
+	OpClose        byte = 0x8
+	OpPing         byte = 0x9
+	OpPong         byte = 0xa
+)
+
+// RSV1 などのビット。Frame.RSV に指定する。
+const (
+	RSV1 byte = 0x40
+	RSV2 byte = 0x20
+	RSV3 byte = 0x10
+)
+
+// CloseNoStatus は CloseFrame にステータスコードがない場合に CloseCode が返す値。
+const CloseNoStatus uint16 = 1005
+
+// MaxFrameSize は ReadFrame で読み込むペイロードの上限。
+// テスト対象のサーバーの上限より大きく、壊れた長さでメモリを使い切らない値にする。
+const MaxFrameSize = 64 << 20
+
+var errFrameTooLarge = errors.New("wstest: frame too large")
+
+// Frame は WebSocket のフレーム。
+//
+// 仕様:
+//
+//	不正なフレームも送信できるよう、値の検証は行わない。
+//	Masked の場合、書き込み時にランダムな masking key でマスクする。読み込んだ Payload はマスクを外したもの。
+type Frame struct {
+	Fin bool
+	// RSV は RSV1, RSV2, RSV3 のビットの組み合わせ。
+	RSV     byte
+	Opcode  byte
+	Masked  bool
+	Payload []byte
+}
+
+// Text は 1 フレームの TextFrame。
+func Text(s string) Frame {
+	return Frame{Fin: true, Opcode: OpText, Payload: []byte(s)}
+}
+
+// Binary は 1 フレームの BinaryFrame。
+func Binary(b []byte) Frame {
+	return Frame{Fin: true, Opcode: OpBinary, Payload: b}
+}
+
+// Ping は PingFrame。
+func Ping(b []byte) Frame {
+	return Frame{Fin: true, Opcode: OpPing, Payload: b}
+}
+
+// Pong は PongFrame。
+func Pong(b []byte) Frame {
+	return Frame{Fin: true, Opcode: OpPong, Payload: b}
+}
+
+// Close は code と reason の CloseFrame。code が 0 の場合はペイロードのない CloseFrame になる。
+func Close(code uint16, reason string) Frame {
+	f := Frame{Fin: true, Opcode: OpClose}
+	if code != 0 {
+		f.Payload = binary.BigEndian.AppendUint16(nil, code)
+		f.Payload = append(f.Payload, reason...)
+	}
+
+	return f
+}
+
+// Fragments は opcode のメッセージを n 個のフレームに分割する。n が 1 未満の場合は 1 フレームにする。
+func Fragments(opcode byte, payload []byte, n int) []Frame {
+	n = max(n, 1)
+	size := (len(payload) + n - 1) / n
+	frames := make([]Frame, 0, n)
+	for i := 0; i < n; i++ {
+		start := min(i*size, len(payload))
+		end := min(start+size, len(payload))
+		f := Frame{Opcode: OpContinuation, Payload: payload[start:end]}
+		if i == 0 {
+			f.Opcode = opcode
+		}
+		f.Fin = i == n-1
+		frames = append(frames, f)
+	}
+
+	return frames
+}
+
+// CloseCode は CloseFrame のステータスコードと理由を返す。ステータスコードがない場合は CloseNoStatus を返す。
+func (f Frame) CloseCode() (uint16, string) {
+	if len(f.Payload) < 2 {
+		return CloseNoStatus, ""
+	}
+
+	return binary.BigEndian.Uint16(f.Payload), string(f.Payload[2:])
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("{fin: %t, rsv: %#x, opcode: %#x, masked: %t, len: %d}", f.Fin, f.RSV, f.Opcode, f.Masked, len(f.Payload))
+}
+
+// AppendFrame は f をエンコードして b に追加する。
+func AppendFrame(b []byte, f Frame) []byte {
+	b0 := f.RSV&(RSV1|RSV2|RSV3) | f.Opcode&0x0f
+	if f.Fin {
+		b0 |= 0x80
+	}
+	b = append(b, b0)
+
+	var mask byte
+	if f.Masked {
+		mask = 0x80
+	}
+	switch n := len(f.Payload); {
+	case n < 126:
+		b = append(b, mask|byte(n))
+	case n <= 0xffff:
+		b = append(b, mask|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, mask|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+
+	if !f.Masked {
+		return append(b, f.Payload...)
+	}
+
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], rand.Uint32())
+	b = append(b, key[:]...)
+	for i, c := range f.Payload {
+		b = append(b, c^key[i%4])
+	}
+
+	return b
+}
+
+// ReadFrame は r から 1 つのフレームを読み込む。
+// ペイロードが MaxFrameSize を超える場合はエラーを返す。
+func ReadFrame(r io.Reader) (Frame, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return Frame{}, err
+	}
+
+	f := Frame{
+		Fin:    h[0]&0x80 != 0,
+		RSV:    h[0] & (RSV1 | RSV2 | RSV3),
+		Opcode: h[0] & 0x0f,
+		Masked: h[1]&0x80 != 0,
+	}
+
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > MaxFrameSize {
+		return Frame{}, fmt.Errorf("%w: %d", errFrameTooLarge, n)
+	}
+
+	var key [4]byte
+	if f.Masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+	}
+
+	f.Payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	if f.Masked {
+		for i := range f.Payload {
+			f.Payload[i] ^= key[i%4]
+		}
+	}
+
+	return f, nil
+}
+
+// unexpectedEOF はフレームの途中で切断された場合に io.EOF を io.ErrUnexpectedEOF にする。
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,3 @@
+module wstest
+
+go 1.22
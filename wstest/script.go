@@ -0,0 +1,217 @@
+package wstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Step はスクリプトの 1 つの手順。Conn.Run で順に実行する。
+type Step func(c *Conn) error
+
+// Send は frames を順に書き込む。
+func Send(frames ...Frame) Step {
+	return func(c *Conn) error {
+		for _, f := range frames {
+			if err := c.WriteFrame(f); err != nil {
+				return fmt.Errorf("failed to send %s: %w", f, err)
+			}
+		}
+		return nil
+	}
+}
+
+// SendText は s を 1 フレームの TextFrame で書き込む。
+func SendText(s string) Step {
+	return Send(Text(s))
+}
+
+// SendRaw は b をそのまま書き込む。エンコードできない不正なフレームを送る場合に使う。
+func SendRaw(b []byte) Step {
+	return func(c *Conn) error {
+		if err := c.WriteRaw(b); err != nil {
+			return fmt.Errorf("failed to send raw bytes: %w", err)
+		}
+		return nil
+	}
+}
+
+// SendClose は code と reason の CloseFrame を書き込む。code が 0 の場合はペイロードのない CloseFrame になる。
+func SendClose(code uint16, reason string) Step {
+	return Send(Close(code, reason))
+}
+
+// Sleep は d だけ待つ。
+func Sleep(d time.Duration) Step {
+	return func(*Conn) error {
+		time.Sleep(d)
+		return nil
+	}
+}
+
+// Drop は CloseFrame を送らずにコネクションを閉じる。
+func Drop() Step {
+	return func(c *Conn) error {
+		return c.Close()
+	}
+}
+
+// Echo は CloseFrame を受信するまで、データメッセージを同じ opcode で 1 フレームにして返す。
+func Echo() Step {
+	return func(c *Conn) error {
+		for {
+			opcode, payload, err := c.ReadMessage()
+			var ce *CloseError
+			if errors.As(err, &ce) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := c.WriteFrame(Frame{Fin: true, Opcode: opcode, Payload: payload}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ExpectFrame は次のフレームを読み込み、match で検証する。
+// PingFrame などの制御フレームもそのまま渡す。
+func ExpectFrame(match func(f Frame) error) Step {
+	return func(c *Conn) error {
+		f, err := c.ReadFrame()
+		if err != nil {
+			return fmt.Errorf("failed to read frame: %w", err)
+		}
+		return match(f)
+	}
+}
+
+// ExpectMessage は次のデータメッセージを読み込み、match で検証する。
+func ExpectMessage(match func(opcode byte, payload []byte) error) Step {
+	return func(c *Conn) error {
+		opcode, payload, err := c.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+		return match(opcode, payload)
+	}
+}
+
+// ExpectText は次のデータメッセージが want の TextFrame であることを検証する。
+func ExpectText(want string) Step {
+	return ExpectMessage(func(opcode byte, payload []byte) error {
+		if opcode != OpText || string(payload) != want {
+			return fmt.Errorf("got opcode %#x %q, want text %q", opcode, payload, want)
+		}
+		return nil
+	})
+}
+
+// ExpectBinary は次のデータメッセージが want の BinaryFrame であることを検証する。
+func ExpectBinary(want []byte) Step {
+	return ExpectMessage(func(opcode byte, payload []byte) error {
+		if opcode != OpBinary || !bytes.Equal(payload, want) {
+			return fmt.Errorf("got opcode %#x %x, want binary %x", opcode, payload, want)
+		}
+		return nil
+	})
+}
+
+// ExpectJSON は次のデータメッセージが want を含む JSON であることを検証する。
+//
+// 仕様:
+//
+//	want のオブジェクトに書いたフィールドのみを比較し、受信したメッセージの他のフィールドは無視する。
+//	配列は要素数が同じで、要素ごとに同じ規則で一致する必要がある。
+func ExpectJSON(want string) Step {
+	var w any
+	wantErr := json.Unmarshal([]byte(want), &w)
+
+	return ExpectMessage(func(opcode byte, payload []byte) error {
+		if wantErr != nil {
+			return fmt.Errorf("invalid want %q: %w", want, wantErr)
+		}
+		var got any
+		if err := json.Unmarshal(payload, &got); err != nil {
+			return fmt.Errorf("got %q, want JSON: %w", payload, err)
+		}
+		if !containsJSON(got, w) {
+			return fmt.Errorf("got %s, want %s", payload, want)
+		}
+		return nil
+	})
+}
+
+// containsJSON は got が want を含むかどうかを返す。
+func containsJSON(got, want any) bool {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			return false
+		}
+		for k, wv := range w {
+			gv, ok := g[k]
+			if !ok || !containsJSON(gv, wv) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		g, ok := got.([]any)
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !containsJSON(g[i], w[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(got, want)
+	}
+}
+
+// ExpectClose は CloseFrame を受信し、ステータスコードが code であることを検証する。
+// CloseFrame の前に受信したデータメッセージは読み捨てる。
+func ExpectClose(code uint16) Step {
+	return func(c *Conn) error {
+		for {
+			_, _, err := c.ReadMessage()
+			var ce *CloseError
+			if errors.As(err, &ce) {
+				if ce.Code != code {
+					return fmt.Errorf("got close code %d %q, want %d", ce.Code, ce.Reason, code)
+				}
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read close frame: %w", err)
+			}
+		}
+	}
+}
+
+// ExpectNoMessage は d の間データメッセージを受信しないことを検証する。
+func ExpectNoMessage(d time.Duration) Step {
+	return func(c *Conn) error {
+		timeout := c.Timeout
+		c.Timeout = d
+		defer func() { c.Timeout = timeout }()
+
+		opcode, payload, err := c.ReadMessage()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+		return fmt.Errorf("got opcode %#x %q, want no message", opcode, payload)
+	}
+}
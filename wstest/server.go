@@ -0,0 +1,121 @@
+package wstest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Server は httptest で空いているポートに起動したサーバー。
+type Server struct {
+	*httptest.Server
+}
+
+// Start は h を空いているポートで起動する。サーバーはテストの終了時に閉じる。
+func Start(t testing.TB, h http.Handler) *Server {
+	t.Helper()
+
+	s := &Server{Server: httptest.NewServer(h)}
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// URL は path に接続する ws:// の URL を返す。path はクエリを含んでもよい。
+func (s *Server) URL(path string) string {
+	return "ws" + strings.TrimPrefix(s.Server.URL, "http") + path
+}
+
+// HTTPURL は path にリクエストする http:// の URL を返す。
+func (s *Server) HTTPURL(path string) string {
+	return s.Server.URL + path
+}
+
+// FakeServer は接続ごとに Steps を実行する WebSocket サーバー。
+//
+// 仕様:
+//
+//	Protocols のうち、クライアントが提示したものを提示された順に選ぶ。Protocols が空の場合は subprotocol を返さない。
+//	Steps を全て実行した後、CloseFrame を送らずにコネクションを閉じる。
+//	CloseFrame を返す場合は Steps の最後に SendClose か Echo を書く。
+type FakeServer struct {
+	Protocols []string
+	Steps     []Step
+}
+
+// Start は f を空いているポートで起動する。全ての path で接続を受け付ける。
+func (f FakeServer) Start(t testing.TB) *Server {
+	t.Helper()
+
+	return Start(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, err := f.upgrade(t, w, req)
+		if err != nil {
+			t.Errorf("fake server: failed to upgrade: %s", err)
+			return
+		}
+		defer c.Close()
+
+		c.Run(f.Steps...)
+	}))
+}
+
+// StartEcho はデータメッセージをそのまま返すサーバーを空いているポートで起動する。
+func StartEcho(t testing.TB) *Server {
+	t.Helper()
+
+	return FakeServer{Steps: []Step{Echo()}}.Start(t)
+}
+
+// upgrade は WebSocket の handshake を行い、サーバー側の Conn を返す。
+func (f FakeServer) upgrade(t testing.TB, w http.ResponseWriter, req *http.Request) (*Conn, error) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+		return nil, fmt.Errorf("unexpected Upgrade: %q", req.Header.Get("Upgrade"))
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Sec-WebSocket-Key is required", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	var protocol string
+	for _, v := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); protocol == "" && slices.Contains(f.Protocols, p) {
+				protocol = p
+			}
+		}
+	}
+
+	nc, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	res := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if protocol != "" {
+		res += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	res += "\r\n"
+	if _, err := nc.Write([]byte(res)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	return &Conn{
+		t:        t,
+		nc:       nc,
+		r:        brw.Reader,
+		Protocol: protocol,
+		Timeout:  DefaultTimeout,
+	}, nil
+}
@@ -0,0 +1,127 @@
+package wstest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		for _, masked := range []bool{false, true} {
+			want := Frame{Fin: true, RSV: RSV1, Opcode: OpBinary, Masked: masked, Payload: bytes.Repeat([]byte{'x'}, size)}
+			got, err := ReadFrame(bytes.NewReader(AppendFrame(nil, want)))
+			if err != nil {
+				t.Fatalf("size %d, masked %t: %s", size, masked, err)
+			}
+			if got.Fin != want.Fin || got.RSV != want.RSV || got.Opcode != want.Opcode || got.Masked != want.Masked || !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("size %d, masked %t: got %s, want %s", size, masked, got, want)
+			}
+		}
+	}
+}
+
+func TestEcho(t *testing.T) {
+	s := StartEcho(t)
+	c := Dial(t, s.URL("/"))
+
+	c.Run(
+		SendText("hello"),
+		ExpectText("hello"),
+		Send(Fragments(OpBinary, []byte("fragmented"), 3)...),
+		ExpectBinary([]byte("fragmented")),
+		// サーバーの ReadMessage が PingFrame に PongFrame を返す。
+		Send(Ping([]byte("ping"))),
+		ExpectFrame(func(f Frame) error {
+			if f.Opcode != OpPong || string(f.Payload) != "ping" {
+				return fmt.Errorf("got %s %q, want pong", f, f.Payload)
+			}
+			return nil
+		}),
+		SendClose(1000, ""),
+		ExpectClose(1000),
+	)
+}
+
+func TestFakeServer(t *testing.T) {
+	s := FakeServer{
+		Protocols: []string{"pubsub.v1.json"},
+		Steps: []Step{
+			ExpectText("subscribe"),
+			SendText(`{"kind":"message","topic":"t","payload":"hi","id":"1"}`),
+			SendClose(4000, "bye"),
+		},
+	}.Start(t)
+
+	c := Dial(t, s.URL("/t"), "pubsub.v1.text", "pubsub.v1.json")
+	if c.Protocol != "pubsub.v1.json" {
+		t.Errorf("got protocol %q, want pubsub.v1.json", c.Protocol)
+	}
+	c.Run(
+		SendText("subscribe"),
+		ExpectJSON(`{"kind":"message","payload":"hi"}`),
+		ExpectClose(4000),
+	)
+}
+
+func TestExpectNoMessage(t *testing.T) {
+	s := FakeServer{Steps: []Step{Sleep(100 * time.Millisecond), SendText("late")}}.Start(t)
+	c := Dial(t, s.URL("/"))
+
+	c.Run(
+		ExpectNoMessage(50*time.Millisecond),
+		ExpectText("late"),
+	)
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	s := Start(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+
+	_, resp, err := Handshake(t, s.URL("/"), nil)
+	if err == nil {
+		t.Fatal("got no error, want rejection")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got response %v, want 403", resp)
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, err := FakeServer{}.upgrade(t, w, req)
+		if err != nil {
+			t.Errorf("failed to upgrade: %s", err)
+			return
+		}
+		defer c.Close()
+
+		c.Run(Echo())
+	}))
+	t.Cleanup(s.Close)
+
+	url := "wss" + strings.TrimPrefix(s.URL, "https") + "/"
+	c, _, err := ConnectTLS(url, nil, s.Client().Transport.(*http.Transport).TLSClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.t = t
+	t.Cleanup(func() { c.Close() })
+
+	c.Run(
+		SendText("over tls"),
+		ExpectText("over tls"),
+		SendClose(1000, ""),
+		ExpectClose(1000),
+	)
+
+	// 検証できない証明書の場合は接続しない。
+	if _, _, err := Connect(url, nil); err == nil {
+		t.Error("got no error with an untrusted certificate")
+	}
+}
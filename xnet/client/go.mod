@@ -2,4 +2,9 @@ module xnet-client
 
 go 1.20
 
-require golang.org/x/net v0.9.0
+require (
+	diag v0.0.0
+	golang.org/x/net v0.9.0
+)
+
+replace diag => ../../diag
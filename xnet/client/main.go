@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"golang.org/x/net/websocket"
+
+	"diag"
 )
 
 const (
@@ -29,6 +31,8 @@ func unmarshal(msg []byte, payloadType byte, v any) (err error) {
 }
 
 func main() {
+	diag.Serve()
+
 	origin := fmt.Sprintf("http://%s", hostPort)
 	url := fmt.Sprintf("ws://%s/subscribe", hostPort)
 
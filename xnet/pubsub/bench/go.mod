@@ -0,0 +1,10 @@
+module xnet-pubsub-bench
+
+go 1.22
+
+require (
+	diag v0.0.0
+	golang.org/x/net v0.24.0
+)
+
+replace diag => ../../../diag
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"diag"
+)
+
+// bench は pubsub サーバーに subscriber と publisher を接続し、配信の遅延とスループットを測る。
+//
+// 仕様:
+//
+//	subscriber と publisher を topic に順に割り当てる (i 番目は i % topics 番目の topic)。
+//	コネクションは rampUp の間に一定の間隔で張り、全て張った後に duration の間 publish する。
+//	publisher はそれぞれ rate msg/s で、送信時刻と連番を先頭に付けた size バイトのメッセージを publish する。
+//	subscriber は受け取ったメッセージの送信時刻から遅延を計算する。同じホストで実行しない場合は時計のずれが含まれる。
+//	publish の終了後、drain の間配信を待ってから切断する。
+//	切断されたコネクションは 1 秒後に再接続し、再接続の回数として数える。
+
+const (
+	// protocol は計測に使う subprotocol。エンベロープのエンコードを含めないよう、ペイロードのみを送る。
+	protocol = "pubsub.v1.text"
+
+	dialTimeout    = 10 * time.Second
+	reconnectDelay = time.Second
+	// minSize は送信時刻と連番を書き込むのに必要なメッセージの大きさ。
+	minSize = 40
+)
+
+// duration は JSON で "10s" のような文字列にする time.Duration。
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// benchOptions は計測の条件。
+type benchOptions struct {
+	URL         string   `json:"url"`
+	Subscribers int      `json:"subscribers"`
+	Publishers  int      `json:"publishers"`
+	Topics      int      `json:"topics"`
+	TopicPrefix string   `json:"topicPrefix"`
+	RampUp      duration `json:"rampUp"`
+	Duration    duration `json:"duration"`
+	Drain       duration `json:"drain"`
+	// Size は publish するメッセージのバイト数。
+	Size int `json:"size"`
+	// Rate は publisher 1 つあたりの 1 秒間の publish 数。
+	Rate float64 `json:"rate"`
+}
+
+func (o benchOptions) validate() error {
+	var errs []error
+	if o.Subscribers < 0 || o.Publishers < 1 || o.Topics < 1 {
+		errs = append(errs, fmt.Errorf("need at least 1 publisher and 1 topic: subscribers=%d, publishers=%d, topics=%d", o.Subscribers, o.Publishers, o.Topics))
+	}
+	if o.Size < minSize {
+		errs = append(errs, fmt.Errorf("size must be at least %d: %d", minSize, o.Size))
+	}
+	if o.Rate <= 0 {
+		errs = append(errs, fmt.Errorf("rate must be positive: %g", o.Rate))
+	}
+	if o.Duration <= 0 || o.RampUp < 0 || o.Drain < 0 {
+		errs = append(errs, errors.New("duration must be positive, rampUp and drain must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// topic は i 番目のコネクションが参加する topic。
+func (o benchOptions) topic(i int) string {
+	return fmt.Sprintf("%s%d", o.TopicPrefix, i%o.Topics)
+}
+
+type bench struct {
+	opts benchOptions
+
+	counters  counters
+	latencies latencies
+
+	// subscribers は topic ごとの接続中の subscriber 数。publish 時の expected の計算に使う。
+	subscribers   map[string]int
+	subscribersMu sync.RWMutex
+}
+
+// dial は topic に接続する。
+func (b *bench) dial(topic string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(strings.TrimSuffix(b.opts.URL, "/")+"/"+topic, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{protocol}
+	config.Dialer = &net.Dialer{Timeout: dialTimeout}
+
+	return websocket.DialConfig(config)
+}
+
+// connect は ctx が終了するまで topic に接続し続け、接続するたびに serve を呼ぶ。
+// 最初の接続を試みた後に connected を呼ぶ。ok は接続できたかどうか。
+func (b *bench) connect(ctx context.Context, topic string, connected func(ok bool), serve func(ws *websocket.Conn)) {
+	first := true
+	for ctx.Err() == nil {
+		ws, err := b.dial(topic)
+		if err != nil {
+			b.counters.dialErrors.Add(1)
+			slog.Debug(fmt.Sprintf("failed to dial %s: %s", topic, err))
+		} else if !first {
+			b.counters.reconnects.Add(1)
+		}
+		if first {
+			connected(err == nil)
+			first = false
+		}
+
+		if err == nil {
+			// ctx の終了時に読み込みを中断する。
+			stop := context.AfterFunc(ctx, func() { ws.Close() })
+			serve(ws)
+			stop()
+			ws.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// subscribe は切断されるまでメッセージを受け取り、遅延を記録する。
+func (b *bench) subscribe(ctx context.Context, topic string, ws *websocket.Conn) {
+	b.subscribersMu.Lock()
+	b.subscribers[topic]++
+	b.subscribersMu.Unlock()
+	defer func() {
+		b.subscribersMu.Lock()
+		b.subscribers[topic]--
+		b.subscribersMu.Unlock()
+	}()
+
+	for {
+		// PingFrame への PongFrame はライブラリが返す。
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			if ctx.Err() == nil {
+				b.counters.readErrors.Add(1)
+				slog.Debug(fmt.Sprintf("failed to receive on %s: %s", topic, err))
+			}
+			return
+		}
+
+		sent, err := decodeSentAt(msg)
+		if err != nil {
+			b.counters.decodeErrors.Add(1)
+			slog.Debug(fmt.Sprintf("failed to decode %q: %s", msg, err))
+			continue
+		}
+		b.counters.delivered.Add(1)
+		b.latencies.add(time.Since(sent))
+	}
+}
+
+// publish は start が閉じられてから stop が閉じられるまで rate msg/s で publish する。
+// その後は ctx が終了するまで接続したまま待つ。
+// publisher 自身には配信されないが、PingFrame に応答するため読み込みも行う。
+func (b *bench) publish(ctx context.Context, topic string, start, stop <-chan struct{}, ws *websocket.Conn) {
+	go func() {
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-start:
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / b.opts.Rate))
+	defer ticker.Stop()
+
+	var seq uint64
+	buf := make([]byte, b.opts.Size)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			<-ctx.Done()
+			return
+		case <-ticker.C:
+		}
+
+		seq++
+		b.subscribersMu.RLock()
+		subscribers := b.subscribers[topic]
+		b.subscribersMu.RUnlock()
+
+		if _, err := ws.Write(encodeMessage(buf, time.Now(), seq)); err != nil {
+			if ctx.Err() == nil {
+				b.counters.writeErrors.Add(1)
+				slog.Debug(fmt.Sprintf("failed to publish to %s: %s", topic, err))
+			}
+			return
+		}
+		b.counters.published.Add(1)
+		b.counters.expected.Add(int64(subscribers))
+	}
+}
+
+// encodeMessage は buf に送信時刻と連番を書き込み、残りを埋めたメッセージを返す。
+func encodeMessage(buf []byte, sent time.Time, seq uint64) []byte {
+	b := strconv.AppendInt(buf[:0], sent.UnixNano(), 10)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, seq, 10)
+	b = append(b, ' ')
+	for len(b) < cap(buf) {
+		b = append(b, 'x')
+	}
+
+	return b
+}
+
+// decodeSentAt はメッセージの先頭の送信時刻を返す。
+func decodeSentAt(msg string) (time.Time, error) {
+	s, _, ok := strings.Cut(msg, " ")
+	if !ok {
+		return time.Time{}, errors.New("no timestamp")
+	}
+	ns, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, ns), nil
+}
+
+// run は計測を行い、結果を返す。ctx が終了した場合は、その時点までの結果を返す。
+func (b *bench) run(ctx context.Context) result {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	total := b.opts.Subscribers + b.opts.Publishers
+	var interval time.Duration
+	if total > 1 {
+		interval = time.Duration(b.opts.RampUp) / time.Duration(total-1)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		ready     sync.WaitGroup
+		mu        sync.Mutex
+		connected int
+		start     = make(chan struct{})
+		stop      = make(chan struct{})
+	)
+	onConnected := func(ok bool) {
+		if ok {
+			mu.Lock()
+			connected++
+			mu.Unlock()
+		}
+		ready.Done()
+	}
+
+	// subscriber を先に接続し、publish の開始時に全ての subscriber が参加しているようにする。
+	slog.Info(fmt.Sprintf("ramping up %d subscribers and %d publishers over %s", b.opts.Subscribers, b.opts.Publishers, time.Duration(b.opts.RampUp)))
+	for i := range total {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(interval):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		ready.Add(1)
+		if i < b.opts.Subscribers {
+			topic := b.opts.topic(i)
+			go func() {
+				defer wg.Done()
+				b.connect(ctx, topic, onConnected, func(ws *websocket.Conn) { b.subscribe(ctx, topic, ws) })
+			}()
+		} else {
+			topic := b.opts.topic(i - b.opts.Subscribers)
+			go func() {
+				defer wg.Done()
+				b.connect(ctx, topic, onConnected, func(ws *websocket.Conn) { b.publish(ctx, topic, start, stop, ws) })
+			}()
+		}
+	}
+	ready.Wait()
+	slog.Info(fmt.Sprintf("%d / %d connections established", connected, total))
+
+	slog.Info(fmt.Sprintf("publishing for %s", time.Duration(b.opts.Duration)))
+	started := time.Now()
+	close(start)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(b.opts.Duration)):
+	}
+	close(stop)
+	elapsed := time.Since(started)
+
+	// 配信中のメッセージを待つ。
+	if ctx.Err() == nil {
+		slog.Info(fmt.Sprintf("draining for %s", time.Duration(b.opts.Drain)))
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(b.opts.Drain)):
+		}
+	}
+
+	r := newResult(b.opts, connected, elapsed, &b.counters, &b.latencies)
+	cancel()
+	wg.Wait()
+
+	return r
+}
+
+func main() {
+	// flag の設定。
+	opts := benchOptions{}
+	flag.StringVar(&opts.URL, "url", "ws://localhost:12345", "The base WebSocket URL of the pubsub server (topics are appended as the path)")
+	flag.IntVar(&opts.Subscribers, "subscribers", 100, "The number of subscribers (N)")
+	flag.IntVar(&opts.Publishers, "publishers", 10, "The number of publishers (M)")
+	flag.IntVar(&opts.Topics, "topics", 10, "The number of topics (K) the connections are spread across")
+	flag.StringVar(&opts.TopicPrefix, "topicPrefix", "bench.", "The prefix of the topic names")
+	rampUp := flag.Duration("rampUp", 5*time.Second, "How long to spread opening the connections over")
+	d := flag.Duration("duration", 10*time.Second, "How long to publish")
+	drain := flag.Duration("drain", 2*time.Second, "How long to wait for in-flight messages after publishing")
+	flag.IntVar(&opts.Size, "size", 128, fmt.Sprintf("The size of each message in bytes (at least %d)", minSize))
+	flag.Float64Var(&opts.Rate, "rate", 10, "The messages per second each publisher sends")
+	jsonPath := flag.String("json", "", "Also write the results as JSON to this file (- for stdout)")
+	logLevel := flag.String("logLevel", slog.LevelInfo.String(), "The log level")
+	flag.Parse()
+
+	diag.Serve()
+
+	opts.RampUp = duration(*rampUp)
+	opts.Duration = duration(*d)
+	opts.Drain = duration(*drain)
+
+	var ll slog.Level
+	if err := ll.UnmarshalText([]byte(*logLevel)); err != nil {
+		slog.Error(fmt.Sprintf("invalid log level: %s", err))
+		os.Exit(1)
+	}
+	slog.SetLogLoggerLevel(ll)
+
+	if err := opts.validate(); err != nil {
+		slog.Error(fmt.Sprintf("invalid options: %s", err))
+		os.Exit(1)
+	}
+
+	// Ctrl-C の場合は、その時点までの結果を出力する。
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	b := &bench{
+		opts:        opts,
+		subscribers: make(map[string]int),
+	}
+	r := b.run(ctx)
+
+	if err := r.writeTable(os.Stdout); err != nil {
+		slog.Error(fmt.Sprintf("failed to write table: %s", err))
+	}
+	if *jsonPath == "" {
+		return
+	}
+
+	w := os.Stdout
+	if *jsonPath != "-" {
+		f, err := os.Create(*jsonPath)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to create %s: %s", *jsonPath, err))
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := r.writeJSON(w); err != nil {
+		slog.Error(fmt.Sprintf("failed to write JSON: %s", err))
+		os.Exit(1)
+	}
+}
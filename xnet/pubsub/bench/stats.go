@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// counters は計測中に複数の goroutine から更新する回数。
+type counters struct {
+	// published は publish したメッセージ数。
+	published atomic.Int64
+	// expected は publish した時点で topic に接続していた subscriber 数の合計。全て配信された場合の配信数。
+	expected atomic.Int64
+	// delivered は subscriber が受け取ったメッセージ数。
+	delivered atomic.Int64
+
+	dialErrors   atomic.Int64
+	writeErrors  atomic.Int64
+	readErrors   atomic.Int64
+	decodeErrors atomic.Int64
+	// reconnects は切断された後に再接続した回数。
+	reconnects atomic.Int64
+}
+
+// latencies は publish から配信までの時間を記録する。
+type latencies struct {
+	mu sync.Mutex
+	d  []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.d = append(l.d, d)
+}
+
+// stats は記録した時間のパーセンタイルを返す。
+func (l *latencies) stats() latencyStats {
+	l.mu.Lock()
+	d := slices.Clone(l.d)
+	l.mu.Unlock()
+
+	if len(d) == 0 {
+		return latencyStats{}
+	}
+	slices.Sort(d)
+
+	var sum time.Duration
+	for _, v := range d {
+		sum += v
+	}
+
+	return latencyStats{
+		Min:  ms(d[0]),
+		Mean: ms(sum / time.Duration(len(d))),
+		P50:  ms(percentile(d, 0.50)),
+		P95:  ms(percentile(d, 0.95)),
+		P99:  ms(percentile(d, 0.99)),
+		Max:  ms(d[len(d)-1]),
+	}
+}
+
+// percentile はソート済みの d のうち q の割合がそれ以下となる値 (nearest-rank) を返す。
+// d が空の場合は 0 を返す。
+func percentile(d []time.Duration, q float64) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(d)))) - 1
+
+	return d[min(max(i, 0), len(d)-1)]
+}
+
+// ms は d をミリ秒にする。
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// latencyStats は publish から配信までの時間 (ミリ秒)。
+type latencyStats struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// errorStats は種類ごとのエラー数。
+type errorStats struct {
+	Dial   int64 `json:"dial"`
+	Write  int64 `json:"write"`
+	Read   int64 `json:"read"`
+	Decode int64 `json:"decode"`
+}
+
+func (e errorStats) total() int64 {
+	return e.Dial + e.Write + e.Read + e.Decode
+}
+
+// result は計測結果。-json で JSON として書き出す。
+type result struct {
+	Options benchOptions `json:"options"`
+
+	// Connected は計測開始時に接続できていたコネクション数。
+	Connected int `json:"connected"`
+	// Duration は publish していた時間 (秒)。
+	Duration float64 `json:"durationSeconds"`
+
+	Published int64 `json:"published"`
+	Expected  int64 `json:"expected"`
+	Delivered int64 `json:"delivered"`
+	// Missing は配信されなかったメッセージ数 (Expected - Delivered)。
+	Missing int64 `json:"missing"`
+
+	// PublishRate, DeliverRate は 1 秒あたりのメッセージ数。
+	PublishRate float64 `json:"publishPerSecond"`
+	DeliverRate float64 `json:"deliverPerSecond"`
+
+	Latency    latencyStats `json:"latencyMillis"`
+	Errors     errorStats   `json:"errors"`
+	Reconnects int64        `json:"reconnects"`
+}
+
+// newResult は計測中の値から result を作る。
+func newResult(opts benchOptions, connected int, elapsed time.Duration, c *counters, l *latencies) result {
+	r := result{
+		Options:   opts,
+		Connected: connected,
+		Duration:  elapsed.Seconds(),
+		Published: c.published.Load(),
+		Expected:  c.expected.Load(),
+		Delivered: c.delivered.Load(),
+		Latency:   l.stats(),
+		Errors: errorStats{
+			Dial:   c.dialErrors.Load(),
+			Write:  c.writeErrors.Load(),
+			Read:   c.readErrors.Load(),
+			Decode: c.decodeErrors.Load(),
+		},
+		Reconnects: c.reconnects.Load(),
+	}
+	r.Missing = max(r.Expected-r.Delivered, 0)
+	if r.Duration > 0 {
+		r.PublishRate = float64(r.Published) / r.Duration
+		r.DeliverRate = float64(r.Delivered) / r.Duration
+	}
+
+	return r
+}
+
+// writeTable は r を表にして w に書き出す。
+func (r result) writeTable(w io.Writer) error {
+	// 表ごとに列の幅を揃える。
+	tables := []func(tw *tabwriter.Writer){
+		func(tw *tabwriter.Writer) {
+			fmt.Fprintf(tw, "connections\t%d / %d\t\n", r.Connected, r.Options.Subscribers+r.Options.Publishers)
+			fmt.Fprintf(tw, "duration\t%.1fs\t\n", r.Duration)
+			fmt.Fprintf(tw, "published\t%d\t%.1f msg/s\t\n", r.Published, r.PublishRate)
+			fmt.Fprintf(tw, "delivered\t%d / %d\t%.1f msg/s\t\n", r.Delivered, r.Expected, r.DeliverRate)
+			fmt.Fprintf(tw, "missing\t%d\t\n", r.Missing)
+			fmt.Fprintf(tw, "reconnects\t%d\t\n", r.Reconnects)
+		},
+		func(tw *tabwriter.Writer) {
+			fmt.Fprintf(tw, "latency (ms)\tmin\tmean\tp50\tp95\tp99\tmax\t\n")
+			l := r.Latency
+			fmt.Fprintf(tw, "\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t\n", l.Min, l.Mean, l.P50, l.P95, l.P99, l.Max)
+		},
+		func(tw *tabwriter.Writer) {
+			e := r.Errors
+			fmt.Fprintf(tw, "errors\tdial\twrite\tread\tdecode\ttotal\t\n")
+			fmt.Fprintf(tw, "\t%d\t%d\t%d\t%d\t%d\t\n", e.Dial, e.Write, e.Read, e.Decode, e.total())
+		},
+	}
+
+	for i, table := range tables {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		table(tw)
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeJSON は r を JSON で w に書き出す。
+func (r result) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(r)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	// 1ms から 100ms までの 100 個のサンプル。
+	hundred := make([]time.Duration, 100)
+	for i := range hundred {
+		hundred[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	tests := []struct {
+		name string
+		d    []time.Duration
+		q    float64
+		want time.Duration
+	}{
+		{"empty", nil, 0.5, 0},
+		{"single p0", []time.Duration{5 * time.Millisecond}, 0, 5 * time.Millisecond},
+		{"single p50", []time.Duration{5 * time.Millisecond}, 0.5, 5 * time.Millisecond},
+		{"single p100", []time.Duration{5 * time.Millisecond}, 1, 5 * time.Millisecond},
+		{"p50", hundred, 0.50, 50 * time.Millisecond},
+		{"p95", hundred, 0.95, 95 * time.Millisecond},
+		{"p99", hundred, 0.99, 99 * time.Millisecond},
+		{"p100", hundred, 1, 100 * time.Millisecond},
+		// nearest-rank では補間せず、サンプルのいずれかを返す。
+		{"p50 of even", []time.Duration{1, 2, 3, 4}, 0.5, 2},
+		{"p51 of even", []time.Duration{1, 2, 3, 4}, 0.51, 3},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.d, tt.q); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	var l latencies
+	if got := l.stats(); got != (latencyStats{}) {
+		t.Errorf("empty: got %+v, want zero", got)
+	}
+
+	// 記録した順によらず、ソートしてから計算する。
+	for _, v := range []int{3, 1, 4, 2} {
+		l.add(time.Duration(v) * time.Millisecond)
+	}
+	want := latencyStats{Min: 1, Mean: 2.5, P50: 2, P95: 4, P99: 4, Max: 4}
+	if got := l.stats(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"wire"
+)
+
+// permessage-deflate 拡張。
+// see: https://datatracker.ietf.org/doc/html/rfc7692
+//
+// 圧縮と展開はサーバーと同じ wire で行う。
+
+// maxPayloadSize は展開後のメッセージの上限。
+const maxPayloadSize = 1998_0206
+
+// deflateOptions は permessage-deflate としてサーバーに要求する内容。
+type deflateOptions struct {
+	// serverNoContextTakeover はサーバーにメッセージごとに圧縮の状態をリセットさせるかどうか。
+	serverNoContextTakeover bool
+	// clientNoContextTakeover はクライアントがメッセージごとに圧縮の状態をリセットするかどうか。
+	clientNoContextTakeover bool
+	// minSize はこのバイト数未満のメッセージを圧縮せずに送信する。
+	minSize int
+}
+
+// offer は Sec-WebSocket-Extensions に含める値を返す。
+// compress/flate はウィンドウサイズを指定できないため、client_max_window_bits は値なしで提示する。
+// サーバーが 15 未満を指定した場合はクライアントからは圧縮しない。
+func (o deflateOptions) offer() string {
+	s := []string{wire.DeflateExtension}
+	if o.serverNoContextTakeover {
+		s = append(s, "server_no_context_takeover")
+	}
+	if o.clientNoContextTakeover {
+		s = append(s, "client_no_context_takeover")
+	}
+	s = append(s, "client_max_window_bits")
+
+	return strings.Join(s, "; ")
+}
+
+// deflateParams はサーバーと合意した permessage-deflate のパラメータ。
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	// clientMaxWindowBits は 0 の場合は指定なし (15) を表す。
+	clientMaxWindowBits int
+}
+
+// parseDeflateResponse はサーバーが返した Sec-WebSocket-Extensions を検証する。
+// permessage-deflate が含まれない場合は ok が false になる。
+func parseDeflateResponse(values []string, o deflateOptions) (p deflateParams, ok bool, err error) {
+	for _, v := range values {
+		for _, ext := range strings.Split(v, ",") {
+			parts := strings.Split(ext, ";")
+			name := strings.TrimSpace(parts[0])
+			if name != wire.DeflateExtension {
+				return deflateParams{}, false, fmt.Errorf("unexpected extension: %q", name)
+			}
+			if ok {
+				return deflateParams{}, false, errors.New("permessage-deflate is accepted twice")
+			}
+			ok = true
+
+			p.clientNoContextTakeover = o.clientNoContextTakeover
+			for _, param := range parts[1:] {
+				k, v, _ := strings.Cut(param, "=")
+				k, v = strings.TrimSpace(k), strings.Trim(strings.TrimSpace(v), `"`)
+
+				switch k {
+				case "server_no_context_takeover":
+					p.serverNoContextTakeover = true
+				case "client_no_context_takeover":
+					p.clientNoContextTakeover = true
+				case "server_max_window_bits":
+					// 展開は常に 15 bit のウィンドウで行えるため、値は使わない。
+				case "client_max_window_bits":
+					bits, err := strconv.Atoi(v)
+					if err != nil {
+						return deflateParams{}, false, fmt.Errorf("invalid %s: %w", k, err)
+					}
+					p.clientMaxWindowBits = bits
+				default:
+					return deflateParams{}, false, fmt.Errorf("unknown parameter: %s", k)
+				}
+			}
+		}
+	}
+
+	return p, ok, nil
+}
+
+// deflater はコネクションの圧縮と展開の状態。
+type deflater struct {
+	params  deflateParams
+	minSize int
+
+	c wire.Compressor
+	d wire.Decompressor
+
+	// raw, compressed は圧縮して送受信したメッセージの圧縮前後のバイト数。
+	raw, compressed atomic.Int64
+}
+
+func newDeflater(p deflateParams, minSize int) *deflater {
+	return &deflater{
+		params:  p,
+		minSize: minSize,
+		c:       wire.Compressor{NoContextTakeover: p.clientNoContextTakeover},
+		d:       wire.Decompressor{NoContextTakeover: p.serverNoContextTakeover},
+	}
+}
+
+// compress は payload を圧縮する。
+// 圧縮しない場合は ok が false になり、payload をそのまま送信する必要がある。
+func (d *deflater) compress(payload []byte) (compressed []byte, ok bool, err error) {
+	if len(payload) < d.minSize || (d.params.clientMaxWindowBits != 0 && d.params.clientMaxWindowBits < wire.DeflateMaxWindowBits) {
+		return nil, false, nil
+	}
+
+	if compressed, err = d.c.Compress(payload); err != nil {
+		return nil, false, err
+	}
+
+	d.raw.Add(int64(len(payload)))
+	d.compressed.Add(int64(len(compressed)))
+
+	return compressed, true, nil
+}
+
+// decompress はサーバーから届いた圧縮されたメッセージを展開する。
+func (d *deflater) decompress(compressed []byte) ([]byte, error) {
+	payload, err := d.d.Decompress(compressed, maxPayloadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	d.raw.Add(int64(len(payload)))
+	d.compressed.Add(int64(len(compressed)))
+
+	return payload, nil
+}
+
+// ratio は 圧縮後 / 圧縮前 の比率を返す。
+func (d *deflater) ratio() float64 {
+	raw := d.raw.Load()
+	if raw == 0 {
+		return 0
+	}
+	return float64(d.compressed.Load()) / float64(raw)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+
+	"wire"
+)
+
+var errConnClosed = errors.New("connection already closed")
+
+// handshakeConn はハンドシェイクのレスポンスから Sec-WebSocket-Extensions を取り除く net.Conn。
+//
+// x/net/websocket のクライアントは Sec-WebSocket-Extensions を含むレスポンスを拒否するため、
+// permessage-deflate の合意内容はここで取り出し、x/net/websocket には渡さない。
+type handshakeConn struct {
+	net.Conn
+
+	// extensions はレスポンスに含まれていた Sec-WebSocket-Extensions の値。
+	extensions []string
+
+	done    bool
+	pending []byte
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.done {
+		return c.Conn.Read(p)
+	}
+
+	// ヘッダーの終わりまで読み込む。
+	var buf []byte
+	chunk := make([]byte, 4096)
+	for !bytes.Contains(buf, []byte("\r\n\r\n")) {
+		n, err := c.Conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if err != nil {
+			// ヘッダーが途中で終わった場合は x/net/websocket にエラーを任せる。
+			c.done = true
+			c.pending = buf
+			return c.Read(p)
+		}
+	}
+	c.done = true
+
+	head, rest, _ := bytes.Cut(buf, []byte("\r\n\r\n"))
+	var filtered []string
+	for _, line := range strings.Split(string(head), "\r\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), wire.ExtensionsHeader) {
+			c.extensions = append(c.extensions, strings.TrimSpace(v))
+			continue
+		}
+		filtered = append(filtered, line)
+	}
+
+	c.pending = append([]byte(strings.Join(filtered, "\r\n")+"\r\n\r\n"), rest...)
+	return c.Read(p)
+}
+
+// frameWriter はマスクしたフレームをコネクションに直接書き込む。
+//
+// websocket.Conn の書き込みでは RSV ビットを指定できないため、
+// permessage-deflate で圧縮したフレームを送信できるよう、書き込みは全て frameWriter から行う。
+type frameWriter struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+
+	// deflate は permessage-deflate の状態。nil の場合は圧縮しない。
+	deflate *deflater
+}
+
+// writeFrame はロックを取得した状態で 1 つのフレームを書き込む。
+// クライアントから送信するフレームは必ずマスクする。
+func (fw *frameWriter) writeFrame(opcode byte, rsv1 bool, payload []byte) error {
+	if fw.closed {
+		return errConnClosed
+	}
+
+	b := wire.AppendMaskedFrame(make([]byte, 0, 14+len(payload)), opcode, rsv1, payload)
+	_, err := fw.conn.Write(b)
+	return err
+}
+
+// writeMessage は TextFrame か BinaryFrame を書き込む。
+// permessage-deflate が有効な場合は圧縮して書き込む。
+func (fw *frameWriter) writeMessage(opcode byte, payload []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.deflate != nil {
+		compressed, ok, err := fw.deflate.compress(payload)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return fw.writeFrame(opcode, true, compressed)
+		}
+	}
+
+	return fw.writeFrame(opcode, false, payload)
+}
+
+// writeControl は PingFrame などの制御フレームを書き込む。
+func (fw *frameWriter) writeControl(opcode byte, payload []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	return fw.writeFrame(opcode, false, payload)
+}
+
+// close は CloseFrame を書き込んでからコネクションを閉じる。
+// 2 回目以降の呼び出しでは何もしない。
+func (fw *frameWriter) close(status uint16) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.closed {
+		return nil
+	}
+
+	err := fw.writeFrame(websocket.CloseFrame, false, binary.BigEndian.AppendUint16(nil, status))
+	fw.closed = true
+
+	return errors.Join(err, fw.conn.Close())
+}
@@ -2,4 +2,12 @@ module xnet-client
 
 go 1.22.2
 
-require golang.org/x/net v0.9.0
+require (
+	diag v0.0.0
+	golang.org/x/net v0.9.0
+	wire v0.0.0
+)
+
+replace diag => ../../../diag
+
+replace wire => ../../../wire
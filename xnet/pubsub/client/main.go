@@ -10,10 +10,20 @@ import (
 	"log"
 	"log/slog"
 	"math/rand/v2"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/websocket"
+
+	"diag"
+	"wire"
 )
 
 const (
@@ -22,57 +32,348 @@ const (
 	defaultLogLevel = slog.LevelInfo
 )
 
-// PingFrame 送信のための Codec。
-// see: https://github.com/golang/net/blob/v0.24.0/websocket/websocket.go#L372-L419
-var pingMessage = websocket.Codec{
-	Marshal:   marshal,
-	Unmarshal: unmarshal,
-}
+// サーバーが対応している subprotocol。
+const (
+	protocolText    = "pubsub.v1.text"
+	protocolJSON    = "pubsub.v1.json"
+	protocolMsgpack = "pubsub.v1.msgpack"
+)
+
+// pingPayload は PingFrame のペイロード。
+var pingPayload = []byte("ping")
+
+// message は pubsub.v1.json, pubsub.v1.msgpack の時にサーバーとやり取りするメッセージ。
+type message struct {
+	Kind    string `json:"kind"`
+	Topic   string `json:"topic,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	Self    bool   `json:"self,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+
+	ID          string `json:"id,omitempty"`
+	Redelivered bool   `json:"redelivered,omitempty"`
+
+	CorrelationID string `json:"correlationId,omitempty"`
+	ReplyTo       string `json:"replyTo,omitempty"`
 
-func marshal(_ any) (msg []byte, payloadType byte, err error) {
-	return []byte("ping"), websocket.PingFrame, nil
+	Name string `json:"name,omitempty"`
+	To   string `json:"to,omitempty"`
+	From string `json:"from,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	// Messages は kind: batch にまとめられた配信。
+	Messages []message `json:"messages,omitempty"`
 }
 
-func unmarshal(msg []byte, payloadType byte, v any) (err error) {
-	return json.Unmarshal(msg, v)
+// clientOptions は接続時にサーバーに指定するオプション。
+type clientOptions struct {
+	// filter は受け取るメッセージを絞り込む条件式。空の場合は全て受け取る。
+	filter string
+	// message は送信するメッセージ。%s は name に置換される。
+	message string
+	// subprotocols はサーバーに提示する subprotocol。優先するものから順に並べる。
+	subprotocols []string
+	// echo は自身が publish したメッセージも受け取るかどうか。
+	echo bool
+	// delivery は配信の保証。at-most-once か at-least-once。
+	delivery string
+	// session は at-least-once の配信状態を識別する ID。
+	session string
+	// retain は publish するメッセージを retained message にするかどうか。
+	retain bool
+	// willTopic, willPayload, willRetain は異常切断時に publish される last will message。
+	willTopic   string
+	willPayload string
+	willRetain  bool
+	// request が空でない場合、publish の代わりにリクエストを 1 度送信し、reply を表示して終了する。
+	request        string
+	requestTimeout time.Duration
+	// respond は受け取ったリクエストに reply を返すかどうか。
+	respond bool
+	// to が空でない場合、publish の代わりに to の名前のクライアントにダイレクトメッセージを送信する。
+	to string
+	// deflate が nil でない場合、permessage-deflate を提示する。
+	deflate *deflateOptions
+	// batchInterval が 0 でない場合、サーバーに配信をまとめて送信させる。
+	// まとめられた配信は 1 件ずつ受け取った場合と同じように扱う。
+	batchInterval time.Duration
+	// batchSize は 1 回にまとめる配信の上限。0 の場合はサーバーのデフォルト。
+	batchSize int
 }
 
 type client struct {
 	hostPort string
 	topic    string
 	name     string
+	opts     clientOptions
 
 	// output はメッセージを表示するための io.Writer。
 	output io.Writer
+
+	// protocol はサーバーが選択した subprotocol。
+	protocol string
+	// w はコネクションへの書き込みに使う。書き込みは websocket.Conn ではなく全て w から行う。
+	w *frameWriter
+
+	// pending は correlation ID ごとの reply を待っている request。
+	pending   map[string]chan message
+	pendingMu sync.Mutex
 }
 
-func newClient(hostPort, topic, name string) *client {
+func newClient(hostPort, topic, name string, opts clientOptions) *client {
 	return &client{
 		hostPort: hostPort,
 		topic:    topic,
 		name:     name,
+		opts:     opts,
+
+		output:  os.Stdout,
+		pending: make(map[string]chan message),
+	}
+}
+
+// query は接続時のクエリパラメータを返す。
+func (c *client) query() url.Values {
+	q := url.Values{}
+	if c.opts.filter != "" {
+		q.Set("filter", c.opts.filter)
+	}
+	if c.opts.echo {
+		q.Set("echo", "true")
+	}
+	if c.opts.delivery != "" {
+		q.Set("delivery", c.opts.delivery)
+	}
+	if c.opts.session != "" {
+		q.Set("session", c.opts.session)
+	}
+	if c.opts.willTopic != "" {
+		q.Set("willTopic", c.opts.willTopic)
+		q.Set("willPayload", c.opts.willPayload)
+		if c.opts.willRetain {
+			q.Set("willRetain", "true")
+		}
+	}
+	if c.opts.batchInterval > 0 {
+		q.Set("batchInterval", c.opts.batchInterval.String())
+		if c.opts.batchSize > 0 {
+			q.Set("batchSize", strconv.Itoa(c.opts.batchSize))
+		}
+	}
+
+	return q
+}
+
+// receive は受け取ったメッセージを表示する。
+// pubsub.v1.text 以外の場合は message に変換して handle で処理する。
+func (c *client) receive(data []byte) {
+	if c.protocol == protocolText {
+		fmt.Fprintf(c.output, "%s\n", string(data))
+		return
+	}
+
+	m, err := c.decode(data)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to unmarshal message: %s", err))
+		return
+	}
 
-		output: os.Stdout,
+	c.handle(m)
+}
+
+// handle は受け取った message を種類に合わせて処理する。
+// id の付いたメッセージには ack を返す。
+// reply は待っている request に渡し、リクエストには respond が有効な場合に reply を返す。
+// kind: batch の場合はまとめられた配信を 1 件ずつ処理する。
+func (c *client) handle(m message) {
+	switch m.Kind {
+	case "batch":
+		// まとめられた配信を順に処理する。
+		slog.Debug(fmt.Sprintf("batch of %d messages", len(m.Messages)))
+		for _, m := range m.Messages {
+			c.handle(m)
+		}
+		return
+
+	case "reply":
+		if !c.resolve(m) {
+			slog.Debug(fmt.Sprintf("reply ignored: %s", m.CorrelationID))
+		}
+		return
+
+	case "error":
+		if m.CorrelationID != "" && c.resolve(m) {
+			return
+		}
+		slog.Error(fmt.Sprintf("error from server: %s", m.Error))
+		return
+
+	case "hello":
+		slog.Info(fmt.Sprintf("registered as %s", m.Name))
+		return
+
+	case "direct":
+		fmt.Fprintf(c.output, "%s (from %s)\n", m.Payload, m.From)
+		return
+
+	case "request":
+		fmt.Fprintf(c.output, "%s (request)\n", m.Payload)
+		if c.opts.respond {
+			if err := c.respond(m); err != nil {
+				slog.Error(fmt.Sprintf("failed to send reply: %s", err))
+			}
+		}
+		return
+	}
+
+	var marks []string
+	if m.Self {
+		marks = append(marks, "(self)")
+	}
+	if m.Retain {
+		marks = append(marks, "(retained)")
+	}
+	if m.Redelivered {
+		marks = append(marks, "(redelivered)")
+	}
+	fmt.Fprintln(c.output, strings.Join(append([]string{m.Payload}, marks...), " "))
+
+	if m.ID != "" {
+		if err := c.send(message{Kind: "ack", ID: m.ID}); err != nil {
+			slog.Error(fmt.Sprintf("failed to send ack: %s", err))
+		}
 	}
 }
 
-func (c *client) run() error {
+// send は選択された subprotocol に合わせて message を送信する。
+func (c *client) send(m message) error {
+	if c.protocol == protocolMsgpack {
+		b, err := wire.MarshalMsgpack(m)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		return c.w.writeMessage(websocket.BinaryFrame, b)
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return c.w.writeMessage(websocket.TextFrame, b)
+}
+
+// decode は選択された subprotocol に合わせて受け取ったデータを message に変換する。
+func (c *client) decode(data []byte) (message, error) {
+	var m message
+	if c.protocol == protocolMsgpack {
+		return m, wire.UnmarshalMsgpack(data, &m)
+	}
+
+	return m, json.Unmarshal(data, &m)
+}
+
+// publish は選択された subprotocol に合わせてメッセージを送信する。
+// to が指定されている場合はダイレクトメッセージとして送信する。
+func (c *client) publish(payload string) error {
+	if c.protocol == protocolText {
+		return c.w.writeMessage(websocket.TextFrame, []byte(payload))
+	}
+
+	if c.opts.to != "" {
+		return c.send(message{Kind: "direct", To: c.opts.to, Payload: payload})
+	}
+
+	return c.send(message{Kind: "publish", Payload: payload, Retain: c.opts.retain})
+}
+
+// dial はサーバーに接続し、permessage-deflate の合意内容に合わせて frameWriter を用意する。
+func (c *client) dial(config *websocket.Config) (*websocket.Conn, error) {
+	if c.opts.deflate != nil {
+		config.Header.Set(wire.ExtensionsHeader, c.opts.deflate.offer())
+	}
+
+	conn, err := net.Dial("tcp", c.hostPort)
+	if err != nil {
+		return nil, err
+	}
+	// DIAG_RECORD が設定されている場合は、全てのフレームを記録する。
+	conn = diag.Recording().Client(conn)
+
+	hc := &handshakeConn{Conn: conn}
+	ws, err := websocket.NewClient(config, hc)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.w = &frameWriter{conn: conn}
+	if len(hc.extensions) == 0 {
+		return ws, nil
+	}
+
+	if c.opts.deflate == nil {
+		c.w.close(wire.CloseStatusNormal)
+		return nil, fmt.Errorf("unexpected extensions: %q", hc.extensions)
+	}
+	p, ok, err := parseDeflateResponse(hc.extensions, *c.opts.deflate)
+	if err != nil {
+		c.w.close(wire.CloseStatusNormal)
+		return nil, fmt.Errorf("invalid extensions: %w", err)
+	}
+	if ok {
+		c.w.deflate = newDeflater(p, c.opts.deflate.minSize)
+		slog.Debug(fmt.Sprintf("permessage-deflate: %q", hc.extensions))
+	}
+
+	return ws, nil
+}
+
+// run は ctx が終了するまでメッセージの送受信を行う。
+// ctx が終了した場合は CloseFrame を送信して正常に切断する。
+func (c *client) run(ctx context.Context) error {
 	origin := fmt.Sprintf("http://%s", c.hostPort)
-	url := fmt.Sprintf("ws://%s/%s", c.hostPort, c.topic)
+	u := url.URL{Scheme: "ws", Host: c.hostPort, Path: "/" + c.topic, RawQuery: c.query().Encode()}
 
-	ws, err := websocket.Dial(url, "", origin)
+	config, err := websocket.NewConfig(u.String(), origin)
 	if err != nil {
 		log.Fatal(err)
 	}
+	config.Protocol = c.opts.subprotocols
 
-	ctx, cancel := context.WithCancelCause(context.Background())
+	ws, err := c.dial(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if d := c.w.deflate; d != nil {
+		defer func() {
+			slog.Info(fmt.Sprintf("compression ratio: %.3f (%d / %d bytes)", d.ratio(), d.compressed.Load(), d.raw.Load()))
+		}()
+	}
+
+	// サーバーが選択した subprotocol に合わせてメッセージの形式を切り替える。
+	if len(ws.Config().Protocol) != 1 {
+		return fmt.Errorf("no subprotocol selected by the server")
+	}
+	c.protocol = ws.Config().Protocol[0]
+	slog.Debug(fmt.Sprintf("subprotocol: %s", c.protocol))
+
+	ctx, cancel := context.WithCancelCause(ctx)
 	defer cancel(nil)
 
+	// ダイレクトメッセージを受け取れるよう、name を登録する。
+	if c.protocol != protocolText {
+		if err := c.send(message{Kind: "hello", Name: c.name}); err != nil {
+			return fmt.Errorf("failed to send hello: %w", err)
+		}
+	}
+
 	// Ping するための goroutine。
 	go func(ctx context.Context) {
 		defer func() {
 			if r := recover(); r != nil {
-				slog.Error("[ping] panic recovered", r)
+				slog.Error(fmt.Sprintf("[ping] panic recovered: %v", r))
 			}
 		}()
 
@@ -84,8 +385,8 @@ func (c *client) run() error {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				if err := pingMessage.Send(ws, nil); err != nil {
-					slog.Error("pingMessage.Send", err)
+				if err := c.w.writeControl(websocket.PingFrame, pingPayload); err != nil {
+					slog.Error(fmt.Sprintf("failed to send ping: %s", err))
 					return
 				}
 			}
@@ -96,7 +397,7 @@ func (c *client) run() error {
 	go func(ctx context.Context, cancel context.CancelCauseFunc) {
 		defer func() {
 			if r := recover(); r != nil {
-				slog.Error("[read] panic recovered", r)
+				slog.Error(fmt.Sprintf("[read] panic recovered: %v", r))
 			}
 		}()
 
@@ -109,7 +410,11 @@ func (c *client) run() error {
 
 			fr, err := ws.NewFrameReader()
 			if err != nil {
-				slog.Error("ws.NewFrameReader", err)
+				// 自身で切断した場合はエラーとしない。
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error(fmt.Sprintf("ws.NewFrameReader: %s", err))
 
 				return
 			}
@@ -120,9 +425,27 @@ func (c *client) run() error {
 				slog.Debug(fmt.Sprintf("PongFrame: %s", string(b)))
 				continue
 
-			case websocket.TextFrame:
+			case websocket.TextFrame, websocket.BinaryFrame:
+				compressed, err := wire.IsCompressed(fr)
+				if err != nil {
+					slog.Error(fmt.Sprintf("failed to read frame header: %s", err))
+					cancel(err)
+					return
+				}
+
 				b, _ := io.ReadAll(fr)
-				fmt.Fprintf(c.output, "%s\n", string(b))
+				if compressed {
+					if c.w.deflate == nil {
+						slog.Error("compressed frame received without permessage-deflate")
+						cancel(errors.New("unexpected compressed frame"))
+						return
+					}
+					if b, err = c.w.deflate.decompress(b); err != nil {
+						slog.Error(err.Error())
+						continue
+					}
+				}
+				c.receive(b)
 				continue
 
 			case websocket.CloseFrame:
@@ -138,21 +461,43 @@ func (c *client) run() error {
 		}
 	}(ctx, cancel)
 
+	if c.opts.request != "" {
+		defer func() {
+			// 読み込みのエラーとしないよう、先に ctx を終了させる。
+			cancel(nil)
+			c.w.close(wire.CloseStatusNormal)
+		}()
+
+		res, err := c.request(ctx, "", c.opts.request, c.opts.requestTimeout)
+		if err != nil {
+			slog.Error(fmt.Sprintf("request: %s", err))
+			return err
+		}
+		fmt.Fprintln(c.output, res)
+
+		return nil
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
+			// CloseFrame を送信してから切断する。
+			c.w.close(wire.CloseStatusNormal)
 			return ctx.Err()
 		default:
 		}
 
-		if _, err := ws.Write([]byte(fmt.Sprintf("hello im %s", c.name))); err != nil {
-			slog.Error("ws.Write", err)
-			return fmt.Errorf("failed to ws.Write: %w", err)
+		if err := c.publish(strings.ReplaceAll(c.opts.message, "%s", c.name)); err != nil {
+			slog.Error(fmt.Sprintf("publish: %s", err))
+			return fmt.Errorf("failed to publish: %w", err)
 		}
 
 		// メッセージ送信のエミュレーション。
 		// ランダムな時間待機してから再度メッセージを送信する。
-		time.Sleep(time.Duration((rand.IntN(5) + 1)) * time.Second)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration((rand.IntN(5) + 1)) * time.Second):
+		}
 	}
 }
 
@@ -162,14 +507,72 @@ func main() {
 	topic := flag.String("topic", "topic", "The topic to subscribe to")
 	logLevel := flag.String("logLevel", defaultLogLevel.String(), "The log level")
 	name := flag.String("name", "john doe", "The name of the client")
+	filter := flag.String("filter", "", `The filter expression for received messages (e.g. 'type == "alert" && level >= 3')`)
+	message := flag.String("message", "hello im %s", "The message to publish (%s is replaced with the name)")
+	subprotocols := flag.String("subprotocols", protocolText, "Comma separated subprotocols to offer in order of preference (pubsub.v1.text, pubsub.v1.json, pubsub.v1.msgpack)")
+	echo := flag.Bool("echo", false, "Receive own messages marked as (self). Not supported on pubsub.v1.text")
+	delivery := flag.String("delivery", "at-most-once", "The delivery guarantee (at-most-once or at-least-once). at-least-once requires -session and is not supported on pubsub.v1.text")
+	session := flag.String("session", "", "The session ID to resume unacked messages on reconnect")
+	retain := flag.Bool("retain", false, "Publish messages as the retained message of the topic. Not supported on pubsub.v1.text")
+	willTopic := flag.String("willTopic", "", "The topic to publish the last will message to on abnormal disconnect")
+	willPayload := flag.String("willPayload", "", "The last will message")
+	willRetain := flag.Bool("willRetain", false, "Publish the last will message as the retained message")
+	request := flag.String("request", "", "Send the request to the topic, print the first reply and exit. Offers pubsub.v1.json by default")
+	requestTimeout := flag.Duration("requestTimeout", 5*time.Second, "The timeout to wait for the reply of -request")
+	respond := flag.Bool("respond", false, "Reply to the requests from other clients. Offers pubsub.v1.json by default")
+	to := flag.String("to", "", "Send messages directly to the client with the name instead of publishing. Offers pubsub.v1.json by default")
+	deflate := flag.Bool("deflate", false, "Offer permessage-deflate")
+	deflateOpts := deflateOptions{}
+	flag.BoolVar(&deflateOpts.serverNoContextTakeover, "deflateServerNoContextTakeover", false, "Request the server to reset the compression context for each message")
+	flag.BoolVar(&deflateOpts.clientNoContextTakeover, "deflateClientNoContextTakeover", false, "Reset the compression context for each message sent by the client")
+	flag.IntVar(&deflateOpts.minSize, "deflateMinSize", 256, "Messages smaller than this size in bytes are sent uncompressed")
+	batchInterval := flag.Duration("batchInterval", 0, "Let the server batch messages for up to this duration (e.g. 50ms, max 1s)")
+	batchSize := flag.Int("batchSize", 0, "The max number of messages in a batch (1-1000). Requires -batchInterval")
 	flag.Parse()
 
+	diag.Serve()
+
+	// request/reply とダイレクトメッセージは pubsub.v1.text では行えないため、
+	// subprotocol の指定がない場合は pubsub.v1.json を提示する。
+	if (*request != "" || *respond || *to != "") && *subprotocols == protocolText {
+		*subprotocols = protocolJSON
+	}
+
 	// logger の設定。
 	ll := defaultLogLevel
 	ll.UnmarshalText([]byte(*logLevel))
 	slog.SetLogLoggerLevel(ll)
 
 	// client の作成と実行。
-	cl := newClient(*hostPort, *topic, *name)
-	cl.run()
+	opts := clientOptions{
+		filter:       *filter,
+		message:      *message,
+		subprotocols: strings.Split(*subprotocols, ","),
+		echo:         *echo,
+		delivery:     *delivery,
+		session:      *session,
+		retain:       *retain,
+
+		willTopic:   *willTopic,
+		willPayload: *willPayload,
+		willRetain:  *willRetain,
+
+		request:        *request,
+		requestTimeout: *requestTimeout,
+		respond:        *respond,
+		to:             *to,
+
+		batchInterval: *batchInterval,
+		batchSize:     *batchSize,
+	}
+	if *deflate {
+		opts.deflate = &deflateOpts
+	}
+	cl := newClient(*hostPort, *topic, *name, opts)
+
+	// signal を受け取った場合は正常に切断する。
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	cl.run(ctx)
 }
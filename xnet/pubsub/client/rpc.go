@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errNoResponse は request の timeout までに reply がない場合のエラー。
+var errNoResponse = errors.New("no response")
+
+// newCorrelationID はリクエストと reply を対応付ける ID を生成する。
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// request は topic にリクエストを送信し、最初に返ってきた reply のペイロードを返す。
+//
+// 仕様:
+//
+//	topic が空の場合は接続している topic に送信する。
+//	timeout までに reply がない場合、またはサーバーからエラーが返ってきた場合はエラーを返す。
+//	2 つ目以降の reply は無視する。
+func (c *client) request(ctx context.Context, topic, payload string, timeout time.Duration) (string, error) {
+	id := newCorrelationID()
+	ch := make(chan message, 1)
+
+	c.pendingMu.Lock()
+	c.pending[id] = ch
+	c.pendingMu.Unlock()
+
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+	}()
+
+	if err := c.send(message{
+		Kind:          "request",
+		Topic:         topic,
+		Payload:       payload,
+		CorrelationID: id,
+	}); err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("request %s: %w", id, errNoResponse)
+		}
+		return "", ctx.Err()
+
+	case m := <-ch:
+		if m.Kind == "error" {
+			return "", fmt.Errorf("request %s: %s", id, m.Error)
+		}
+		return m.Payload, nil
+	}
+}
+
+// resolve は reply (またはエラー) を待っている request に渡す。
+// 待っている request がない場合は false を返す。
+func (c *client) resolve(m message) bool {
+	c.pendingMu.Lock()
+	ch, ok := c.pending[m.CorrelationID]
+	if ok {
+		delete(c.pending, m.CorrelationID)
+	}
+	c.pendingMu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	ch <- m
+	return true
+}
+
+// respond はリクエストに reply を返す。
+func (c *client) respond(req message) error {
+	return c.send(message{
+		Kind:          "reply",
+		ReplyTo:       req.ReplyTo,
+		CorrelationID: req.CorrelationID,
+		Payload:       fmt.Sprintf("re: %s (from %s)", req.Payload, c.name),
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ACL で許可する操作。
+const (
+	aclSubscribe = "subscribe"
+	aclPublish   = "publish"
+)
+
+// aclRule は topic と接続元ごとに許可する操作。
+//
+// 仕様:
+//
+//	topic は topic 名か、末尾の * による前方一致 (例: sensors.*)。* のみの場合は全ての topic に一致する。
+//	from は接続元の IP アドレスか CIDR。省略した場合は全ての接続元に一致する。
+//	allow は許可する操作 (subscribe, publish)。空の場合は何も許可しない。
+type aclRule struct {
+	Topic string   `json:"topic" yaml:"topic"`
+	From  []string `json:"from" yaml:"from"`
+	Allow []string `json:"allow" yaml:"allow"`
+}
+
+func (r aclRule) validate() error {
+	if r.Topic == "" {
+		return errors.New("topic must not be empty")
+	}
+	if i := strings.IndexByte(r.Topic, '*'); i >= 0 && i != len(r.Topic)-1 {
+		return fmt.Errorf("topic: * is only allowed at the end: %q", r.Topic)
+	}
+	if _, err := parsePrefixes(r.From); err != nil {
+		return err
+	}
+	for _, a := range r.Allow {
+		if a != aclSubscribe && a != aclPublish {
+			return fmt.Errorf("allow: unknown action %q (available: %s, %s)", a, aclSubscribe, aclPublish)
+		}
+	}
+
+	return nil
+}
+
+// parsePrefixes は IP アドレスか CIDR の一覧を netip.Prefix にする。
+func parsePrefixes(from []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(from))
+	for _, s := range from {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("from: invalid address or CIDR %q", s)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// acl は検証済みの aclRule の一覧。
+//
+// 仕様:
+//
+//	ルールは上から順に評価し、topic と接続元が一致した最初のルールの allow で決まる。
+//	一致するルールがない場合は拒否する。ルールが 1 つもない場合は全て許可する。
+type acl struct {
+	rules []compiledACLRule
+}
+
+type compiledACLRule struct {
+	topic  string
+	prefix bool
+	from   []netip.Prefix
+	allow  []string
+}
+
+// newACL は rules から acl を作る。rules は validate 済みであること。
+func newACL(rules []aclRule) *acl {
+	a := &acl{}
+	for _, r := range rules {
+		from, _ := parsePrefixes(r.From)
+		a.rules = append(a.rules, compiledACLRule{
+			topic:  strings.TrimSuffix(r.Topic, "*"),
+			prefix: strings.HasSuffix(r.Topic, "*"),
+			from:   from,
+			allow:  r.Allow,
+		})
+	}
+
+	return a
+}
+
+func (r compiledACLRule) match(topic string, addr netip.Addr) bool {
+	if r.prefix {
+		if !strings.HasPrefix(topic, r.topic) {
+			return false
+		}
+	} else if topic != r.topic {
+		return false
+	}
+
+	if len(r.from) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.from, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// allows は addr から接続したコネクションが topic に action を行えるかどうかを返す。
+// a が nil の場合は全て許可する。
+func (a *acl) allows(action, topic string, addr netip.Addr) bool {
+	if a == nil || len(a.rules) == 0 {
+		return true
+	}
+
+	for _, r := range a.rules {
+		if r.match(topic, addr) {
+			return slices.Contains(r.allow, action)
+		}
+	}
+
+	return false
+}
+
+// remoteAddr はリクエストの接続元の IP アドレスを返す。取得できない場合はゼロ値を返す。
+func remoteAddr(req *http.Request) netip.Addr {
+	ap, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	return ap.Addr().Unmap()
+}
+
+// allowed は sub が topic に action を行えるかどうかを、現在の ACL で判定する。
+// 許可されない場合はエラーを返す。
+func (h *handler) allowed(action, topic string, sub *subscriber) error {
+	if !h.acl.Load().allows(action, topic, sub.addr) {
+		return fmt.Errorf("%s to %s is not allowed", action, topic)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBatchSize は batchSize を指定しない場合に、1 回の flush でまとめるメッセージ数の上限。
+	defaultBatchSize = 64
+	// maxBatchSize は batchSize に指定できる上限。
+	maxBatchSize = 1000
+	// maxBatchInterval は batchInterval に指定できる上限。
+	maxBatchInterval = time.Second
+)
+
+// batchOptions は接続時に指定するバッチの設定。
+type batchOptions struct {
+	// interval は最初のメッセージをためてから flush するまでの時間。
+	interval time.Duration
+	// size は 1 回の flush でまとめるメッセージ数の上限。たまった時点で interval を待たずに flush する。
+	size int
+}
+
+// parseBatchOptions は batchInterval, batchSize のクエリパラメータから batchOptions を取り出す。
+// batchInterval を指定しない場合は nil を返す。
+func parseBatchOptions(interval, size string, f format) (*batchOptions, error) {
+	if interval == "" {
+		if size != "" {
+			return nil, errors.New("batchInterval is required for batchSize")
+		}
+		return nil, nil
+	}
+
+	// MQTT, STOMP はそれぞれのプロトコルでメッセージを送信するため、まとめられない。
+	if f == formatMQTT || f == formatSTOMP {
+		return nil, fmt.Errorf("batching is not supported on %s", f)
+	}
+
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid batchInterval: %w", err)
+	}
+	if d <= 0 || d > maxBatchInterval {
+		return nil, fmt.Errorf("batchInterval must be in (0, %s]: %s", maxBatchInterval, d)
+	}
+
+	opts := &batchOptions{interval: d, size: defaultBatchSize}
+	if size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid batchSize: %w", err)
+		}
+		if n < 1 || n > maxBatchSize {
+			return nil, fmt.Errorf("batchSize must be in [1, %d]: %d", maxBatchSize, n)
+		}
+		opts.size = n
+	}
+
+	return opts, nil
+}
+
+// batcher は subscriber への送信をまとめる。
+//
+// 仕様:
+//
+//	書き込んだフレームはすぐには flush せず、interval が経過するか size 件たまった時にまとめて flush する。
+//	message の形式でやり取りする場合、配信 (kindMessage) は kind: batch の 1 つのメッセージにまとめて送信する。
+//	それ以外のメッセージは、順序を保つためにそれまでにためた配信の後に送信する。
+//	PingFrame などの制御フレームはためずにすぐに送信する。
+type batcher struct {
+	mu     sync.Mutex
+	w      wsConn
+	format format
+	opts   batchOptions
+
+	// queued は kind: batch にまとめる配信。
+	queued []message
+	// pending は flush していないメッセージ数。
+	pending int
+
+	timer        *time.Timer
+	timerRunning bool
+	closed       bool
+}
+
+// newBatcher は w への書き込みをまとめる batcher を作る。
+// w はコネクションを使い始める前に渡すこと。
+func newBatcher(w wsConn, f format, opts batchOptions) *batcher {
+	b := &batcher{
+		w:      w,
+		format: f,
+		opts:   opts,
+	}
+	w.setCoalesce()
+	b.timer = time.AfterFunc(opts.interval, b.flushOnTimer)
+	b.timer.Stop()
+
+	return b
+}
+
+// send は m を送信するメッセージとしてためる。
+// write は m をまとめずに書き込む関数で、message の形式でない場合と、配信以外のメッセージの場合に呼ばれる。
+func (b *batcher) send(m message, write func() error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errConnClosed
+	}
+
+	if b.format.hasEnvelope() && m.Kind == kindMessage {
+		b.queued = append(b.queued, m)
+	} else {
+		if err := b.writeQueuedLocked(); err != nil {
+			return err
+		}
+		if err := write(); err != nil {
+			return err
+		}
+	}
+
+	b.pending++
+	if b.pending >= b.opts.size {
+		return b.flushLocked()
+	}
+	if !b.timerRunning {
+		b.timer.Reset(b.opts.interval)
+		b.timerRunning = true
+	}
+
+	return nil
+}
+
+// writeQueuedLocked はためた配信を 1 つのメッセージにまとめて書き込む。
+// 1 件のみの場合はまとめずにそのまま書き込む。b.mu を取得した状態で呼ぶ。
+func (b *batcher) writeQueuedLocked() error {
+	if len(b.queued) == 0 {
+		return nil
+	}
+
+	m := b.queued[0]
+	if len(b.queued) > 1 {
+		m = message{Kind: kindBatch, Messages: b.queued}
+	}
+	b.queued = nil
+
+	opcode, data, err := encodeMessage(b.format, m)
+	if err != nil {
+		return err
+	}
+
+	return b.w.writeMessage(opcode, data)
+}
+
+// flushLocked はためたメッセージを書き込み、コネクションに flush する。b.mu を取得した状態で呼ぶ。
+func (b *batcher) flushLocked() error {
+	if b.timerRunning {
+		b.timer.Stop()
+		b.timerRunning = false
+	}
+	if b.pending == 0 {
+		return nil
+	}
+	b.pending = 0
+
+	if err := b.writeQueuedLocked(); err != nil {
+		return err
+	}
+
+	return b.w.flush()
+}
+
+func (b *batcher) flushOnTimer() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Stop が間に合わなかった場合は、既に flush されている。
+	if !b.timerRunning || b.closed {
+		return
+	}
+
+	if err := b.flushLocked(); err != nil {
+		slog.Info(fmt.Sprintf("failed to flush batch: %s", err))
+	}
+}
+
+// close はためたメッセージを flush し、以降の送信を拒否する。
+func (b *batcher) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	err := b.flushLocked()
+	b.closed = true
+
+	return err
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config はサーバーの設定。-config で JSON か YAML のファイルを指定する。
+//
+// 仕様:
+//
+//	ファイルに書かなかった項目はデフォルト値になる。未知の項目がある場合はエラーにする。
+//	起動オプションを明示した場合は、ファイルの値より起動オプションを優先する。
+//	SIGHUP を受け取るとファイルを読み直し、再起動せずに変更できる項目 (reloadable) のみを反映する。
+//	それ以外の項目が変わっている場合は警告を出し、起動時の値を使い続ける。
+//	不正な設定の場合は何も反映せず、起動時はエラーで終了する。
+type config struct {
+	// Listen は待ち受けるアドレス。
+	Listen string `json:"listen" yaml:"listen"`
+	// LogLevel はログレベル。reloadable。
+	LogLevel string `json:"logLevel" yaml:"logLevel"`
+	// Transport は接続を受け付ける WebSocket のライブラリ。
+	Transport string `json:"transport" yaml:"transport"`
+	// TLS を設定した場合は wss で待ち受ける。
+	TLS tlsConfig `json:"tls" yaml:"tls"`
+	// Limits は接続とメッセージの上限。
+	Limits limitsConfig `json:"limits" yaml:"limits"`
+	// ACL は topic ごとの subscribe, publish の許可。reloadable。
+	ACL []aclRule `json:"acl" yaml:"acl"`
+	// Retention は topic と session を保持する時間。reloadable。
+	Retention retentionConfig `json:"retention" yaml:"retention"`
+	// Heartbeat は PingFrame の送信間隔と切断とみなすまでの時間。
+	Heartbeat heartbeatConfig `json:"heartbeat" yaml:"heartbeat"`
+	// Shutdown はシャットダウン時の振る舞い。reloadable。
+	Shutdown shutdownConfig `json:"shutdown" yaml:"shutdown"`
+}
+
+type tlsConfig struct {
+	CertFile string `json:"certFile" yaml:"certFile"`
+	KeyFile  string `json:"keyFile" yaml:"keyFile"`
+}
+
+// enabled は TLS で待ち受けるかどうか。
+func (c tlsConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+type limitsConfig struct {
+	// MaxConnections は同時に接続できるコネクション数。0 の場合は制限しない。reloadable。
+	MaxConnections int `json:"maxConnections" yaml:"maxConnections"`
+	// MaxPayloadSize は受け取るメッセージのペイロードの上限 (バイト)。
+	MaxPayloadSize int `json:"maxPayloadSize" yaml:"maxPayloadSize"`
+}
+
+type retentionConfig struct {
+	// TopicGracePeriod はコネクションのない topic と retained message を保持する時間。
+	TopicGracePeriod duration `json:"topicGracePeriod" yaml:"topicGracePeriod"`
+	// SessionTTL は切断された at-least-once の session を保持する時間。
+	SessionTTL duration `json:"sessionTTL" yaml:"sessionTTL"`
+}
+
+type heartbeatConfig struct {
+	Interval duration `json:"interval" yaml:"interval"`
+	Timeout  duration `json:"timeout" yaml:"timeout"`
+}
+
+type shutdownConfig struct {
+	// DrainDelay は /readyz を失敗させてからコネクションを閉じるまで待つ時間。
+	// ロードバランサーが新しい接続を振り分けなくなるよう、readiness probe の間隔より長くする。
+	DrainDelay duration `json:"drainDelay" yaml:"drainDelay"`
+}
+
+// duration は "10s" のような文字列で書く time.Duration。
+type duration time.Duration
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// defaultConfig は設定ファイルを指定しない場合の設定。
+func defaultConfig() config {
+	return config{
+		Listen:    hostPort,
+		LogLevel:  defaultLogLevel.String(),
+		Transport: "xnet",
+		Limits: limitsConfig{
+			MaxPayloadSize: defaultMaxPayloadSize,
+		},
+		Retention: retentionConfig{
+			TopicGracePeriod: duration(time.Minute),
+			SessionTTL:       duration(defaultSessionTTL),
+		},
+		Heartbeat: heartbeatConfig{
+			Interval: duration(defaultHeartbeatInterval),
+			Timeout:  duration(3 * defaultHeartbeatInterval),
+		},
+	}
+}
+
+// loadConfig は path の設定ファイルを base に上書きして読み込む。
+// 拡張子が .json の場合は JSON、.yaml, .yml の場合は YAML として読み込む。
+func loadConfig(path string, base config) (config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return config{}, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	c := base
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&c)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err = dec.Decode(&c); errors.Is(err, io.EOF) {
+			// 空のファイルはデフォルト値のみの設定とする。
+			err = nil
+		}
+	default:
+		return config{}, fmt.Errorf("unsupported config format %q: use .json, .yaml or .yml", ext)
+	}
+	if err != nil {
+		return config{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+// validate は設定の値を検証する。エラーには不正な項目の名前を含める。
+func (c config) validate() error {
+	var errs []error
+	invalid := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Listen == "" {
+		invalid("listen", "must not be empty")
+	}
+	var ll slog.Level
+	if err := ll.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		invalid("logLevel", "unknown level %q", c.LogLevel)
+	}
+	if _, ok := transports[c.Transport]; !ok {
+		invalid("transport", "unknown transport %q (available: %s)", c.Transport, strings.Join(transportNames(), ", "))
+	}
+
+	if c.TLS.enabled() {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			invalid("tls", "both certFile and keyFile are required")
+		} else if _, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile); err != nil {
+			invalid("tls", "failed to load key pair: %s", err)
+		}
+	}
+
+	if c.Limits.MaxConnections < 0 {
+		invalid("limits.maxConnections", "must not be negative: %d", c.Limits.MaxConnections)
+	}
+	if c.Limits.MaxPayloadSize <= 0 {
+		invalid("limits.maxPayloadSize", "must be positive: %d", c.Limits.MaxPayloadSize)
+	}
+
+	for i, r := range c.ACL {
+		if err := r.validate(); err != nil {
+			invalid(fmt.Sprintf("acl[%d]", i), "%s", err)
+		}
+	}
+
+	if c.Retention.TopicGracePeriod < 0 {
+		invalid("retention.topicGracePeriod", "must not be negative: %s", time.Duration(c.Retention.TopicGracePeriod))
+	}
+	if c.Retention.SessionTTL <= 0 {
+		invalid("retention.sessionTTL", "must be positive: %s", time.Duration(c.Retention.SessionTTL))
+	}
+
+	if c.Heartbeat.Interval <= 0 {
+		invalid("heartbeat.interval", "must be positive: %s", time.Duration(c.Heartbeat.Interval))
+	}
+	if c.Heartbeat.Timeout <= c.Heartbeat.Interval {
+		invalid("heartbeat.timeout", "must be longer than heartbeat.interval: %s", time.Duration(c.Heartbeat.Timeout))
+	}
+
+	if c.Shutdown.DrainDelay < 0 {
+		invalid("shutdown.drainDelay", "must not be negative: %s", time.Duration(c.Shutdown.DrainDelay))
+	}
+
+	return errors.Join(errs...)
+}
+
+// restartRequired は再起動しないと反映できない項目のうち、c と next で異なるものの名前を返す。
+func (c config) restartRequired(next config) []string {
+	var fields []string
+	if c.Listen != next.Listen {
+		fields = append(fields, "listen")
+	}
+	if c.Transport != next.Transport {
+		fields = append(fields, "transport")
+	}
+	if c.TLS != next.TLS {
+		fields = append(fields, "tls")
+	}
+	if c.Limits.MaxPayloadSize != next.Limits.MaxPayloadSize {
+		fields = append(fields, "limits.maxPayloadSize")
+	}
+	if c.Heartbeat != next.Heartbeat {
+		fields = append(fields, "heartbeat")
+	}
+
+	return fields
+}
+
+// reloadable は next のうち再起動せずに反映できる項目を c に上書きした設定を返す。
+func (c config) reloadable(next config) config {
+	c.LogLevel = next.LogLevel
+	c.Limits.MaxConnections = next.Limits.MaxConnections
+	c.ACL = slices.Clone(next.ACL)
+	c.Retention = next.Retention
+	c.Shutdown = next.Shutdown
+
+	return c
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"wire"
+)
+
+// permessage-deflate 拡張。
+// see: https://datatracker.ietf.org/doc/html/rfc7692
+//
+// 圧縮と展開は wire で行う。compress/flate は LZ77 のウィンドウサイズを指定できないため、
+// クライアントが server_max_window_bits に 15 未満を指定した場合は、拡張を受け入れた上でサーバーからは圧縮しない。
+
+// deflateStats は permessage-deflate による圧縮の統計。/debug/vars で公開する。
+//
+//	sent_raw, sent_compressed:         サーバーが圧縮して送信したメッセージの圧縮前後のバイト数
+//	received_raw, received_compressed: クライアントから圧縮されて届いたメッセージの展開後と展開前のバイト数
+//	sent_skipped:                      minSize 未満などで圧縮せずに送信したメッセージ数
+//	ratio:                             送受信を合わせた 圧縮後 / 圧縮前 の比率
+var deflateStats = expvar.NewMap("deflate")
+
+func init() {
+	deflateStats.Set("ratio", expvar.Func(func() any {
+		raw := statValue("sent_raw") + statValue("received_raw")
+		if raw == 0 {
+			return 0.0
+		}
+		return float64(statValue("sent_compressed")+statValue("received_compressed")) / float64(raw)
+	}))
+}
+
+func statValue(key string) int64 {
+	if v, ok := deflateStats.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// deflateConfig は permessage-deflate の設定。
+type deflateConfig struct {
+	// enabled は拡張を受け入れるかどうか。
+	enabled bool
+	// serverNoContextTakeover はサーバーからのメッセージごとに圧縮の状態をリセットするかどうか。
+	// メモリ使用量が減る代わりに圧縮率が下がる。
+	serverNoContextTakeover bool
+	// clientNoContextTakeover はクライアントにメッセージごとに圧縮の状態をリセットさせるかどうか。
+	clientNoContextTakeover bool
+	// clientMaxWindowBits はクライアントが圧縮に使うウィンドウサイズの上限 (8-15)。
+	// クライアントが client_max_window_bits を提示した場合のみ指定できる。
+	clientMaxWindowBits int
+	// minSize はこのバイト数未満のメッセージを圧縮せずに送信する。
+	minSize int
+}
+
+func (c deflateConfig) validate() error {
+	if c.clientMaxWindowBits < wire.DeflateMinWindowBits || c.clientMaxWindowBits > wire.DeflateMaxWindowBits {
+		return fmt.Errorf("client max window bits must be between %d and %d: %d", wire.DeflateMinWindowBits, wire.DeflateMaxWindowBits, c.clientMaxWindowBits)
+	}
+	if c.minSize < 0 {
+		return fmt.Errorf("min size must not be negative: %d", c.minSize)
+	}
+
+	return nil
+}
+
+// deflateParams は 1 つのコネクションで合意した permessage-deflate のパラメータ。
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	// serverMaxWindowBits, clientMaxWindowBits は 0 の場合は指定なし (15) を表す。
+	serverMaxWindowBits int
+	clientMaxWindowBits int
+}
+
+// String は Sec-WebSocket-Extensions のレスポンスに含める値を返す。
+func (p deflateParams) String() string {
+	s := []string{wire.DeflateExtension}
+	if p.serverNoContextTakeover {
+		s = append(s, "server_no_context_takeover")
+	}
+	if p.clientNoContextTakeover {
+		s = append(s, "client_no_context_takeover")
+	}
+	if p.serverMaxWindowBits != 0 {
+		s = append(s, fmt.Sprintf("server_max_window_bits=%d", p.serverMaxWindowBits))
+	}
+	if p.clientMaxWindowBits != 0 {
+		s = append(s, fmt.Sprintf("client_max_window_bits=%d", p.clientMaxWindowBits))
+	}
+
+	return strings.Join(s, "; ")
+}
+
+// negotiateDeflate はリクエストの Sec-WebSocket-Extensions から permessage-deflate のパラメータを決める。
+//
+// 仕様:
+//
+//	提示された順に、受け入れられる最初の offer を選ぶ。
+//	未知のパラメータや不正な値を含む offer は受け入れない。
+//	受け入れられる offer がない場合は ok が false になり、圧縮せずに接続する。
+func negotiateDeflate(header http.Header, config deflateConfig) (deflateParams, bool) {
+	if !config.enabled {
+		return deflateParams{}, false
+	}
+
+	for _, offer := range parseExtensions(header) {
+		if offer.name != wire.DeflateExtension {
+			continue
+		}
+		if p, err := acceptDeflateOffer(offer.params, config); err == nil {
+			return p, true
+		}
+	}
+
+	return deflateParams{}, false
+}
+
+// acceptDeflateOffer は 1 つの offer を検証し、レスポンスとするパラメータを返す。
+func acceptDeflateOffer(params map[string]string, config deflateConfig) (deflateParams, error) {
+	p := deflateParams{
+		serverNoContextTakeover: config.serverNoContextTakeover,
+		clientNoContextTakeover: config.clientNoContextTakeover,
+	}
+
+	for k, v := range params {
+		switch k {
+		case "server_no_context_takeover":
+			if v != "" {
+				return deflateParams{}, fmt.Errorf("%s must not have a value", k)
+			}
+			p.serverNoContextTakeover = true
+
+		case "client_no_context_takeover":
+			if v != "" {
+				return deflateParams{}, fmt.Errorf("%s must not have a value", k)
+			}
+			p.clientNoContextTakeover = true
+
+		case "server_max_window_bits":
+			bits, err := parseWindowBits(v)
+			if err != nil {
+				return deflateParams{}, fmt.Errorf("invalid %s: %w", k, err)
+			}
+			p.serverMaxWindowBits = bits
+
+		case "client_max_window_bits":
+			// 値がない場合は、クライアントがウィンドウサイズの指定に対応していることのみを表す。
+			// 展開は常に 15 bit のウィンドウで行えるため、設定で制限する場合のみレスポンスに含める。
+			bits := wire.DeflateMaxWindowBits
+			if v != "" {
+				var err error
+				if bits, err = parseWindowBits(v); err != nil {
+					return deflateParams{}, fmt.Errorf("invalid %s: %w", k, err)
+				}
+			}
+			if config.clientMaxWindowBits < wire.DeflateMaxWindowBits {
+				p.clientMaxWindowBits = min(bits, config.clientMaxWindowBits)
+			}
+
+		default:
+			return deflateParams{}, fmt.Errorf("unknown parameter: %s", k)
+		}
+	}
+
+	return p, nil
+}
+
+func parseWindowBits(v string) (int, error) {
+	bits, err := strconv.Atoi(strings.Trim(v, `"`))
+	if err != nil {
+		return 0, err
+	}
+	if bits < wire.DeflateMinWindowBits || bits > wire.DeflateMaxWindowBits {
+		return 0, fmt.Errorf("out of range: %d", bits)
+	}
+
+	return bits, nil
+}
+
+// extension は Sec-WebSocket-Extensions の 1 つの要素。
+type extension struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions は Sec-WebSocket-Extensions をパースする。
+// 同名のパラメータが重複する要素は不正なものとして読み飛ばす。
+func parseExtensions(header http.Header) []extension {
+	var exts []extension
+
+	for _, v := range header.Values(wire.ExtensionsHeader) {
+	offers:
+		for _, offer := range strings.Split(v, ",") {
+			parts := strings.Split(offer, ";")
+			ext := extension{
+				name:   strings.TrimSpace(parts[0]),
+				params: make(map[string]string),
+			}
+			if ext.name == "" {
+				continue
+			}
+
+			for _, param := range parts[1:] {
+				k, v, _ := strings.Cut(param, "=")
+				k = strings.TrimSpace(k)
+				if _, ok := ext.params[k]; ok {
+					continue offers
+				}
+				ext.params[k] = strings.TrimSpace(v)
+			}
+
+			exts = append(exts, ext)
+		}
+	}
+
+	return exts
+}
+
+// deflater はコネクションごとの圧縮と展開の状態。
+//
+// 注意)
+//   - compress は frameWriter のロック中に、decompress は読み込みの goroutine からのみ呼ぶこと。
+type deflater struct {
+	params  deflateParams
+	minSize int
+
+	c wire.Compressor
+	d wire.Decompressor
+}
+
+func newDeflater(p deflateParams, minSize int) *deflater {
+	return &deflater{
+		params:  p,
+		minSize: minSize,
+		c:       wire.Compressor{NoContextTakeover: p.serverNoContextTakeover},
+		d:       wire.Decompressor{NoContextTakeover: p.clientNoContextTakeover},
+	}
+}
+
+// shouldCompress は size バイトのメッセージを圧縮して送信するかどうかを返す。
+// 15 未満のウィンドウサイズでは圧縮できないため、圧縮せずに送信する。
+func (d *deflater) shouldCompress(size int) bool {
+	return size >= d.minSize && (d.params.serverMaxWindowBits == 0 || d.params.serverMaxWindowBits >= wire.DeflateMaxWindowBits)
+}
+
+// compress は payload を圧縮する。
+// 圧縮しない場合は ok が false になり、payload をそのまま送信する必要がある。
+func (d *deflater) compress(payload []byte) (compressed []byte, ok bool, err error) {
+	if !d.shouldCompress(len(payload)) {
+		deflateStats.Add("sent_skipped", 1)
+		return nil, false, nil
+	}
+
+	if compressed, err = d.c.Compress(payload); err != nil {
+		return nil, false, err
+	}
+
+	deflateStats.Add("sent_raw", int64(len(payload)))
+	deflateStats.Add("sent_compressed", int64(len(compressed)))
+
+	return compressed, true, nil
+}
+
+// decompress は圧縮されたメッセージを展開する。
+// 展開後のサイズが limit を超える場合は errPayloadTooLarge を返す。
+func (d *deflater) decompress(compressed []byte, limit int) ([]byte, error) {
+	payload, err := d.d.Decompress(compressed, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	deflateStats.Add("received_raw", int64(len(payload)))
+	deflateStats.Add("received_compressed", int64(len(compressed)))
+
+	return payload, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	errNameRequired     = errors.New("name is required")
+	errNameTaken        = errors.New("name is already taken")
+	errAlreadyHello     = errors.New("hello is already done")
+	errHelloRequired    = errors.New("hello is required before sending direct messages")
+	errRecipientOffline = errors.New("recipient is offline")
+)
+
+// hello はコネクションに一意な名前を登録する。
+//
+// 仕様:
+//
+//	登録に成功した場合は、同じ name の hello を返す。
+//	名前が使用中の場合、既に登録済みの場合はエラーを返す。
+//	名前はコネクションの切断時に解放される。
+func (h *handler) hello(m message, sub *subscriber) error {
+	if err := h.registerName(m.Name, sub); err != nil {
+		return sub.send(message{
+			Kind:  kindError,
+			Name:  m.Name,
+			Error: err.Error(),
+		})
+	}
+
+	slog.Info(fmt.Sprintf("hello from %s", m.Name))
+
+	return sub.send(message{Kind: kindHello, Name: m.Name})
+}
+
+// registerName は名前とコネクションを紐付ける。
+func (h *handler) registerName(name string, sub *subscriber) error {
+	if name == "" {
+		return errNameRequired
+	}
+
+	h.namesMu.Lock()
+	defer h.namesMu.Unlock()
+
+	if sub.name != "" {
+		return errAlreadyHello
+	}
+
+	if _, ok := h.names[name]; ok {
+		return fmt.Errorf("%w: %s", errNameTaken, name)
+	}
+
+	h.names[name] = sub
+	sub.name = name
+
+	return nil
+}
+
+// unregisterName はコネクションの名前を解放する。
+func (h *handler) unregisterName(sub *subscriber) {
+	h.namesMu.Lock()
+	defer h.namesMu.Unlock()
+
+	if sub.name != "" && h.names[sub.name] == sub {
+		delete(h.names, sub.name)
+	}
+}
+
+// direct は to の名前を持つコネクションにメッセージを送信する。
+//
+// 仕様:
+//
+//	送信元は hello で名前を登録している必要がある。
+//	宛先が接続していない場合は、送信元にエラーを返す。
+func (h *handler) direct(m message, sender *subscriber) error {
+	h.namesMu.RLock()
+	from := sender.name
+	recipient, ok := h.names[m.To]
+	h.namesMu.RUnlock()
+
+	if from == "" {
+		return sender.send(message{Kind: kindError, To: m.To, Error: errHelloRequired.Error()})
+	}
+
+	if !ok {
+		return sender.send(message{
+			Kind:  kindError,
+			To:    m.To,
+			Error: fmt.Sprintf("%s: %s", errRecipientOffline, m.To),
+		})
+	}
+
+	return recipient.send(message{
+		Kind:    kindDirect,
+		From:    from,
+		Payload: m.Payload,
+	})
+}
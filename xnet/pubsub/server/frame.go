@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+
+	"wire"
+)
+
+var (
+	errConnClosed = errors.New("connection already closed")
+	errCloseFrame = errors.New("CloseFrame received")
+)
+
+// rawConn は websocket.Server が Hijack したコネクション。
+//
+// websocket.Conn の書き込みでは RSV ビットを指定できないため、
+// permessage-deflate で圧縮したフレームを書き込めるよう、書き込みはこのコネクションに直接行う。
+// gobwas の transport も、アップグレードしたコネクションに同じ方法で書き込む。
+type rawConn struct {
+	conn net.Conn
+	buf  *bufio.ReadWriter
+}
+
+type rawConnKey struct{}
+
+// hijackRecorder は Hijack したコネクションを rawConn に記録する http.ResponseWriter。
+type hijackRecorder struct {
+	http.ResponseWriter
+	raw *rawConn
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := r.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.raw.conn = conn
+	r.raw.buf = buf
+
+	return conn, buf, nil
+}
+
+// recordHijack は next が Hijack したコネクションを、リクエストの context から取り出せるようにする。
+func recordHijack(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := &rawConn{}
+		r = r.WithContext(context.WithValue(r.Context(), rawConnKey{}, raw))
+
+		next.ServeHTTP(&hijackRecorder{ResponseWriter: w, raw: raw}, r)
+	})
+}
+
+// rawConnFrom はリクエストに紐づく Hijack 済みのコネクションを返す。
+func rawConnFrom(req *http.Request) (*rawConn, bool) {
+	raw, ok := req.Context().Value(rawConnKey{}).(*rawConn)
+	if !ok || raw.conn == nil {
+		return nil, false
+	}
+
+	return raw, true
+}
+
+// frameWriter はフレームをコネクションに直接書き込む。
+//
+// 注意)
+//   - 同じコネクションへの書き込みは全て frameWriter から行うこと。
+//     websocket.Conn から書き込むと、フレームが混ざる可能性がある。
+type frameWriter struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	c      io.Closer
+	closed bool
+
+	// deflate は permessage-deflate の状態。nil の場合は圧縮しない。
+	deflate *deflater
+	// coalesce が true の場合、データフレームは書き込むだけで flush せず、flush の呼び出しでまとめて送信する。
+	// batcher が setCoalesce で設定する。
+	coalesce bool
+}
+
+func newFrameWriter(raw *rawConn, d *deflater) *frameWriter {
+	return &frameWriter{
+		w:       raw.buf.Writer,
+		c:       raw.conn,
+		deflate: d,
+	}
+}
+
+// writeFrame はロックを取得した状態で 1 つのフレームを書き込む。
+func (fw *frameWriter) writeFrame(opcode byte, rsv1 bool, payload []byte) error {
+	if fw.closed {
+		return errConnClosed
+	}
+
+	var header [14]byte
+	if _, err := fw.w.Write(wire.AppendFrameHeader(header[:0], opcode, rsv1, len(payload))); err != nil {
+		return err
+	}
+	if _, err := fw.w.Write(payload); err != nil {
+		return err
+	}
+
+	return fw.flushLocked(opcode)
+}
+
+// flushLocked は opcode のフレームを書き込んだ後に、ロックを取得した状態で flush する。
+// coalesce の場合、データフレームは flush しない。制御フレームはためているフレームと共にすぐに送信する。
+func (fw *frameWriter) flushLocked(opcode byte) error {
+	if fw.coalesce && opcode < websocket.CloseFrame {
+		return nil
+	}
+
+	return fw.w.Flush()
+}
+
+// setCoalesce は以降のデータフレームを flush の呼び出しまでまとめて送信する。
+func (fw *frameWriter) setCoalesce() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.coalesce = true
+}
+
+// flush は書き込んだフレームをコネクションに送信する。
+func (fw *frameWriter) flush() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.closed {
+		return errConnClosed
+	}
+
+	return fw.w.Flush()
+}
+
+// writeMessage は TextFrame か BinaryFrame を書き込む。
+// permessage-deflate が有効な場合は圧縮して書き込む。
+func (fw *frameWriter) writeMessage(opcode byte, payload []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.deflate != nil {
+		compressed, ok, err := fw.deflate.compress(payload)
+		if err != nil {
+			return fmt.Errorf("failed to compress: %w", err)
+		}
+		if ok {
+			return fw.writeFrame(opcode, true, compressed)
+		}
+	}
+
+	return fw.writeFrame(opcode, false, payload)
+}
+
+// writePrepared は preparedMessage を f の形式で書き込む。
+// エンコード済みのフレームをそのまま書き込むため、subscriber ごとのエンコードは行わない。
+func (fw *frameWriter) writePrepared(pm *preparedMessage, f format) error {
+	p, err := pm.framesFor(f)
+	if err != nil {
+		return err
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.closed {
+		return errConnClosed
+	}
+
+	frame := p.raw
+	if d := fw.deflate; d != nil {
+		if !d.shouldCompress(len(p.payload)) {
+			deflateStats.Add("sent_skipped", 1)
+		} else if !d.params.serverNoContextTakeover {
+			// context takeover では圧縮の状態がコネクションごとに異なるため、ここで圧縮する。
+			compressed, _, err := d.compress(p.payload)
+			if err != nil {
+				return fmt.Errorf("failed to compress: %w", err)
+			}
+			return fw.writeFrame(p.opcode, true, compressed)
+		} else {
+			if frame, err = p.compressedFrame(); err != nil {
+				return fmt.Errorf("failed to compress: %w", err)
+			}
+			deflateStats.Add("sent_raw", int64(len(p.payload)))
+			deflateStats.Add("sent_compressed", int64(p.compressedSize))
+		}
+	}
+
+	if _, err := fw.w.Write(frame); err != nil {
+		return err
+	}
+
+	return fw.flushLocked(p.opcode)
+}
+
+// writeControl は PingFrame や PongFrame などの制御フレームを書き込む。
+// 制御フレームは圧縮しない。
+func (fw *frameWriter) writeControl(opcode byte, payload []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	return fw.writeFrame(opcode, false, payload)
+}
+
+// ping は PingFrame を書き込む。
+func (fw *frameWriter) ping() error {
+	return fw.writeControl(websocket.PingFrame, pingPayload)
+}
+
+// close は CloseFrame を書き込んでからコネクションを閉じる。
+// 2 回目以降の呼び出しでは何もしない。
+func (fw *frameWriter) close(status uint16) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.closed {
+		return nil
+	}
+
+	payload := binary.BigEndian.AppendUint16(nil, status)
+	err := fw.writeFrame(websocket.CloseFrame, false, payload)
+	fw.closed = true
+
+	return errors.Join(err, fw.c.Close())
+}
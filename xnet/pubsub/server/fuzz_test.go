@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"wire"
+	"wstest"
+)
+
+// fuzz のテスト。
+//
+// memo.md の「文字化け」のように、フレームの読み込みがずれると、後続のフレームのヘッダーやペイロードを取り違える。
+// ここでは任意のバイト列をサーバーの読み込みとデコーダーに与え、panic しないこと、ずれないこと、上限を超えないことを確認する。
+// 見つかった入力は testdata/fuzz に保存し、go test で毎回実行する。
+//
+//	go test -run='^$' -fuzz=FuzzReadLoop -fuzztime=1m
+
+// fuzzMaxPayloadSize は fuzz で使う maxPayloadSize。上限を超えるメッセージも生成できるよう小さくする。
+const fuzzMaxPayloadSize = 1024
+
+// fuzzMaxFrames は 1 つの入力から作るフレーム数の上限。
+const fuzzMaxFrames = 32
+
+// fuzzSentinel は fuzz のフレームの後に送る TextFrame のペイロード。
+const fuzzSentinel = "fuzz-sentinel"
+
+// fuzzFrames は data をフレームの列として解釈する。
+//
+// 仕様:
+//
+//	フレームの長さは常に実際のペイロードと一致させ、FIN, RSV, opcode, マスクの有無とペイロードを任意にする。
+//	1 byte 目はフレームの 1 byte 目 (FIN, RSV, opcode) と同じ。
+//	2 byte 目の最上位ビットが 1 の場合はマスクしない。下位 7 bit はペイロードの長さで、127 の場合は続く 2 byte の
+//	  (長さ / 64, 繰り返すバイト) でペイロードを作る。maxPayloadSize を超えるメッセージを作るため。
+//	data がフレームの途中で終わる場合は、残りをペイロードにする。
+func fuzzFrames(data []byte) []wstest.Frame {
+	var frames []wstest.Frame
+	for len(data) >= 2 && len(frames) < fuzzMaxFrames {
+		f := wstest.Frame{
+			Fin:    data[0]&0x80 != 0,
+			RSV:    data[0] & 0x70,
+			Opcode: data[0] & 0x0f,
+			Masked: data[1]&0x80 == 0,
+		}
+		n := int(data[1] & 0x7f)
+		data = data[2:]
+
+		if n == 127 {
+			if len(data) < 2 {
+				break
+			}
+			f.Payload = bytes.Repeat(data[1:2], int(data[0])*64)
+			data = data[2:]
+		} else {
+			n = min(n, len(data))
+			f.Payload, data = data[:n], data[n:]
+		}
+		frames = append(frames, f)
+	}
+
+	return frames
+}
+
+// fuzzInput は frames を fuzzFrames で読み込める入力にする。seed の作成に使う。
+// 127 byte 以上のペイロードは、先頭のバイトを繰り返した 64 の倍数の長さにする。
+func fuzzInput(frames ...wstest.Frame) []byte {
+	var b []byte
+	for _, f := range frames {
+		first := f.RSV | f.Opcode
+		if f.Fin {
+			first |= 0x80
+		}
+		b = append(b, first)
+
+		var unmasked byte
+		if !f.Masked {
+			unmasked = 0x80
+		}
+		if len(f.Payload) < 127 {
+			b = append(b, unmasked|byte(len(f.Payload)))
+			b = append(b, f.Payload...)
+			continue
+		}
+		b = append(b, unmasked|127, byte(len(f.Payload)/64), f.Payload[0])
+	}
+
+	return b
+}
+
+// fuzzMessages は frames を受信したサーバーが publish してよいメッセージを、データメッセージごとに返す。
+// 分割されたメッセージは結合したものに加え、最初のフレームのみも許す (x/net/websocket は最初のフレームしか読まない)。
+func fuzzMessages(frames []wstest.Frame) [][][]byte {
+	var (
+		msgs       [][][]byte
+		cur        []byte
+		inProgress bool
+	)
+	for _, f := range frames {
+		switch f.Opcode {
+		case wstest.OpText, wstest.OpBinary:
+			msgs = append(msgs, [][]byte{f.Payload})
+			cur, inProgress = slices.Clone(f.Payload), !f.Fin
+
+		case wstest.OpContinuation:
+			if !inProgress {
+				continue
+			}
+			cur = append(cur, f.Payload...)
+			if f.Fin {
+				msgs[len(msgs)-1] = append(msgs[len(msgs)-1], cur)
+				inProgress = false
+			}
+		}
+	}
+
+	return msgs
+}
+
+// handlerGuard は WebSocket のハンドラーの終了を待ち、panic を記録する。
+// net/http はハンドラーの panic を recover してコネクションを閉じるだけのため、テストから検出できるようにする。
+type handlerGuard struct {
+	wg sync.WaitGroup
+
+	mu     sync.Mutex
+	panics []string
+}
+
+func (g *handlerGuard) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		g.wg.Add(1)
+		defer g.wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				g.mu.Lock()
+				g.panics = append(g.panics, fmt.Sprintf("%v\n%s", r, debug.Stack()))
+				g.mu.Unlock()
+			}
+		}()
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// wait はハンドラーが全て終了するまで timeout まで待ち、記録した panic をエラーとして返す。
+func (g *handlerGuard) wait(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return fmt.Errorf("handlers did not return within %s after the connections were closed", timeout)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.panics) > 0 {
+		return fmt.Errorf("handler panicked: %s", g.panics[0])
+	}
+
+	return nil
+}
+
+// fuzzServer は 1 つの transport の pubsub サーバー。
+type fuzzServer struct {
+	transport string
+	s         *wstest.Server
+	h         *handler
+	guard     *handlerGuard
+}
+
+// readLoop は frames を送信し、サーバーの読み込みがずれていないことを確認する。
+//
+// 仕様:
+//
+//	送信用と受信用のコネクションを同じ topic に接続し、送信用のコネクションから frames と fuzzSentinel を送る。
+//	受信用のコネクションに届くメッセージは、送った順に fuzzMessages のいずれかと一致し、maxPayloadSize 以下である必要がある。
+//	サーバーは fuzzSentinel を届けるか、送信用のコネクションを閉じる必要がある。どちらもない場合は読み込みがずれている。
+func (fs *fuzzServer) readLoop(t *testing.T, frames []wstest.Frame) {
+	const topic = "fuzz"
+	recv := wstest.Dial(t, fs.s.URL("/"+topic), string(formatText))
+	send := wstest.Dial(t, fs.s.URL("/"+topic), string(formatText))
+	waitJoined(t, fs.h, topic, 2)
+
+	// サーバーが送信用のコネクションを閉じたことを検出する。
+	// CloseFrame を受信した場合は CloseFrame を返し、閉じられたとみなす。
+	closed := make(chan struct{})
+	send.Timeout = time.Minute
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := send.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	sentinel := wstest.Text(fuzzSentinel)
+	sentinel.Masked = true
+	for _, f := range append(slices.Clone(frames), sentinel) {
+		// サーバーが閉じた後の書き込みは失敗する。
+		var err error
+		if f.Masked {
+			err = send.WriteFrame(f)
+		} else {
+			err = send.WriteRaw(wstest.AppendFrame(nil, f))
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	want := fuzzMessages(frames)
+	next := 0
+	recv.Timeout = 20 * time.Millisecond
+	deadline := time.Now().Add(wstest.DefaultTimeout)
+	for {
+		_, payload, err := recv.ReadMessage()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// コネクションを失敗させた場合、fuzzSentinel は届かない。
+			if isClosed(closed) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %s was not delivered and the connection is still open", fs.transport, fuzzSentinel)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to receive: %s", fs.transport, err)
+		}
+
+		if len(payload) > maxPayloadSize {
+			t.Fatalf("%s: got %d bytes message, limit is %d", fs.transport, len(payload), maxPayloadSize)
+		}
+		if string(payload) == fuzzSentinel {
+			break
+		}
+		i := slices.IndexFunc(want[next:], func(candidates [][]byte) bool {
+			return slices.ContainsFunc(candidates, func(c []byte) bool { return bytes.Equal(c, payload) })
+		})
+		if i < 0 {
+			t.Fatalf("%s: got unexpected message %q (desync?)", fs.transport, payload)
+		}
+		next += i + 1
+	}
+
+	send.Close()
+	recv.Close()
+	<-closed
+	if err := fs.guard.wait(wstest.DefaultTimeout); err != nil {
+		t.Fatalf("%s: %s", fs.transport, err)
+	}
+}
+
+// isClosed は c が閉じられているかどうかを返す。
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// FuzzReadLoop は全ての transport で、任意のフレームの列を受信した後もメッセージの区切りがずれないことを確認する。
+func FuzzReadLoop(f *testing.F) {
+	// クライアントのフレームはマスクする。
+	masked := func(frames ...wstest.Frame) []wstest.Frame {
+		for i := range frames {
+			frames[i].Masked = true
+		}
+		return frames
+	}
+	seeds := [][]wstest.Frame{
+		masked(wstest.Text("hello")),
+		// memo.md: PingFrame のペイロードを読み残すと、後続のフレームを取り違える。
+		masked(wstest.Ping([]byte("ping payload")), wstest.Text("hello im minami"), wstest.Text("hello im ore")),
+		masked(wstest.Pong([]byte("unsolicited")), wstest.Binary([]byte{0xce, 0xba, 0xff})),
+		masked(wstest.Fragments(wstest.OpText, []byte("fragmented message"), 3)...),
+		masked(wstest.Frame{Opcode: wstest.OpText, Payload: []byte("frag")}, wstest.Ping(nil), wstest.Frame{Fin: true, Opcode: wstest.OpContinuation, Payload: []byte("ment")}),
+		masked(wstest.Frame{Fin: true, Opcode: wstest.OpContinuation, Payload: []byte("orphan")}, wstest.Text("after")),
+		masked(wstest.Text(string(bytes.Repeat([]byte{'x'}, 2*fuzzMaxPayloadSize))), wstest.Text("after too large")),
+		masked(wstest.Frame{Fin: true, RSV: wstest.RSV1, Opcode: wstest.OpText, Payload: []byte("compressed?")}),
+		masked(wstest.Frame{Fin: true, Opcode: 0x3, Payload: []byte("reserved")}, wstest.Text("after")),
+		{wstest.Text("unmasked")},
+		masked(wstest.Close(wire.CloseStatusNormal, ""), wstest.Text("after close")),
+	}
+	for _, frames := range seeds {
+		f.Add(fuzzInput(frames...))
+	}
+
+	var servers []*fuzzServer
+	for _, transport := range transportNames() {
+		cfg := defaultConfig()
+		cfg.Transport = transport
+		cfg.LogLevel = "ERROR"
+		cfg.Limits.MaxPayloadSize = fuzzMaxPayloadSize
+
+		guard := &handlerGuard{}
+		s, h := startServerConfig(f, cfg, guard.wrap)
+		servers = append(servers, &fuzzServer{transport: transport, s: s, h: h, guard: guard})
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frames := fuzzFrames(data)
+		for _, s := range servers {
+			s.readLoop(t, frames)
+		}
+	})
+}
+
+// FuzzDecodeMessage は pubsub.v1.json, pubsub.v1.msgpack のデコードが panic せず、
+// デコードできたメッセージはエンコードとデコードを繰り返しても変わらないことを確認する。
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte(`{"kind":"publish","payload":"hello"}`))
+	f.Add([]byte(`{"kind":"batch","messages":[{"kind":"message","payload":"a"},{"kind":"message"}]}`))
+	f.Add([]byte(`{"kind":"publish","payload":"\xce\xba\xff"}`))
+	for _, m := range []message{
+		{Kind: kindPublish, Topic: "news", Payload: "hello", Retain: true},
+		{Kind: kindBatch, Messages: []message{{Kind: kindMessage, Payload: "a", ID: "1"}}},
+	} {
+		b, err := wire.MarshalMsgpack(m)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, format := range []format{formatJSON, formatMsgpack} {
+			sub := &subscriber{format: format}
+			m, err := sub.decodeMessage(data)
+			if err != nil {
+				continue
+			}
+
+			_, b, err := encodeMessage(format, m)
+			if err != nil {
+				t.Fatalf("%s: failed to encode decoded message %+v: %s", format, m, err)
+			}
+			m2, err := sub.decodeMessage(b)
+			if err != nil {
+				t.Fatalf("%s: failed to decode encoded message %q: %s", format, b, err)
+			}
+			_, b2, err := encodeMessage(format, m2)
+			if err != nil {
+				t.Fatalf("%s: failed to encode message %+v: %s", format, m2, err)
+			}
+			if !bytes.Equal(b, b2) {
+				t.Fatalf("%s: encoding is not stable: %q != %q", format, b, b2)
+			}
+		}
+	})
+}
+
+// chunkConn は chunks を 1 つずつデータメッセージとして返す wsConn。chunks がなくなると io.EOF を返す。
+// readMessage 以外は使わない。
+type chunkConn struct {
+	wsConn
+	opcode byte
+	chunks [][]byte
+}
+
+func (c *chunkConn) readMessage(time.Duration) (byte, []byte, error) {
+	if len(c.chunks) == 0 {
+		return 0, nil, io.EOF
+	}
+	b := c.chunks[0]
+	c.chunks = c.chunks[1:]
+
+	return c.opcode, b, nil
+}
+
+// splitChunks は data を size byte ずつに分ける。size が 0 の場合は分けない。
+func splitChunks(data []byte, size int) [][]byte {
+	if size == 0 {
+		return [][]byte{data}
+	}
+
+	var chunks [][]byte
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+
+	return append(chunks, data)
+}
+
+// setFuzzMaxPayloadSize はテストの間 maxPayloadSize を fuzzMaxPayloadSize にする。
+func setFuzzMaxPayloadSize(f *testing.F) {
+	prev := maxPayloadSize
+	maxPayloadSize = fuzzMaxPayloadSize
+	f.Cleanup(func() { maxPayloadSize = prev })
+}
+
+// FuzzMQTTPackets は MQTT のパケットの区切りが、データがどのように WebSocket のメッセージに分割されても同じになることを確認する。
+func FuzzMQTTPackets(f *testing.F) {
+	setFuzzMaxPayloadSize(f)
+
+	connect := appendMQTTPacket(nil, mqttConnect, 0, []byte("\x00\x04MQTT\x04\x02\x00\x3c\x00\x03abc"))
+	publish := appendMQTTPacket(nil, mqttPublish, 0x02, []byte("\x00\x04news\x00\x01hello"))
+	f.Add(append(slices.Clone(connect), publish...), uint8(1))
+	f.Add(append(slices.Clone(publish), 0x30, 0xff, 0xff, 0xff, 0x7f), uint8(3))
+	f.Add([]byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}, uint8(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, size uint8) {
+		read := func(size int) ([]mqttPacket, error) {
+			c := &mqttConn{sub: &subscriber{w: &chunkConn{opcode: websocket.BinaryFrame, chunks: splitChunks(data, size)}}}
+			var pkts []mqttPacket
+			for {
+				pkt, err := c.next(time.Second)
+				if err != nil {
+					return pkts, err
+				}
+				if len(pkt.body) > maxPayloadSize {
+					t.Fatalf("got %d bytes packet, limit is %d", len(pkt.body), maxPayloadSize)
+				}
+				if pkt.typ == mqttConnect {
+					// CONNECT のデコードは panic しない。
+					parseMQTTConnect(pkt.body)
+				}
+				pkts = append(pkts, pkt)
+			}
+		}
+
+		whole, wholeErr := read(0)
+		split, splitErr := read(int(size))
+		if !slices.EqualFunc(whole, split, func(a, b mqttPacket) bool {
+			return a.typ == b.typ && a.flags == b.flags && bytes.Equal(a.body, b.body)
+		}) {
+			t.Fatalf("got %d packets in %d byte chunks, want %d", len(split), size, len(whole))
+		}
+		if errors.Is(wholeErr, io.EOF) != errors.Is(splitErr, io.EOF) {
+			t.Fatalf("got %v in %d byte chunks, want %v", splitErr, size, wholeErr)
+		}
+	})
+}
+
+// FuzzSTOMPFrames は STOMP のフレームの区切りが、データがどのように WebSocket のメッセージに分割されても同じになることを確認する。
+func FuzzSTOMPFrames(f *testing.F) {
+	setFuzzMaxPayloadSize(f)
+
+	connect := appendSTOMPFrame(nil, "CONNECT", [][2]string{{"accept-version", "1.2"}, {"host", "localhost"}}, nil)
+	send := appendSTOMPFrame(nil, "SEND", [][2]string{{"destination", "/topic/news"}}, []byte("hello\x00world"))
+	f.Add(append(append(slices.Clone(connect), '\n', '\n'), send...), uint8(1))
+	f.Add([]byte("SEND\r\ndestination:/topic/news\r\n\r\nhello\x00"), uint8(5))
+	f.Add([]byte("SEND\ncontent-length:-1\n\n\x00"), uint8(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, size uint8) {
+		read := func(size int) ([]stompFrame, error) {
+			c := &stompConn{sub: &subscriber{w: &chunkConn{opcode: websocket.TextFrame, chunks: splitChunks(data, size)}}}
+			var frames []stompFrame
+			for {
+				f, err := c.next(time.Second)
+				if err != nil {
+					return frames, err
+				}
+				if len(f.body) > maxPayloadSize {
+					t.Fatalf("got %d bytes body, limit is %d", len(f.body), maxPayloadSize)
+				}
+				frames = append(frames, f)
+			}
+		}
+
+		whole, wholeErr := read(0)
+		split, splitErr := read(int(size))
+		if !slices.EqualFunc(whole, split, func(a, b stompFrame) bool {
+			return a.command == b.command && slices.Equal(a.headers, b.headers) && bytes.Equal(a.body, b.body)
+		}) {
+			t.Fatalf("got %d frames in %d byte chunks, want %d", len(split), size, len(whole))
+		}
+		if errors.Is(wholeErr, io.EOF) != errors.Is(splitErr, io.EOF) {
+			t.Fatalf("got %v in %d byte chunks, want %v", splitErr, size, wholeErr)
+		}
+	})
+}
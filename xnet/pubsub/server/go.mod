@@ -2,4 +2,26 @@ module xnet-server
 
 go 1.22
 
-require golang.org/x/net v0.24.0
+require (
+	github.com/gobwas/ws v1.2.0
+	github.com/gorilla/websocket v1.5.0
+	golang.org/x/net v0.24.0
+	gopkg.in/yaml.v3 v3.0.1
+	nhooyr.io/websocket v1.8.7
+	wire v0.0.0
+	wstest v0.0.0
+)
+
+require (
+	diag v0.0.0
+	github.com/gobwas/httphead v0.1.0 // indirect
+	github.com/gobwas/pool v0.2.1 // indirect
+	github.com/klauspost/compress v1.10.3 // indirect
+	golang.org/x/sys v0.19.0 // indirect
+)
+
+replace wstest => ../../../wstest
+
+replace diag => ../../../diag
+
+replace wire => ../../../wire
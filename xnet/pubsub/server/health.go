@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var errDraining = errors.New("server is shutting down")
+
+// readiness は新しい接続を受け付けられるかどうかの状態。
+//
+// 仕様:
+//
+//	シャットダウンの drain 中は準備ができていないとする。
+//	topic, retained message, session は全てプロセスのメモリ上に保持し、外部のブローカーやストレージに依存しない。
+//	そのため、drain 中でなければ常に準備ができているとする。
+type readiness struct {
+	draining atomic.Bool
+}
+
+// drain は以降の確認を失敗させ、新しい接続を受け付けないようにする。
+func (r *readiness) drain() {
+	r.draining.Store(true)
+}
+
+// check は準備ができていない場合にその理由を返す。
+func (r *readiness) check() error {
+	if r.draining.Load() {
+		return errDraining
+	}
+
+	return nil
+}
+
+// rejectHandshake は health check の path への WebSocket の handshake を 403 で拒否する。
+// GET /healthz, GET /readyz は GET /{topic} より優先されるため、healthz, readyz という topic には path で接続できない。
+// handshake でない場合は false を返す。
+func rejectHandshake(w http.ResponseWriter, req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	err := fmt.Errorf("topic %s is reserved for health checks", strings.TrimPrefix(req.URL.Path, "/"))
+	slog.Info(fmt.Sprintf("handshake rejected: %s", err))
+	http.Error(w, err.Error(), http.StatusForbidden)
+
+	return true
+}
+
+// healthz はプロセスが動作しているかどうかを返す。
+// drain 中もリクエストに応答できる限り 200 を返す。
+func (h *handler) healthz(w http.ResponseWriter, req *http.Request) {
+	if rejectHandshake(w, req) {
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz は新しい接続を受け付けられるかどうかを返す。
+// 準備ができていない場合は 503 と、その理由を返す。
+func (h *handler) readyz(w http.ResponseWriter, req *http.Request) {
+	if rejectHandshake(w, req) {
+		return
+	}
+
+	if err := h.ready.check(); err != nil {
+		http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
@@ -1,202 +1,644 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
-	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
-	"golang.org/x/net/websocket"
+	"diag"
+	"wire"
 )
 
 const (
 	hostPort        = ":12345"
 	defaultLogLevel = slog.LevelInfo
+
+	// defaultHeartbeatInterval は設定ファイルで指定しない場合の heartbeatInterval。
+	defaultHeartbeatInterval = 10 * time.Second
+	// defaultMaxPayloadSize は設定ファイルで指定しない場合の maxPayloadSize。
+	defaultMaxPayloadSize = 1998_0206
 )
 
-// PongFrame 送信のための Codec。
-// see: https://github.com/golang/net/blob/v0.24.0/websocket/websocket.go#L372-L419
-var pongMessage = websocket.Codec{
-	Marshal:   marshal,
-	Unmarshal: unmarshal,
-}
+// 起動時に設定から決まり、以降は変更しない値。
+var (
+	// heartbeatInterval はサーバーから PingFrame を送信する間隔。
+	heartbeatInterval = defaultHeartbeatInterval
+	// heartbeatTimeout はフレームを受信しない場合に切断とみなすまでの時間。
+	heartbeatTimeout = 3 * defaultHeartbeatInterval
+
+	// maxPayloadSize は受け取るメッセージのペイロードの上限。
+	maxPayloadSize = defaultMaxPayloadSize
+)
+
+// PingFrame, PongFrame のペイロード。
+var (
+	pingPayload = []byte("ping")
+	pongPayload = []byte("thanks to ping!")
+)
 
-func marshal(_ any) (msg []byte, payloadType byte, err error) {
-	return []byte("thanks to ping!"), websocket.PongFrame, nil
+// subscriber は topic に参加しているコネクションと、その購読条件。
+type subscriber struct {
+	// id はコネクションの ID。handler.topics でのコネクションの識別に使う。
+	id uint64
+	// addr は接続元の IP アドレス。ACL の判定に使う。
+	addr netip.Addr
+	// w はコネクション。読み書きは -transport で選択したライブラリによらず、全て w から行う。
+	w wsConn
+
+	// filter は受け取るメッセージの条件。nil の場合は全て受け取る。
+	filter *wire.Filter
+	// format はメッセージの形式。接続時に選択された subprotocol で決まる。
+	format format
+	// echo は自身が publish したメッセージも受け取るかどうか。
+	echo bool
+	// session は delivery=at-least-once の場合の配信状態。nil の場合は送りっぱなしにする。
+	session *session
+	// inbox は reply を受け取るための、コネクション専用の宛先。message の形式でやり取りする場合のみ割り当てる。
+	inbox string
+	// name は hello で登録したコネクションの名前。登録前は空。
+	// handler.namesMu で保護する。
+	name string
+	// mqtt は formatMQTT の場合の MQTT の接続状態。
+	mqtt *mqttConn
+	// stomp は formatSTOMP の場合の STOMP の接続状態。
+	stomp *stompConn
+	// batch は送信をまとめる場合の状態。nil の場合はメッセージごとに送信する。
+	batch *batcher
 }
 
-func unmarshal(msg []byte, payloadType byte, v any) (err error) {
-	return json.Unmarshal(msg, v)
+// connOptions は接続時にクエリパラメータで指定するオプション。
+//
+// 仕様:
+//
+//	filter: 受け取るメッセージを絞り込む条件式。（例: type == "alert" && level >= 3）
+//	echo:   true の場合、自身が publish したメッセージも self: true として受け取る。
+//	        自身のメッセージかを区別するため、pubsub.v1.text 以外の subprotocol の場合のみ指定できる。
+//	delivery: 配信の保証。at-most-once (デフォルト) か at-least-once。
+//	          at-least-once の場合、メッセージには id が付与され、クライアントは ack を返す必要がある。
+//	          ack を返すため、pubsub.v1.text 以外の subprotocol と session の指定が必要。
+//	session:  at-least-once の配信状態を識別する ID。
+//	          再接続時に同じ ID を指定すると、未 ack のメッセージが再送される。
+//	          MQTT, STOMP の session と区別するため、mqtt:, stomp: で始まる ID は指定できない。
+//	willTopic, willPayload, willRetain:
+//	          異常切断時に publish する last will message。
+//	batchInterval, batchSize:
+//	          指定した場合、送信するメッセージを batchInterval (最大 1s) の間、または batchSize 件 (デフォルト 64) までためてまとめて送信する。
+//	          message の形式の場合、配信は kind: batch の messages にまとめる。pubsub.v1.text の場合は 1 回の書き込みにまとめる。
+type connOptions struct {
+	filter    *wire.Filter
+	format    format
+	echo      bool
+	ackNeeded bool
+	sessionID string
+	will      *will
+	batch     *batchOptions
 }
 
-type textFR interface {
-	io.Reader
-	Len() int
+// parseConnOptions はリクエストと、選択された subprotocol の format から connOptions を取り出す。
+func parseConnOptions(req *http.Request, f format) (connOptions, error) {
+	opts := connOptions{
+		format: f,
+	}
+
+	q := req.URL.Query()
+	if src := q.Get("filter"); src != "" {
+		f, err := wire.ParseFilter(src)
+		if err != nil {
+			return connOptions{}, fmt.Errorf("invalid filter: %w", err)
+		}
+		opts.filter = f
+	}
+
+	if v := q.Get("echo"); v != "" {
+		echo, err := strconv.ParseBool(v)
+		if err != nil {
+			return connOptions{}, fmt.Errorf("invalid echo: %w", err)
+		}
+		if echo && !opts.format.hasEnvelope() {
+			return connOptions{}, fmt.Errorf("echo is not supported on %s", opts.format)
+		}
+		opts.echo = echo
+	}
+
+	switch d := q.Get("delivery"); d {
+	case "", "at-most-once":
+	case "at-least-once":
+		if !opts.format.hasEnvelope() {
+			return connOptions{}, fmt.Errorf("at-least-once delivery is not supported on %s", opts.format)
+		}
+		opts.sessionID = q.Get("session")
+		if opts.sessionID == "" {
+			return connOptions{}, errors.New("at-least-once delivery requires session")
+		}
+		if isReservedSessionID(opts.sessionID) {
+			return connOptions{}, fmt.Errorf("session must not start with %s", strings.Join(reservedSessionPrefixes, " or "))
+		}
+		opts.ackNeeded = true
+	default:
+		return connOptions{}, fmt.Errorf("unknown delivery: %q", d)
+	}
+
+	if q.Has("willTopic") {
+		w := &will{
+			topic:   q.Get("willTopic"),
+			payload: q.Get("willPayload"),
+		}
+		if w.topic == "" {
+			return connOptions{}, errors.New("willTopic must not be empty")
+		}
+		if v := q.Get("willRetain"); v != "" {
+			retain, err := strconv.ParseBool(v)
+			if err != nil {
+				return connOptions{}, fmt.Errorf("invalid willRetain: %w", err)
+			}
+			w.retain = retain
+		}
+		opts.will = w
+	} else if q.Has("willPayload") || q.Has("willRetain") {
+		return connOptions{}, errors.New("willTopic is required for last will")
+	}
+
+	batch, err := parseBatchOptions(q.Get("batchInterval"), q.Get("batchSize"), opts.format)
+	if err != nil {
+		return connOptions{}, err
+	}
+	opts.batch = batch
+
+	return opts, nil
 }
 
 type handler struct {
-	// topic ごとのコネクション一覧。
-	// コネクションの識別は保持するポインタの値比較で行う。
-	topics   map[string][]*websocket.Conn
-	topicsMu sync.RWMutex
+	// topic ごとのコネクションと retained message。
+	topics *registry
+	// connSeq はコネクションの ID の採番に使う。
+	connSeq atomic.Uint64
+
+	// session ID ごとの at-least-once の配信状態。
+	sessions   map[string]*session
+	sessionsMu sync.Mutex
+	// msgSeq は at-least-once で配信するメッセージの ID の採番に使う。
+	msgSeq atomic.Uint64
+
+	// inbox ごとのコネクション。
+	inboxes   map[string]*subscriber
+	inboxesMu sync.RWMutex
+
+	// hello で登録された名前ごとのコネクション。
+	names   map[string]*subscriber
+	namesMu sync.RWMutex
+
+	// shuttingDown はサーバーのシャットダウン中かどうか。
+	shuttingDown atomic.Bool
+
+	// conns は接続中のコネクション数。
+	conns atomic.Int64
+
+	// 以下は設定の再読み込みで変わるため atomic に保持する。
+	// acl は topic ごとの subscribe, publish の許可。nil の場合は全て許可する。
+	acl atomic.Pointer[acl]
+	// maxConns は同時に接続できるコネクション数。0 の場合は制限しない。
+	maxConns atomic.Int64
+	// sessionTTL は切断された session を保持する時間 (time.Duration)。
+	sessionTTL atomic.Int64
+	// drainDelay はシャットダウン時に /readyz を失敗させてからコネクションを閉じるまで待つ時間 (time.Duration)。
+	drainDelay atomic.Int64
+
+	// ready は /readyz で返す、新しい接続を受け付けられるかどうか。
+	ready readiness
+
+	// deflate は permessage-deflate の設定。
+	deflate deflateConfig
+}
+
+// newHandler は cfg と deflate の設定で handler を作る。cfg は validate 済みであること。
+func newHandler(cfg config, deflate deflateConfig) *handler {
+	h := &handler{
+		topics:   newRegistry(time.Duration(cfg.Retention.TopicGracePeriod)),
+		sessions: make(map[string]*session),
+		inboxes:  make(map[string]*subscriber),
+		names:    make(map[string]*subscriber),
+		deflate:  deflate,
+	}
+	h.applyConfig(cfg)
+
+	return h
+}
+
+// applyConfig は再起動せずに変更できる設定を反映する。c は validate 済みであること。
+func (h *handler) applyConfig(c config) {
+	var ll slog.Level
+	ll.UnmarshalText([]byte(c.LogLevel))
+	slog.SetLogLoggerLevel(ll)
+
+	h.acl.Store(newACL(c.ACL))
+	h.maxConns.Store(int64(c.Limits.MaxConnections))
+	h.topics.setGracePeriod(time.Duration(c.Retention.TopicGracePeriod))
+	h.sessionTTL.Store(int64(c.Retention.SessionTTL))
+	h.drainDelay.Store(int64(c.Shutdown.DrainDelay))
 }
 
 // getConns は topic に紐づくコネクション一覧を返す。
 //
 // 注意)
-//   - []*websocket.Conn の各要素の値が変わってしまうことまでは防げない。
-func (h *handler) getConns(topic string) []*websocket.Conn {
-	h.topicsMu.RLock()
-	defer h.topicsMu.RUnlock()
-
-	return slices.Clone(h.topics[topic])
+//   - 返す一覧は他の呼び出し元と共有しているため、変更してはならない。
+func (h *handler) getConns(topic string) []*subscriber {
+	return h.topics.getConns(topic)
 }
 
 // join は topic にコネクションを追加する。
-func (h *handler) join(topic string, ws *websocket.Conn) {
-	h.topicsMu.Lock()
-	defer h.topicsMu.Unlock()
-
-	h.topics[topic] = append(h.topics[topic], ws)
+func (h *handler) join(topic string, sub *subscriber) {
+	h.topics.join(topic, sub)
 }
 
 // leave は topic からコネクションを削除する。
-func (h *handler) leave(topic string, ws *websocket.Conn) {
-	h.topicsMu.Lock()
-	defer h.topicsMu.Unlock()
-
-	conns := h.topics[topic]
-	for i, conn := range conns {
-		if conn == ws {
-			h.topics[topic] = slices.Delete(conns, i, i+1)
-			return
-		}
-	}
+func (h *handler) leave(topic string, sub *subscriber) {
+	h.topics.leave(topic, sub)
 }
 
-// pubsub は WebSocket での pubsub を行う。
-func (h *handler) pubsub(ws *websocket.Conn) {
-	defer ws.Close()
+// serve は transport が受け付けたコネクションで pubsub を行う。
+// f は accept で選択した subprotocol の format。
+func (h *handler) serve(conn wsConn, req *http.Request, f format) {
+	// accept で検証済みのため、ここではエラーにならない。
+	opts, _ := parseConnOptions(req, f)
+
+	h.conns.Add(1)
+	defer h.conns.Add(-1)
+
+	topic := req.PathValue("topic")
+	sub := &subscriber{
+		id:     h.connSeq.Add(1),
+		addr:   remoteAddr(req),
+		w:      conn,
+		filter: opts.filter,
+		format: opts.format,
+		echo:   opts.echo,
+	}
+	defer sub.w.close(wire.CloseStatusNormal)
+	if opts.batch != nil {
+		sub.batch = newBatcher(sub.w, sub.format, *opts.batch)
+		defer sub.batch.close()
+	}
 
-	topic := ws.Request().PathValue("topic")
-	h.join(topic, ws)
-	defer h.leave(topic, ws)
+	// MQTT, STOMP の接続は path の topic を使わず、SUBSCRIBE で指定された topic に参加する。
+	switch sub.format {
+	case formatMQTT:
+		h.serveMQTT(sub)
+		return
+	case formatSTOMP:
+		h.serveSTOMP(sub)
+		return
+	}
 
-	for {
-		// fr は最後まで読み込む必要がある。
-		fr, err := ws.NewFrameReader()
+	// graceful は CloseFrame を受け取って正常に切断されたかどうか。
+	// topic からの削除後に last will を publish するため、最初に defer する。
+	graceful := false
+	defer func() {
+		if opts.will != nil && !graceful && !h.shuttingDown.Load() {
+			h.publishWill(opts.will, sub)
+		}
+	}()
+
+	if opts.ackNeeded {
+		s, err := h.attachSession(opts.sessionID, sub, attachOptions{})
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				slog.Info("connection closed")
-				break
+			slog.Info(fmt.Sprintf("failed to attach session %s: %s", opts.sessionID, err))
+			if errors.Is(err, errSessionInUse) {
+				sub.send(message{Kind: kindError, Error: err.Error()})
+				return
 			}
-
-			continue
 		}
+		sub.session = s
+		defer h.detachSession(s, sub)
+	}
 
-		switch fr.PayloadType() {
-		case websocket.PingFrame:
-			b, _ := io.ReadAll(fr)
-			slog.Debug(fmt.Sprintf("PingFrame: %s", string(b)))
-			pongMessage.Send(ws, nil)
-			continue
+	if sub.format.hasEnvelope() {
+		h.registerInbox(sub)
+		defer h.unregisterInbox(sub)
+		defer h.unregisterName(sub)
+	}
+
+	h.join(topic, sub)
+	defer h.leave(topic, sub)
 
-		case websocket.TextFrame:
-			if err := h.handleTextFrame(fr, topic, ws); err != nil {
+	if err := h.sendRetained(topic, sub); err != nil {
+		slog.Error(fmt.Sprintf("failed to send retained message: %s", err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go heartbeat(ctx, sub.w)
+
+	for {
+		// heartbeatTimeout の間フレームを受信しない場合は切断とみなす。
+		_, payload, err := sub.w.readMessage(heartbeatTimeout)
+		if err != nil {
+			switch {
+			case errors.Is(err, errPayloadTooLarge):
+				// メッセージは読み捨てられているため、コネクションは閉じずに次のメッセージを読む。
 				slog.Error(fmt.Sprintf("failed to handle text frame: %s", err))
 				continue
+			case errors.Is(err, errCloseFrame):
+				slog.Info("CloseFrame received")
+				graceful = true
+			case errors.Is(err, io.EOF):
+				slog.Info("connection closed")
+			default:
+				slog.Info(fmt.Sprintf("connection lost: %s", err))
 			}
 
-		default:
+			return
 		}
 
-		// 不要な fr を読み捨てる。
-		io.Copy(io.Discard, fr)
+		if err := h.handleTextFrame(payload, topic, sub); err != nil {
+			slog.Error(fmt.Sprintf("failed to handle text frame: %s", err))
+		}
+	}
+}
+
+// heartbeat は ctx が終了するまで定期的に PingFrame を送信する。
+// PongFrame を含むフレームの受信により、読み込みのタイムアウトが延長される。
+func heartbeat(ctx context.Context, w wsConn) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.ping(); err != nil {
+				slog.Debug(fmt.Sprintf("failed to send ping: %s", err))
+				return
+			}
+		}
 	}
 }
 
-// handleTextFrame は TextFrame を処理する。
+// handleTextFrame は TextFrame のペイロードを処理する。
 //
 // 仕様:
 //
-//	TextFrame のペイロードが大きすぎる場合はエラーを返す。
-//	それ以外の場合は subscribe している topic にメッセージを送信する。
-func (h *handler) handleTextFrame(r textFR, topic string, ws *websocket.Conn) error {
-	if r.Len() > 1998_0206 {
-		return fmt.Errorf("too large payload: %d", r.Len())
-	}
-
-	res, err := io.ReadAll(r)
+//	subscribe している topic にメッセージを送信する。
+//	pubsub.v1.json, pubsub.v1.msgpack の場合は message として解釈し、kind に応じて処理する。
+//	pubsub.v1.msgpack の場合は BinaryFrame も同様に処理する。
+func (h *handler) handleTextFrame(payload []byte, topic string, sub *subscriber) error {
+	m, err := sub.decodeMessage(payload)
 	if err != nil {
-		return fmt.Errorf("failed to read payload: %w", err)
+		return err
 	}
 
-	if err := h.publishText(topic, res, ws); err != nil {
-		return fmt.Errorf("failed to publish: %w", err)
+	switch m.Kind {
+	case kindPublish:
+		if err := h.allowed(aclPublish, topic, sub); err != nil {
+			sub.send(message{Kind: kindError, Topic: topic, Error: err.Error()})
+			return err
+		}
+		if m.Retain {
+			h.retain(topic, []byte(m.Payload))
+		}
+
+		if err := h.publishText(topic, []byte(m.Payload), sub); err != nil {
+			return fmt.Errorf("failed to publish: %w", err)
+		}
+
+	case kindAck:
+		if sub.session == nil {
+			return errors.New("ack received without at-least-once delivery")
+		}
+		sub.session.ack(m.ID)
+
+	case kindRequest:
+		// topic の指定がない場合は接続している topic に送信する。
+		to := cmp.Or(m.Topic, topic)
+		if isInbox(to) {
+			return errors.New("request to inbox is not allowed")
+		}
+		if err := h.request(to, m, sub); err != nil {
+			return fmt.Errorf("failed to request: %w", err)
+		}
+
+	case kindReply:
+		if err := h.reply(m, sub); err != nil {
+			return fmt.Errorf("failed to reply: %w", err)
+		}
+
+	case kindHello:
+		if err := h.hello(m, sub); err != nil {
+			return fmt.Errorf("failed to hello: %w", err)
+		}
+
+	case kindDirect:
+		if err := h.direct(m, sub); err != nil {
+			return fmt.Errorf("failed to send direct message: %w", err)
+		}
+
+	default:
+		return fmt.Errorf("unexpected message kind: %q", m.Kind)
 	}
 
 	return nil
 }
 
-func (h *handler) publishText(topic string, payload []byte, publisher *websocket.Conn) error {
+// publishText は topic の subscriber にメッセージを送信する。
+//
+// 仕様:
+//
+//	publisher 自身には、echo が有効な場合のみ self として送信する。
+//	at-least-once の subscriber には ack 待ちとして保持してから送信する。
+//	それ以外の subscriber には、format ごとに 1 度だけエンコードしたフレームを送信する。
+//	送信に失敗した subscriber があっても残りの subscriber には送信し、失敗をまとめて返す。
+func (h *handler) publishText(topic string, payload []byte, publisher *subscriber) error {
 	conns := h.getConns(topic)
 
 	slog.Debug(fmt.Sprintf("len(conns): %v", len(conns)))
 	slog.Debug(fmt.Sprintf("string(payload): %v\n", string(payload)))
 
+	pm := newPreparedMessage(message{
+		Kind:    kindMessage,
+		Topic:   topic,
+		Payload: string(payload),
+	})
+
+	var errs []error
 	for _, conn := range conns {
-		if conn != publisher {
-			if err := websocket.Message.Send(conn, string(payload)); err != nil {
-				return fmt.Errorf("failed to send message: %w", err)
-			}
+		self := conn == publisher
+		if self && !conn.echo {
+			continue
+		}
+
+		// 条件に合わないメッセージは送信しない。
+		// 自身へのエコーは受理の確認のため、条件に関わらず送信する。
+		if !self && conn.filter != nil && !conn.filter.Match(payload) {
+			continue
+		}
+
+		// 他の subscriber と同じ内容を送る場合は、エンコード済みのフレームを使い回す。
+		var err error
+		if !self && conn.session == nil && pm.supports(conn.format) {
+			err = conn.sendPrepared(pm)
+		} else {
+			m := pm.m
+			m.Self = self
+			err = h.sendMessage(conn, m)
+		}
+		// 1 つの subscriber への送信に失敗しても、残りの subscriber には送信する。
+		if err != nil {
+			slog.Info(fmt.Sprintf("failed to send message to %d: %s", conn.id, err))
+			errs = append(errs, fmt.Errorf("failed to send message to %d: %w", conn.id, err))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// sendMessage は subscriber にメッセージを送信する。
+// at-least-once の subscriber には ack 待ちとして保持してから送信する。
+func (h *handler) sendMessage(sub *subscriber, m message) error {
+	if sub.session != nil {
+		return h.deliver(sub.session, m)
+	}
+
+	return sub.send(m)
 }
 
 // close は handler のリソースを解放する。
 func (h *handler) close() {
-	for topic, conns := range h.topics {
-		for _, conn := range conns {
-			conn.Close()
+	// サーバーからの切断では last will を publish しない。
+	h.shuttingDown.Store(true)
+
+	for _, conn := range h.topics.close() {
+		conn.w.close(wire.CloseStatusNormal)
+	}
+}
+
+// listenAndServe は srv で待ち受ける。DIAG_RECORD が設定されている場合は、全てのコネクションのフレームを記録する。
+// TLS の場合は暗号化する前のフレームを記録するため、TLS を終端したコネクションを記録する。（r.TLS は nil になる）
+func listenAndServe(srv *http.Server, tlsCfg tlsConfig) error {
+	rec := diag.Recording()
+	if rec == nil {
+		if tlsCfg.enabled() {
+			return srv.ListenAndServeTLS(tlsCfg.CertFile, tlsCfg.KeyFile)
 		}
+		return srv.ListenAndServe()
+	}
 
-		delete(h.topics, topic)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
 	}
+	if tlsCfg.enabled() {
+		cert, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	return srv.Serve(rec.Listener(ln))
 }
 
 func main() {
 	// flag の設定。
 	slog.SetLogLoggerLevel(slog.LevelDebug)
+	configPath := flag.String("config", "", "The config file (.json, .yaml or .yml). Reloaded on SIGHUP")
 	logLevel := flag.String("logLevel", defaultLogLevel.String(), "The log level")
+	deflate := deflateConfig{}
+	flag.BoolVar(&deflate.enabled, "deflate", true, "Accept permessage-deflate")
+	flag.BoolVar(&deflate.serverNoContextTakeover, "deflateServerNoContextTakeover", false, "Reset the compression context for each message sent by the server")
+	flag.BoolVar(&deflate.clientNoContextTakeover, "deflateClientNoContextTakeover", false, "Request clients to reset the compression context for each message")
+	flag.IntVar(&deflate.clientMaxWindowBits, "deflateClientMaxWindowBits", wire.DeflateMaxWindowBits, "The max LZ77 window bits (8-15) clients use for compression")
+	flag.IntVar(&deflate.minSize, "deflateMinSize", 256, "Messages smaller than this size in bytes are sent uncompressed")
+	transport := flag.String("transport", "xnet", fmt.Sprintf("The WebSocket library that accepts connections (%s)", strings.Join(transportNames(), ", ")))
+	topicGracePeriod := flag.Duration("topicGracePeriod", time.Minute, "How long a topic without connections and its retained message are kept (0 to reclaim immediately)")
 	flag.Parse()
 
-	// logger の設定。
-	ll := defaultLogLevel
-	ll.UnmarshalText([]byte(*logLevel))
-	slog.SetLogLoggerLevel(ll)
+	if err := deflate.validate(); err != nil {
+		slog.Error(fmt.Sprintf("invalid deflate option: %s", err))
+		os.Exit(1)
+	}
+
+	// 明示した起動オプションは、設定ファイルの値より優先する。
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	readConfig := func() (config, error) {
+		c := defaultConfig()
+		if *configPath != "" {
+			var err error
+			if c, err = loadConfig(*configPath, c); err != nil {
+				return config{}, err
+			}
+		}
+		if explicit["logLevel"] {
+			c.LogLevel = *logLevel
+		}
+		if explicit["transport"] {
+			c.Transport = *transport
+		}
+		if explicit["topicGracePeriod"] {
+			c.Retention.TopicGracePeriod = duration(*topicGracePeriod)
+		}
+
+		return c, c.validate()
+	}
+
+	cfg, err := readConfig()
+	if err != nil {
+		slog.Error(fmt.Sprintf("invalid config: %s", err))
+		os.Exit(1)
+	}
+
+	// 再起動しないと変更できない値。
+	heartbeatInterval = time.Duration(cfg.Heartbeat.Interval)
+	heartbeatTimeout = time.Duration(cfg.Heartbeat.Timeout)
+	maxPayloadSize = cfg.Limits.MaxPayloadSize
 
 	// handler の設定。
-	h := &handler{
-		topics:   make(map[string][]*websocket.Conn),
-		topicsMu: sync.RWMutex{},
+	h := newHandler(cfg, deflate)
+	h.topics.onTopicCreated(func(topic string) {
+		slog.Info(fmt.Sprintf("topic created: %s", topic))
+	})
+	h.topics.onTopicDestroyed(func(topic string) {
+		slog.Info(fmt.Sprintf("topic destroyed: %s", topic))
+	})
+	expvar.Publish("topics", expvar.Func(func() any { return h.topics.count() }))
+	expvar.Publish("connections", expvar.Func(func() any { return h.conns.Load() }))
+
+	ws, err := h.newTransportHandler(cfg.Transport)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
+	slog.Info(fmt.Sprintf("transport: %s", cfg.Transport))
+
+	diag.Serve()
 
 	mux := http.NewServeMux()
-	mux.Handle("GET /{topic}", websocket.Handler(h.pubsub))
+	// DIAG_LEAKCHECK が設定されている場合は、コネクションを閉じた後も残る goroutine を検出する。
+	mux.Handle("GET /{topic}", diag.LeakCheck(ws))
+	// オーケストレーターの liveness probe, readiness probe。
+	mux.HandleFunc("GET /healthz", h.healthz)
+	mux.HandleFunc("GET /readyz", h.readyz)
 
 	srv := &http.Server{
-		Addr:    hostPort,
+		Addr:    cfg.Listen,
 		Handler: mux,
 	}
 
@@ -204,9 +646,38 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt, os.Kill)
 	defer stop()
 
+	// ack されないメッセージを再送する。
+	go h.redeliverLoop(ctx)
+
+	// SIGHUP で設定ファイルを読み直す。
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			next, err := readConfig()
+			if err != nil {
+				slog.Error(fmt.Sprintf("config reload rejected: %s", err))
+				continue
+			}
+			if fields := cfg.restartRequired(next); len(fields) > 0 {
+				slog.Warn(fmt.Sprintf("config reload: %s cannot be changed without restart, keeping the current values", strings.Join(fields, ", ")))
+			}
+			cfg = cfg.reloadable(next)
+			h.applyConfig(cfg)
+			slog.Info("config reloaded")
+		}
+	}()
+
 	// signal を受け取るために goroutine で ListenAndServe を実行する。
+	// cfg は再読み込みで書き換わるため、TLS の設定は goroutine の開始前に取り出す。
+	tlsCfg := cfg.TLS
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		if tlsCfg.enabled() {
+			slog.Info(fmt.Sprintf("listening on %s (TLS)", srv.Addr))
+		} else {
+			slog.Info(fmt.Sprintf("listening on %s", srv.Addr))
+		}
+		if err := listenAndServe(srv, tlsCfg); err != nil {
 			if errors.Is(err, http.ErrServerClosed) {
 				slog.Info("server closed gracefully")
 				return
@@ -216,8 +687,18 @@ func main() {
 	}()
 
 	<-ctx.Done()
+	// 2 回目の signal では drain を待たずに終了できるよう、signal の処理を元に戻す。
+	stop()
 	slog.Info("shutting down...")
 
+	// /readyz を失敗させ、ロードバランサーが新しい接続を振り分けなくなるまで待つ。
+	// 既存のコネクションは待っている間も配信を続ける。
+	h.ready.drain()
+	if d := time.Duration(h.drainDelay.Load()); d > 0 {
+		slog.Info(fmt.Sprintf("draining for %s...", d))
+		time.Sleep(d)
+	}
+
 	// 正常にリソースを解放した後、サーバーをシャットダウンする。
 	h.close()
 	if err := srv.Shutdown(ctx); err != nil {
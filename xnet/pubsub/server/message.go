@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"golang.org/x/net/websocket"
+
+	"wire"
+)
+
+// format はコネクションとやり取りするメッセージの形式。
+// 接続時に Sec-WebSocket-Protocol で選択された subprotocol によって決まる。
+type format string
+
+const (
+	// formatText はペイロードをそのまま TextFrame で送受信する。
+	formatText format = "pubsub.v1.text"
+	// formatJSON は message を JSON にして TextFrame で送受信する。
+	formatJSON format = "pubsub.v1.json"
+	// formatMsgpack は message を MessagePack にして BinaryFrame で送受信する。
+	formatMsgpack format = "pubsub.v1.msgpack"
+	// formatMQTT は MQTT 3.1.1 のパケットを BinaryFrame で送受信する。
+	formatMQTT format = "mqtt"
+	// formatSTOMP は STOMP 1.2 のフレームを送受信する。
+	formatSTOMP format = "v12.stomp"
+)
+
+// supportedFormats はサーバーが対応している subprotocol。
+var supportedFormats = []format{formatText, formatJSON, formatMsgpack, formatMQTT, formatSTOMP}
+
+// hasEnvelope は message の形式でやり取りするかどうかを返す。
+// formatText ではペイロードのみを、formatMQTT, formatSTOMP ではそれぞれのプロトコルのフレームをやり取りするため、
+// message の各フィールドは使えない。
+func (f format) hasEnvelope() bool {
+	return f == formatJSON || f == formatMsgpack
+}
+
+// selectFormat はクライアントが提示した subprotocol から、対応しているものを提示された順に選ぶ。
+func selectFormat(offered []string) (format, error) {
+	for _, p := range offered {
+		if f := format(p); slices.Contains(supportedFormats, f) {
+			return f, nil
+		}
+	}
+
+	return "", fmt.Errorf("no acceptable subprotocol in %q (supported: %q)", offered, supportedFormats)
+}
+
+// message の種類。
+const (
+	// kindPublish はクライアントからの publish。
+	kindPublish = "publish"
+	// kindAck はクライアントからの受信確認。
+	kindAck = "ack"
+	// kindRequest は reply を求めるリクエスト。
+	// クライアントから受け取り、topic の subscriber に送信する。
+	kindRequest = "request"
+	// kindReply はリクエストへの返信。
+	// クライアントから受け取り、replyTo の inbox を持つコネクションに送信する。
+	kindReply = "reply"
+	// kindHello はコネクションの名前の登録。
+	// クライアントから受け取り、登録できた場合は同じ内容を返す。
+	kindHello = "hello"
+	// kindDirect は名前を指定したコネクションへのメッセージ。
+	// クライアントから受け取り、to の名前のコネクションに from を付けて送信する。
+	kindDirect = "direct"
+	// kindMessage はサーバーからの配信。
+	kindMessage = "message"
+	// kindError はサーバーからのエラー通知。
+	kindError = "error"
+	// kindBatch はサーバーからの複数の配信をまとめたもの。batchInterval を指定した場合に送信する。
+	kindBatch = "batch"
+)
+
+// message は formatJSON, formatMsgpack のコネクションとやり取りするメッセージ。
+type message struct {
+	Kind    string `json:"kind"`
+	Topic   string `json:"topic,omitempty"`
+	Payload string `json:"payload,omitempty"`
+
+	// Self は自身が publish したメッセージが返ってきたものかどうか。
+	Self bool `json:"self,omitempty"`
+	// Retain は retained message かどうか。
+	// publish 時に指定すると topic の retained message として保持し、以降に subscribe したコネクションにも送信する。
+	// 配信時は retained message として送信されたものかを表す。
+	Retain bool `json:"retain,omitempty"`
+
+	// ID は delivery=at-least-once の配信で ack に使う ID。
+	ID string `json:"id,omitempty"`
+	// Redelivered は再送されたメッセージかどうか。
+	Redelivered bool `json:"redelivered,omitempty"`
+
+	// CorrelationID はリクエストと reply を対応付ける ID。
+	CorrelationID string `json:"correlationId,omitempty"`
+	// ReplyTo は reply の送信先の inbox。
+	ReplyTo string `json:"replyTo,omitempty"`
+
+	// Name は hello で登録するコネクションの名前。
+	Name string `json:"name,omitempty"`
+	// To はダイレクトメッセージの宛先の名前。
+	To string `json:"to,omitempty"`
+	// From はダイレクトメッセージの送信元の名前。
+	From string `json:"from,omitempty"`
+
+	// Error は kindError の内容。
+	Error string `json:"error,omitempty"`
+
+	// Messages は kindBatch にまとめた配信。
+	Messages []message `json:"messages,omitempty"`
+}
+
+// decodeMessage はクライアントから受け取ったデータを message に変換する。
+// formatText の場合、データはそのまま publish のペイロードとして扱う。
+func (s *subscriber) decodeMessage(data []byte) (message, error) {
+	var (
+		m   message
+		err error
+	)
+
+	switch s.format {
+	case formatJSON:
+		err = json.Unmarshal(data, &m)
+	case formatMsgpack:
+		err = wire.UnmarshalMsgpack(data, &m)
+	default:
+		return message{Kind: kindPublish, Payload: string(data)}, nil
+	}
+
+	if err != nil {
+		return message{}, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+
+	return m, nil
+}
+
+// encodeMessage は format に合わせて message をエンコードし、送信に使う opcode と共に返す。
+// formatText の場合はペイロードのみを返す。formatMQTT, formatSTOMP はコネクションごとの状態が必要なため扱わない。
+func encodeMessage(f format, m message) (byte, []byte, error) {
+	switch f {
+	case formatJSON:
+		b, err := json.Marshal(m)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to marshal message: %w", err)
+		}
+		return websocket.TextFrame, b, nil
+
+	case formatMsgpack:
+		b, err := wire.MarshalMsgpack(m)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to marshal message: %w", err)
+		}
+		return websocket.BinaryFrame, b, nil
+
+	default:
+		return websocket.TextFrame, []byte(m.Payload), nil
+	}
+}
+
+// send は subscriber の format に合わせてメッセージを送信する。
+// formatText の場合はペイロードのみを、formatMQTT の場合は PUBLISH パケットを、
+// formatSTOMP の場合は MESSAGE フレームを送信する。
+func (s *subscriber) send(m message) error {
+	switch s.format {
+	case formatMQTT:
+		return s.mqtt.publish(m)
+
+	case formatSTOMP:
+		return s.stomp.send(m)
+
+	default:
+		write := func() error {
+			opcode, b, err := encodeMessage(s.format, m)
+			if err != nil {
+				return err
+			}
+			return s.w.writeMessage(opcode, b)
+		}
+		if s.batch != nil {
+			return s.batch.send(m, write)
+		}
+		return write()
+	}
+}
+
+// sendPrepared は他の subscriber と同じ内容の pm を送信する。
+// バッチにまとめる場合を除き、エンコード済みのフレームをそのまま書き込む。
+func (s *subscriber) sendPrepared(pm *preparedMessage) error {
+	write := func() error {
+		return s.w.writePrepared(pm, s.format)
+	}
+	if s.batch != nil {
+		return s.batch.send(pm.m, write)
+	}
+	return write()
+}
@@ -0,0 +1,752 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// MQTT 3.1.1 over WebSocket のブリッジ。
+// see: https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html
+//
+// MQTT の topic は handler.topics の topic と同じものとして扱うため、
+// MQTT のクライアントと pubsub のクライアントは同じ topic でメッセージをやり取りできる。
+
+// MQTT のパケットの種類。
+const (
+	mqttConnect     byte = 1
+	mqttConnack     byte = 2
+	mqttPublish     byte = 3
+	mqttPuback      byte = 4
+	mqttSubscribe   byte = 8
+	mqttSuback      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsuback    byte = 11
+	mqttPingreq     byte = 12
+	mqttPingresp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+// CONNACK の return code。
+const (
+	mqttAccepted             byte = 0x00
+	mqttUnacceptableProtocol byte = 0x01
+	mqttIdentifierRejected   byte = 0x02
+	mqttNotAuthorized        byte = 0x05
+)
+
+const (
+	// mqttProtocolLevel は MQTT 3.1.1 のプロトコルレベル。
+	mqttProtocolLevel byte = 4
+	// mqttMaxQoS は対応している QoS の上限。
+	mqttMaxQoS byte = 1
+	// mqttSubscribeFailure は SUBACK で subscribe できなかったことを表す。
+	mqttSubscribeFailure byte = 0x80
+	// mqttMaxRemainingLengthSize は remaining length のバイト数の上限。
+	mqttMaxRemainingLengthSize = 4
+	// mqttSessionPrefix は client ID から session ID を作る際の接頭辞。
+	// delivery=at-least-once の session ID には使えないため、衝突しない。
+	mqttSessionPrefix = "mqtt:"
+)
+
+var (
+	errMQTTIncomplete  = errors.New("mqtt: incomplete packet")
+	errMQTTMalformed   = errors.New("mqtt: malformed packet")
+	errMQTTUnsupported = errors.New("mqtt: unsupported packet")
+)
+
+// mqttPacket は固定ヘッダーで区切った 1 つのパケット。
+type mqttPacket struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+// parseMQTTPacket は data の先頭のパケットを取り出し、パケットのバイト数とともに返す。
+// data がパケットの途中で終わっている場合は errMQTTIncomplete を返す。
+func parseMQTTPacket(data []byte) (mqttPacket, int, error) {
+	if len(data) < 2 {
+		return mqttPacket{}, 0, errMQTTIncomplete
+	}
+
+	// remaining length は 1 から 4 byte の可変長で表す。
+	length, multiplier := 0, 1
+	i := 1
+	for {
+		if i > mqttMaxRemainingLengthSize {
+			return mqttPacket{}, 0, fmt.Errorf("%w: remaining length too long", errMQTTMalformed)
+		}
+		if i >= len(data) {
+			return mqttPacket{}, 0, errMQTTIncomplete
+		}
+
+		b := data[i]
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		i++
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > maxPayloadSize {
+		return mqttPacket{}, 0, fmt.Errorf("too large packet: %d", length)
+	}
+	if len(data) < i+length {
+		return mqttPacket{}, 0, errMQTTIncomplete
+	}
+
+	return mqttPacket{
+		typ:   data[0] >> 4,
+		flags: data[0] & 0x0f,
+		body:  data[i : i+length],
+	}, i + length, nil
+}
+
+// appendMQTTPacket はパケットを b に追加する。
+func appendMQTTPacket(b []byte, typ, flags byte, body []byte) []byte {
+	b = append(b, typ<<4|flags)
+
+	n := len(body)
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+
+	return append(b, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttDecoder はパケットの可変ヘッダーとペイロードを先頭から読み込む。
+// 途中で不正なデータがあった場合、以降の読み込みは全て失敗し err に記録される。
+type mqttDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *mqttDecoder) byte() byte {
+	if d.err != nil || len(d.data) < 1 {
+		d.err = errMQTTMalformed
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *mqttDecoder) uint16() uint16 {
+	if d.err != nil || len(d.data) < 2 {
+		d.err = errMQTTMalformed
+		return 0
+	}
+	n := binary.BigEndian.Uint16(d.data)
+	d.data = d.data[2:]
+	return n
+}
+
+func (d *mqttDecoder) bytes() []byte {
+	n := int(d.uint16())
+	if d.err != nil || len(d.data) < n {
+		d.err = errMQTTMalformed
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *mqttDecoder) string() string {
+	return string(d.bytes())
+}
+
+// mqttConnectPacket は CONNECT パケットの内容。
+type mqttConnectPacket struct {
+	protocol     string
+	level        byte
+	cleanSession bool
+	keepAlive    time.Duration
+	clientID     string
+	will         *will
+}
+
+func parseMQTTConnect(body []byte) (mqttConnectPacket, error) {
+	d := &mqttDecoder{data: body}
+	p := mqttConnectPacket{
+		protocol: d.string(),
+		level:    d.byte(),
+	}
+	flags := d.byte()
+	p.keepAlive = time.Duration(d.uint16()) * time.Second
+	p.clientID = d.string()
+
+	if flags&0x01 != 0 {
+		return mqttConnectPacket{}, fmt.Errorf("%w: reserved flag is set", errMQTTMalformed)
+	}
+	p.cleanSession = flags&0x02 != 0
+
+	if flags&0x04 != 0 {
+		p.will = &will{
+			topic:   d.string(),
+			payload: d.string(),
+			retain:  flags&0x20 != 0,
+		}
+	}
+	// username と password は認証を行わないため読み捨てる。
+	if flags&0x80 != 0 {
+		d.bytes()
+	}
+	if flags&0x40 != 0 {
+		d.bytes()
+	}
+
+	if d.err != nil {
+		return mqttConnectPacket{}, d.err
+	}
+	if p.will != nil && !validMQTTTopic(p.will.topic) {
+		return mqttConnectPacket{}, fmt.Errorf("invalid will topic: %q", p.will.topic)
+	}
+
+	return p, nil
+}
+
+// validMQTTTopic は topic が publish 先として使えるかどうかを返す。
+// ワイルドカードには対応していないため、subscribe 時の topic filter にも使う。
+func validMQTTTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00") && !isInbox(topic)
+}
+
+// mqttConn は 1 つの MQTT の接続の状態。
+//
+// QoS 1 の配信は delivery=at-least-once の session を使って行う。
+// session のメッセージ ID と MQTT の packet ID を対応付け、PUBACK を ack として扱う。
+type mqttConn struct {
+	h   *handler
+	sub *subscriber
+	// session は CONNECT で指定された client ID の session。CONNECT の受信後に設定する。
+	session *session
+
+	mu sync.Mutex
+	// packetIDs, msgIDs は ack 待ちのメッセージ ID と packet ID の対応。
+	packetIDs map[string]uint16
+	msgIDs    map[uint16]string
+	nextID    uint16
+
+	// buf は受信したデータのうち、まだパケットとして処理していない部分。
+	buf []byte
+}
+
+// serveMQTT は MQTT のパケットを処理する。
+//
+// 仕様:
+//
+//	最初のパケットは CONNECT である必要がある。
+//	CleanSession=0 の場合、subscription と未 PUBACK の QoS 1 のメッセージを client ID ごとに保持する。
+//	  再接続時は subscription を復元し、未 PUBACK のメッセージを DUP 付きで再送する。
+//	  既に同じ client ID で接続している場合は、接続中のクライアントを切断して session を引き継ぐ。(MQTT 3.1.1 3.1.4 [MQTT-3.1.4-2])
+//	PUBLISH と SUBSCRIBE の QoS は 1 まで対応する。QoS 2 の PUBLISH を受け取った場合は切断する。
+//	  SUBSCRIBE の QoS 2 は 1 として許可する。
+//	  ワイルドカードを含む topic filter は SUBSCRIBE で failure を返す。
+//	配信の QoS は subscription で許可した QoS になる。
+//	DISCONNECT を受け取らずに切断された場合は will message を publish する。
+//	keep alive の 1.5 倍の間パケットを受信しない場合は切断とみなす。
+func (h *handler) serveMQTT(sub *subscriber) {
+	c := &mqttConn{
+		h:         h,
+		sub:       sub,
+		packetIDs: make(map[string]uint16),
+		msgIDs:    make(map[uint16]string),
+	}
+	sub.mqtt = c
+	// MQTT 3.1.1 では自身が publish したメッセージも受け取る。
+	sub.echo = true
+
+	// 最初のパケットは CONNECT。
+	pkt, err := c.next(heartbeatTimeout)
+	if err != nil {
+		slog.Info(fmt.Sprintf("mqtt: connection closed before CONNECT: %s", err))
+		return
+	}
+	if pkt.typ != mqttConnect {
+		slog.Info(fmt.Sprintf("mqtt: first packet must be CONNECT: %d", pkt.typ))
+		return
+	}
+
+	connect, err := parseMQTTConnect(pkt.body)
+	if err != nil {
+		slog.Info(fmt.Sprintf("mqtt: invalid CONNECT: %s", err))
+		return
+	}
+
+	s, ok := c.connect(connect)
+	if !ok {
+		return
+	}
+
+	// graceful は DISCONNECT を受け取って正常に切断されたかどうか。
+	// topic からの削除後に will message を publish するため、先に defer する。
+	graceful := false
+	defer func() {
+		if connect.will != nil && !graceful && !h.shuttingDown.Load() {
+			h.publishWill(connect.will, sub)
+		}
+	}()
+	defer func() {
+		for topic := range c.subscriptions() {
+			h.leave(topic, sub)
+		}
+		h.detachSession(s, sub)
+		if connect.cleanSession {
+			h.discardSession(s)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go heartbeat(ctx, sub.w)
+
+	timeout := heartbeatTimeout
+	if connect.keepAlive > 0 {
+		timeout = connect.keepAlive * 3 / 2
+	}
+
+	for {
+		pkt, err := c.next(timeout)
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF), errors.Is(err, errCloseFrame):
+				slog.Info("mqtt: connection closed")
+			default:
+				slog.Info(fmt.Sprintf("mqtt: connection lost: %s", err))
+			}
+			return
+		}
+
+		if pkt.typ == mqttDisconnect {
+			slog.Info(fmt.Sprintf("mqtt: DISCONNECT received from %s", connect.clientID))
+			graceful = true
+			return
+		}
+
+		if err := c.handle(pkt); err != nil {
+			slog.Info(fmt.Sprintf("mqtt: closing connection: %s", err))
+			return
+		}
+	}
+}
+
+// connect は CONNECT を検証して CONNACK を返し、client ID の session に接続する。
+// 接続を拒否した場合は false を返す。
+func (c *mqttConn) connect(p mqttConnectPacket) (*session, bool) {
+	if p.protocol != "MQTT" || p.level != mqttProtocolLevel {
+		slog.Info(fmt.Sprintf("mqtt: unacceptable protocol: %s (level %d)", p.protocol, p.level))
+		c.write(mqttConnack, 0, []byte{0, mqttUnacceptableProtocol})
+		return nil, false
+	}
+
+	if p.clientID == "" {
+		// client ID を保持しない場合のみ、サーバーが割り当てる。
+		if !p.cleanSession {
+			c.write(mqttConnack, 0, []byte{0, mqttIdentifierRejected})
+			return nil, false
+		}
+		b := make([]byte, 8)
+		rand.Read(b)
+		p.clientID = "auto-" + hex.EncodeToString(b)
+	}
+
+	// will message は切断時に publish するため、接続時に publish の ACL で判定する。
+	if p.will != nil {
+		if err := c.h.allowed(aclPublish, p.will.topic, c.sub); err != nil {
+			slog.Info(fmt.Sprintf("mqtt: connection refused: %s", err))
+			c.write(mqttConnack, 0, []byte{0, mqttNotAuthorized})
+			return nil, false
+		}
+	}
+
+	// 同じ client ID のクライアントが接続中の場合は、そのクライアントを切断して session を引き継ぐ。
+	// CONNACK は session に紐付けた後、未 PUBACK のメッセージを再送する前に送る。
+	id := mqttSessionPrefix + p.clientID
+	s, err := c.h.attachSession(id, c.sub, attachOptions{
+		takeover: true,
+		clean:    p.cleanSession,
+		attached: func(s *session, present bool) error {
+			// 再送や配信の PUBLISH は c.session の subscription を参照するため、ここで設定する。
+			c.session = s
+			var ack byte
+			if present {
+				ack = 1 // session present
+			}
+			if err := c.write(mqttConnack, 0, []byte{ack, mqttAccepted}); err != nil {
+				return fmt.Errorf("failed to send CONNACK: %w", err)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		slog.Info(fmt.Sprintf("mqtt: failed to attach session %s: %s", id, err))
+		if s != nil {
+			c.h.detachSession(s, c.sub)
+			if p.cleanSession {
+				c.h.discardSession(s)
+			}
+		}
+		return nil, false
+	}
+	c.sub.session = s
+
+	// 保持していた subscription を復元する。
+	// 新しいメッセージは topic に参加した後に届くため、c.session の設定より後になる。
+	for topic := range c.subscriptions() {
+		c.h.join(topic, c.sub)
+	}
+
+	slog.Info(fmt.Sprintf("mqtt: connected: %s (clean session: %t)", p.clientID, p.cleanSession))
+	return s, true
+}
+
+// handle は CONNECT 以降のパケットを処理する。
+// エラーを返した場合は切断する。
+func (c *mqttConn) handle(pkt mqttPacket) error {
+	switch pkt.typ {
+	case mqttPublish:
+		return c.handlePublish(pkt)
+
+	case mqttPuback:
+		d := &mqttDecoder{data: pkt.body}
+		pid := d.uint16()
+		if d.err != nil {
+			return d.err
+		}
+		c.ack(pid)
+		return nil
+
+	case mqttSubscribe:
+		return c.handleSubscribe(pkt)
+
+	case mqttUnsubscribe:
+		return c.handleUnsubscribe(pkt)
+
+	case mqttPingreq:
+		return c.write(mqttPingresp, 0, nil)
+
+	case mqttConnect:
+		return errors.New("CONNECT received twice")
+	}
+
+	return fmt.Errorf("%w: %d", errMQTTUnsupported, pkt.typ)
+}
+
+func (c *mqttConn) handlePublish(pkt mqttPacket) error {
+	qos := pkt.flags >> 1 & 0x03
+	retain := pkt.flags&0x01 != 0
+	if qos > mqttMaxQoS {
+		return fmt.Errorf("%w: QoS %d", errMQTTUnsupported, qos)
+	}
+
+	d := &mqttDecoder{data: pkt.body}
+	topic := d.string()
+	var pid uint16
+	if qos > 0 {
+		pid = d.uint16()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if !validMQTTTopic(topic) {
+		return fmt.Errorf("invalid topic name: %q", topic)
+	}
+	payload := d.data
+
+	// MQTT 3.1.1 には PUBLISH の拒否を伝える方法がないため、許可されない PUBLISH は破棄する。
+	if err := c.h.allowed(aclPublish, topic, c.sub); err != nil {
+		slog.Info(fmt.Sprintf("mqtt: %s", err))
+		if qos == 1 {
+			return c.write(mqttPuback, 0, binary.BigEndian.AppendUint16(nil, pid))
+		}
+		return nil
+	}
+
+	if retain {
+		c.h.retain(topic, payload)
+	}
+	if err := c.h.publishText(topic, payload, c.sub); err != nil {
+		slog.Error(fmt.Sprintf("mqtt: failed to publish: %s", err))
+	}
+
+	if qos == 1 {
+		return c.write(mqttPuback, 0, binary.BigEndian.AppendUint16(nil, pid))
+	}
+
+	return nil
+}
+
+func (c *mqttConn) handleSubscribe(pkt mqttPacket) error {
+	if pkt.flags != 0x02 {
+		return fmt.Errorf("%w: invalid SUBSCRIBE flags", errMQTTMalformed)
+	}
+
+	d := &mqttDecoder{data: pkt.body}
+	pid := d.uint16()
+
+	type request struct {
+		topic string
+		qos   byte
+	}
+	var reqs []request
+	for d.err == nil && len(d.data) > 0 {
+		reqs = append(reqs, request{topic: d.string(), qos: d.byte()})
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(reqs) == 0 {
+		return fmt.Errorf("%w: SUBSCRIBE without topic filters", errMQTTMalformed)
+	}
+
+	codes := binary.BigEndian.AppendUint16(nil, pid)
+	var subscribed []string
+	for _, r := range reqs {
+		if r.qos > 2 || !validMQTTTopic(r.topic) {
+			codes = append(codes, mqttSubscribeFailure)
+			continue
+		}
+		if err := c.h.allowed(aclSubscribe, r.topic, c.sub); err != nil {
+			slog.Info(fmt.Sprintf("mqtt: %s", err))
+			codes = append(codes, mqttSubscribeFailure)
+			continue
+		}
+
+		granted := min(r.qos, mqttMaxQoS)
+		if c.subscribe(r.topic, granted) {
+			c.h.join(r.topic, c.sub)
+		}
+		codes = append(codes, granted)
+		subscribed = append(subscribed, r.topic)
+	}
+
+	if err := c.write(mqttSuback, 0, codes); err != nil {
+		return err
+	}
+
+	// retained message は SUBACK の後に送信する。
+	for _, topic := range subscribed {
+		if err := c.h.sendRetained(topic, c.sub); err != nil {
+			slog.Error(fmt.Sprintf("mqtt: failed to send retained message: %s", err))
+		}
+	}
+
+	return nil
+}
+
+func (c *mqttConn) handleUnsubscribe(pkt mqttPacket) error {
+	if pkt.flags != 0x02 {
+		return fmt.Errorf("%w: invalid UNSUBSCRIBE flags", errMQTTMalformed)
+	}
+
+	d := &mqttDecoder{data: pkt.body}
+	pid := d.uint16()
+	for d.err == nil && len(d.data) > 0 {
+		topic := d.string()
+		if d.err == nil && c.unsubscribe(topic) {
+			c.h.leave(topic, c.sub)
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	return c.write(mqttUnsuback, 0, binary.BigEndian.AppendUint16(nil, pid))
+}
+
+// subscribe は subscription を session に記録する。
+// 新しく subscribe した topic の場合は true を返す。
+func (c *mqttConn) subscribe(topic string, qos byte) bool {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	_, ok := c.session.subscriptions[topic]
+	c.session.subscriptions[topic] = qos
+
+	return !ok
+}
+
+// unsubscribe は subscription を session から削除する。
+// subscribe していた topic の場合は true を返す。
+func (c *mqttConn) unsubscribe(topic string) bool {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	_, ok := c.session.subscriptions[topic]
+	delete(c.session.subscriptions, topic)
+
+	return ok
+}
+
+// subscriptions は session の subscription のコピーを返す。
+func (c *mqttConn) subscriptions() map[string]byte {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	return maps.Clone(c.session.subscriptions)
+}
+
+// publish はメッセージを PUBLISH パケットとして送信する。
+//
+// 仕様:
+//
+//	ID の付いたメッセージは、subscription の QoS が 1 の場合は packet ID を割り当てて QoS 1 で送信する。
+//	QoS 0 の subscription の場合は、送信と同時に ack する。
+//	再送のメッセージは QoS 1 で送信したものであるため、DUP を付けて QoS 1 で送信する。
+//	配信以外のメッセージ (エラーなど) は MQTT で表せないため送信しない。
+func (c *mqttConn) publish(m message) error {
+	if m.Kind != kindMessage {
+		slog.Debug(fmt.Sprintf("mqtt: %s message is not sent", m.Kind))
+		return nil
+	}
+
+	var flags byte
+	if m.Retain {
+		flags |= 0x01
+	}
+
+	body := appendMQTTString(nil, m.Topic)
+	if m.ID != "" {
+		if !m.Redelivered && c.qos(m.Topic) == 0 {
+			c.session.ack(m.ID)
+		} else {
+			flags |= 0x02 // QoS 1
+			if m.Redelivered {
+				flags |= 0x08 // DUP
+			}
+			body = binary.BigEndian.AppendUint16(body, c.packetID(m.ID))
+		}
+	}
+	body = append(body, m.Payload...)
+
+	return c.write(mqttPublish, flags, body)
+}
+
+// qos は topic の subscription の QoS を返す。
+// UNSUBSCRIBE の直後など、subscription がない topic は QoS 1 とする。
+func (c *mqttConn) qos(topic string) byte {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	qos, ok := c.session.subscriptions[topic]
+	if !ok {
+		return mqttMaxQoS
+	}
+
+	return qos
+}
+
+// packetID はメッセージ ID に packet ID を割り当てる。
+// 再送の場合は同じ packet ID を使う。
+func (c *mqttConn) packetID(msgID string) uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pid, ok := c.packetIDs[msgID]; ok {
+		return pid
+	}
+
+	// 0 は packet ID として使えない。
+	for {
+		c.nextID++
+		if _, ok := c.msgIDs[c.nextID]; c.nextID != 0 && !ok {
+			break
+		}
+	}
+
+	c.packetIDs[msgID] = c.nextID
+	c.msgIDs[c.nextID] = msgID
+
+	return c.nextID
+}
+
+// ack は PUBACK された packet ID のメッセージを ack する。
+func (c *mqttConn) ack(pid uint16) {
+	c.mu.Lock()
+	msgID, ok := c.msgIDs[pid]
+	delete(c.msgIDs, pid)
+	delete(c.packetIDs, msgID)
+	c.mu.Unlock()
+
+	if !ok {
+		slog.Debug(fmt.Sprintf("mqtt: PUBACK for unknown packet ID: %d", pid))
+		return
+	}
+
+	c.session.ack(msgID)
+}
+
+// write はパケットを BinaryFrame として送信する。
+func (c *mqttConn) write(typ, flags byte, body []byte) error {
+	return c.sub.w.writeMessage(websocket.BinaryFrame, appendMQTTPacket(nil, typ, flags, body))
+}
+
+// next は次のパケットを返す。
+// パケットは複数のフレームに分割されたり、1 つのフレームに複数含まれる場合があるため、
+// 受信したデータを buf に溜めてパケットに区切る。
+func (c *mqttConn) next(timeout time.Duration) (mqttPacket, error) {
+	for {
+		pkt, n, err := parseMQTTPacket(c.buf)
+		if err == nil {
+			c.buf = c.buf[n:]
+			return pkt, nil
+		}
+		if !errors.Is(err, errMQTTIncomplete) {
+			return mqttPacket{}, err
+		}
+
+		payloadType, b, err := c.sub.w.readMessage(timeout)
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		// MQTT のパケットは BinaryFrame で送る必要がある。
+		if payloadType != websocket.BinaryFrame {
+			return mqttPacket{}, errors.New("mqtt: TextFrame is not allowed")
+		}
+		c.buf = append(c.buf, b...)
+	}
+}
+
+// discardSession は切断中の session を、未 ack のメッセージとともに削除する。
+// 接続中の場合や、takeover で別の session に置き換わっている場合は削除しない。
+func (h *handler) discardSession(s *session) {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+
+	if h.sessions[s.id] != s {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sub == nil {
+		delete(h.sessions, s.id)
+	}
+}
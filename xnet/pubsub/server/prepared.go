@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+
+	"wire"
+)
+
+// preparedMessage は複数の subscriber に同じ内容を送信するメッセージ。
+//
+// 仕様:
+//
+//	エンコードとフレームの組み立ては format ごとに最初の送信時に 1 度だけ行い、
+//	以降の subscriber には同じバイト列をそのまま書き込む。(gorilla/websocket の PreparedMessage と同様)
+//	permessage-deflate のコネクションのうち、server_no_context_takeover のものには
+//	圧縮したフレームも使い回す。context takeover のものは圧縮の状態がコネクションごとに異なるため、
+//	エンコードしたペイロードのみを使い回し、圧縮はコネクションごとに行う。
+//
+// 注意)
+//   - 並行に使うことはできない。
+//   - Self や ID などの subscriber ごとに異なるフィールドを持つメッセージには使えない。
+type preparedMessage struct {
+	m      message
+	frames map[format]*preparedFrames
+}
+
+// preparedFrames は 1 つの format でエンコードしたメッセージと、そのフレーム。
+type preparedFrames struct {
+	opcode  byte
+	payload []byte
+	// raw は圧縮しないフレーム。
+	raw []byte
+	// compressed は no context takeover で圧縮したフレーム。最初に必要になった時に作る。
+	compressed []byte
+	// compressedSize は compressed のペイロードのサイズ。
+	compressedSize int
+}
+
+func newPreparedMessage(m message) *preparedMessage {
+	return &preparedMessage{
+		m:      m,
+		frames: make(map[format]*preparedFrames),
+	}
+}
+
+// supports は format のコネクションに preparedMessage を使えるかどうかを返す。
+// formatMQTT, formatSTOMP はパケット ID やサブスクリプションなど、コネクションごとに内容が異なるため使えない。
+func (pm *preparedMessage) supports(f format) bool {
+	return f == formatText || f == formatJSON || f == formatMsgpack
+}
+
+// framesFor は format でエンコードしたメッセージを返す。
+func (pm *preparedMessage) framesFor(f format) (*preparedFrames, error) {
+	if p, ok := pm.frames[f]; ok {
+		return p, nil
+	}
+
+	opcode, payload, err := encodeMessage(f, pm.m)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 0, 14+len(payload))
+	raw = wire.AppendFrameHeader(raw, opcode, false, len(payload))
+	raw = append(raw, payload...)
+
+	p := &preparedFrames{opcode: opcode, payload: payload, raw: raw}
+	pm.frames[f] = p
+
+	return p, nil
+}
+
+// compressors は preparedFrames の圧縮に使う wire.Compressor。
+var compressors = sync.Pool{
+	New: func() any {
+		return &wire.Compressor{NoContextTakeover: true}
+	},
+}
+
+// compressedFrame は no context takeover で圧縮したフレームを返す。
+func (p *preparedFrames) compressedFrame() ([]byte, error) {
+	if p.compressed != nil {
+		return p.compressed, nil
+	}
+
+	c := compressors.Get().(*wire.Compressor)
+	defer compressors.Put(c)
+
+	compressed, err := c.Compress(p.payload)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, 0, 14+len(compressed))
+	frame = wire.AppendFrameHeader(frame, p.opcode, true, len(compressed))
+	p.compressed = append(frame, compressed...)
+	p.compressedSize = len(compressed)
+
+	return p.compressed, nil
+}
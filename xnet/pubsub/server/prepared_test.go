@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// newDiscardSubscribers は書き込みを捨てる n 個の subscriber を作る。
+// newDeflater が nil の場合は permessage-deflate を使わない。
+func newDiscardSubscribers(n int, f format, newDeflater func() *deflater) []*subscriber {
+	subs := make([]*subscriber, n)
+	for i := range subs {
+		var d *deflater
+		if newDeflater != nil {
+			d = newDeflater()
+		}
+		subs[i] = &subscriber{
+			id:     uint64(i + 1),
+			format: f,
+			w: &xnetConn{
+				frameWriter: &frameWriter{
+					w:       bufio.NewWriter(io.Discard),
+					c:       nopCloser{},
+					deflate: d,
+				},
+			},
+		}
+	}
+
+	return subs
+}
+
+// BenchmarkBroadcast は 1 つのメッセージを 100 の subscriber に送信するコスト。
+// perSubscriber は subscriber ごとにエンコードとフレームの組み立てを行う以前の方法、
+// prepared は preparedMessage でエンコード済みのフレームを使い回す方法。
+func BenchmarkBroadcast(b *testing.B) {
+	const subscribers = 100
+
+	m := message{
+		Kind:    kindMessage,
+		Topic:   "t",
+		Payload: strings.Repeat(`{"type":"alert","level":3} `, 20),
+	}
+
+	deflates := []struct {
+		name string
+		new  func() *deflater
+	}{
+		{"none", nil},
+		{"noContextTakeover", func() *deflater {
+			return newDeflater(deflateParams{serverNoContextTakeover: true}, 256)
+		}},
+		{"contextTakeover", func() *deflater {
+			return newDeflater(deflateParams{}, 256)
+		}},
+	}
+
+	for _, f := range []format{formatText, formatJSON, formatMsgpack} {
+		for _, d := range deflates {
+			subs := newDiscardSubscribers(subscribers, f, d.new)
+
+			b.Run(fmt.Sprintf("%s/deflate=%s/perSubscriber", f, d.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					for _, sub := range subs {
+						if err := sub.send(m); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+
+			b.Run(fmt.Sprintf("%s/deflate=%s/prepared", f, d.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					pm := newPreparedMessage(m)
+					for _, sub := range subs {
+						if err := sub.w.writePrepared(pm, sub.format); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// newBufferSubscriber は書き込んだフレームを buf にためる subscriber を作る。
+func newBufferSubscriber(f format, d *deflater) (*subscriber, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	sub := &subscriber{
+		id:     1,
+		format: f,
+		w: &xnetConn{
+			frameWriter: &frameWriter{
+				w:       bufio.NewWriter(buf),
+				c:       nopCloser{},
+				deflate: d,
+			},
+		},
+	}
+
+	return sub, buf
+}
+
+// TestPreparedMatchesPerSubscriber は preparedMessage で送信したフレームが、
+// subscriber ごとにエンコードして送信したフレームとバイト単位で一致することを確認する。
+func TestPreparedMatchesPerSubscriber(t *testing.T) {
+	messages := []message{
+		{Kind: kindMessage, Topic: "t", Payload: strings.Repeat(`{"type":"alert","level":3} `, 20)},
+		// context takeover の場合は、直前のメッセージを参照して圧縮される。
+		{Kind: kindMessage, Topic: "t", Payload: strings.Repeat(`{"type":"alert","level":3} `, 20)},
+		// minSize 未満のメッセージは圧縮しない。
+		{Kind: kindMessage, Topic: "t", Payload: "short", Retain: true},
+		{Kind: kindMessage, Topic: "t", Payload: strings.Repeat("x", 70000)},
+	}
+
+	deflates := []struct {
+		name   string
+		params *deflateParams
+	}{
+		{"none", nil},
+		{"noContextTakeover", &deflateParams{serverNoContextTakeover: true}},
+		{"contextTakeover", &deflateParams{}},
+	}
+
+	for _, f := range []format{formatText, formatJSON, formatMsgpack} {
+		for _, d := range deflates {
+			t.Run(fmt.Sprintf("%s/deflate=%s", f, d.name), func(t *testing.T) {
+				newD := func() *deflater {
+					if d.params == nil {
+						return nil
+					}
+					return newDeflater(*d.params, 256)
+				}
+
+				want, wantBuf := newBufferSubscriber(f, newD())
+				// 同じ preparedMessage を複数の subscriber に送信し、使い回したフレームも確認する。
+				var prepared []*subscriber
+				var preparedBufs []*bytes.Buffer
+				for i := 0; i < 2; i++ {
+					sub, buf := newBufferSubscriber(f, newD())
+					prepared = append(prepared, sub)
+					preparedBufs = append(preparedBufs, buf)
+				}
+
+				for _, m := range messages {
+					if err := want.send(m); err != nil {
+						t.Fatal(err)
+					}
+					pm := newPreparedMessage(m)
+					for _, sub := range prepared {
+						if err := sub.w.writePrepared(pm, sub.format); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+
+				if wantBuf.Len() == 0 {
+					t.Fatal("no frames written")
+				}
+				for i, buf := range preparedBufs {
+					if !bytes.Equal(buf.Bytes(), wantBuf.Bytes()) {
+						t.Errorf("subscriber %d: prepared frames differ from per-subscriber frames\ngot:  % x\nwant: % x", i, head(buf.Bytes()), head(wantBuf.Bytes()))
+					}
+				}
+			})
+		}
+	}
+}
+
+// head はエラーメッセージに含めるため、b の先頭のみを返す。
+func head(b []byte) []byte {
+	return b[:min(len(b), 64)]
+}
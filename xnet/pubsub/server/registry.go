@@ -0,0 +1,232 @@
+package main
+
+import (
+	"hash/maphash"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// registryShards は registry のシャードの数。
+// topic をシャードに分けてロックすることで、別の topic への参加や離脱が互いに待たないようにする。
+const registryShards = 64
+
+// registry は topic ごとのコネクションと retained message を管理する。
+//
+// 仕様:
+//
+//	topic はハッシュでシャードに振り分け、シャードごとのロックで保護する。
+//	コネクションは subscriber.id をキーにした集合で管理するため、参加と離脱は O(1) で行える。
+//	fan-out で使うコネクション一覧は copy-on-write のスナップショットとして保持する。
+//	スナップショットは参加や離脱で破棄され、次に必要になった時に作り直す。
+//	そのため、publish のたびにコネクション一覧を複製することはない。
+type registry struct {
+	seed   maphash.Seed
+	shards [registryShards]registryShard
+
+	// gracePeriod はコネクションのない topic を破棄するまでの猶予 (time.Duration)。
+	// 設定の再読み込みで変わるため atomic に保持する。
+	gracePeriod atomic.Int64
+	// hooks は topic の作成時と破棄時に呼ばれる関数。
+	hooks topicHooks
+	// closed は close が呼ばれたかどうか。close 後は topic の破棄を予定しない。
+	closed atomic.Bool
+}
+
+// registryShard は registry の 1 つのシャード。
+type registryShard struct {
+	mu sync.RWMutex
+	// topics はシャードに振り分けられた topic。
+	// コネクションのない topic は、破棄されるまで (retained message を保持している間は破棄されない) 空の集合として残る。
+	topics map[string]*topicEntry
+	// timers は破棄を予定している topic ごとのタイマー。
+	timers map[string]*reclaimTimer
+}
+
+// topicEntry は 1 つの topic の状態。registryShard.mu で保護する。
+type topicEntry struct {
+	// members は subscriber.id ごとのコネクション。
+	members map[uint64]*subscriber
+	// snapshot は members の一覧。nil の場合は次の getConns で作り直す。
+	// 読み込みロックの中で作り直せるよう atomic.Pointer で保持する。
+	snapshot atomic.Pointer[[]*subscriber]
+
+	// retained は retained message のペイロード。hasRetained が false の場合は保持していない。
+	retained    string
+	hasRetained bool
+}
+
+// reclaimable はコネクションも retained message もなく、破棄できるかどうかを返す。
+func (t *topicEntry) reclaimable() bool {
+	return len(t.members) == 0 && !t.hasRetained
+}
+
+func newRegistry(gracePeriod time.Duration) *registry {
+	r := &registry{
+		seed: maphash.MakeSeed(),
+	}
+	r.gracePeriod.Store(int64(gracePeriod))
+	for i := range r.shards {
+		r.shards[i].topics = make(map[string]*topicEntry)
+		r.shards[i].timers = make(map[string]*reclaimTimer)
+	}
+
+	return r
+}
+
+// shard は topic が振り分けられるシャードを返す。
+func (r *registry) shard(topic string) *registryShard {
+	return &r.shards[maphash.String(r.seed, topic)%registryShards]
+}
+
+// getConns は topic に紐づくコネクション一覧を返す。
+//
+// 注意)
+//   - 返す一覧は他の呼び出し元と共有しているため、変更してはならない。
+//   - []*subscriber の各要素の値が変わってしまうことまでは防げない。
+func (r *registry) getConns(topic string) []*subscriber {
+	s := r.shard(topic)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.topics[topic]
+	if !ok {
+		return nil
+	}
+
+	if snapshot := t.snapshot.Load(); snapshot != nil {
+		return *snapshot
+	}
+
+	// 読み込みロックの中では members は変更されないため、
+	// 複数の呼び出し元が同時に作り直しても同じ内容になる。
+	snapshot := make([]*subscriber, 0, len(t.members))
+	for _, sub := range t.members {
+		snapshot = append(snapshot, sub)
+	}
+	t.snapshot.Store(&snapshot)
+
+	return snapshot
+}
+
+// join は topic にコネクションを追加する。
+// topic が存在しない場合は作成する。
+func (r *registry) join(topic string, sub *subscriber) {
+	s := r.shard(topic)
+	s.mu.Lock()
+	t, created := r.ensureTopicLocked(s, topic)
+	t.members[sub.id] = sub
+	t.snapshot.Store(nil)
+	s.mu.Unlock()
+
+	if created {
+		r.fireTopicCreated(topic)
+	}
+}
+
+// leave は topic からコネクションを削除する。
+// topic のコネクションがなくなった場合は、gracePeriod の後に topic を破棄する。
+func (r *registry) leave(topic string, sub *subscriber) {
+	s := r.shard(topic)
+	s.mu.Lock()
+	destroyed := false
+	if t, ok := s.topics[topic]; ok && t.members[sub.id] == sub {
+		delete(t.members, sub.id)
+		t.snapshot.Store(nil)
+		destroyed = r.scheduleReclaimLocked(s, topic)
+	}
+	s.mu.Unlock()
+
+	if destroyed {
+		r.fireTopicDestroyed(topic)
+	}
+}
+
+// retain は topic の retained message を更新する。
+// ペイロードが空の場合は retained message を削除する。
+//
+// retained message は topic に保持するため、topic が存在しない場合は作成する。
+// retained message を保持している間は topic を破棄せず、削除した時にコネクションがなければ破棄を予定する。
+func (r *registry) retain(topic string, payload []byte) {
+	s := r.shard(topic)
+
+	if len(payload) == 0 {
+		s.mu.Lock()
+		destroyed := false
+		if t, ok := s.topics[topic]; ok {
+			t.retained, t.hasRetained = "", false
+			destroyed = r.scheduleReclaimLocked(s, topic)
+		}
+		s.mu.Unlock()
+
+		if destroyed {
+			r.fireTopicDestroyed(topic)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	t, created := r.ensureTopicLocked(s, topic)
+	t.retained, t.hasRetained = string(payload), true
+	s.mu.Unlock()
+
+	if created {
+		r.fireTopicCreated(topic)
+	}
+}
+
+// getRetained は topic の retained message を返す。
+func (r *registry) getRetained(topic string) (string, bool) {
+	s := r.shard(topic)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.topics[topic]
+	if !ok || !t.hasRetained {
+		return "", false
+	}
+
+	return t.retained, true
+}
+
+// count は存在している topic の数を返す。
+func (r *registry) count() int {
+	n := 0
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.RLock()
+		n += len(s.topics)
+		s.mu.RUnlock()
+	}
+
+	return n
+}
+
+// close は全ての topic を削除し、参加していたコネクションを重複なく返す。
+// 破棄の予定は取り消し、以降は予定しない。
+func (r *registry) close() []*subscriber {
+	r.closed.Store(true)
+
+	conns := make(map[uint64]*subscriber)
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		for topic, t := range s.timers {
+			t.timer.Stop()
+			delete(s.timers, topic)
+		}
+		for topic, t := range s.topics {
+			maps.Copy(conns, t.members)
+			delete(s.topics, topic)
+		}
+		s.mu.Unlock()
+	}
+
+	subs := make([]*subscriber, 0, len(conns))
+	for _, sub := range conns {
+		subs = append(subs, sub)
+	}
+
+	return subs
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// topicsMuRegistry は registry 導入前の設計。
+// topic ごとのスライスを 1 つの RWMutex で保護し、leave は線形探索、getConns は毎回複製する。
+// registry との比較のためにのみ残している。
+type topicsMuRegistry struct {
+	topics   map[string][]*subscriber
+	topicsMu sync.RWMutex
+}
+
+func (r *topicsMuRegistry) getConns(topic string) []*subscriber {
+	r.topicsMu.RLock()
+	defer r.topicsMu.RUnlock()
+
+	return slices.Clone(r.topics[topic])
+}
+
+func (r *topicsMuRegistry) join(topic string, sub *subscriber) {
+	r.topicsMu.Lock()
+	defer r.topicsMu.Unlock()
+
+	r.topics[topic] = append(r.topics[topic], sub)
+}
+
+func (r *topicsMuRegistry) leave(topic string, sub *subscriber) {
+	r.topicsMu.Lock()
+	defer r.topicsMu.Unlock()
+
+	conns := r.topics[topic]
+	for i, conn := range conns {
+		if conn == sub {
+			r.topics[topic] = slices.Delete(conns, i, i+1)
+			return
+		}
+	}
+}
+
+type topicRegistry interface {
+	getConns(topic string) []*subscriber
+	join(topic string, sub *subscriber)
+	leave(topic string, sub *subscriber)
+}
+
+var registryImpls = []struct {
+	name string
+	new  func() topicRegistry
+}{
+	{"topicsMu", func() topicRegistry { return &topicsMuRegistry{topics: make(map[string][]*subscriber)} }},
+	{"registry", func() topicRegistry { return newRegistry(0) }},
+}
+
+var subscriberCounts = []int{10, 1_000, 10_000}
+
+func newSubscribers(n int) []*subscriber {
+	subs := make([]*subscriber, n)
+	for i := range subs {
+		subs[i] = &subscriber{id: uint64(i + 1)}
+	}
+
+	return subs
+}
+
+// BenchmarkLeave は subscriber の多い topic で、1 つのコネクションが離脱して再び参加するコスト。
+// topicsMu では離脱するコネクションが後ろにあるほど線形探索が長くなるため、最後のコネクションで計測する。
+func BenchmarkLeave(b *testing.B) {
+	for _, impl := range registryImpls {
+		for _, n := range subscriberCounts {
+			b.Run(fmt.Sprintf("%s/subscribers=%d", impl.name, n), func(b *testing.B) {
+				r := impl.new()
+				subs := newSubscribers(n)
+				for _, sub := range subs {
+					r.join("t", sub)
+				}
+				last := subs[n-1]
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					r.leave("t", last)
+					r.join("t", last)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkFanOut は publish のたびに topic のコネクション一覧を取得するコスト。
+func BenchmarkFanOut(b *testing.B) {
+	for _, impl := range registryImpls {
+		for _, n := range subscriberCounts {
+			b.Run(fmt.Sprintf("%s/subscribers=%d", impl.name, n), func(b *testing.B) {
+				r := impl.new()
+				for _, sub := range newSubscribers(n) {
+					r.join("t", sub)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						for _, conn := range r.getConns("t") {
+							_ = conn
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkChurn は多数の topic で並行に参加、離脱、publish が起きる場合のコスト。
+// topicsMu では別の topic への操作も 1 つのロックを待つ。
+func BenchmarkChurn(b *testing.B) {
+	const topics = 256
+
+	for _, impl := range registryImpls {
+		b.Run(impl.name, func(b *testing.B) {
+			r := impl.new()
+			names := make([]string, topics)
+			for i := range names {
+				names[i] = fmt.Sprintf("t%d", i)
+				for _, sub := range newSubscribers(100) {
+					r.join(names[i], sub)
+				}
+			}
+
+			var seq atomic.Uint64
+			seq.Store(1 << 32)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				sub := &subscriber{id: seq.Add(1)}
+				for i := 0; pb.Next(); i++ {
+					topic := names[(i*7+int(sub.id))%topics]
+					r.join(topic, sub)
+					for _, conn := range r.getConns(topic) {
+						_ = conn
+					}
+					r.leave(topic, sub)
+				}
+			})
+		})
+	}
+}
+
+func TestRetainKeepsTopic(t *testing.T) {
+	for _, gracePeriod := range []time.Duration{0, 10 * time.Millisecond} {
+		r := newRegistry(gracePeriod)
+		sub := &subscriber{id: 1}
+
+		// コネクションのない topic に保持しても破棄しない。
+		r.retain("news", []byte("hello"))
+		r.join("news", sub)
+		r.leave("news", sub)
+		time.Sleep(5 * gracePeriod)
+		if got, ok := r.getRetained("news"); !ok || got != "hello" {
+			t.Errorf("gracePeriod=%s: getRetained = %q, %v, want hello", gracePeriod, got, ok)
+		}
+
+		// retained message を削除すると破棄する。
+		r.retain("news", nil)
+		deadline := time.Now().Add(time.Second)
+		for r.count() != 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if n := r.count(); n != 0 {
+			t.Errorf("gracePeriod=%s: %d topics after clearing retained message, want 0", gracePeriod, n)
+		}
+	}
+}
+
+// ids は subs の id を昇順で返す。
+func ids(subs []*subscriber) []uint64 {
+	ids := make([]uint64, 0, len(subs))
+	for _, sub := range subs {
+		ids = append(ids, sub.id)
+	}
+	slices.Sort(ids)
+
+	return ids
+}
+
+func TestRegistryJoinLeave(t *testing.T) {
+	r := newRegistry(time.Minute)
+	subs := newSubscribers(3)
+	for _, sub := range subs {
+		r.join("news", sub)
+	}
+	r.join("sports", subs[0])
+
+	if got := ids(r.getConns("news")); !slices.Equal(got, []uint64{1, 2, 3}) {
+		t.Errorf("news = %v, want [1 2 3]", got)
+	}
+	if got := ids(r.getConns("sports")); !slices.Equal(got, []uint64{1}) {
+		t.Errorf("sports = %v, want [1]", got)
+	}
+
+	r.leave("news", subs[1])
+	// 同じ id でも別のコネクションは削除しない。
+	r.leave("news", &subscriber{id: 3})
+	// 参加していない topic からの離脱は何もしない。
+	r.leave("weather", subs[0])
+
+	if got := ids(r.getConns("news")); !slices.Equal(got, []uint64{1, 3}) {
+		t.Errorf("news after leave = %v, want [1 3]", got)
+	}
+	if got := r.getConns("weather"); got != nil {
+		t.Errorf("weather = %v, want nil", got)
+	}
+	if n := r.count(); n != 2 {
+		t.Errorf("count = %d, want 2", n)
+	}
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	r := newRegistry(time.Minute)
+	subs := newSubscribers(3)
+	r.join("news", subs[0])
+	r.join("news", subs[1])
+
+	// 参加や離脱がない間は同じスナップショットを返す。
+	first := r.getConns("news")
+	if second := r.getConns("news"); &first[0] != &second[0] {
+		t.Error("snapshot is rebuilt without membership change")
+	}
+
+	// 参加や離脱の後は作り直し、以前のスナップショットは変更しない。
+	r.join("news", subs[2])
+	joined := r.getConns("news")
+	if got := ids(joined); !slices.Equal(got, []uint64{1, 2, 3}) {
+		t.Errorf("after join = %v, want [1 2 3]", got)
+	}
+	if got := ids(first); !slices.Equal(got, []uint64{1, 2}) {
+		t.Errorf("previous snapshot = %v, want [1 2]", got)
+	}
+
+	r.leave("news", subs[0])
+	if got := ids(r.getConns("news")); !slices.Equal(got, []uint64{2, 3}) {
+		t.Errorf("after leave = %v, want [2 3]", got)
+	}
+	if got := ids(joined); !slices.Equal(got, []uint64{1, 2, 3}) {
+		t.Errorf("previous snapshot = %v, want [1 2 3]", got)
+	}
+}
+
+// topicEvents は topic の作成と破棄の hook の呼び出しを記録する。
+type topicEvents struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *topicEvents) record(r *registry) {
+	r.onTopicCreated(func(topic string) { e.add("created " + topic) })
+	r.onTopicDestroyed(func(topic string) { e.add("destroyed " + topic) })
+}
+
+func (e *topicEvents) add(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.events = append(e.events, event)
+}
+
+func (e *topicEvents) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return slices.Clone(e.events)
+}
+
+func TestRegistryReclaim(t *testing.T) {
+	const gracePeriod = 50 * time.Millisecond
+
+	r := newRegistry(gracePeriod)
+	var events topicEvents
+	events.record(r)
+	sub := &subscriber{id: 1}
+
+	// 猶予の間に再び参加した場合は破棄しない。
+	r.join("news", sub)
+	r.leave("news", sub)
+	time.Sleep(gracePeriod / 2)
+	r.join("news", sub)
+	time.Sleep(gracePeriod)
+	if n := r.count(); n != 1 {
+		t.Fatalf("count after rejoin = %d, want 1", n)
+	}
+
+	// 猶予が過ぎると破棄する。
+	r.leave("news", sub)
+	if n := r.count(); n != 1 {
+		t.Errorf("count during grace period = %d, want 1", n)
+	}
+	deadline := time.Now().Add(time.Second)
+	for r.count() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := r.count(); n != 0 {
+		t.Fatalf("count after grace period = %d, want 0", n)
+	}
+	if got, want := events.get(), []string{"created news", "destroyed news"}; !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+
+	// 猶予が 0 の場合はすぐに破棄する。
+	r.setGracePeriod(0)
+	r.join("sports", sub)
+	r.leave("sports", sub)
+	if n := r.count(); n != 0 {
+		t.Errorf("count with no grace period = %d, want 0", n)
+	}
+}
+
+// TestRegistryConcurrent は並行な参加、離脱と fan-out の一覧の取得で、一覧が壊れないことを確認する。
+// データ競合の検出のため -race で実行する。
+func TestRegistryConcurrent(t *testing.T) {
+	const (
+		topics     = 8
+		publishers = 4
+		joiners    = 16
+		rounds     = 500
+	)
+
+	r := newRegistry(time.Millisecond)
+	names := make([]string, topics)
+	for i := range names {
+		names[i] = fmt.Sprintf("t%d", i)
+	}
+	// 最後まで参加しているコネクション。
+	stay := newSubscribers(topics)
+	for i, sub := range stay {
+		r.join(names[i], sub)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				seen := make(map[uint64]bool)
+				for _, sub := range r.getConns(names[i%topics]) {
+					if sub == nil || seen[sub.id] {
+						t.Errorf("broken snapshot: %v", sub)
+						return
+					}
+					seen[sub.id] = true
+				}
+			}
+		}()
+	}
+
+	var joinWG sync.WaitGroup
+	for j := 0; j < joiners; j++ {
+		joinWG.Add(1)
+		go func() {
+			defer joinWG.Done()
+			sub := &subscriber{id: uint64(1000 + j)}
+			for i := 0; i < rounds; i++ {
+				topic := names[(i+j)%topics]
+				r.join(topic, sub)
+				r.leave(topic, sub)
+			}
+		}()
+	}
+	joinWG.Wait()
+	close(done)
+	wg.Wait()
+
+	for i, topic := range names {
+		if got := ids(r.getConns(topic)); !slices.Equal(got, []uint64{stay[i].id}) {
+			t.Errorf("%s = %v, want [%d]", topic, got, stay[i].id)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// retain は topic の retained message を更新する。
+//
+// 仕様:
+//
+//	ペイロードが空の場合は retained message を削除する。
+//	retained message を保持している topic は破棄されない。削除するとコネクションのない topic は破棄される。
+func (h *handler) retain(topic string, payload []byte) {
+	h.topics.retain(topic, payload)
+
+	if len(payload) == 0 {
+		slog.Debug(fmt.Sprintf("retained message cleared: %s", topic))
+	}
+}
+
+// getRetained は topic の retained message を返す。
+func (h *handler) getRetained(topic string) (string, bool) {
+	return h.topics.getRetained(topic)
+}
+
+// sendRetained は topic に retained message があれば subscriber に送信する。
+func (h *handler) sendRetained(topic string, sub *subscriber) error {
+	payload, ok := h.getRetained(topic)
+	if !ok {
+		return nil
+	}
+
+	if sub.filter != nil && !sub.filter.Match([]byte(payload)) {
+		return nil
+	}
+
+	return h.sendMessage(sub, message{
+		Kind:    kindMessage,
+		Topic:   topic,
+		Payload: payload,
+		Retain:  true,
+	})
+}
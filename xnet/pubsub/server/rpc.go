@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// inboxPrefix は reply を受け取るための inbox の接頭辞。
+// inbox はコネクションごとに専用のため、topic として subscribe することはできない。
+const inboxPrefix = "_inbox."
+
+var (
+	errNoResponders = errors.New("no responders")
+	errNoSuchInbox  = errors.New("no such inbox")
+)
+
+// isInbox は topic が inbox の名前かどうかを返す。
+func isInbox(topic string) bool {
+	return strings.HasPrefix(topic, inboxPrefix)
+}
+
+// newInbox は推測されにくい inbox の名前を生成する。
+func newInbox() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return inboxPrefix + hex.EncodeToString(b)
+}
+
+// registerInbox は subscriber に inbox を割り当てる。
+func (h *handler) registerInbox(sub *subscriber) {
+	sub.inbox = newInbox()
+
+	h.inboxesMu.Lock()
+	defer h.inboxesMu.Unlock()
+
+	h.inboxes[sub.inbox] = sub
+}
+
+// unregisterInbox は subscriber の inbox を削除する。
+func (h *handler) unregisterInbox(sub *subscriber) {
+	h.inboxesMu.Lock()
+	defer h.inboxesMu.Unlock()
+
+	delete(h.inboxes, sub.inbox)
+}
+
+// request は topic の subscriber にリクエストを送信する。
+//
+// 仕様:
+//
+//	replyTo にはリクエスト元の inbox を設定する。クライアントが指定した値は使わない。
+//	reply を返せない pubsub.v1.text の subscriber とリクエスト元自身には送信しない。
+//	送信先が 1 つもない場合は、リクエスト元に no responders のエラーを返す。
+func (h *handler) request(topic string, m message, requester *subscriber) error {
+	if m.CorrelationID == "" {
+		return errors.New("request without correlationId")
+	}
+	// リクエストも topic の subscriber に届くため、publish と同じく ACL で判定する。
+	if err := h.allowed(aclPublish, topic, requester); err != nil {
+		requester.send(message{Kind: kindError, Topic: topic, CorrelationID: m.CorrelationID, Error: err.Error()})
+		return err
+	}
+
+	req := message{
+		Kind:          kindRequest,
+		Topic:         topic,
+		Payload:       m.Payload,
+		CorrelationID: m.CorrelationID,
+		ReplyTo:       requester.inbox,
+	}
+
+	sent := 0
+	for _, conn := range h.getConns(topic) {
+		if conn == requester || !conn.format.hasEnvelope() {
+			continue
+		}
+
+		if conn.filter != nil && !conn.filter.Match([]byte(m.Payload)) {
+			continue
+		}
+
+		if err := conn.send(req); err != nil {
+			slog.Error(fmt.Sprintf("failed to send request: %s", err))
+			continue
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		return requester.send(message{
+			Kind:          kindError,
+			CorrelationID: m.CorrelationID,
+			Error:         errNoResponders.Error(),
+		})
+	}
+
+	return nil
+}
+
+// reply は replyTo の inbox を持つコネクションに reply を送信する。
+// inbox が存在しない場合は、返信元に no such inbox のエラーを返す。
+func (h *handler) reply(m message, responder *subscriber) error {
+	h.inboxesMu.RLock()
+	requester, ok := h.inboxes[m.ReplyTo]
+	h.inboxesMu.RUnlock()
+
+	if !ok {
+		return responder.send(message{
+			Kind:          kindError,
+			CorrelationID: m.CorrelationID,
+			Error:         errNoSuchInbox.Error(),
+		})
+	}
+
+	return requester.send(message{
+		Kind:          kindReply,
+		Payload:       m.Payload,
+		CorrelationID: m.CorrelationID,
+	})
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wire"
+	"wstest"
+)
+
+// startServer は transport で接続を受け付ける pubsub サーバーを空いているポートで起動する。
+func startServer(t testing.TB, transport string) (*wstest.Server, *handler) {
+	t.Helper()
+
+	cfg := defaultConfig()
+	cfg.Transport = transport
+
+	return startServerConfig(t, cfg, nil)
+}
+
+// startServerConfig は cfg の pubsub サーバーを空いているポートで起動する。
+// wrap を指定した場合は、WebSocket の接続を受け付けるハンドラーを wrap で包む。
+func startServerConfig(t testing.TB, cfg config, wrap func(http.Handler) http.Handler) (*wstest.Server, *handler) {
+	t.Helper()
+
+	h := newHandler(cfg, deflateConfig{})
+	t.Cleanup(h.close)
+
+	ws, err := h.newTransportHandler(cfg.Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrap != nil {
+		ws = wrap(ws)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /{topic}", ws)
+	mux.HandleFunc("GET /healthz", h.healthz)
+	mux.HandleFunc("GET /readyz", h.readyz)
+
+	return wstest.Start(t, mux), h
+}
+
+// waitJoined は topic に n 個のコネクションが参加するまで待つ。
+func waitJoined(t testing.TB, h *handler, topic string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(wstest.DefaultTimeout)
+	for len(h.getConns(topic)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d connections on %s, want %d", len(h.getConns(topic)), topic, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitLeft は topic のコネクションが n 個になるまで待つ。
+func waitLeft(t testing.TB, h *handler, topic string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(wstest.DefaultTimeout)
+	for len(h.getConns(topic)) > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d connections on %s, want %d", len(h.getConns(topic)), topic, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	for _, transport := range transportNames() {
+		t.Run(transport, func(t *testing.T) {
+			s, h := startServer(t, transport)
+
+			pub := wstest.Dial(t, s.URL("/news"), string(formatJSON))
+			sub := wstest.Dial(t, s.URL("/news"), string(formatText))
+			other := wstest.Dial(t, s.URL("/sports"), string(formatText))
+			waitJoined(t, h, "news", 2)
+			waitJoined(t, h, "sports", 1)
+
+			pub.Run(wstest.SendText(`{"kind":"publish","payload":"hello"}`))
+			sub.Run(wstest.ExpectText("hello"))
+			// echo を指定しない場合、自身の publish は受け取らない。
+			pub.Run(wstest.ExpectNoMessage(100 * time.Millisecond))
+			other.Run(wstest.ExpectNoMessage(100 * time.Millisecond))
+
+			sub.Run(wstest.SendText("world"))
+			pub.Run(wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"world"}`))
+		})
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	for _, transport := range transportNames() {
+		t.Run(transport, func(t *testing.T) {
+			s, _ := startServer(t, transport)
+
+			c := wstest.Dial(t, s.URL("/news"), string(formatText))
+			c.Run(
+				wstest.SendClose(wire.CloseStatusNormal, ""),
+				wstest.ExpectClose(wire.CloseStatusNormal),
+			)
+		})
+	}
+}
+
+func TestRejectHandshake(t *testing.T) {
+	for _, transport := range transportNames() {
+		t.Run(transport, func(t *testing.T) {
+			s, _ := startServer(t, transport)
+
+			tests := []struct {
+				path   string
+				format format
+			}{
+				{"/" + inboxPrefix + "x", formatText},
+				{"/news?delivery=at-least-once", formatText},
+				// MQTT, STOMP の session には接続できない。
+				{"/news?delivery=at-least-once&session=" + mqttSessionPrefix + "device", formatJSON},
+				{"/news?delivery=at-least-once&session=" + stompSessionPrefix + "0", formatJSON},
+				// health check の path と重なる topic には接続できない。
+				{"/healthz", formatText},
+				{"/readyz", formatText},
+			}
+			for _, tt := range tests {
+				header := http.Header{"Sec-WebSocket-Protocol": {string(tt.format)}}
+				_, resp, err := wstest.Handshake(t, s.URL(tt.path), header)
+				if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+					t.Errorf("%s: got %v, want 403", tt.path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	s, h := startServer(t, "xnet")
+
+	get := func() int {
+		resp, err := http.Get(s.HTTPURL("/readyz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Errorf("got %d before drain, want 200", code)
+	}
+	h.ready.drain()
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("got %d while draining, want 503", code)
+	}
+	header := http.Header{"Sec-WebSocket-Protocol": {string(formatText)}}
+	if _, resp, _ := wstest.Handshake(t, s.URL("/news"), header); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %v while draining, want 403", resp)
+	}
+}
+
+// mqttConnectFrame は clientID の CONNECT パケットの BinaryFrame を返す。
+func mqttConnectFrame(clientID string, cleanSession bool) wstest.Frame {
+	var flags byte
+	if cleanSession {
+		flags |= 0x02
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, mqttProtocolLevel, flags, 0, 60)
+	body = appendMQTTString(body, clientID)
+
+	return wstest.Binary(appendMQTTPacket(nil, mqttConnect, 0, body))
+}
+
+func TestMQTTTakeover(t *testing.T) {
+	for _, transport := range transportNames() {
+		t.Run(transport, func(t *testing.T) {
+			s, _ := startServer(t, transport)
+
+			old := wstest.Dial(t, s.URL("/mqtt"), string(formatMQTT))
+			old.Run(
+				wstest.Send(mqttConnectFrame("device", false)),
+				wstest.ExpectBinary(appendMQTTPacket(nil, mqttConnack, 0, []byte{0, mqttAccepted})),
+			)
+
+			// 同じ client ID で接続すると、接続中のクライアントを切断して session を引き継ぐ。
+			c := wstest.Dial(t, s.URL("/mqtt"), string(formatMQTT))
+			c.Run(
+				wstest.Send(mqttConnectFrame("device", false)),
+				wstest.ExpectBinary(appendMQTTPacket(nil, mqttConnack, 0, []byte{1, mqttAccepted})),
+			)
+			old.Run(wstest.ExpectClose(wire.CloseStatusNormal))
+
+			// clean session の場合は引き継がない。
+			clean := wstest.Dial(t, s.URL("/mqtt"), string(formatMQTT))
+			clean.Run(
+				wstest.Send(mqttConnectFrame("device", true)),
+				wstest.ExpectBinary(appendMQTTPacket(nil, mqttConnack, 0, []byte{0, mqttAccepted})),
+			)
+			c.Run(wstest.ExpectClose(wire.CloseStatusNormal))
+		})
+	}
+}
+
+func TestACL(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ACL = []aclRule{
+		{Topic: "news", Allow: []string{aclSubscribe, aclPublish}},
+		{Topic: "*", Allow: []string{aclSubscribe}},
+	}
+	s, h := startServerConfig(t, cfg, nil)
+
+	// request も publish と同じく判定する。
+	c := wstest.Dial(t, s.URL("/news"), string(formatJSON))
+	c.Run(
+		wstest.SendText(`{"kind":"request","topic":"alerts","correlationId":"1","payload":"x"}`),
+		wstest.ExpectJSON(`{"kind":"error","topic":"alerts","correlationId":"1","error":"publish to alerts is not allowed"}`),
+	)
+
+	// publish が許可されない topic を last will に指定した接続は拒否する。
+	header := http.Header{"Sec-WebSocket-Protocol": {string(formatText)}}
+	if _, resp, err := wstest.Handshake(t, s.URL("/news?willTopic=alerts&willPayload=bye"), header); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("will to alerts: got %v, want 403", err)
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, mqttProtocolLevel, 0x02|0x04, 0, 60)
+	body = appendMQTTString(body, "device")
+	body = appendMQTTString(body, "alerts")
+	body = appendMQTTString(body, "bye")
+	m := wstest.Dial(t, s.URL("/mqtt"), string(formatMQTT))
+	m.Run(
+		wstest.Send(wstest.Binary(appendMQTTPacket(nil, mqttConnect, 0, body))),
+		wstest.ExpectBinary(appendMQTTPacket(nil, mqttConnack, 0, []byte{0, mqttNotAuthorized})),
+	)
+
+	// 接続後に publish が許可されなくなった場合、last will は publish しない。
+	sub := wstest.Dial(t, s.URL("/news"), string(formatText))
+	will := wstest.Dial(t, s.URL("/news?willTopic=news&willPayload=bye"), string(formatText))
+	waitJoined(t, h, "news", 3)
+
+	cfg.ACL = []aclRule{{Topic: "*", Allow: []string{aclSubscribe}}}
+	h.applyConfig(cfg)
+	will.Run(wstest.Drop())
+	sub.Run(wstest.ExpectNoMessage(200 * time.Millisecond))
+}
+
+func TestPayloadTooLarge(t *testing.T) {
+	prev := maxPayloadSize
+	maxPayloadSize = 16
+	t.Cleanup(func() { maxPayloadSize = prev })
+
+	// 読み捨てられる transport はコネクションを閉じずに続けて読み込み、それ以外は 1009 で閉じる。
+	tests := map[string]bool{
+		"xnet":    true,
+		"gobwas":  true,
+		"gorilla": false,
+		"nhooyr":  false,
+	}
+	for _, transport := range transportNames() {
+		t.Run(transport, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Transport = transport
+			// 読み込みのエラーを繰り返すと、ライブラリによっては panic する。
+			var panicked atomic.Value
+			s, h := startServerConfig(t, cfg, func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					defer func() {
+						if p := recover(); p != nil {
+							panicked.Store(p)
+						}
+					}()
+					next.ServeHTTP(w, req)
+				})
+			})
+
+			c := wstest.Dial(t, s.URL("/news"), string(formatText))
+			sub := wstest.Dial(t, s.URL("/news"), string(formatText))
+			waitJoined(t, h, "news", 2)
+
+			c.Run(wstest.SendText(strings.Repeat("a", 100)))
+			if !tests[transport] {
+				c.Run(wstest.ExpectClose(wire.CloseStatusTooBig))
+				waitLeft(t, h, "news", 1)
+				if p := panicked.Load(); p != nil {
+					t.Fatalf("handler panicked: %v", p)
+				}
+				return
+			}
+			c.Run(wstest.SendText("small"))
+			sub.Run(wstest.ExpectText("small"))
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	s, h := startServer(t, "xnet")
+
+	pub := wstest.Dial(t, s.URL("/news"), string(formatText))
+	sub := wstest.Dial(t, s.URL("/news?filter="+url.QueryEscape("level >= 3")), string(formatText))
+	waitJoined(t, h, "news", 2)
+
+	pub.Run(
+		wstest.SendText(`{"level":1}`),
+		wstest.SendText(`{"level":5}`),
+	)
+	sub.Run(
+		wstest.ExpectText(`{"level":5}`),
+		wstest.ExpectNoMessage(100*time.Millisecond),
+	)
+
+	header := http.Header{"Sec-WebSocket-Protocol": {string(formatText)}}
+	if _, resp, err := wstest.Handshake(t, s.URL("/news?filter="+url.QueryEscape("level >=")), header); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("invalid filter: got %v, want 403", err)
+	}
+}
+
+// brokenConn は書き込みが常に失敗する wsConn。
+type brokenConn struct{ wsConn }
+
+func (brokenConn) writeMessage(byte, []byte) error              { return errors.New("broken") }
+func (brokenConn) writePrepared(*preparedMessage, format) error { return errors.New("broken") }
+
+func TestPublishContinuesOnSendError(t *testing.T) {
+	s, h := startServer(t, "xnet")
+
+	sub := wstest.Dial(t, s.URL("/news"), string(formatText))
+	waitJoined(t, h, "news", 1)
+	broken := &subscriber{id: 0, w: brokenConn{}, format: formatText}
+	h.join("news", broken)
+	t.Cleanup(func() { h.leave("news", broken) })
+
+	err := h.publishText("news", []byte("hello"), nil)
+	if err == nil {
+		t.Error("got nil error, want send failure")
+	}
+	sub.Run(wstest.ExpectText("hello"))
+}
+
+// waitDetached は session id のコネクションが切断されるまで待つ。
+func waitDetached(t testing.TB, h *handler, id string) {
+	t.Helper()
+
+	attached := func() bool {
+		h.sessionsMu.Lock()
+		s, ok := h.sessions[id]
+		h.sessionsMu.Unlock()
+		if !ok {
+			return false
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.sub != nil
+	}
+
+	deadline := time.Now().Add(wstest.DefaultTimeout)
+	for attached() {
+		if time.Now().After(deadline) {
+			t.Fatalf("session %s is still attached", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAtLeastOnce(t *testing.T) {
+	s, h := startServer(t, "xnet")
+	path := "/news?delivery=at-least-once&session=s1"
+
+	pub := wstest.Dial(t, s.URL("/news"), string(formatText))
+	sub := wstest.Dial(t, s.URL(path), string(formatJSON))
+	waitJoined(t, h, "news", 2)
+
+	pub.Run(
+		wstest.SendText("first"),
+		wstest.SendText("second"),
+	)
+	sub.Run(
+		wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"first","id":"1"}`),
+		wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"second","id":"2"}`),
+		// ack したメッセージは再送されない。
+		wstest.SendText(`{"kind":"ack","id":"1"}`),
+		wstest.Drop(),
+	)
+	waitDetached(t, h, "s1")
+
+	// 再接続すると、未 ack のメッセージが再送される。
+	sub = wstest.Dial(t, s.URL(path), string(formatJSON))
+	sub.Run(
+		wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"second","id":"2","redelivered":true}`),
+		wstest.ExpectNoMessage(100*time.Millisecond),
+	)
+	waitJoined(t, h, "news", 2)
+
+	// 再送が上限を超えると、dead letter topic に送られる。
+	dlq := wstest.Dial(t, s.URL("/"+deadLetterTopic("news")), string(formatText))
+	waitJoined(t, h, deadLetterTopic("news"), 1)
+
+	now := time.Now()
+	for i := 2; i <= maxRedeliveries; i++ {
+		now = now.Add(ackTimeout)
+		h.redeliver(now)
+		sub.Run(wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"second","id":"2","redelivered":true}`))
+	}
+	h.redeliver(now.Add(ackTimeout))
+	dlq.Run(wstest.ExpectText("second"))
+	sub.Run(wstest.ExpectNoMessage(100 * time.Millisecond))
+}
+
+// sendSTOMP は STOMP のフレームを TextFrame で送信する。
+func sendSTOMP(command string, headers [][2]string, body string) wstest.Step {
+	return wstest.SendText(string(appendSTOMPFrame(nil, command, headers, []byte(body))))
+}
+
+// expectSTOMP は次のデータメッセージが command の STOMP のフレームであることを検証する。
+// headers に指定したヘッダーのみを比較し、他のヘッダーは無視する。
+func expectSTOMP(command string, headers [][2]string, body string) wstest.Step {
+	return wstest.ExpectMessage(func(_ byte, payload []byte) error {
+		f, _, err := parseSTOMPFrame(payload)
+		if err != nil {
+			return fmt.Errorf("got %q: %w", payload, err)
+		}
+		if f.command != command || string(f.body) != body {
+			return fmt.Errorf("got %q, want %s with body %q", payload, command, body)
+		}
+		for _, h := range headers {
+			if v, ok := f.header(h[0]); !ok || v != h[1] {
+				return fmt.Errorf("got %q, want header %s:%s", payload, h[0], h[1])
+			}
+		}
+		return nil
+	})
+}
+
+// TestFeatures は機能ごとに、xnet の transport のサーバーに接続して動作を確認する。
+func TestFeatures(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s *wstest.Server, h *handler)
+	}{
+		{
+			name: "echo",
+			run: func(t *testing.T, s *wstest.Server, h *handler) {
+				pub := wstest.Dial(t, s.URL("/news?echo=true"), string(formatJSON))
+				sub := wstest.Dial(t, s.URL("/news"), string(formatJSON))
+				waitJoined(t, h, "news", 2)
+
+				pub.Run(
+					wstest.SendText(`{"kind":"publish","payload":"hello"}`),
+					wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"hello","self":true}`),
+				)
+				sub.Run(wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"hello"}`))
+
+				// echo は message の形式でやり取りする場合のみ指定できる。
+				header := http.Header{"Sec-WebSocket-Protocol": {string(formatText)}}
+				if _, resp, err := wstest.Handshake(t, s.URL("/news?echo=true"), header); resp == nil || resp.StatusCode != http.StatusForbidden {
+					t.Errorf("echo on %s: got %v, want 403", formatText, err)
+				}
+			},
+		},
+		{
+			name: "retain",
+			run: func(t *testing.T, s *wstest.Server, h *handler) {
+				// echo で publish が処理されたことを確認してから subscribe する。
+				pub := wstest.Dial(t, s.URL("/news?echo=true"), string(formatJSON))
+				pub.Run(
+					wstest.SendText(`{"kind":"publish","payload":"v1","retain":true}`),
+					wstest.ExpectJSON(`{"kind":"message","payload":"v1","self":true}`),
+				)
+
+				// 後から subscribe したコネクションにも retained message が送信される。
+				sub := wstest.Dial(t, s.URL("/news"), string(formatJSON))
+				sub.Run(wstest.ExpectJSON(`{"kind":"message","topic":"news","payload":"v1","retain":true}`))
+
+				// 空のペイロードで retained message を削除する。
+				pub.Run(wstest.SendText(`{"kind":"publish","retain":true}`))
+				sub.Run(wstest.ExpectJSON(`{"kind":"message","topic":"news"}`))
+				late := wstest.Dial(t, s.URL("/news"), string(formatJSON))
+				late.Run(wstest.ExpectNoMessage(100 * time.Millisecond))
+			},
+		},
+		{
+			name: "will",
+			run: func(t *testing.T, s *wstest.Server, h *handler) {
+				sub := wstest.Dial(t, s.URL("/status"), string(formatText))
+				clean := wstest.Dial(t, s.URL("/news?willTopic=status&willPayload=clean"), string(formatText))
+				dropped := wstest.Dial(t, s.URL("/news?willTopic=status&willPayload=dropped"), string(formatText))
+				waitJoined(t, h, "news", 2)
+
+				// CloseFrame で正常に切断した場合は publish しない。
+				clean.Run(
+					wstest.SendClose(wire.CloseStatusNormal, ""),
+					wstest.ExpectClose(wire.CloseStatusNormal),
+				)
+				waitLeft(t, h, "news", 1)
+				sub.Run(wstest.ExpectNoMessage(100 * time.Millisecond))
+
+				// CloseFrame を送らずに切断した場合は publish する。
+				dropped.Run(wstest.Drop())
+				sub.Run(wstest.ExpectText("dropped"))
+			},
+		},
+		{
+			name: "rpc",
+			run: func(t *testing.T, s *wstest.Server, h *handler) {
+				responder := wstest.Dial(t, s.URL("/rpc"), string(formatJSON))
+				requester := wstest.Dial(t, s.URL("/clients"), string(formatJSON))
+				waitJoined(t, h, "rpc", 1)
+				waitJoined(t, h, "clients", 1)
+
+				requester.Run(wstest.SendText(`{"kind":"request","topic":"rpc","correlationId":"42","payload":"ping"}`))
+
+				// replyTo にはサーバーが割り当てたリクエスト元の inbox が入る。
+				var req message
+				responder.Run(wstest.ExpectMessage(func(opcode byte, payload []byte) error {
+					if err := json.Unmarshal(payload, &req); err != nil {
+						return err
+					}
+					if req.Kind != kindRequest || req.CorrelationID != "42" || req.Payload != "ping" || !isInbox(req.ReplyTo) {
+						return fmt.Errorf("got %s, want request with inbox", payload)
+					}
+					return nil
+				}))
+
+				reply, err := json.Marshal(message{Kind: kindReply, CorrelationID: req.CorrelationID, ReplyTo: req.ReplyTo, Payload: "pong"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				responder.Run(wstest.SendText(string(reply)))
+				requester.Run(wstest.ExpectJSON(`{"kind":"reply","correlationId":"42","payload":"pong"}`))
+
+				// subscriber がいない topic へのリクエストは no responders になる。
+				requester.Run(
+					wstest.SendText(`{"kind":"request","topic":"nobody","correlationId":"43"}`),
+					wstest.ExpectJSON(`{"kind":"error","correlationId":"43","error":"no responders"}`),
+				)
+			},
+		},
+		{
+			name: "direct",
+			run: func(t *testing.T, s *wstest.Server, h *handler) {
+				alice := wstest.Dial(t, s.URL("/chat"), string(formatJSON))
+				bob := wstest.Dial(t, s.URL("/lobby"), string(formatJSON))
+				other := wstest.Dial(t, s.URL("/chat"), string(formatJSON))
+
+				// hello の前は送信できない。
+				alice.Run(
+					wstest.SendText(`{"kind":"direct","to":"bob","payload":"hi"}`),
+					wstest.ExpectJSON(`{"kind":"error","to":"bob","error":"hello is required before sending direct messages"}`),
+					wstest.SendText(`{"kind":"hello","name":"alice"}`),
+					wstest.ExpectJSON(`{"kind":"hello","name":"alice"}`),
+				)
+				bob.Run(
+					wstest.SendText(`{"kind":"hello","name":"bob"}`),
+					wstest.ExpectJSON(`{"kind":"hello","name":"bob"}`),
+				)
+
+				// topic によらず、名前で宛先を指定して送信する。
+				alice.Run(wstest.SendText(`{"kind":"direct","to":"bob","payload":"hi"}`))
+				bob.Run(wstest.ExpectJSON(`{"kind":"direct","from":"alice","payload":"hi"}`))
+				other.Run(wstest.ExpectNoMessage(100 * time.Millisecond))
+
+				alice.Run(
+					wstest.SendText(`{"kind":"direct","to":"carol","payload":"hi"}`),
+					wstest.ExpectJSON(`{"kind":"error","to":"carol","error":"recipient is offline: carol"}`),
+				)
+			},
+		},
+		{
+			name: "deflate",
+			run: func(t *testing.T, s *wstest.Server, h *handler) {
+				h.deflate = deflateConfig{enabled: true, clientMaxWindowBits: wire.DeflateMaxWindowBits}
+
+				tests := []struct {
+					offer string
+					want  string
+				}{
+					{"permessage-deflate; client_max_window_bits", "permessage-deflate"},
+					{"permessage-deflate; server_no_context_takeover", "permessage-deflate; server_no_context_takeover"},
+					// 受け入れられない offer の場合は圧縮せずに接続する。
+					{"permessage-deflate; unknown", ""},
+					{"x-webkit-deflate-frame", ""},
+				}
+				for _, tt := range tests {
+					header := http.Header{
+						"Sec-WebSocket-Protocol": {string(formatText)},
+						wire.ExtensionsHeader:    {tt.offer},
+					}
+					_, resp, err := wstest.Handshake(t, s.URL("/news"), header)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := resp.Header.Get(wire.ExtensionsHeader); got != tt.want {
+						t.Errorf("%q: got %q, want %q", tt.offer, got, tt.want)
+					}
+				}
+			},
+		},
+		{
+			name: "stomp",
+			run: func(t *testing.T, s *wstest.Server, h *handler) {
+				c := wstest.Dial(t, s.URL("/stomp"), string(formatSTOMP))
+				sub := wstest.Dial(t, s.URL("/news"), string(formatText))
+				waitJoined(t, h, "news", 1)
+
+				c.Run(
+					sendSTOMP("CONNECT", [][2]string{{"accept-version", "1.1,1.2"}, {"host", "localhost"}}, ""),
+					expectSTOMP("CONNECTED", [][2]string{{"version", stompVersion}}, ""),
+					sendSTOMP("SUBSCRIBE", [][2]string{{"id", "0"}, {"destination", "/topic/news"}, {"receipt", "r1"}}, ""),
+					expectSTOMP("RECEIPT", [][2]string{{"receipt-id", "r1"}}, ""),
+				)
+				waitJoined(t, h, "news", 2)
+
+				// STOMP では自身が送信したメッセージも受け取り、RECEIPT は処理後に返す。
+				c.Run(
+					sendSTOMP("SEND", [][2]string{{"destination", "/topic/news"}, {"receipt", "r2"}}, "hello"),
+					expectSTOMP("MESSAGE", [][2]string{{"subscription", "0"}, {"destination", "/topic/news"}}, "hello"),
+					expectSTOMP("RECEIPT", [][2]string{{"receipt-id", "r2"}}, ""),
+				)
+				sub.Run(wstest.ExpectText("hello"))
+
+				c.Run(
+					sendSTOMP("DISCONNECT", [][2]string{{"receipt", "r3"}}, ""),
+					expectSTOMP("RECEIPT", [][2]string{{"receipt-id", "r3"}}, ""),
+				)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, h := startServer(t, "xnet")
+			tt.run(t, s, h)
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wire"
+)
+
+const (
+	// ackTimeout は ack が返ってこない場合に再送するまでの時間。
+	ackTimeout = 10 * time.Second
+	// maxRedeliveries は再送の上限回数。超えたメッセージは dead letter topic に送る。
+	maxRedeliveries = 5
+	// defaultSessionTTL は切断された session を保持する時間のデフォルト。
+	// 過ぎた場合、未 ack のメッセージは dead letter topic に送る。設定ファイルの retention.sessionTTL で変更できる。
+	defaultSessionTTL = 5 * time.Minute
+	// deadLetterPrefix は dead letter topic の接頭辞。
+	deadLetterPrefix = "dlq."
+)
+
+var errSessionInUse = errors.New("session is already in use")
+
+// reservedSessionPrefixes は MQTT, STOMP の session ID の接頭辞。
+// delivery=at-least-once の session ID には使えないようにし、MQTT, STOMP の session に接続できないようにする。
+var reservedSessionPrefixes = []string{mqttSessionPrefix, stompSessionPrefix}
+
+// isReservedSessionID は id が MQTT, STOMP の session ID の接頭辞で始まるかどうかを返す。
+func isReservedSessionID(id string) bool {
+	for _, prefix := range reservedSessionPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// deadLetterTopic は topic に対応する dead letter topic を返す。
+func deadLetterTopic(topic string) string {
+	return deadLetterPrefix + topic
+}
+
+// session は delivery=at-least-once のコネクションの配信状態。
+// 再接続時に同じ session ID を指定すると、未 ack のメッセージが再送される。
+type session struct {
+	id string
+
+	mu sync.Mutex
+	// sub は session に接続中の subscriber。切断中は nil。
+	sub *subscriber
+	// pending は ack を待っているメッセージ。
+	pending map[string]*pendingMessage
+	// disconnectedAt は最後に切断された時刻。
+	disconnectedAt time.Time
+	// subscriptions は MQTT の接続で subscribe している topic と、許可した QoS。
+	// CleanSession=0 で再接続した場合に復元する。
+	subscriptions map[string]byte
+}
+
+// pendingMessage は ack を待っているメッセージ。
+type pendingMessage struct {
+	msg message
+	// redeliveries は再送した回数。
+	redeliveries int
+	sentAt       time.Time
+}
+
+func newSession(id string) *session {
+	return &session{
+		id:            id,
+		pending:       make(map[string]*pendingMessage),
+		subscriptions: make(map[string]byte),
+	}
+}
+
+// attachOptions は attachSession の振る舞い。ゼロ値の場合は、接続中の session には紐付けない。
+type attachOptions struct {
+	// takeover は session に接続中の subscriber がいる場合に、そのコネクションを切断して置き換えるかどうか。
+	// false の場合は errSessionInUse を返す。
+	takeover bool
+	// clean は既存の session を引き継がず、新しい session に紐付けるかどうか。
+	clean bool
+	// attached は紐付けた後、未 ack のメッセージの再送や新しいメッセージの配信より先に呼ぶ。
+	// present は既存の session を引き継いだかどうか。エラーを返した場合は再送せずにそのエラーを返す。
+	// session のロック中に呼ぶため、session を操作してはいけない。
+	attached func(s *session, present bool) error
+}
+
+// attachSession は subscriber を session に紐付ける。
+// session が存在しない場合は作成し、存在する場合は未 ack のメッセージを再送する。
+//
+// 仕様:
+//
+//	opts.takeover の場合、接続中の subscriber のコネクションは紐付けた後に切断する。(MQTT 3.1.1 [MQTT-3.1.4-2])
+//	紐付けと opts.attached は session のロック中に行うため、opts.attached より先にメッセージが配信されることはない。
+//	切断されたコネクションの detachSession は、session が置き換わっているため何もしない。
+//	opts.clean の場合、既存の session は切断されたコネクションのものとして残し、新しい session と置き換える。
+func (h *handler) attachSession(id string, sub *subscriber, opts attachOptions) (*session, error) {
+	h.sessionsMu.Lock()
+	prev, present := h.sessions[id]
+	var old *subscriber
+	if present {
+		prev.mu.Lock()
+		old = prev.sub
+		prev.mu.Unlock()
+	}
+	if old != nil && !opts.takeover {
+		h.sessionsMu.Unlock()
+		return nil, errSessionInUse
+	}
+
+	s := prev
+	if !present || opts.clean {
+		s = newSession(id)
+		h.sessions[id] = s
+		present = false
+	}
+
+	s.mu.Lock()
+	s.sub = sub
+	h.sessionsMu.Unlock()
+
+	if opts.attached != nil {
+		if err := opts.attached(s, present); err != nil {
+			s.mu.Unlock()
+			closeTakenOver(id, old)
+			return s, err
+		}
+	}
+
+	// 再接続時は未 ack のメッセージを全て再送する。
+	resend := make([]message, 0, len(s.pending))
+	now := time.Now()
+	for _, p := range s.pending {
+		p.redeliveries++
+		p.sentAt = now
+		p.msg.Redelivered = true
+		resend = append(resend, p.msg)
+	}
+	s.mu.Unlock()
+
+	closeTakenOver(id, old)
+
+	for _, m := range resend {
+		if err := sub.send(m); err != nil {
+			return s, fmt.Errorf("failed to redeliver message: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// closeTakenOver は takeover で session を引き継がれたコネクションを切断する。old が nil の場合は何もしない。
+func closeTakenOver(id string, old *subscriber) {
+	if old == nil {
+		return
+	}
+
+	slog.Info(fmt.Sprintf("session %s is taken over: closing connection %d", id, old.id))
+	old.w.close(wire.CloseStatusNormal)
+}
+
+// detachSession は subscriber と session の紐付けを解除する。
+// 未 ack のメッセージは次の接続まで保持する。
+func (h *handler) detachSession(s *session, sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sub == sub {
+		s.sub = nil
+		s.disconnectedAt = time.Now()
+	}
+}
+
+// deliver は ID を付与したメッセージを ack 待ちとして保持してから送信する。
+func (h *handler) deliver(s *session, m message) error {
+	m.ID = strconv.FormatUint(h.msgSeq.Add(1), 10)
+
+	s.mu.Lock()
+	s.pending[m.ID] = &pendingMessage{msg: m, sentAt: time.Now()}
+	sub := s.sub
+	s.mu.Unlock()
+
+	// 切断中の場合は再接続時に送信する。
+	if sub == nil {
+		return nil
+	}
+
+	return sub.send(m)
+}
+
+// ack は ack されたメッセージを ack 待ちから削除する。
+func (s *session) ack(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, id)
+}
+
+// redeliverLoop は ack されないメッセージを定期的に再送する。
+//
+// 仕様:
+//
+//	ackTimeout を過ぎても ack されないメッセージを再送する。
+//	再送が maxRedeliveries を超えたメッセージは dead letter topic に送る。
+//	retention.sessionTTL を過ぎても再接続されない session は削除し、未 ack のメッセージは dead letter topic に送る。
+func (h *handler) redeliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.redeliver(now)
+		}
+	}
+}
+
+func (h *handler) redeliver(now time.Time) {
+	h.sessionsMu.Lock()
+	sessions := make([]*session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.sessionsMu.Unlock()
+
+	for _, s := range sessions {
+		var resend, dead []message
+
+		s.mu.Lock()
+		sub := s.sub
+		expired := sub == nil && now.Sub(s.disconnectedAt) > time.Duration(h.sessionTTL.Load())
+		for id, p := range s.pending {
+			switch {
+			case expired || p.redeliveries >= maxRedeliveries && now.Sub(p.sentAt) >= ackTimeout:
+				dead = append(dead, p.msg)
+				delete(s.pending, id)
+			case sub != nil && now.Sub(p.sentAt) >= ackTimeout:
+				p.redeliveries++
+				p.sentAt = now
+				p.msg.Redelivered = true
+				resend = append(resend, p.msg)
+			}
+		}
+		s.mu.Unlock()
+
+		if expired {
+			// 判定後に再接続されている場合は削除しない。
+			h.sessionsMu.Lock()
+			s.mu.Lock()
+			if s.sub == nil {
+				delete(h.sessions, s.id)
+			}
+			s.mu.Unlock()
+			h.sessionsMu.Unlock()
+		}
+
+		for _, m := range resend {
+			if err := sub.send(m); err != nil {
+				slog.Error(fmt.Sprintf("failed to redeliver message: %s", err))
+				break
+			}
+		}
+
+		for _, m := range dead {
+			slog.Info(fmt.Sprintf("message %s to session %s is dead-lettered", m.ID, s.id))
+			if err := h.publishText(deadLetterTopic(m.Topic), []byte(m.Payload), nil); err != nil {
+				slog.Error(fmt.Sprintf("failed to publish dead letter: %s", err))
+			}
+		}
+	}
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/websocket"
+)
+
+// STOMP 1.2 over WebSocket。
+// see: https://stomp.github.io/stomp-specification-1.2.html
+//
+// STOMP の destination は handler.topics の topic と同じものとして扱う。
+// destination の先頭の /topic/ は取り除くため、/topic/foo と foo は同じ topic になる。
+
+const (
+	stompVersion = "1.2"
+	// stompTopicPrefix は destination から取り除く接頭辞。
+	stompTopicPrefix = "/topic/"
+	// stompSessionPrefix はコネクションごとの session ID の接頭辞。
+	stompSessionPrefix = "stomp:"
+	// stompHeartbeatTolerance は heart-beat の間隔に対して、切断とみなすまでの倍率。
+	stompHeartbeatTolerance = 2
+)
+
+// SUBSCRIBE の ack モード。
+const (
+	stompAckAuto             = "auto"
+	stompAckClient           = "client"
+	stompAckClientIndividual = "client-individual"
+)
+
+var (
+	errSTOMPIncomplete = errors.New("stomp: incomplete frame")
+	errSTOMPMalformed  = errors.New("stomp: malformed frame")
+)
+
+// stompFrame は STOMP のフレーム。
+type stompFrame struct {
+	command string
+	// headers は受信した順のヘッダー。同じ名前のヘッダーは最初のものが優先される。
+	headers [][2]string
+	body    []byte
+}
+
+// header は name のヘッダーの値を返す。
+func (f stompFrame) header(name string) (string, bool) {
+	for _, h := range f.headers {
+		if h[0] == name {
+			return h[1], true
+		}
+	}
+	return "", false
+}
+
+// stompEscaper, stompUnescaper は CONNECT, CONNECTED 以外のヘッダーのエスケープ。
+var (
+	stompEscaper   = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+	stompUnescaper = strings.NewReplacer(`\\`, `\`, `\r`, "\r", `\n`, "\n", `\c`, ":")
+)
+
+// parseSTOMPFrame は data の先頭のフレームを取り出し、フレームのバイト数とともに返す。
+// フレームの前の改行は heart-beat として読み飛ばす。
+// data がフレームの途中で終わっている場合は errSTOMPIncomplete を返す。
+func parseSTOMPFrame(data []byte) (stompFrame, int, error) {
+	// heart-beat を読み飛ばす。
+	start := 0
+	for start < len(data) && (data[start] == '\n' || data[start] == '\r') {
+		start++
+	}
+	if start == len(data) {
+		return stompFrame{}, start, errSTOMPIncomplete
+	}
+
+	end := bytes.Index(data[start:], []byte("\n\n"))
+	crlf := bytes.Index(data[start:], []byte("\r\n\r\n"))
+	sep := 2
+	if crlf >= 0 && (end < 0 || crlf < end) {
+		end, sep = crlf, 4
+	}
+	if end < 0 {
+		if len(data)-start > maxPayloadSize {
+			return stompFrame{}, 0, fmt.Errorf("%w: too large headers", errSTOMPMalformed)
+		}
+		return stompFrame{}, 0, errSTOMPIncomplete
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(data[start:start+end]), "\r\n", "\n"), "\n")
+	f := stompFrame{command: lines[0]}
+	unescape := f.command != "CONNECT" && f.command != "STOMP"
+	for _, line := range lines[1:] {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return stompFrame{}, 0, fmt.Errorf("%w: invalid header: %q", errSTOMPMalformed, line)
+		}
+		if unescape {
+			k, v = stompUnescaper.Replace(k), stompUnescaper.Replace(v)
+		}
+		f.headers = append(f.headers, [2]string{k, v})
+	}
+
+	// content-length がある場合はその長さを、ない場合は NULL までを body とする。
+	bodyStart := start + end + sep
+	if v, ok := f.header("content-length"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxPayloadSize {
+			return stompFrame{}, 0, fmt.Errorf("%w: invalid content-length: %q", errSTOMPMalformed, v)
+		}
+		if len(data) < bodyStart+n+1 {
+			return stompFrame{}, 0, errSTOMPIncomplete
+		}
+		if data[bodyStart+n] != 0 {
+			return stompFrame{}, 0, fmt.Errorf("%w: missing NULL after body", errSTOMPMalformed)
+		}
+		f.body = data[bodyStart : bodyStart+n]
+		return f, bodyStart + n + 1, nil
+	}
+
+	n := bytes.IndexByte(data[bodyStart:], 0)
+	if n < 0 {
+		if len(data)-bodyStart > maxPayloadSize {
+			return stompFrame{}, 0, fmt.Errorf("%w: too large body", errSTOMPMalformed)
+		}
+		return stompFrame{}, 0, errSTOMPIncomplete
+	}
+	f.body = data[bodyStart : bodyStart+n]
+
+	return f, bodyStart + n + 1, nil
+}
+
+// appendSTOMPFrame はフレームを b に追加する。
+// body がある場合は content-length を付与する。
+func appendSTOMPFrame(b []byte, command string, headers [][2]string, body []byte) []byte {
+	escape := command != "CONNECTED"
+
+	b = append(b, command...)
+	b = append(b, '\n')
+	for _, h := range headers {
+		k, v := h[0], h[1]
+		if escape {
+			k, v = stompEscaper.Replace(k), stompEscaper.Replace(v)
+		}
+		b = append(b, k...)
+		b = append(b, ':')
+		b = append(b, v...)
+		b = append(b, '\n')
+	}
+	if len(body) > 0 {
+		b = append(b, "content-length:"...)
+		b = strconv.AppendInt(b, int64(len(body)), 10)
+		b = append(b, '\n')
+	}
+	b = append(b, '\n')
+	b = append(b, body...)
+
+	return append(b, 0)
+}
+
+// stompTopic は destination を topic に変換する。
+func stompTopic(destination string) (string, error) {
+	topic := strings.TrimPrefix(destination, stompTopicPrefix)
+	if topic == "" || isInbox(topic) {
+		return "", fmt.Errorf("invalid destination: %q", destination)
+	}
+
+	return topic, nil
+}
+
+// parseHeartbeat は heart-beat ヘッダーの値を、送信と受信の間隔に変換する。
+func parseHeartbeat(v string) (send, receive time.Duration, err error) {
+	if v == "" {
+		return 0, 0, nil
+	}
+
+	cx, cy, ok := strings.Cut(v, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid heart-beat: %q", v)
+	}
+	x, errX := strconv.Atoi(strings.TrimSpace(cx))
+	y, errY := strconv.Atoi(strings.TrimSpace(cy))
+	if errX != nil || errY != nil || x < 0 || y < 0 {
+		return 0, 0, fmt.Errorf("invalid heart-beat: %q", v)
+	}
+
+	return time.Duration(x) * time.Millisecond, time.Duration(y) * time.Millisecond, nil
+}
+
+// stompSubscription は SUBSCRIBE で作成された subscription。
+type stompSubscription struct {
+	id          string
+	destination string
+	topic       string
+	ack         string
+	// unacked は ACK を待っているメッセージ ID。送信した順に並ぶ。
+	unacked []string
+}
+
+// stompConn は 1 つの STOMP の接続の状態。
+//
+// ACK が必要な配信は、コネクションごとの delivery=at-least-once の session を使って行う。
+// ACK がない場合は再送され、NACK されたメッセージは dead letter topic に送られる。
+type stompConn struct {
+	h       *handler
+	sub     *subscriber
+	session *session
+
+	mu sync.Mutex
+	// subscriptions は subscription の ID ごとの subscription。
+	subscriptions map[string]*stompSubscription
+
+	// buf は受信したデータのうち、まだフレームとして処理していない部分。
+	buf []byte
+}
+
+// serveSTOMP は STOMP のフレームを処理する。
+//
+// 仕様:
+//
+//	最初のフレームは CONNECT (または STOMP) である必要があり、accept-version に 1.2 を含む必要がある。
+//	SUBSCRIBE の ack が client, client-individual の場合、ACK のないメッセージは再送される。
+//	  client の ACK は、その subscription で以前に送信したメッセージもまとめて ACK する。
+//	  NACK されたメッセージは dead letter topic に送られる。
+//	receipt ヘッダーのあるフレームには、処理後に RECEIPT を返す。
+//	heart-beat は CONNECT で指定された間隔に合わせて送受信する。
+//	  受信側の間隔の 2 倍の間フレームを受信しない場合は切断とみなす。
+//	不正なフレームを受け取った場合は ERROR を返して切断する。
+func (h *handler) serveSTOMP(sub *subscriber) {
+	c := &stompConn{
+		h:             h,
+		sub:           sub,
+		subscriptions: make(map[string]*stompSubscription),
+	}
+	sub.stomp = c
+	// STOMP では自身が送信したメッセージも受け取る。
+	sub.echo = true
+
+	f, err := c.next(heartbeatTimeout)
+	if err != nil {
+		slog.Info(fmt.Sprintf("stomp: connection closed before CONNECT: %s", err))
+		return
+	}
+	if f.command != "CONNECT" && f.command != "STOMP" {
+		c.sendError(fmt.Sprintf("first frame must be CONNECT: %s", f.command), f)
+		return
+	}
+
+	versions, _ := f.header("accept-version")
+	if !slices.Contains(strings.Split(versions, ","), stompVersion) {
+		c.sendError(fmt.Sprintf("supported version is %s: %q", stompVersion, versions), f)
+		return
+	}
+
+	hb, _ := f.header("heart-beat")
+	clientSend, clientReceive, err := parseHeartbeat(hb)
+	if err != nil {
+		c.sendError(err.Error(), f)
+		return
+	}
+
+	// サーバーは heartbeatInterval ごとに送信でき、同じ間隔で受信したい。
+	var sendInterval, receiveInterval time.Duration
+	if clientReceive > 0 {
+		sendInterval = max(clientReceive, heartbeatInterval)
+	}
+	if clientSend > 0 {
+		receiveInterval = max(clientSend, heartbeatInterval)
+	}
+
+	// ACK を待つための、コネクション専用の session。
+	b := make([]byte, 8)
+	rand.Read(b)
+	s, err := h.attachSession(stompSessionPrefix+hex.EncodeToString(b), sub, attachOptions{})
+	if err != nil {
+		c.sendError(err.Error(), f)
+		return
+	}
+	c.session = s
+	sub.session = s
+	defer func() {
+		c.mu.Lock()
+		topics := make(map[string]bool)
+		for _, ss := range c.subscriptions {
+			topics[ss.topic] = true
+		}
+		c.mu.Unlock()
+		for topic := range topics {
+			h.leave(topic, sub)
+		}
+
+		h.detachSession(s, sub)
+		h.discardSession(s)
+	}()
+
+	heartbeatHeader := fmt.Sprintf("%d,%d", heartbeatInterval.Milliseconds(), heartbeatInterval.Milliseconds())
+	if err := c.write("CONNECTED", [][2]string{
+		{"version", stompVersion},
+		{"heart-beat", heartbeatHeader},
+		{"server", "xnet-pubsub"},
+	}, nil); err != nil {
+		slog.Error(fmt.Sprintf("stomp: failed to send CONNECTED: %s", err))
+		return
+	}
+	slog.Info(fmt.Sprintf("stomp: connected (heart-beat: send %s, receive %s)", sendInterval, receiveInterval))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go heartbeat(ctx, sub.w)
+	if sendInterval > 0 {
+		go c.heartbeat(ctx, sendInterval)
+	}
+
+	timeout := heartbeatTimeout
+	if receiveInterval > 0 {
+		timeout = receiveInterval * stompHeartbeatTolerance
+	}
+
+	for {
+		f, err := c.next(timeout)
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF), errors.Is(err, errCloseFrame):
+				slog.Info("stomp: connection closed")
+			case errors.Is(err, errSTOMPMalformed):
+				c.sendError(err.Error(), stompFrame{})
+			default:
+				slog.Info(fmt.Sprintf("stomp: connection lost: %s", err))
+			}
+			return
+		}
+
+		if f.command == "DISCONNECT" {
+			slog.Info("stomp: DISCONNECT received")
+			c.receipt(f)
+			return
+		}
+
+		if err := c.handle(f); err != nil {
+			c.sendError(err.Error(), f)
+			return
+		}
+		if err := c.receipt(f); err != nil {
+			slog.Error(fmt.Sprintf("stomp: failed to send RECEIPT: %s", err))
+			return
+		}
+	}
+}
+
+// handle は CONNECT 以降のフレームを処理する。
+// エラーを返した場合は ERROR を返して切断する。
+func (c *stompConn) handle(f stompFrame) error {
+	switch f.command {
+	case "SEND":
+		dest, _ := f.header("destination")
+		topic, err := stompTopic(dest)
+		if err != nil {
+			return err
+		}
+		if err := c.h.allowed(aclPublish, topic, c.sub); err != nil {
+			return err
+		}
+		if err := c.h.publishText(topic, f.body, c.sub); err != nil {
+			slog.Error(fmt.Sprintf("stomp: failed to publish: %s", err))
+		}
+		return nil
+
+	case "SUBSCRIBE":
+		return c.subscribe(f)
+
+	case "UNSUBSCRIBE":
+		id, ok := f.header("id")
+		if !ok {
+			return errors.New("UNSUBSCRIBE requires id")
+		}
+		c.unsubscribe(id)
+		return nil
+
+	case "ACK", "NACK":
+		id, ok := f.header("id")
+		if !ok {
+			return fmt.Errorf("%s requires id", f.command)
+		}
+		c.ack(id, f.command == "NACK")
+		return nil
+
+	case "CONNECT", "STOMP":
+		return errors.New("already connected")
+	}
+
+	return fmt.Errorf("unsupported command: %q", f.command)
+}
+
+func (c *stompConn) subscribe(f stompFrame) error {
+	id, ok := f.header("id")
+	if !ok {
+		return errors.New("SUBSCRIBE requires id")
+	}
+	dest, _ := f.header("destination")
+	topic, err := stompTopic(dest)
+	if err != nil {
+		return err
+	}
+	if err := c.h.allowed(aclSubscribe, topic, c.sub); err != nil {
+		return err
+	}
+
+	ack, ok := f.header("ack")
+	if !ok {
+		ack = stompAckAuto
+	}
+	if ack != stompAckAuto && ack != stompAckClient && ack != stompAckClientIndividual {
+		return fmt.Errorf("unknown ack mode: %q", ack)
+	}
+
+	c.mu.Lock()
+	if _, ok := c.subscriptions[id]; ok {
+		c.mu.Unlock()
+		return fmt.Errorf("subscription id is already used: %q", id)
+	}
+	joined := c.subscribed(topic)
+	c.subscriptions[id] = &stompSubscription{
+		id:          id,
+		destination: dest,
+		topic:       topic,
+		ack:         ack,
+	}
+	c.mu.Unlock()
+
+	// 同じ topic の subscription が複数ある場合、topic には 1 度だけ参加する。
+	if !joined {
+		c.h.join(topic, c.sub)
+	}
+
+	if err := c.h.sendRetained(topic, c.sub); err != nil {
+		slog.Error(fmt.Sprintf("stomp: failed to send retained message: %s", err))
+	}
+
+	return nil
+}
+
+// unsubscribe は subscription を削除する。
+// ACK を待っているメッセージは再送しないよう ack する。
+func (c *stompConn) unsubscribe(id string) {
+	c.mu.Lock()
+	ss, ok := c.subscriptions[id]
+	delete(c.subscriptions, id)
+	leave := ok && !c.subscribed(ss.topic)
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, msgID := range ss.unacked {
+		c.session.ack(msgID)
+	}
+	if leave {
+		c.h.leave(ss.topic, c.sub)
+	}
+}
+
+// subscribed は topic の subscription があるかどうかを返す。c.mu を取得した状態で呼ぶ。
+func (c *stompConn) subscribed(topic string) bool {
+	for _, ss := range c.subscriptions {
+		if ss.topic == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// ack は ACK (または NACK) されたメッセージを ack 待ちから削除する。
+// client モードの subscription の場合は、以前に送信したメッセージもまとめて削除する。
+// NACK の場合は dead letter topic に送る。
+func (c *stompConn) ack(id string, nack bool) {
+	var ids []string
+
+	c.mu.Lock()
+	for _, ss := range c.subscriptions {
+		i := slices.Index(ss.unacked, id)
+		if i < 0 {
+			continue
+		}
+		if ss.ack == stompAckClient {
+			ids = append(ids, ss.unacked[:i+1]...)
+			ss.unacked = slices.Delete(ss.unacked, 0, i+1)
+		} else {
+			ids = append(ids, id)
+			ss.unacked = slices.Delete(ss.unacked, i, i+1)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, msgID := range ids {
+		if nack {
+			c.deadLetter(msgID)
+		}
+		c.session.ack(msgID)
+	}
+}
+
+// deadLetter は ack 待ちのメッセージを dead letter topic に送る。
+func (c *stompConn) deadLetter(msgID string) {
+	c.session.mu.Lock()
+	p, ok := c.session.pending[msgID]
+	c.session.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	slog.Info(fmt.Sprintf("stomp: message %s is nacked", msgID))
+	if err := c.h.publishText(deadLetterTopic(p.msg.Topic), []byte(p.msg.Payload), nil); err != nil {
+		slog.Error(fmt.Sprintf("stomp: failed to publish dead letter: %s", err))
+	}
+}
+
+// send はメッセージを、topic の各 subscription に MESSAGE フレームとして送信する。
+//
+// 仕様:
+//
+//	ack が auto の subscription のみに送信するメッセージは、送信と同時に ack する。
+//	配信以外のメッセージ (エラーなど) は ERROR フレームとして送ると切断が必要になるため、送信しない。
+func (c *stompConn) send(m message) error {
+	if m.Kind != kindMessage {
+		slog.Debug(fmt.Sprintf("stomp: %s message is not sent", m.Kind))
+		return nil
+	}
+
+	type delivery struct {
+		id, destination string
+		needsAck        bool
+	}
+	var deliveries []delivery
+	needsAck := false
+
+	c.mu.Lock()
+	for _, ss := range c.subscriptions {
+		if ss.topic != m.Topic {
+			continue
+		}
+		d := delivery{id: ss.id, destination: ss.destination}
+		if ss.ack != stompAckAuto && m.ID != "" {
+			d.needsAck = true
+			needsAck = true
+			if !slices.Contains(ss.unacked, m.ID) {
+				ss.unacked = append(ss.unacked, m.ID)
+			}
+		}
+		deliveries = append(deliveries, d)
+	}
+	c.mu.Unlock()
+
+	if m.ID != "" && !needsAck {
+		c.session.ack(m.ID)
+	}
+
+	msgID := m.ID
+	if msgID == "" {
+		msgID = strconv.FormatUint(c.h.msgSeq.Add(1), 10)
+	}
+
+	for _, d := range deliveries {
+		headers := [][2]string{
+			{"subscription", d.id},
+			{"message-id", msgID},
+			{"destination", d.destination},
+		}
+		if d.needsAck {
+			headers = append(headers, [2]string{"ack", msgID})
+		}
+		if m.Retain {
+			headers = append(headers, [2]string{"retained", "true"})
+		}
+		if m.Redelivered {
+			headers = append(headers, [2]string{"redelivered", "true"})
+		}
+
+		if err := c.write("MESSAGE", headers, []byte(m.Payload)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// receipt はフレームに receipt ヘッダーがある場合に RECEIPT を返す。
+func (c *stompConn) receipt(f stompFrame) error {
+	id, ok := f.header("receipt")
+	if !ok {
+		return nil
+	}
+
+	return c.write("RECEIPT", [][2]string{{"receipt-id", id}}, nil)
+}
+
+// sendError は ERROR フレームを送信する。
+// ERROR を送信した後は切断する必要がある。
+func (c *stompConn) sendError(msg string, f stompFrame) {
+	slog.Info(fmt.Sprintf("stomp: %s", msg))
+
+	headers := [][2]string{{"message", msg}}
+	if id, ok := f.header("receipt"); ok {
+		headers = append(headers, [2]string{"receipt-id", id})
+	}
+
+	if err := c.write("ERROR", headers, nil); err != nil {
+		slog.Error(fmt.Sprintf("stomp: failed to send ERROR: %s", err))
+	}
+}
+
+// write はフレームを送信する。
+// body が UTF-8 として正しくない場合は BinaryFrame で送信する。
+func (c *stompConn) write(command string, headers [][2]string, body []byte) error {
+	payloadType := byte(websocket.TextFrame)
+	if !utf8.Valid(body) {
+		payloadType = websocket.BinaryFrame
+	}
+
+	return c.sub.w.writeMessage(payloadType, appendSTOMPFrame(nil, command, headers, body))
+}
+
+// heartbeat は ctx が終了するまで interval ごとに heart-beat (改行) を送信する。
+func (c *stompConn) heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.sub.w.writeMessage(websocket.TextFrame, []byte("\n")); err != nil {
+				slog.Debug(fmt.Sprintf("stomp: failed to send heart-beat: %s", err))
+				return
+			}
+		}
+	}
+}
+
+// next は次のフレームを返す。
+// フレームは複数の WebSocket のフレームに分割されたり、1 つに複数含まれる場合があるため、
+// 受信したデータを buf に溜めてフレームに区切る。
+func (c *stompConn) next(timeout time.Duration) (stompFrame, error) {
+	for {
+		f, n, err := parseSTOMPFrame(c.buf)
+		if err == nil {
+			c.buf = c.buf[n:]
+			return f, nil
+		}
+		if !errors.Is(err, errSTOMPIncomplete) {
+			return stompFrame{}, err
+		}
+		// heart-beat のみの場合は読み飛ばす。
+		c.buf = c.buf[n:]
+
+		_, b, err := c.sub.w.readMessage(timeout)
+		if err != nil {
+			return stompFrame{}, err
+		}
+		c.buf = append(c.buf, b...)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import "time"
+
+// topic のライフサイクル。
+//
+// topic は最初のコネクションが参加した時、または retained message が保持された時に作成される。
+// コネクションも retained message もない状態が gracePeriod 続いた場合、topic は破棄される。
+// 猶予の間に再びコネクションが参加した場合や、retained message が保持された場合は破棄しない。
+// retained message は後から subscribe するコネクションのためのものであるため、保持している topic は破棄しない。
+// 使われなくなった topic のメモリは、空のペイロードで retained message を削除すると解放される。
+
+// topicHooks は topic の作成時と破棄時に呼ばれる関数。
+type topicHooks struct {
+	created   []func(topic string)
+	destroyed []func(topic string)
+}
+
+// onTopicCreated は topic の作成時に呼ばれる関数を登録する。
+//
+// 注意)
+//   - サーバーの起動前に登録すること。登録は並行に行えない。
+//   - 関数はロックを解放した後に呼ばれるため、registry のメソッドを呼んでもよい。
+func (r *registry) onTopicCreated(f func(topic string)) {
+	r.hooks.created = append(r.hooks.created, f)
+}
+
+// onTopicDestroyed は topic の破棄時に呼ばれる関数を登録する。
+// 注意事項は onTopicCreated と同じ。
+func (r *registry) onTopicDestroyed(f func(topic string)) {
+	r.hooks.destroyed = append(r.hooks.destroyed, f)
+}
+
+func (r *registry) fireTopicCreated(topic string) {
+	for _, f := range r.hooks.created {
+		f(topic)
+	}
+}
+
+func (r *registry) fireTopicDestroyed(topic string) {
+	for _, f := range r.hooks.destroyed {
+		f(topic)
+	}
+}
+
+// ensureTopicLocked は topic が存在しない場合に作成し、破棄の予定があれば取り消す。
+// topic を作成した場合は true を返す。s.mu を取得した状態で呼ぶ。
+func (r *registry) ensureTopicLocked(s *registryShard, topic string) (*topicEntry, bool) {
+	if t, ok := s.timers[topic]; ok {
+		t.timer.Stop()
+		delete(s.timers, topic)
+	}
+
+	if t, ok := s.topics[topic]; ok {
+		return t, false
+	}
+	t := &topicEntry{members: make(map[uint64]*subscriber)}
+	s.topics[topic] = t
+
+	return t, true
+}
+
+// reclaimTimer は topic の破棄の予定。registryShard.mu で保護する。
+type reclaimTimer struct {
+	timer *time.Timer
+}
+
+// scheduleReclaimLocked はコネクションも retained message もない topic の破棄を予定する。
+// gracePeriod が 0 の場合はすぐに破棄し、true を返す。s.mu を取得した状態で呼ぶ。
+func (r *registry) scheduleReclaimLocked(s *registryShard, topic string) bool {
+	// close 後は全ての topic が削除済み。
+	if !s.topics[topic].reclaimable() || r.closed.Load() {
+		return false
+	}
+
+	gracePeriod := time.Duration(r.gracePeriod.Load())
+	if gracePeriod <= 0 {
+		delete(s.topics, topic)
+		return true
+	}
+
+	if _, ok := s.timers[topic]; ok {
+		return false
+	}
+
+	// タイマーの関数は AfterFunc が返る前に呼ばれることがあるため、timer ではなく t で予定を識別する。
+	t := &reclaimTimer{}
+	t.timer = time.AfterFunc(gracePeriod, func() {
+		r.reclaim(s, topic, t)
+	})
+	s.timers[topic] = t
+
+	return false
+}
+
+// setGracePeriod は以降に破棄を予定する topic の猶予を変更する。既に予定している破棄には影響しない。
+func (r *registry) setGracePeriod(d time.Duration) {
+	r.gracePeriod.Store(int64(d))
+}
+
+// reclaim は猶予が過ぎた topic を破棄する。
+// 猶予の間に参加や retained message の保持、再度の予定があった場合は何もしない。
+func (r *registry) reclaim(s *registryShard, topic string, t *reclaimTimer) {
+	s.mu.Lock()
+	if s.timers[topic] != t || !s.topics[topic].reclaimable() {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.timers, topic)
+	delete(s.topics, topic)
+	s.mu.Unlock()
+
+	r.fireTopicDestroyed(topic)
+}
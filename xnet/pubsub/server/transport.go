@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"wire"
+)
+
+// errPayloadTooLarge はメッセージのペイロードが maxPayloadSize を超えている場合のエラー。
+// メッセージは読み捨てられるため、続けて読み込める。
+// 読み捨てられない transport (gorilla) は、このエラーを返さずに CloseStatusTooBig でコネクションを閉じる。
+// permessage-deflate の展開後のサイズが超えている場合も同じエラーにする。
+var errPayloadTooLarge = wire.ErrPayloadTooLarge
+
+// wsConn は WebSocket のライブラリに依存しないコネクション。
+//
+// 仕様:
+//
+//	topic への参加や配信などの pubsub の処理は、このインターフェースのみを通してコネクションを扱う。
+//	opcode は RFC 6455 の値 (TextFrame: 1, BinaryFrame: 2) で、ライブラリの定数には依存しない。
+//	PingFrame, PongFrame, CloseFrame の処理は transport が行い、readMessage はデータメッセージのみを返す。
+//	書き込みは複数の goroutine から呼ばれるため、transport が直列化する。
+type wsConn interface {
+	// readMessage は次のデータメッセージを読み込み、opcode とペイロードを返す。
+	// permessage-deflate で圧縮されている場合は展開して返す。
+	// timeout の間フレームを受信しない場合はエラーを、CloseFrame を受信した場合は errCloseFrame を返す。
+	readMessage(timeout time.Duration) (opcode byte, payload []byte, err error)
+	// writeMessage は TextFrame か BinaryFrame を書き込む。
+	writeMessage(opcode byte, payload []byte) error
+	// writePrepared は preparedMessage を f の形式で書き込む。
+	writePrepared(pm *preparedMessage, f format) error
+	// ping は PingFrame を送信する。
+	ping() error
+	// setCoalesce は以降のデータフレームを flush の呼び出しまでまとめて送信する。
+	// 対応していない transport ではメッセージごとに送信する。
+	setCoalesce()
+	// flush はまとめているデータフレームを送信する。
+	flush() error
+	// close は CloseFrame を書き込んでからコネクションを閉じる。2 回目以降の呼び出しでは何もしない。
+	close(status uint16) error
+}
+
+// transports は -transport で選択できる WebSocket のライブラリと、その HTTP ハンドラーの作成。
+var transports = map[string]func(h *handler) http.Handler{
+	"xnet":    (*handler).xnetHandler,
+	"gorilla": (*handler).gorillaHandler,
+	"nhooyr":  (*handler).nhooyrHandler,
+	"gobwas":  (*handler).gobwasHandler,
+}
+
+// transportNames は選択できる transport の一覧。
+func transportNames() []string {
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// newTransportHandler は name の transport で WebSocket の接続を受け付ける HTTP ハンドラーを作る。
+func (h *handler) newTransportHandler(name string) (http.Handler, error) {
+	newHandler, ok := transports[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport: %q (available: %s)", name, strings.Join(transportNames(), ", "))
+	}
+
+	return newHandler(h), nil
+}
+
+// offeredProtocols は Sec-WebSocket-Protocol で提示された subprotocol を提示された順に返す。
+func offeredProtocols(req *http.Request) []string {
+	var protocols []string
+	for _, v := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+
+	return protocols
+}
+
+// accept は WebSocket の接続前に subprotocol を選択し、接続オプションを検証する。
+// エラーを返した場合、接続は 403 で拒否する。transport によらず同じ条件で受け付ける。
+//
+// 仕様:
+//
+//	Sec-WebSocket-Protocol で提示された subprotocol のうち、対応しているものを提示された順に選ぶ。
+//	対応している subprotocol がない場合は接続を拒否する。
+//	シャットダウンの drain 中、limits.maxConnections に達している場合と、path の topic の subscribe、last will の topic の publish が ACL で許可されない場合も拒否する。
+func (h *handler) accept(req *http.Request, protocols []string) (format, error) {
+	// readyz が失敗した後も振り分けられた接続は、閉じられるコネクションを増やさないよう拒否する。
+	if h.ready.draining.Load() {
+		slog.Info(fmt.Sprintf("handshake rejected: %s", errDraining))
+		return "", errDraining
+	}
+
+	topic := req.PathValue("topic")
+	if isInbox(topic) {
+		err := errors.New("inbox cannot be subscribed")
+		slog.Info(fmt.Sprintf("handshake rejected: %s", err))
+		return "", err
+	}
+
+	if limit := h.maxConns.Load(); limit > 0 && h.conns.Load() >= limit {
+		err := fmt.Errorf("too many connections: %d", limit)
+		slog.Info(fmt.Sprintf("handshake rejected: %s", err))
+		return "", err
+	}
+
+	f, err := selectFormat(protocols)
+	if err != nil {
+		slog.Info(fmt.Sprintf("handshake rejected: %s", err))
+		return "", err
+	}
+
+	opts, err := parseConnOptions(req, f)
+	if err != nil {
+		slog.Info(fmt.Sprintf("handshake rejected: %s", err))
+		return "", err
+	}
+
+	// MQTT, STOMP は path の topic を使わないため、SUBSCRIBE の時に判定する。
+	if f != formatMQTT && f != formatSTOMP && !h.acl.Load().allows(aclSubscribe, topic, remoteAddr(req)) {
+		err := fmt.Errorf("%s to %s is not allowed", aclSubscribe, topic)
+		slog.Info(fmt.Sprintf("handshake rejected: %s", err))
+		return "", err
+	}
+	// last will は切断時に publish するため、接続時に publish の ACL で判定する。
+	if opts.will != nil && !h.acl.Load().allows(aclPublish, opts.will.topic, remoteAddr(req)) {
+		err := fmt.Errorf("%s to %s is not allowed", aclPublish, opts.will.topic)
+		slog.Info(fmt.Sprintf("handshake rejected: %s", err))
+		return "", err
+	}
+
+	return f, nil
+}
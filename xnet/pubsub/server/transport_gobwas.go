@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gobwas/ws"
+	"golang.org/x/net/websocket"
+
+	"wire"
+)
+
+// gobwasConn は github.com/gobwas/ws のコネクション。
+//
+// 仕様:
+//
+//	ハンドシェイクとフレームのヘッダーの読み込みに gobwas/ws を使い、書き込みは xnet と同じく frameWriter から行う。
+//	permessage-deflate とデータフレームの coalesce に対応する。
+//	分割されたメッセージは最後のフレームを受信してから返す。
+//	PingFrame には同じペイロードの PongFrame を返す。
+type gobwasConn struct {
+	*frameWriter
+	nc net.Conn
+	r  *bufio.Reader
+
+	// fragments は分割されて届いているメッセージ。
+	fragments  []byte
+	fragOp     ws.OpCode
+	compressed bool
+}
+
+// gobwasHandler は github.com/gobwas/ws で接続を受け付ける。
+func (h *handler) gobwasHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f, err := h.accept(req, offeredProtocols(req))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		u := ws.HTTPUpgrader{
+			Protocol: func(p string) bool { return p == string(f) },
+		}
+		var d *deflater
+		if p, ok := negotiateDeflate(req.Header, h.deflate); ok {
+			// 受け入れた permessage-deflate のパラメータをレスポンスに含める。
+			u.Header = http.Header{wire.ExtensionsHeader: []string{p.String()}}
+			d = newDeflater(p, h.deflate.minSize)
+		}
+
+		nc, rw, _, err := u.Upgrade(req, w)
+		if err != nil {
+			slog.Info(fmt.Sprintf("failed to upgrade: %s", err))
+			return
+		}
+
+		conn := &gobwasConn{
+			frameWriter: newFrameWriter(&rawConn{conn: nc, buf: rw}, d),
+			nc:          nc,
+			// ハンドシェイクの読み込みで、最初のフレームまで読み込まれている場合がある。
+			r: rw.Reader,
+		}
+		h.serve(conn, req, f)
+	})
+}
+
+func (c *gobwasConn) readMessage(timeout time.Duration) (byte, []byte, error) {
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(timeout))
+
+		hdr, err := ws.ReadHeader(c.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !hdr.Masked {
+			return 0, nil, errors.New("unmasked frame from client")
+		}
+		if hdr.Length > int64(maxPayloadSize) || int64(len(c.fragments))+hdr.Length > int64(maxPayloadSize) {
+			// 分割されたメッセージの途中の場合も、メッセージ全体を読み捨てる。
+			if _, err := io.CopyN(io.Discard, c.r, hdr.Length); err != nil {
+				return 0, nil, err
+			}
+			if hdr.OpCode.IsData() {
+				c.fragments = nil
+				return 0, nil, fmt.Errorf("%w: > %d", errPayloadTooLarge, maxPayloadSize)
+			}
+			return 0, nil, fmt.Errorf("too large control frame: %d", hdr.Length)
+		}
+
+		payload := make([]byte, hdr.Length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return 0, nil, err
+		}
+		ws.Cipher(payload, hdr.Mask, 0)
+
+		switch hdr.OpCode {
+		case ws.OpPing:
+			c.writeControl(websocket.PongFrame, payload)
+			continue
+
+		case ws.OpPong:
+			continue
+
+		case ws.OpClose:
+			return 0, nil, errCloseFrame
+
+		case ws.OpText, ws.OpBinary:
+			if c.fragments != nil {
+				return 0, nil, errors.New("new message while fragmented message in progress")
+			}
+			if !hdr.Fin {
+				c.fragOp, c.fragments, c.compressed = hdr.OpCode, payload, hdr.Rsv1()
+				continue
+			}
+			b, err := inflatePayload(c.deflate, payload, hdr.Rsv1())
+			return byte(hdr.OpCode), b, err
+
+		case ws.OpContinuation:
+			if c.fragments == nil {
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+			c.fragments = append(c.fragments, payload...)
+			if !hdr.Fin {
+				continue
+			}
+			payload, c.fragments = c.fragments, nil
+			b, err := inflatePayload(c.deflate, payload, c.compressed)
+			return byte(c.fragOp), b, err
+
+		default:
+			return 0, nil, fmt.Errorf("unknown opcode: %d", hdr.OpCode)
+		}
+	}
+}
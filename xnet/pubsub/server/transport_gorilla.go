@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+
+	"wire"
+)
+
+// gorillaConn は github.com/gorilla/websocket のコネクション。
+//
+// 仕様:
+//
+//	PingFrame には同じペイロードの PongFrame を返す (ライブラリのデフォルト)。
+//	permessage-deflate とデータフレームの coalesce には対応しない。
+//	writePrepared はエンコード済みのペイロードを使い回し、フレームの組み立てはライブラリが行う。
+type gorillaConn struct {
+	c *gorilla.Conn
+
+	// timeout は読み込み中の readMessage のタイムアウト。PongFrame の受信でも読み込みのタイムアウトを延長する。
+	// 読み込みの goroutine のみが参照する。
+	timeout time.Duration
+
+	// mu は書き込みを直列化する。gorilla.Conn はデータフレームの同時書き込みに対応していない。
+	mu     sync.Mutex
+	closed bool
+}
+
+// gorillaHandler は github.com/gorilla/websocket で接続を受け付ける。
+func (h *handler) gorillaHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f, err := h.accept(req, gorilla.Subprotocols(req))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		u := gorilla.Upgrader{
+			Subprotocols: []string{string(f)},
+			// x/net の websocket.Server と同じく、Origin は検証しない。
+			CheckOrigin: func(*http.Request) bool { return true },
+		}
+		// 失敗した場合、Upgrade がエラーのレスポンスを返す。
+		c, err := u.Upgrade(w, req, nil)
+		if err != nil {
+			slog.Info(fmt.Sprintf("failed to upgrade: %s", err))
+			return
+		}
+
+		h.serve(newGorillaConn(c), req, f)
+	})
+}
+
+func newGorillaConn(c *gorilla.Conn) *gorillaConn {
+	conn := &gorillaConn{c: c}
+
+	c.SetReadLimit(int64(maxPayloadSize))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(conn.timeout))
+	})
+	ping := c.PingHandler()
+	c.SetPingHandler(func(data string) error {
+		c.SetReadDeadline(time.Now().Add(conn.timeout))
+		return ping(data)
+	})
+
+	return conn
+}
+
+func (c *gorillaConn) readMessage(timeout time.Duration) (byte, []byte, error) {
+	c.timeout = timeout
+	c.c.SetReadDeadline(time.Now().Add(timeout))
+
+	typ, b, err := c.c.ReadMessage()
+	if err != nil {
+		var ce *gorilla.CloseError
+		switch {
+		// CloseAbnormalClosure は CloseFrame を受信せずに切断された場合にライブラリが返す。
+		case errors.As(err, &ce) && ce.Code != gorilla.CloseAbnormalClosure:
+			return 0, nil, errCloseFrame
+		case errors.Is(err, gorilla.ErrReadLimit):
+			// ライブラリはメッセージを読み捨てず、以降の読み込みは同じエラーを返し続ける。
+			// 続けて読み込めないため、errPayloadTooLarge にはせずコネクションを閉じる。
+			c.close(wire.CloseStatusTooBig)
+			return 0, nil, fmt.Errorf("too large payload: > %d: %w", maxPayloadSize, err)
+		}
+		return 0, nil, err
+	}
+
+	return byte(typ), b, nil
+}
+
+func (c *gorillaConn) writeMessage(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+
+	return c.c.WriteMessage(int(opcode), payload)
+}
+
+func (c *gorillaConn) writePrepared(pm *preparedMessage, f format) error {
+	p, err := pm.framesFor(f)
+	if err != nil {
+		return err
+	}
+
+	return c.writeMessage(p.opcode, p.payload)
+}
+
+// ping は PingFrame を書き込む。WriteControl は他の書き込みと同時に呼び出せる。
+func (c *gorillaConn) ping() error {
+	return c.c.WriteControl(gorilla.PingMessage, pingPayload, time.Now().Add(heartbeatInterval))
+}
+
+func (c *gorillaConn) setCoalesce() {}
+
+func (c *gorillaConn) flush() error {
+	return nil
+}
+
+func (c *gorillaConn) close(status uint16) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	err := c.c.WriteControl(gorilla.CloseMessage, gorilla.FormatCloseMessage(int(status), ""), time.Now().Add(heartbeatInterval))
+	if errors.Is(err, gorilla.ErrCloseSent) {
+		// CloseFrame を受信した場合、ライブラリが既に CloseFrame を返している。
+		err = nil
+	}
+
+	return errors.Join(err, c.c.Close())
+}
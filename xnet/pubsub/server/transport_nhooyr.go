@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+	nhooyr "nhooyr.io/websocket"
+)
+
+// nhooyrConn は nhooyr.io/websocket のコネクション。
+//
+// 仕様:
+//
+//	PingFrame には同じペイロードの PongFrame を返す (ライブラリのデフォルト)。
+//	permessage-deflate とデータフレームの coalesce には対応しない。
+//	ライブラリは読み込みの context が終了するとコネクションを閉じるため、フレームごとの読み込みのタイムアウトは
+//	watch で最後にフレームを受信してからの時間を確認して実現する。
+type nhooyrConn struct {
+	c *nhooyr.Conn
+
+	// ctx はコネクションの読み書きに使う。cancel するとコネクションは閉じられる。
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// lastActive は最後にメッセージか PongFrame を受信した時刻 (UnixNano)。
+	lastActive atomic.Int64
+	// timeout は読み込み中の readMessage のタイムアウト。
+	timeout atomic.Int64
+
+	closed atomic.Bool
+}
+
+// nhooyrHandler は nhooyr.io/websocket で接続を受け付ける。
+func (h *handler) nhooyrHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f, err := h.accept(req, offeredProtocols(req))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		// 失敗した場合、Accept がエラーのレスポンスを返す。
+		c, err := nhooyr.Accept(w, req, &nhooyr.AcceptOptions{
+			Subprotocols: []string{string(f)},
+			// x/net の websocket.Server と同じく、Origin は検証しない。
+			InsecureSkipVerify: true,
+			CompressionMode:    nhooyr.CompressionDisabled,
+		})
+		if err != nil {
+			slog.Info(fmt.Sprintf("failed to upgrade: %s", err))
+			return
+		}
+
+		conn := newNhooyrConn(c)
+		defer conn.cancel()
+		go conn.watch()
+
+		h.serve(conn, req, f)
+	})
+}
+
+func newNhooyrConn(c *nhooyr.Conn) *nhooyrConn {
+	c.SetReadLimit(int64(maxPayloadSize))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &nhooyrConn{
+		c:      c,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	conn.lastActive.Store(time.Now().UnixNano())
+	conn.timeout.Store(int64(heartbeatTimeout))
+
+	return conn
+}
+
+// watch は最後にフレームを受信してから readMessage のタイムアウトが経過した場合にコネクションを閉じる。
+func (c *nhooyrConn) watch() {
+	t := time.NewTimer(time.Duration(c.timeout.Load()))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		idle := time.Since(time.Unix(0, c.lastActive.Load()))
+		timeout := time.Duration(c.timeout.Load())
+		if idle >= timeout {
+			slog.Debug(fmt.Sprintf("no frame received in %s", timeout))
+			c.cancel()
+			return
+		}
+		t.Reset(timeout - idle)
+	}
+}
+
+func (c *nhooyrConn) readMessage(timeout time.Duration) (byte, []byte, error) {
+	c.timeout.Store(int64(timeout))
+	c.lastActive.Store(time.Now().UnixNano())
+
+	typ, b, err := c.c.Read(c.ctx)
+	if err != nil {
+		switch {
+		case nhooyr.CloseStatus(err) != -1:
+			return 0, nil, errCloseFrame
+		case c.ctx.Err() != nil && !c.closed.Load():
+			return 0, nil, fmt.Errorf("no frame received in %s: %w", timeout, err)
+		}
+		return 0, nil, err
+	}
+	c.lastActive.Store(time.Now().UnixNano())
+
+	switch typ {
+	case nhooyr.MessageText:
+		return websocket.TextFrame, b, nil
+	default:
+		return websocket.BinaryFrame, b, nil
+	}
+}
+
+func (c *nhooyrConn) writeMessage(opcode byte, payload []byte) error {
+	if c.closed.Load() {
+		return errConnClosed
+	}
+
+	typ := nhooyr.MessageText
+	if opcode == websocket.BinaryFrame {
+		typ = nhooyr.MessageBinary
+	}
+
+	return c.c.Write(c.ctx, typ, payload)
+}
+
+func (c *nhooyrConn) writePrepared(pm *preparedMessage, f format) error {
+	p, err := pm.framesFor(f)
+	if err != nil {
+		return err
+	}
+
+	return c.writeMessage(p.opcode, p.payload)
+}
+
+// ping は PingFrame を送信し、PongFrame を受信するまで待つ。
+// heartbeatTimeout の間に PongFrame を受信しない場合、ライブラリがコネクションを閉じる。
+func (c *nhooyrConn) ping() error {
+	ctx, cancel := context.WithTimeout(c.ctx, heartbeatTimeout)
+	defer cancel()
+
+	if err := c.c.Ping(ctx); err != nil {
+		return err
+	}
+	c.lastActive.Store(time.Now().UnixNano())
+
+	return nil
+}
+
+func (c *nhooyrConn) setCoalesce() {}
+
+func (c *nhooyrConn) flush() error {
+	return nil
+}
+
+// close は CloseFrame を書き込み、相手の CloseFrame を待ってからコネクションを閉じる。
+func (c *nhooyrConn) close(status uint16) error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer c.cancel()
+
+	err := c.c.Close(nhooyr.StatusCode(status), "")
+	if errors.Is(err, context.Canceled) {
+		// 読み込みのタイムアウトで既に閉じられている。
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"wire"
+)
+
+type textFR interface {
+	io.Reader
+	Len() int
+}
+
+// xnetConn は golang.org/x/net/websocket のコネクション。
+//
+// 仕様:
+//
+//	読み込みは websocket.Conn のフレーム単位の読み込みを使い、書き込みは Hijack したコネクションに frameWriter から直接行う。
+//	permessage-deflate に対応する。
+//	PingFrame には pongPayload を返す。
+type xnetConn struct {
+	*frameWriter
+	ws *websocket.Conn
+}
+
+// xnetHandler は golang.org/x/net/websocket で接続を受け付ける。
+func (h *handler) xnetHandler() http.Handler {
+	// 圧縮したフレームを書き込むため、Hijack したコネクションを記録する。
+	return recordHijack(websocket.Server{
+		Handler:   h.serveXnet,
+		Handshake: h.xnetHandshake,
+	})
+}
+
+// xnetHandshake は subprotocol と permessage-deflate のパラメータをレスポンスに設定する。
+func (h *handler) xnetHandshake(config *websocket.Config, req *http.Request) error {
+	f, err := h.accept(req, config.Protocol)
+	if err != nil {
+		return err
+	}
+	// 選択した subprotocol のみをレスポンスに含める。
+	config.Protocol = []string{string(f)}
+
+	// 受け入れた permessage-deflate のパラメータをレスポンスに含める。
+	if p, ok := negotiateDeflate(req.Header, h.deflate); ok {
+		if config.Header == nil {
+			config.Header = make(http.Header)
+		}
+		config.Header.Set(wire.ExtensionsHeader, p.String())
+	}
+
+	return nil
+}
+
+func (h *handler) serveXnet(ws *websocket.Conn) {
+	raw, ok := rawConnFrom(ws.Request())
+	if !ok {
+		slog.Error("hijacked connection is not recorded")
+		ws.Close()
+		return
+	}
+
+	var d *deflater
+	if p, ok := negotiateDeflate(ws.Request().Header, h.deflate); ok {
+		d = newDeflater(p, h.deflate.minSize)
+	}
+
+	conn := &xnetConn{
+		frameWriter: newFrameWriter(raw, d),
+		ws:          ws,
+	}
+	h.serve(conn, ws.Request(), format(ws.Config().Protocol[0]))
+}
+
+func (c *xnetConn) readMessage(timeout time.Duration) (byte, []byte, error) {
+	for {
+		c.ws.SetReadDeadline(time.Now().Add(timeout))
+
+		// fr は最後まで読み込む必要がある。
+		fr, err := c.ws.NewFrameReader()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch fr.PayloadType() {
+		case websocket.PingFrame:
+			b, _ := io.ReadAll(fr)
+			slog.Debug(fmt.Sprintf("PingFrame: %s", string(b)))
+			c.writeControl(websocket.PongFrame, pongPayload)
+			continue
+
+		case websocket.CloseFrame:
+			return 0, nil, errCloseFrame
+
+		case websocket.TextFrame, websocket.BinaryFrame:
+			compressed, err := wire.IsCompressed(fr)
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed to read frame header: %w", err)
+			}
+
+			b, err := c.readPayload(fr, compressed)
+			if err != nil {
+				return 0, nil, err
+			}
+			return fr.PayloadType(), b, nil
+		}
+
+		// 不要な fr を読み捨てる。
+		io.Copy(io.Discard, fr)
+	}
+}
+
+// readPayload はフレームのペイロードを読み込む。
+// ペイロードが大きすぎる場合は読み捨てて errPayloadTooLarge を返す。
+func (c *xnetConn) readPayload(fr textFR, compressed bool) ([]byte, error) {
+	if fr.Len() > maxPayloadSize {
+		io.Copy(io.Discard, fr)
+		return nil, fmt.Errorf("%w: %d", errPayloadTooLarge, fr.Len())
+	}
+
+	b, err := io.ReadAll(fr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read payload: %w", err)
+	}
+
+	return inflatePayload(c.deflate, b, compressed)
+}
+
+// inflatePayload は compressed の場合に permessage-deflate で展開したペイロードを返す。
+// 展開後のサイズも maxPayloadSize に制限する。
+func inflatePayload(d *deflater, payload []byte, compressed bool) ([]byte, error) {
+	if !compressed {
+		return payload, nil
+	}
+	if d == nil {
+		return nil, errors.New("compressed frame received without permessage-deflate")
+	}
+
+	return d.decompress(payload, maxPayloadSize)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// will は異常切断時に publish する last will message。
+//
+// 仕様:
+//
+//	CloseFrame を受け取らずに切断された場合に publish する。
+//	  例) 読み込みエラー、heartbeat のタイムアウト、TCP の RST
+//	CloseFrame を受け取って正常に切断された場合、サーバーのシャットダウンによる切断の場合は publish しない。
+type will struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// publishWill は last will message を publish する。
+// 接続中に設定ファイルが読み直されている場合があるため、publish の ACL はここでも判定する。
+func (h *handler) publishWill(w *will, sub *subscriber) {
+	if err := h.allowed(aclPublish, w.topic, sub); err != nil {
+		slog.Info(fmt.Sprintf("last will is not published: %s", err))
+		return
+	}
+	slog.Info(fmt.Sprintf("publishing last will to %s", w.topic))
+
+	if w.retain {
+		h.retain(w.topic, []byte(w.payload))
+	}
+
+	if err := h.publishText(w.topic, []byte(w.payload), sub); err != nil {
+		slog.Error(fmt.Sprintf("failed to publish last will: %s", err))
+	}
+}
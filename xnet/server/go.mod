@@ -2,4 +2,9 @@ module xnet-server
 
 go 1.21.7
 
-require golang.org/x/net v0.24.0
+require (
+	diag v0.0.0
+	golang.org/x/net v0.24.0
+)
+
+replace diag => ../../diag
@@ -8,6 +8,8 @@ import (
 	"net/http"
 
 	"golang.org/x/net/websocket"
+
+	"diag"
 )
 
 const (
@@ -76,8 +78,13 @@ func handleTextFrame(r textFR, ws *websocket.Conn) error {
 }
 
 func main() {
-	http.Handle("/subscribe", websocket.Handler(subscribe))
-	if err := http.ListenAndServe(hostPort, nil); err != nil {
+	diag.Serve()
+
+	// diag を import すると http.DefaultServeMux に pprof が登録されるため、別の mux を使う。
+	mux := http.NewServeMux()
+	mux.Handle("/subscribe", diag.LeakCheck(websocket.Handler(subscribe)))
+	// DIAG_RECORD が設定されている場合は、全てのコネクションのフレームを記録する。
+	if err := diag.ListenAndServe(hostPort, mux); err != nil {
 		panic("ListenAndServe: " + err.Error())
 	}
 }